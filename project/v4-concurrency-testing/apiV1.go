@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+// The shapes of /v1, the ones the API had before /v2. They only ever get new
+// optional fields, what a client of /v1 reads and sends keeps working.
+
+// BookV1 came with a single authorId, it is still read when authorIds is
+// missing and sent as the author credited first.
+type BookV1 struct {
+	ID        int      `json:"id" openapi:"readOnly"` // Auto
+	Name      string   `json:"name"`
+	AuthorID  int      `json:"authorId,omitempty"`
+	AuthorIDs []int    `json:"authorIds,omitempty"`
+	ISBN      string   `json:"isbn,omitempty"`
+	Year      int      `json:"year,omitempty"`
+	Genres    []string `json:"genres,omitempty"`
+}
+
+type AuthorV1 struct {
+	Name string `json:"name"`
+	ID   int    `json:"id" openapi:"readOnly"`
+}
+
+// BookSummaryV1 is a book nested in an answer which has its author already
+type BookSummaryV1 struct {
+	ID   int    `json:"id" openapi:"readOnly"`
+	Name string `json:"name"`
+}
+
+// CombinedResponse only has room for one author, the one credited first
+type CombinedResponse struct {
+	BookSummaryV1
+	AuthorDetails *AuthorV1 `json:"author"` // nil for orphans of a left join
+}
+
+type AuthorWithBooksV1 struct {
+	AuthorV1
+	Books []BookSummaryV1 `json:"books"`
+}
+
+// BookWithAuthorsV1 is a book of include=author, unlike CombinedResponse it
+// has room for every author, in the order they are credited.
+type BookWithAuthorsV1 struct {
+	BookV1
+	Authors []AuthorV1 `json:"authors"`
+}
+
+func bookV1(book Book) BookV1 {
+	return BookV1{book.ID, book.Name, book.firstAuthor(), book.AuthorIDs, book.ISBN, book.Year, book.Genres}
+}
+
+func authorV1(author Author) AuthorV1 {
+	return AuthorV1{author.Name, author.ID}
+}
+
+func bookWithAuthorsV1(joined BookWithAuthors) BookWithAuthorsV1 {
+	authors := make([]AuthorV1, len(joined.Authors))
+	for i, author := range joined.Authors {
+		authors[i] = authorV1(author)
+	}
+	return BookWithAuthorsV1{bookV1(joined.Book), authors}
+}
+
+func authorWithBooksV1(group AuthorWithBooks) AuthorWithBooksV1 {
+	books := make([]BookSummaryV1, len(group.Books))
+	for i, book := range group.Books {
+		books[i] = BookSummaryV1{book.ID, book.Name}
+	}
+	return AuthorWithBooksV1{authorV1(group.Author), books}
+}
+
+func combinedV1(joined BookWithAuthors) CombinedResponse {
+	response := CombinedResponse{BookSummaryV1: BookSummaryV1{joined.ID, joined.Name}}
+	if len(joined.Authors) > 0 {
+		author := authorV1(joined.Authors[0])
+		response.AuthorDetails = &author
+	}
+	return response
+}
+
+type v1Representation struct{}
+
+func (v1Representation) name() string {
+	return "v1"
+}
+
+func (v1Representation) mediaType() string {
+	return "application/json"
+}
+
+func (v1Representation) nestsAuthors() bool {
+	return false
+}
+
+func (v1Representation) book(book Book, authors map[int]*Author) interface{} {
+	return bookV1(book)
+}
+
+func (v1Representation) books(books []Book, authors map[int]*Author) interface{} {
+	response := make([]BookV1, len(books))
+	for i, book := range books {
+		response[i] = bookV1(book)
+	}
+	return response
+}
+
+func (v1Representation) author(author Author) interface{} {
+	return authorV1(author)
+}
+
+func (v1Representation) authors(authors []Author) interface{} {
+	response := make([]AuthorV1, len(authors))
+	for i, author := range authors {
+		response[i] = authorV1(author)
+	}
+	return response
+}
+
+func (v1Representation) joined(books []BookWithAuthors) interface{} {
+	response := make([]CombinedResponse, len(books))
+	for i, joined := range books {
+		response[i] = combinedV1(joined)
+	}
+	return response
+}
+
+func (v1Representation) grouped(authors []AuthorWithBooks) interface{} {
+	response := make([]AuthorWithBooksV1, len(authors))
+	for i, group := range authors {
+		response[i] = authorWithBooksV1(group)
+	}
+	return response
+}
+
+func (v1Representation) bookWithAuthors(book BookWithAuthors) interface{} {
+	return bookWithAuthorsV1(book)
+}
+
+func (v1Representation) booksWithAuthors(books []BookWithAuthors) interface{} {
+	response := make([]BookWithAuthorsV1, len(books))
+	for i, joined := range books {
+		response[i] = bookWithAuthorsV1(joined)
+	}
+	return response
+}
+
+func (v1Representation) authorWithBooks(author AuthorWithBooks) interface{} {
+	return authorWithBooksV1(author)
+}
+
+func (v1Representation) decodeBook(body []byte, book *Book) error {
+	wire := bookV1(book.clone())
+	if err := json.Unmarshal(body, &wire); err != nil {
+		return err
+	}
+	// A body written for a single author only has authorId
+	var given struct {
+		AuthorID  json.RawMessage `json:"authorId"`
+		AuthorIDs json.RawMessage `json:"authorIds"`
+	}
+	json.Unmarshal(body, &given)
+	if given.AuthorIDs == nil && given.AuthorID != nil && string(given.AuthorID) != "null" {
+		wire.AuthorIDs = nil
+		if wire.AuthorID != 0 {
+			wire.AuthorIDs = []int{wire.AuthorID}
+		}
+	}
+	book.ID, book.Name, book.AuthorIDs = wire.ID, wire.Name, wire.AuthorIDs
+	book.ISBN, book.Year, book.Genres = wire.ISBN, wire.Year, wire.Genres
+	return nil
+}
+
+func (v1Representation) decodeAuthor(body []byte, author *Author) error {
+	wire := authorV1(*author)
+	if err := json.Unmarshal(body, &wire); err != nil {
+		return err
+	}
+	author.ID, author.Name = wire.ID, wire.Name
+	return nil
+}
+
+func (v1Representation) samples() samples {
+	return samples{
+		book:    BookV1{},
+		books:   []BookV1{},
+		author:  AuthorV1{},
+		authors: []AuthorV1{},
+		joined:  []CombinedResponse{},
+		grouped: []AuthorWithBooksV1{},
+
+		bookWithAuthors:  BookWithAuthorsV1{},
+		booksWithAuthors: []BookWithAuthorsV1{},
+		authorWithBooks:  AuthorWithBooksV1{},
+	}
+}
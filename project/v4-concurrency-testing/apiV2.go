@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// The shapes of /v2. A book nests its authors instead of carrying their IDs,
+// every entity links to itself and the entities next to it, and tells when it
+// was created and last updated. The timestamps are missing for entities
+// stored before they were recorded.
+
+type BookV2 struct {
+	ID        int               `json:"id" openapi:"readOnly"`
+	Name      string            `json:"name"`
+	Authors   []AuthorV2        `json:"authors"` // only the ids are read in requests
+	ISBN      string            `json:"isbn,omitempty"`
+	Year      int               `json:"year,omitempty"`
+	Genres    []string          `json:"genres"`
+	Version   int               `json:"version" openapi:"readOnly"`
+	Links     map[string]string `json:"links" openapi:"readOnly"`
+	CreatedAt *time.Time        `json:"createdAt,omitempty" openapi:"readOnly"`
+	UpdatedAt *time.Time        `json:"updatedAt,omitempty" openapi:"readOnly"`
+}
+
+type AuthorV2 struct {
+	ID        int               `json:"id"`
+	Name      string            `json:"name"`
+	Version   int               `json:"version" openapi:"readOnly"`
+	Links     map[string]string `json:"links" openapi:"readOnly"`
+	CreatedAt *time.Time        `json:"createdAt,omitempty" openapi:"readOnly"`
+	UpdatedAt *time.Time        `json:"updatedAt,omitempty" openapi:"readOnly"`
+}
+
+type AuthorWithBooksV2 struct {
+	AuthorV2
+	Books []BookV2 `json:"books"`
+}
+
+// bookV2 nests the authors of book found in authors, the others only as a
+// reference with their id and links.
+func bookV2(book Book, authors map[int]*Author) BookV2 {
+	response := BookV2{
+		ID:        book.ID,
+		Name:      book.Name,
+		Authors:   make([]AuthorV2, len(book.AuthorIDs)),
+		ISBN:      book.ISBN,
+		Year:      book.Year,
+		Genres:    append([]string{}, book.Genres...),
+		Version:   book.Version,
+		Links:     map[string]string{"self": "/v2/books/" + strconv.Itoa(book.ID)},
+		CreatedAt: timestampV2(book.CreatedAt),
+		UpdatedAt: timestampV2(book.UpdatedAt),
+	}
+	for i, id := range book.AuthorIDs {
+		response.Authors[i] = authorV2(Author{ID: id})
+		if author := authors[id]; author != nil {
+			response.Authors[i] = authorV2(*author)
+		}
+	}
+	return response
+}
+
+func authorV2(author Author) AuthorV2 {
+	id := strconv.Itoa(author.ID)
+	return AuthorV2{
+		ID:      author.ID,
+		Name:    author.Name,
+		Version: author.Version,
+		Links: map[string]string{
+			"self":  "/v2/authors/" + id,
+			"books": "/v2/books?authorId=" + id,
+		},
+		CreatedAt: timestampV2(author.CreatedAt),
+		UpdatedAt: timestampV2(author.UpdatedAt),
+	}
+}
+
+// authorWithBooksV2 nests the authors found in authors into the books
+func authorWithBooksV2(group AuthorWithBooks, authors map[int]*Author) AuthorWithBooksV2 {
+	books := make([]BookV2, len(group.Books))
+	for i, book := range group.Books {
+		books[i] = bookV2(book, authors)
+	}
+	return AuthorWithBooksV2{authorV2(group.Author), books}
+}
+
+func timestampV2(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+type v2Representation struct{}
+
+func (v2Representation) name() string {
+	return "v2"
+}
+
+func (v2Representation) mediaType() string {
+	return "application/json; version=2"
+}
+
+func (v2Representation) nestsAuthors() bool {
+	return true
+}
+
+func (v2Representation) book(book Book, authors map[int]*Author) interface{} {
+	return bookV2(book, authors)
+}
+
+func (v2Representation) books(books []Book, authors map[int]*Author) interface{} {
+	response := make([]BookV2, len(books))
+	for i, book := range books {
+		response[i] = bookV2(book, authors)
+	}
+	return response
+}
+
+func (v2Representation) author(author Author) interface{} {
+	return authorV2(author)
+}
+
+func (v2Representation) authors(authors []Author) interface{} {
+	response := make([]AuthorV2, len(authors))
+	for i, author := range authors {
+		response[i] = authorV2(author)
+	}
+	return response
+}
+
+func (v2Representation) joined(books []BookWithAuthors) interface{} {
+	response := make([]BookV2, len(books))
+	for i, joined := range books {
+		response[i] = bookV2(joined.Book, indexAuthors(joined.Authors))
+	}
+	return response
+}
+
+// grouped nests every author into the books, co-authors are in other groups
+func (v2Representation) grouped(authors []AuthorWithBooks) interface{} {
+	index := make(map[int]*Author, len(authors))
+	for i := range authors {
+		index[authors[i].ID] = &authors[i].Author
+	}
+	response := make([]AuthorWithBooksV2, len(authors))
+	for i, group := range authors {
+		response[i] = authorWithBooksV2(group, index)
+	}
+	return response
+}
+
+// The books of /v2 nest their authors anyway, include=author changes nothing
+func (v2Representation) bookWithAuthors(book BookWithAuthors) interface{} {
+	return bookV2(book.Book, indexAuthors(book.Authors))
+}
+
+func (r v2Representation) booksWithAuthors(books []BookWithAuthors) interface{} {
+	return r.joined(books)
+}
+
+func (v2Representation) authorWithBooks(author AuthorWithBooks) interface{} {
+	return authorWithBooksV2(author, map[int]*Author{author.ID: &author.Author})
+}
+
+func (v2Representation) decodeBook(body []byte, book *Book) error {
+	wire := bookV2(*book, nil)
+	if err := json.Unmarshal(body, &wire); err != nil {
+		return err
+	}
+	// Before books had several authors /v2 took a single author or null
+	var given struct {
+		Author  json.RawMessage `json:"author"`
+		Authors json.RawMessage `json:"authors"`
+	}
+	json.Unmarshal(body, &given)
+	if given.Authors == nil && given.Author != nil {
+		var author *AuthorV2
+		if err := json.Unmarshal(given.Author, &author); err != nil {
+			return err
+		}
+		wire.Authors = nil
+		if author != nil {
+			wire.Authors = []AuthorV2{*author}
+		}
+	}
+	book.Name, book.ISBN, book.Year, book.Genres = wire.Name, wire.ISBN, wire.Year, wire.Genres
+	book.AuthorIDs = nil
+	for _, author := range wire.Authors {
+		book.AuthorIDs = append(book.AuthorIDs, author.ID)
+	}
+	return nil
+}
+
+func (v2Representation) decodeAuthor(body []byte, author *Author) error {
+	wire := authorV2(*author)
+	if err := json.Unmarshal(body, &wire); err != nil {
+		return err
+	}
+	author.Name = wire.Name
+	return nil
+}
+
+func (v2Representation) samples() samples {
+	return samples{
+		book:    BookV2{},
+		books:   []BookV2{},
+		author:  AuthorV2{},
+		authors: []AuthorV2{},
+		joined:  []BookV2{},
+		grouped: []AuthorWithBooksV2{},
+
+		bookWithAuthors:  BookV2{},
+		booksWithAuthors: []BookV2{},
+		authorWithBooks:  AuthorWithBooksV2{},
+	}
+}
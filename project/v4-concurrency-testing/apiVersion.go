@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// apiVersion selects the shapes of the catalog in requests and responses
+type apiVersion int
+
+const (
+	// negotiated is the version of the routes without prefix, it comes from
+	// the Accept header and is v1 when not asked for, see negotiateVersion.
+	negotiated apiVersion = iota
+	apiV1
+	apiV2
+)
+
+// representation converts between the stored Book and Author and the shapes
+// of one API version, so the handlers are written once for every version.
+type representation interface {
+	// name goes into the ETag, the routes without prefix serve every version
+	name() string
+	mediaType() string
+	// nestsAuthors tells the handlers to fetch the authors of every book
+	nestsAuthors() bool
+	book(book Book, authors map[int]*Author) interface{}
+	books(books []Book, authors map[int]*Author) interface{}
+	author(author Author) interface{}
+	authors(authors []Author) interface{}
+	joined(books []BookWithAuthors) interface{}
+	grouped(authors []AuthorWithBooks) interface{}
+	// bookWithAuthors, booksWithAuthors and authorWithBooks are the shapes
+	// of include, the entities with the related ones embedded
+	bookWithAuthors(book BookWithAuthors) interface{}
+	booksWithAuthors(books []BookWithAuthors) interface{}
+	authorWithBooks(author AuthorWithBooks) interface{}
+	// decodeBook and decodeAuthor apply a request body on top of the stored
+	// value, the fields which are not in the body keep their value.
+	decodeBook(body []byte, book *Book) error
+	decodeAuthor(body []byte, author *Author) error
+	samples() samples
+}
+
+// samples are values of the shapes of a version for the OpenAPI document
+type samples struct {
+	book, books, author, authors, joined, grouped      interface{}
+	bookWithAuthors, booksWithAuthors, authorWithBooks interface{}
+}
+
+func representationFor(version apiVersion) representation {
+	if version == apiV2 {
+		return v2Representation{}
+	}
+	return v1Representation{}
+}
+
+type versionKey struct{}
+
+// representationOf returns the representation versionMiddleware picked for r
+func representationOf(r *http.Request) representation {
+	version, _ := r.Context().Value(versionKey{}).(apiVersion)
+	return representationFor(version)
+}
+
+// Middleware Function, strips the version prefix from the path so the
+// handlers see /books/3 for /v2/books/3, and records the version for
+// representationOf. Without prefix it is negotiated.
+func versionMiddleware(handler http.HandlerFunc, version apiVersion, prefix string) http.HandlerFunc {
+	handler = http.StripPrefix(prefix, handler).ServeHTTP
+	return func(w http.ResponseWriter, r *http.Request) {
+		picked := version
+		if version == negotiated {
+			w.Header().Add("Vary", "Accept")
+			var err error
+			if picked, err = negotiateVersion(r.Header.Get("Accept")); err != nil {
+				writeError(w, err)
+				return
+			}
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), versionKey{}, picked)))
+	}
+}
+
+// negotiateVersion reads the version parameter of the JSON media types in
+// accept, e.g. application/json; version=2. Without any it is v1.
+func negotiateVersion(accept string) (apiVersion, error) {
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(mediaRange)
+		if err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+			continue
+		}
+		switch version, ok := params["version"]; {
+		case !ok:
+			continue
+		case version == "1":
+			return apiV1, nil
+		case version == "2":
+			return apiV2, nil
+		default:
+			return 0, &APIError{
+				Status:  http.StatusNotAcceptable,
+				Code:    "not_acceptable",
+				Message: "Unknown API version " + version,
+				Details: []FieldError{{"Accept", "version must be 1 or 2"}},
+			}
+		}
+	}
+	return apiV1, nil
+}
+
+// writeRepresentation sends value, one of the shapes of rep
+func writeRepresentation(w http.ResponseWriter, rep representation, value interface{}) {
+	w.Header().Set("Content-Type", rep.mediaType())
+	json.NewEncoder(w).Encode(value)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func doAccept(router http.Handler, method, target, accept, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestV1ShapesAreUnchanged(t *testing.T) {
+	for _, prefix := range []string{"", "/v1"} {
+		router := newRouter(newTestAPI())
+		cases := []struct {
+			method, target, body, expected string
+		}{
+			{http.MethodPost, "/authors", `{"name":"Author 1"}`, `{"name":"Author 1","id":1}`},
+			{http.MethodPost, "/books", `{"name":"Book 1","authorId":1}`, `{"id":1,"name":"Book 1","authorId":1,"authorIds":[1]}`},
+			{http.MethodPost, "/books", `{"name":"Book 2"}`, `{"id":2,"name":"Book 2"}`},
+			{http.MethodGet, "/books/1", "", `{"id":1,"name":"Book 1","authorId":1,"authorIds":[1]}`},
+			{http.MethodGet, "/authors", "", `[{"name":"Author 1","id":1}]`},
+			{http.MethodGet, "/books-authors", "", `[{"id":1,"name":"Book 1","author":{"name":"Author 1","id":1}}]`},
+			{http.MethodGet, "/books-authors?join=left", "", `[{"id":1,"name":"Book 1","author":{"name":"Author 1","id":1}},{"id":2,"name":"Book 2","author":null}]`},
+			{http.MethodGet, "/books-authors?group=author", "", `[{"name":"Author 1","id":1,"books":[{"id":1,"name":"Book 1"}]}]`},
+		}
+		for _, c := range cases {
+			rr := doAccept(router, c.method, prefix+c.target, "", c.body)
+			if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/json" {
+				t.Errorf("%s %s: Unexpected response %d with headers %v", c.method, prefix+c.target, rr.Code, rr.Header())
+			}
+			if body := strings.TrimSpace(rr.Body.String()); body != c.expected {
+				t.Errorf("%s %s: Incorrect body - Expected %s, found %s", c.method, prefix+c.target, c.expected, body)
+			}
+		}
+	}
+}
+
+func TestV2Shapes(t *testing.T) {
+	router := newRouter(newTestAPI())
+	do(router, http.MethodPost, "/v2/authors", strings.NewReader(`{"name":"Author 1"}`))
+	rr := do(router, http.MethodPost, "/v2/books", strings.NewReader(`{"name":"Book 1","authors":[{"id":1}]}`))
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/json; version=2" {
+		t.Fatalf("Unexpected response %d with headers %v", rr.Code, rr.Header())
+	}
+	var book BookV2
+	json.Unmarshal(rr.Body.Bytes(), &book)
+	if len(book.Authors) != 1 || book.Authors[0].Name != "Author 1" || book.Authors[0].Links["self"] != "/v2/authors/1" {
+		t.Errorf("Incorrect authors - Expected Author 1, found %+v", book.Authors)
+	}
+	if book.Links["self"] != "/v2/books/1" {
+		t.Errorf("Incorrect links - Expected self, found %v", book.Links)
+	}
+	if book.CreatedAt == nil || book.UpdatedAt == nil || !book.CreatedAt.Equal(*book.UpdatedAt) {
+		t.Errorf("Incorrect timestamps - Expected equal ones, found %v and %v", book.CreatedAt, book.UpdatedAt)
+	}
+	if strings.Contains(rr.Body.String(), `"authorId"`) {
+		t.Errorf("Expected no authorId in %s", rr.Body)
+	}
+
+	// The links of an author are the paths its books are found at
+	rr = do(router, http.MethodGet, "/v2/books?authorId=1", nil)
+	var books []BookV2
+	json.Unmarshal(rr.Body.Bytes(), &books)
+	if len(books) != 1 || len(books[0].Authors) != 1 || books[0].Authors[0].Name != "Author 1" {
+		t.Errorf("Expected Book 1 with its author, found %s", rr.Body)
+	}
+	rr = do(router, http.MethodGet, "/v2/books-authors?group=author", nil)
+	var grouped []AuthorWithBooksV2
+	json.Unmarshal(rr.Body.Bytes(), &grouped)
+	if len(grouped) != 1 || len(grouped[0].Books) != 1 || len(grouped[0].Books[0].Authors) != 1 || grouped[0].Books[0].Authors[0].Name != "Author 1" {
+		t.Errorf("Expected Author 1 with Book 1, found %s", rr.Body)
+	}
+
+	// A PATCH without authors keeps them, an empty list removes them
+	rr = do(router, http.MethodPatch, "/v2/books/1", strings.NewReader(`{"name":"Book One"}`))
+	if json.Unmarshal(rr.Body.Bytes(), &book); len(book.Authors) != 1 || book.Authors[0].ID != 1 {
+		t.Errorf("Incorrect authors - Expected %d, found %+v", 1, book.Authors)
+	}
+	rr = do(router, http.MethodPatch, "/v2/books/1", strings.NewReader(`{"authors":[]}`))
+	book = BookV2{}
+	if json.Unmarshal(rr.Body.Bytes(), &book); rr.Code != http.StatusOK || len(book.Authors) != 0 || book.Name != "Book One" {
+		t.Errorf("Expected Book One without authors, found %d %s", rr.Code, rr.Body)
+	}
+	rr = do(router, http.MethodPut, "/v2/books/1", strings.NewReader(`{"name":"Book 1","authors":[{"id":9}]}`))
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Invalid code! I want %d but get %d", http.StatusUnprocessableEntity, rr.Code)
+	}
+}
+
+// The bodies written before books had several authors still work
+func TestLegacyAuthorPayloads(t *testing.T) {
+	router := newRouter(newTestAPI())
+	do(router, http.MethodPost, "/authors", strings.NewReader(`{"name":"Author 1"}`))
+	do(router, http.MethodPost, "/authors", strings.NewReader(`{"name":"Author 2"}`))
+
+	cases := []struct {
+		method, target, body string
+		expected             []int
+	}{
+		{http.MethodPost, "/v1/books", `{"name":"Book 1","authorId":2}`, []int{2}},
+		{http.MethodPatch, "/v1/books/1", `{"authorId":1}`, []int{1}},
+		{http.MethodPatch, "/v1/books/1", `{"authorIds":[1,2]}`, []int{1, 2}},
+		{http.MethodPatch, "/v1/books/1", `{"name":"Book One"}`, []int{1, 2}},
+		{http.MethodPatch, "/v1/books/1", `{"authorId":0}`, nil},
+		{http.MethodPatch, "/v2/books/1", `{"author":{"id":2}}`, []int{2}},
+		{http.MethodPatch, "/v2/books/1", `{"author":null}`, nil},
+	}
+	for _, c := range cases {
+		rr := do(router, c.method, c.target, strings.NewReader(c.body))
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s %s: Invalid code! I want %d but get %d", c.method, c.body, http.StatusOK, rr.Code)
+			continue
+		}
+		var book BookV1
+		json.Unmarshal(do(router, http.MethodGet, "/v1/books/1", nil).Body.Bytes(), &book)
+		if !sameAuthors(book.AuthorIDs, c.expected) || book.AuthorID != (Book{AuthorIDs: c.expected}).firstAuthor() {
+			t.Errorf("%s %s: Incorrect authors - Expected %v, found %+v", c.method, c.body, c.expected, book)
+		}
+	}
+}
+
+func TestVersionNegotiation(t *testing.T) {
+	router := newRouter(newTestAPI())
+	do(router, http.MethodPost, "/authors", strings.NewReader(`{"name":"Author 1"}`))
+	cases := []struct {
+		target, accept string
+		status         int
+		contentType    string
+	}{
+		{"/authors/1", "", http.StatusOK, "application/json"},
+		{"/authors/1", "*/*", http.StatusOK, "application/json"},
+		{"/authors/1", "application/json; version=1", http.StatusOK, "application/json"},
+		{"/authors/1", "application/json; version=2", http.StatusOK, "application/json; version=2"},
+		{"/authors/1", "text/html, application/json;version=2;q=0.9", http.StatusOK, "application/json; version=2"},
+		{"/authors/1", "application/vnd.bookstore+json; version=2", http.StatusOK, "application/json; version=2"},
+		{"/authors/1", "application/json; version=3", http.StatusNotAcceptable, "application/json"},
+		// The version in the path wins over the header
+		{"/v1/authors/1", "application/json; version=2", http.StatusOK, "application/json"},
+		{"/v2/authors/1", "application/json; version=3", http.StatusOK, "application/json; version=2"},
+	}
+	for _, c := range cases {
+		rr := doAccept(router, http.MethodGet, c.target, c.accept, "")
+		if rr.Code != c.status {
+			t.Errorf("%s with %q: Invalid code! I want %d but get %d", c.target, c.accept, c.status, rr.Code)
+		}
+		if contentType := rr.Header().Get("Content-Type"); contentType != c.contentType {
+			t.Errorf("%s with %q: Incorrect Content-Type - Expected %q, found %q", c.target, c.accept, c.contentType, contentType)
+		}
+		if negotiated := !strings.HasPrefix(c.target, "/v"); (rr.Header().Get("Vary") == "Accept") != negotiated {
+			t.Errorf("%s with %q: Expected Vary: Accept only without version prefix, found %v", c.target, c.accept, rr.Header())
+		}
+	}
+}
+
+func TestVersionsHaveTheirOwnETag(t *testing.T) {
+	router := newRouter(newTestAPI())
+	do(router, http.MethodPost, "/books", strings.NewReader(`{"name":"Book 1"}`))
+	v1 := doAccept(router, http.MethodGet, "/books", "", "").Header().Get("ETag")
+	v2 := doAccept(router, http.MethodGet, "/books", "application/json; version=2", "").Header().Get("ETag")
+	if v1 == "" || v1 == v2 {
+		t.Fatalf("Expected different tags, found %s and %s", v1, v2)
+	}
+	if rr := conditionalGet(router, "/v2/books", "If-None-Match", v1); rr.Code != http.StatusOK {
+		t.Errorf("Invalid code! I want %d but get %d", http.StatusOK, rr.Code)
+	}
+	if rr := conditionalGet(router, "/v2/books", "If-None-Match", v2); rr.Code != http.StatusNotModified {
+		t.Errorf("Invalid code! I want %d but get %d", http.StatusNotModified, rr.Code)
+	}
+	// v2 nests the authors, so a change of an author changes its books
+	do(router, http.MethodPost, "/authors", strings.NewReader(`{"name":"Author 1"}`))
+	if rr := conditionalGet(router, "/v2/books", "If-None-Match", v2); rr.Code != http.StatusOK {
+		t.Errorf("Invalid code! I want %d but get %d", http.StatusOK, rr.Code)
+	}
+	if rr := conditionalGet(router, "/v1/books", "If-None-Match", v1); rr.Code != http.StatusNotModified {
+		t.Errorf("Invalid code! I want %d but get %d", http.StatusNotModified, rr.Code)
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, books BookRepository, authors AuthorRepository) {
+		clock := time.Date(2020, 1, 2, 3, 4, 5, 6789000, time.FixedZone("CET", 3600))
+		books, authors = NewTimestampingRepositories(books, authors, func() time.Time { return clock })
+		created := clock.UTC().Truncate(time.Millisecond)
+
+		author := &Author{Name: "Author 1"}
+		authors.Create(ctx, author)
+		book := &Book{Name: "Book 1", AuthorIDs: []int{author.ID}}
+		if err := books.Create(ctx, book); err != nil {
+			t.Fatal(err)
+		}
+		clock = clock.Add(time.Hour)
+		// A client can't move the creation time
+		update := &Book{ID: book.ID, Name: "Book 2", CreatedAt: clock}
+		if err := books.Update(ctx, update, AnyVersion); err != nil {
+			t.Fatal(err)
+		}
+
+		stored, err := books.GetByID(ctx, book.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !stored.CreatedAt.Equal(created) || !stored.UpdatedAt.Equal(created.Add(time.Hour)) {
+			t.Errorf("Incorrect timestamps - Expected %v and %v, found %v and %v", created, created.Add(time.Hour), stored.CreatedAt, stored.UpdatedAt)
+		}
+		all, _ := authors.GetAll(ctx)
+		if len(all) != 1 || !all[0].CreatedAt.Equal(created) || !all[0].UpdatedAt.Equal(created) {
+			t.Errorf("Incorrect timestamps - Expected %v, found %+v", created, all)
+		}
+		if err := books.Update(ctx, &Book{ID: 42, Name: "Book 42"}, AnyVersion); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Incorrect error - Expected %v, found %v", ErrNotFound, err)
+		}
+	})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Scopes of the write endpoints, reading the catalog needs no credentials.
+// The webhooks are only for partners, reading them needs ScopeWebhooks too.
+const (
+	ScopeBooksWrite   = "books:write"
+	ScopeAuthorsWrite = "authors:write"
+	ScopeWebhooks     = "webhooks"
+)
+
+// Principal is who made a request, see PrincipalFromContext
+type Principal struct {
+	Subject string   `json:"sub"`
+	Scopes  []string `json:"scopes"`
+}
+
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKey is a static credential sent in the X-API-Key header
+type APIKey struct {
+	Key string
+	Principal
+}
+
+// ParseAPIKeys reads subject:key:scope,scope entries separated by semicolons,
+// e.g. ci:s3cret:books:write,authors:write;reader:0p3n:
+func ParseAPIKeys(value string) ([]APIKey, error) {
+	var keys []APIKey
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid API key %q, use subject:key:scope,scope", entry)
+		}
+		key := APIKey{Key: parts[1], Principal: Principal{Subject: parts[0], Scopes: []string{}}}
+		if len(parts) == 3 && parts[2] != "" {
+			key.Scopes = strings.Split(parts[2], ",")
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Authenticator knows the API keys and the secret bearer tokens are signed
+// with. Tokens are JWTs signed with HS256 and must expire.
+type Authenticator struct {
+	apiKeys map[[sha256.Size]byte]Principal // by hash, so looking a key up takes the same time whatever it is
+	secret  []byte
+	now     func() time.Time
+}
+
+// Constructor Function, a nil secret disables bearer tokens
+func NewAuthenticator(apiKeys []APIKey, secret []byte) *Authenticator {
+	a := &Authenticator{apiKeys: make(map[[sha256.Size]byte]Principal), secret: secret, now: time.Now}
+	for _, key := range apiKeys {
+		a.apiKeys[sha256.Sum256([]byte(key.Key))] = key.Principal
+	}
+	return a
+}
+
+// tokenClaims is the payload of a bearer token
+type tokenClaims struct {
+	Subject   string   `json:"sub"`
+	Scopes    []string `json:"scopes"`
+	ExpiresAt int64    `json:"exp"` // Unix time
+}
+
+// The header is always the same, we only issue and accept HS256
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Sign issues a bearer token for subject valid for ttl
+func (a *Authenticator) Sign(subject string, scopes []string, ttl time.Duration) (string, error) {
+	if len(a.secret) == 0 {
+		return "", errors.New("no token secret configured")
+	}
+	claims, err := json.Marshal(tokenClaims{Subject: subject, Scopes: scopes, ExpiresAt: a.now().Add(ttl).Unix()})
+	if err != nil {
+		return "", err
+	}
+	signed := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(claims)
+	return signed + "." + a.signature(signed), nil
+}
+
+func (a *Authenticator) signature(signed string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+var (
+	errMissingCredentials = errors.New("Missing credentials, send X-API-Key or Authorization: Bearer")
+	errInvalidCredentials = errors.New("Invalid credentials")
+	errExpiredToken       = errors.New("Token expired")
+)
+
+// Authenticate finds the principal of r, the error is shown to the client
+func (a *Authenticator) Authenticate(r *http.Request) (*Principal, error) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		principal, ok := a.apiKeys[sha256.Sum256([]byte(key))]
+		if !ok {
+			return nil, errInvalidCredentials
+		}
+		return &principal, nil
+	}
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		return nil, errMissingCredentials
+	}
+	scheme, token := authorization, ""
+	if space := strings.IndexByte(authorization, ' '); space >= 0 {
+		scheme, token = authorization[:space], strings.TrimSpace(authorization[space+1:])
+	}
+	if !strings.EqualFold(scheme, "Bearer") || len(a.secret) == 0 {
+		return nil, errInvalidCredentials
+	}
+	return a.verify(token)
+}
+
+func (a *Authenticator) verify(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenHeader {
+		return nil, errInvalidCredentials
+	}
+	signed := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(a.signature(signed))) {
+		return nil, errInvalidCredentials
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidCredentials
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Subject == "" || claims.ExpiresAt == 0 {
+		return nil, errInvalidCredentials
+	}
+	if !a.now().Before(time.Unix(claims.ExpiresAt, 0)) {
+		return nil, errExpiredToken
+	}
+	if claims.Scopes == nil {
+		claims.Scopes = []string{}
+	}
+	return &Principal{Subject: claims.Subject, Scopes: claims.Scopes}, nil
+}
+
+type principalKey struct{}
+
+// PrincipalFromContext returns who made the request, requests to routes
+// which don't require authentication have none.
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(*Principal)
+	return principal, ok
+}
+
+// Middleware Function, lets the request through to handler when it carries
+// credentials with all of scopes and puts the principal in its context.
+func authMiddleware(handler http.HandlerFunc, auth *Authenticator, scopes ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, err := auth.Authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="bookstore"`)
+			writeError(w, &APIError{Status: http.StatusUnauthorized, Code: "unauthorized", Message: err.Error()})
+			return
+		}
+		for _, scope := range scopes {
+			if !principal.HasScope(scope) {
+				writeError(w, &APIError{Status: http.StatusForbidden, Code: "forbidden", Message: "Missing scope " + scope})
+				return
+			}
+		}
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAPIKeys(t *testing.T) {
+	keys, err := ParseAPIKeys(" ci:s3cret:books:write,authors:write; reader:0p3n: ;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []APIKey{
+		{Key: "s3cret", Principal: Principal{Subject: "ci", Scopes: []string{ScopeBooksWrite, ScopeAuthorsWrite}}},
+		{Key: "0p3n", Principal: Principal{Subject: "reader", Scopes: []string{}}},
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Incorrect keys - Expected %+v, found %+v", expected, keys)
+	}
+	for _, value := range []string{"ci", "ci::books:write", ":key"} {
+		if _, err := ParseAPIKeys(value); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
+
+// newTestAuthenticator has a clock which only moves when told to
+func newTestAuthenticator() (*Authenticator, *time.Time) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	auth := NewAuthenticator([]APIKey{
+		{Key: "writer-key", Principal: Principal{Subject: "writer", Scopes: []string{ScopeBooksWrite, ScopeAuthorsWrite}}},
+		{Key: "reader-key", Principal: Principal{Subject: "reader", Scopes: []string{}}},
+	}, []byte("test secret"))
+	auth.now = func() time.Time { return now }
+	return auth, &now
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	auth, now := newTestAuthenticator()
+	api := newTestAPI()
+	api.authenticator = auth
+	router := newRouter(api)
+
+	booksOnly, _ := auth.Sign("books-bot", []string{ScopeBooksWrite}, time.Hour)
+	forged := booksOnly[:strings.LastIndex(booksOnly, ".")+1] + "AAAA"
+	otherSecret := NewAuthenticator(nil, []byte("other secret"))
+	otherSecret.now = auth.now
+	foreign, _ := otherSecret.Sign("writer", []string{ScopeBooksWrite}, time.Hour)
+
+	cases := []struct {
+		name, method, target, header, value string
+		code                                int
+		errorCode                           string
+	}{
+		{"reads are public", http.MethodGet, "/books", "", "", http.StatusOK, ""},
+		{"no credentials", http.MethodPost, "/authors", "", "", http.StatusUnauthorized, "unauthorized"},
+		{"unknown key", http.MethodPost, "/authors", "X-API-Key", "guess", http.StatusUnauthorized, "unauthorized"},
+		{"key without scope", http.MethodPost, "/authors", "X-API-Key", "reader-key", http.StatusForbidden, "forbidden"},
+		{"key with scope", http.MethodPost, "/authors", "X-API-Key", "writer-key", http.StatusOK, ""},
+		{"token without scope", http.MethodPost, "/authors", "Authorization", "Bearer " + booksOnly, http.StatusForbidden, "forbidden"},
+		{"token with scope", http.MethodPost, "/books", "Authorization", "bearer " + booksOnly, http.StatusOK, ""},
+		{"import needs both scopes", http.MethodPost, "/import?format=ndjson", "Authorization", "Bearer " + booksOnly, http.StatusForbidden, "forbidden"},
+		{"forged signature", http.MethodDelete, "/books/1", "Authorization", "Bearer " + forged, http.StatusUnauthorized, "unauthorized"},
+		{"other secret", http.MethodDelete, "/books/1", "Authorization", "Bearer " + foreign, http.StatusUnauthorized, "unauthorized"},
+		{"basic auth", http.MethodDelete, "/books/1", "Authorization", "Basic d3JpdGVyOmtleQ==", http.StatusUnauthorized, "unauthorized"},
+		{"garbage token", http.MethodDelete, "/books/1", "Authorization", "Bearer a.b.c", http.StatusUnauthorized, "unauthorized"},
+	}
+	for _, c := range cases {
+		body := `{"name":"` + c.name + `"}`
+		req := httptest.NewRequest(c.method, c.target, strings.NewReader(body))
+		if c.header != "" {
+			req.Header.Set(c.header, c.value)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != c.code {
+			t.Errorf("%s: Invalid code! I want %d but get %d", c.name, c.code, rr.Code)
+			continue
+		}
+		if c.errorCode == "" {
+			continue
+		}
+		var response APIError
+		json.NewDecoder(rr.Body).Decode(&response)
+		if response.Code != c.errorCode {
+			t.Errorf("%s: Incorrect error code - Expected %s, found %s", c.name, c.errorCode, response.Code)
+		}
+		if c.code == http.StatusUnauthorized && rr.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: Expected a WWW-Authenticate header", c.name)
+		}
+	}
+
+	// The token stops working once it expires
+	*now = now.Add(time.Hour)
+	req := httptest.NewRequest(http.MethodPost, "/books", strings.NewReader(`{"name":"Expired"}`))
+	req.Header.Set("Authorization", "Bearer "+booksOnly)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized || !strings.Contains(rr.Body.String(), "Token expired") {
+		t.Errorf("Expected the expired token to be refused, found %d %s", rr.Code, rr.Body)
+	}
+}
+
+func TestPrincipalFromContext(t *testing.T) {
+	auth, _ := newTestAuthenticator()
+	var principal *Principal
+	handler := authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		principal, _ = PrincipalFromContext(r.Context())
+	}, auth, ScopeBooksWrite)
+
+	token, _ := auth.Sign("books-bot", []string{ScopeBooksWrite}, time.Minute)
+	req := httptest.NewRequest(http.MethodPost, "/books", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	handler(httptest.NewRecorder(), req)
+	if principal == nil || principal.Subject != "books-bot" || !principal.HasScope(ScopeBooksWrite) {
+		t.Errorf("Unexpected principal %+v", principal)
+	}
+	if _, ok := PrincipalFromContext(ctx); ok {
+		t.Error("Expected no principal outside of authMiddleware")
+	}
+}
+
+func TestAuthErrorsMatchOpenAPIDocument(t *testing.T) {
+	auth, _ := newTestAuthenticator()
+	api := newTestAPI()
+	api.authenticator = auth
+	c := newContract(t, newRouter(api))
+	if lookup(c.doc, "components", "securitySchemes", "bearer") == nil {
+		t.Error("Expected the bearer scheme to be documented")
+	}
+	if lookup(c.doc, "paths", "/books", "get", "security") != nil {
+		t.Error("Expected reads to stay public")
+	}
+	c.do(http.MethodPost, "/books", "/books", `{"name":"Book 1"}`)
+	c.do(http.MethodDelete, "/authors/1", "/authors/{id}", "")
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	authorsBucket        = []byte("authors")
+	authorsByNameBucket  = []byte("authors_by_name")
+	deletedAuthorsBucket = []byte("deleted_authors")
+)
+
+// BoltBackedAuthorRepository is the bolt counterpart of MemoryBackedAuthorRepository.
+type BoltBackedAuthorRepository struct {
+	db *bolt.DB
+}
+
+func (repo *BoltBackedAuthorRepository) GetAll(ctx context.Context) ([]Author, error) {
+	response, _, err := repo.Find(ctx, QueryOptions{})
+	return response, err
+}
+
+func (repo *BoltBackedAuthorRepository) Find(ctx context.Context, opts QueryOptions) ([]Author, int, error) {
+	response := make([]Author, 0)
+	total := 0
+	// Keys are big endian IDs, so for the default order we only keep the
+	// requested page while counting and don't have to sort at all
+	byID := opts.sortsByIDOnly()
+	start := opts.Offset
+	err := repo.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(authorsBucket).ForEach(func(k, v []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var author Author
+			if err := json.Unmarshal(v, &author); err != nil {
+				return err
+			}
+			if !opts.matchesAuthor(author) {
+				return nil
+			}
+			if !byID || (total >= start && (opts.Limit == 0 || total-start < opts.Limit)) {
+				response = append(response, author)
+			}
+			total++
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if byID {
+		return response, total, nil
+	}
+	sortAuthors(response, opts.Sort)
+	start, end := opts.window(total)
+	return response[start:end], total, nil
+}
+
+func (repo *BoltBackedAuthorRepository) Create(ctx context.Context, author *Author) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return repo.db.Update(func(tx *bolt.Tx) error {
+		names := tx.Bucket(authorsByNameBucket)
+		// Check for duplicacy
+		if names.Get([]byte(author.Name)) != nil {
+			return errDuplicateAuthor
+		}
+		authors := tx.Bucket(authorsBucket)
+		seq, err := authors.NextSequence()
+		if err != nil {
+			return err
+		}
+		author.ID, author.Version = int(seq), 1
+		data, err := json.Marshal(author)
+		if err != nil {
+			return err
+		}
+		if err := authors.Put(itob(author.ID), data); err != nil {
+			return err
+		}
+		if err := names.Put([]byte(author.Name), itob(author.ID)); err != nil {
+			return err
+		}
+		return bumpBoltVersion(tx, authorsBucket)
+	})
+}
+
+func (repo *BoltBackedAuthorRepository) GetByID(ctx context.Context, id int) (*Author, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var author *Author
+	err := repo.db.View(func(tx *bolt.Tx) error {
+		var err error
+		author, err = getBoltAuthor(tx, id)
+		return err
+	})
+	return author, err
+}
+
+func (repo *BoltBackedAuthorRepository) Update(ctx context.Context, author *Author, version int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// The new version is only handed back once the transaction committed
+	stored := *author
+	err := repo.db.Update(func(tx *bolt.Tx) error {
+		existing, err := getBoltAuthor(tx, author.ID)
+		if err != nil {
+			return err
+		}
+		if err := checkVersion("Author", author.ID, existing.Version, version); err != nil {
+			return err
+		}
+		stored.Version = existing.Version + 1
+		names := tx.Bucket(authorsByNameBucket)
+		// Renaming must not clash with another author
+		if existing.Name != author.Name {
+			if names.Get([]byte(author.Name)) != nil {
+				return errDuplicateAuthor
+			}
+			if err := names.Delete([]byte(existing.Name)); err != nil {
+				return err
+			}
+			if err := names.Put([]byte(author.Name), itob(author.ID)); err != nil {
+				return err
+			}
+		}
+		data, err := json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(authorsBucket).Put(itob(author.ID), data); err != nil {
+			return err
+		}
+		return bumpBoltVersion(tx, authorsBucket)
+	})
+	if err != nil {
+		return err
+	}
+	author.Version = stored.Version
+	return nil
+}
+
+func (repo *BoltBackedAuthorRepository) Delete(ctx context.Context, id int, version int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return repo.db.Update(func(tx *bolt.Tx) error {
+		existing, err := getBoltAuthor(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := checkVersion("Author", id, existing.Version, version); err != nil {
+			return err
+		}
+		if err := tx.Bucket(authorsByNameBucket).Delete([]byte(existing.Name)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(authorsBucket).Delete(itob(id)); err != nil {
+			return err
+		}
+		if err := putBoltJSON(tx, deletedAuthorsBucket, id, existing); err != nil {
+			return err
+		}
+		return bumpBoltVersion(tx, authorsBucket)
+	})
+}
+
+func (repo *BoltBackedAuthorRepository) GetDeletedByID(ctx context.Context, id int) (*Author, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var author *Author
+	err := repo.db.View(func(tx *bolt.Tx) error {
+		var err error
+		author, err = getDeletedBoltAuthor(tx, id)
+		return err
+	})
+	return author, err
+}
+
+func (repo *BoltBackedAuthorRepository) Undelete(ctx context.Context, id int) (*Author, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var author *Author
+	err := repo.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if author, err = getDeletedBoltAuthor(tx, id); err != nil {
+			return err
+		}
+		names := tx.Bucket(authorsByNameBucket)
+		if names.Get([]byte(author.Name)) != nil {
+			return errDuplicateAuthor
+		}
+		author.Version++
+		if err := putBoltJSON(tx, authorsBucket, id, author); err != nil {
+			return err
+		}
+		if err := names.Put([]byte(author.Name), itob(id)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(deletedAuthorsBucket).Delete(itob(id)); err != nil {
+			return err
+		}
+		return bumpBoltVersion(tx, authorsBucket)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return author, nil
+}
+
+func (repo *BoltBackedAuthorRepository) Version(ctx context.Context) (CatalogVersion, error) {
+	if err := ctx.Err(); err != nil {
+		return CatalogVersion{}, err
+	}
+	var version CatalogVersion
+	err := repo.db.View(func(tx *bolt.Tx) error {
+		version = getBoltVersion(tx, authorsBucket)
+		return nil
+	})
+	return version, err
+}
+
+func getBoltAuthor(tx *bolt.Tx, id int) (*Author, error) {
+	data := tx.Bucket(authorsBucket).Get(itob(id))
+	if data == nil {
+		return nil, errAuthorNotFound
+	}
+	var author Author
+	if err := json.Unmarshal(data, &author); err != nil {
+		return nil, err
+	}
+	return &author, nil
+}
+
+func getDeletedBoltAuthor(tx *bolt.Tx, id int) (*Author, error) {
+	data := tx.Bucket(deletedAuthorsBucket).Get(itob(id))
+	if data == nil {
+		return nil, errDeletedAuthorNotFound
+	}
+	var author Author
+	if err := json.Unmarshal(data, &author); err != nil {
+		return nil, err
+	}
+	return &author, nil
+}
+
+// Constructor Function
+func NewBoltBackedAuthorRepository(db *bolt.DB) (AuthorRepository, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		if err := createBuckets(tx, authorsBucket, authorsByNameBucket, deletedAuthorsBucket, versionsBucket); err != nil {
+			return err
+		}
+		return initBoltVersion(tx, authorsBucket)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltBackedAuthorRepository{db}, nil
+}
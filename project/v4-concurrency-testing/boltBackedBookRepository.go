@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	booksBucket        = []byte("books")
+	booksByNameBucket  = []byte("books_by_name")
+	deletedBooksBucket = []byte("deleted_books")
+)
+
+// BoltBackedBookRepository keeps books in a bolt file so they survive restarts.
+// Books are stored as JSON under their ID, a second bucket maps names to IDs
+// so the duplicate check doesn't need a full scan. Delete moves a book to a
+// third bucket, Undelete back.
+type BoltBackedBookRepository struct {
+	db *bolt.DB
+}
+
+func (repo *BoltBackedBookRepository) GetAll(ctx context.Context) ([]Book, error) {
+	response, _, err := repo.Find(ctx, QueryOptions{})
+	return response, err
+}
+
+func (repo *BoltBackedBookRepository) Find(ctx context.Context, opts QueryOptions) ([]Book, int, error) {
+	response := make([]Book, 0)
+	total := 0
+	// Keys are big endian IDs, so for the default order we only keep the
+	// requested page while counting and don't have to sort at all
+	byID := opts.sortsByIDOnly()
+	start := opts.Offset
+	err := repo.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(booksBucket).ForEach(func(k, v []byte) error {
+			// Stop scanning as soon as the caller gave up
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var book Book
+			if err := json.Unmarshal(v, &book); err != nil {
+				return err
+			}
+			if !opts.matchesBook(book) {
+				return nil
+			}
+			if !byID || (total >= start && (opts.Limit == 0 || total-start < opts.Limit)) {
+				response = append(response, book)
+			}
+			total++
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if byID {
+		return response, total, nil
+	}
+	sortBooks(response, opts.Sort)
+	start, end := opts.window(total)
+	return response[start:end], total, nil
+}
+
+func (repo *BoltBackedBookRepository) Create(ctx context.Context, book *Book) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return repo.db.Update(func(tx *bolt.Tx) error {
+		names := tx.Bucket(booksByNameBucket)
+		// Check for duplicacy
+		if names.Get([]byte(book.Name)) != nil {
+			return errDuplicateBook
+		}
+		books := tx.Bucket(booksBucket)
+		// Generate an ID, the sequence is only persisted if the transaction commits
+		seq, err := books.NextSequence()
+		if err != nil {
+			return err
+		}
+		book.ID, book.Version = int(seq), 1
+		data, err := json.Marshal(book)
+		if err != nil {
+			return err
+		}
+		if err := books.Put(itob(book.ID), data); err != nil {
+			return err
+		}
+		if err := names.Put([]byte(book.Name), itob(book.ID)); err != nil {
+			return err
+		}
+		return bumpBoltVersion(tx, booksBucket)
+	})
+}
+
+func (repo *BoltBackedBookRepository) GetByID(ctx context.Context, id int) (*Book, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var book *Book
+	err := repo.db.View(func(tx *bolt.Tx) error {
+		var err error
+		book, err = getBoltBook(tx, id)
+		return err
+	})
+	return book, err
+}
+
+func (repo *BoltBackedBookRepository) Update(ctx context.Context, book *Book, version int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// The new version is only handed back once the transaction committed
+	stored := *book
+	err := repo.db.Update(func(tx *bolt.Tx) error {
+		existing, err := getBoltBook(tx, book.ID)
+		if err != nil {
+			return err
+		}
+		if err := checkVersion("Book", book.ID, existing.Version, version); err != nil {
+			return err
+		}
+		stored.Version = existing.Version + 1
+		names := tx.Bucket(booksByNameBucket)
+		// Renaming must not clash with another book
+		if existing.Name != book.Name {
+			if names.Get([]byte(book.Name)) != nil {
+				return errDuplicateBook
+			}
+			if err := names.Delete([]byte(existing.Name)); err != nil {
+				return err
+			}
+			if err := names.Put([]byte(book.Name), itob(book.ID)); err != nil {
+				return err
+			}
+		}
+		data, err := json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(booksBucket).Put(itob(book.ID), data); err != nil {
+			return err
+		}
+		return bumpBoltVersion(tx, booksBucket)
+	})
+	if err != nil {
+		return err
+	}
+	book.Version = stored.Version
+	return nil
+}
+
+func (repo *BoltBackedBookRepository) Delete(ctx context.Context, id int, version int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return repo.db.Update(func(tx *bolt.Tx) error {
+		existing, err := getBoltBook(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := checkVersion("Book", id, existing.Version, version); err != nil {
+			return err
+		}
+		if err := tx.Bucket(booksByNameBucket).Delete([]byte(existing.Name)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(booksBucket).Delete(itob(id)); err != nil {
+			return err
+		}
+		if err := putBoltJSON(tx, deletedBooksBucket, id, existing); err != nil {
+			return err
+		}
+		return bumpBoltVersion(tx, booksBucket)
+	})
+}
+
+func (repo *BoltBackedBookRepository) GetDeletedByID(ctx context.Context, id int) (*Book, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var book *Book
+	err := repo.db.View(func(tx *bolt.Tx) error {
+		var err error
+		book, err = getDeletedBoltBook(tx, id)
+		return err
+	})
+	return book, err
+}
+
+func (repo *BoltBackedBookRepository) Undelete(ctx context.Context, id int) (*Book, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var book *Book
+	err := repo.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if book, err = getDeletedBoltBook(tx, id); err != nil {
+			return err
+		}
+		names := tx.Bucket(booksByNameBucket)
+		if names.Get([]byte(book.Name)) != nil {
+			return errDuplicateBook
+		}
+		book.Version++
+		if err := putBoltJSON(tx, booksBucket, id, book); err != nil {
+			return err
+		}
+		if err := names.Put([]byte(book.Name), itob(id)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(deletedBooksBucket).Delete(itob(id)); err != nil {
+			return err
+		}
+		return bumpBoltVersion(tx, booksBucket)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return book, nil
+}
+
+func (repo *BoltBackedBookRepository) Version(ctx context.Context) (CatalogVersion, error) {
+	if err := ctx.Err(); err != nil {
+		return CatalogVersion{}, err
+	}
+	var version CatalogVersion
+	err := repo.db.View(func(tx *bolt.Tx) error {
+		version = getBoltVersion(tx, booksBucket)
+		return nil
+	})
+	return version, err
+}
+
+func getBoltBook(tx *bolt.Tx, id int) (*Book, error) {
+	data := tx.Bucket(booksBucket).Get(itob(id))
+	if data == nil {
+		return nil, errBookNotFound
+	}
+	var book Book
+	if err := json.Unmarshal(data, &book); err != nil {
+		return nil, err
+	}
+	return &book, nil
+}
+
+func getDeletedBoltBook(tx *bolt.Tx, id int) (*Book, error) {
+	data := tx.Bucket(deletedBooksBucket).Get(itob(id))
+	if data == nil {
+		return nil, errDeletedBookNotFound
+	}
+	var book Book
+	if err := json.Unmarshal(data, &book); err != nil {
+		return nil, err
+	}
+	return &book, nil
+}
+
+// Constructor Function
+func NewBoltBackedBookRepository(db *bolt.DB) (BookRepository, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		if err := createBuckets(tx, booksBucket, booksByNameBucket, deletedBooksBucket, versionsBucket); err != nil {
+			return err
+		}
+		return initBoltVersion(tx, booksBucket)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltBackedBookRepository{db}, nil
+}
+
+// itob encodes an ID as a big endian key so bolt keeps entries ordered by ID.
+func itob(v int) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	return b
+}
+
+// putBoltJSON stores v as JSON under id in bucket
+func putBoltJSON(tx *bolt.Tx, bucket []byte, id int, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucket).Put(itob(id), data)
+}
+
+func createBuckets(tx *bolt.Tx, names ...[]byte) error {
+	for _, name := range names {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// versionsBucket holds the CatalogVersion of every entity bucket, the
+// counter followed by the Unix time in nanoseconds of the last write.
+var versionsBucket = []byte("versions")
+
+// initBoltVersion starts counting for files written before versions existed too
+func initBoltVersion(tx *bolt.Tx, bucket []byte) error {
+	if tx.Bucket(versionsBucket).Get(bucket) != nil {
+		return nil
+	}
+	return putBoltVersion(tx, bucket, newCatalogVersion())
+}
+
+func getBoltVersion(tx *bolt.Tx, bucket []byte) CatalogVersion {
+	data := tx.Bucket(versionsBucket).Get(bucket)
+	return CatalogVersion{
+		Counter:  binary.BigEndian.Uint64(data[:8]),
+		Modified: time.Unix(0, int64(binary.BigEndian.Uint64(data[8:]))).UTC(),
+	}
+}
+
+func putBoltVersion(tx *bolt.Tx, bucket []byte, version CatalogVersion) error {
+	data := make([]byte, 16)
+	binary.BigEndian.PutUint64(data[:8], version.Counter)
+	binary.BigEndian.PutUint64(data[8:], uint64(version.Modified.UnixNano()))
+	return tx.Bucket(versionsBucket).Put(bucket, data)
+}
+
+// bumpBoltVersion records a write in the same transaction, so the version
+// only changes when the write commits.
+func bumpBoltVersion(tx *bolt.Tx, bucket []byte) error {
+	version := getBoltVersion(tx, bucket)
+	version.bump()
+	return putBoltVersion(tx, bucket, version)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+)
+
+var historyBucket = []byte("history")
+
+// BoltBackedHistoryRepository keeps the entries of every entity in a bucket
+// of their own inside historyBucket, under their big endian ID. The IDs come
+// from the sequence of historyBucket.
+type BoltBackedHistoryRepository struct {
+	db *bolt.DB
+}
+
+// historyBucketName names the bucket of the entries of one entity, e.g. books/1
+func historyBucketName(entity string, id int) []byte {
+	return []byte(entity + "/" + strconv.Itoa(id))
+}
+
+func (repo *BoltBackedHistoryRepository) Append(ctx context.Context, entry *HistoryEntry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	stored := *entry
+	err := repo.db.Update(func(tx *bolt.Tx) error {
+		history := tx.Bucket(historyBucket)
+		seq, err := history.NextSequence()
+		if err != nil {
+			return err
+		}
+		stored.ID = int(seq)
+		entries, err := history.CreateBucketIfNotExists(historyBucketName(entry.Entity, entry.EntityID))
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+		return entries.Put(itob(stored.ID), data)
+	})
+	if err != nil {
+		return err
+	}
+	entry.ID = stored.ID
+	return nil
+}
+
+func (repo *BoltBackedHistoryRepository) Find(ctx context.Context, entity string, id int) ([]HistoryEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	response := make([]HistoryEntry, 0)
+	err := repo.db.View(func(tx *bolt.Tx) error {
+		entries := tx.Bucket(historyBucket).Bucket(historyBucketName(entity, id))
+		if entries == nil {
+			return nil
+		}
+		return entries.ForEach(func(k, v []byte) error {
+			var entry HistoryEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			response = append(response, entry)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// Constructor Function
+func NewBoltBackedHistoryRepository(db *bolt.DB) (HistoryRepository, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		return createBuckets(tx, historyBucket)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltBackedHistoryRepository{db}, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func openTestBolt(t *testing.T, path string) *bolt.DB {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatalf("Unable to open bolt file: %v", err)
+	}
+	return db
+}
+
+func TestBoltBookRepositoryPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "books.db")
+	db := openTestBolt(t, path)
+	repo, err := NewBoltBackedBookRepository(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Book 1", "Book 2"} {
+		if err := repo.Create(ctx, &Book{Name: name, AuthorIDs: []int{1}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repo.Create(ctx, &Book{Name: "Book 1"}); err == nil {
+		t.Error("Expected duplicate book to be rejected")
+	}
+	db.Close()
+
+	// Reopen the file, the catalog and the sequence must survive
+	db = openTestBolt(t, path)
+	defer db.Close()
+	repo, err = NewBoltBackedBookRepository(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	books, err := repo.GetAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(books) != 2 {
+		t.Fatalf("Incorrect length - Expected %d, found %d", 2, len(books))
+	}
+	book := &Book{Name: "Book 3"}
+	if err := repo.Create(ctx, book); err != nil {
+		t.Fatal(err)
+	}
+	if book.ID != 3 {
+		t.Errorf("Incorrect ID - Expected %d, found %d", 3, book.ID)
+	}
+}
+
+func TestBoltAuthorRepositoryDuplicate(t *testing.T) {
+	db := openTestBolt(t, filepath.Join(t.TempDir(), "authors.db"))
+	defer db.Close()
+	repo, err := NewBoltBackedAuthorRepository(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	author := &Author{Name: "Author 1"}
+	if err := repo.Create(ctx, author); err != nil {
+		t.Fatal(err)
+	}
+	if author.ID != 1 {
+		t.Errorf("Incorrect ID - Expected %d, found %d", 1, author.ID)
+	}
+	if err := repo.Create(ctx, &Author{Name: "Author 1"}); err == nil {
+		t.Error("Expected duplicate author to be rejected")
+	}
+}
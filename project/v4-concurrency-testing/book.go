@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// UnmarshalJSON reads the books stored before they could have several
+// authors, their single authorId becomes the only entry of AuthorIDs.
+func (book *Book) UnmarshalJSON(data []byte) error {
+	type plain Book
+	var stored struct {
+		plain
+		AuthorID int `json:"authorId"`
+	}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+	*book = Book(stored.plain)
+	if len(book.AuthorIDs) == 0 && stored.AuthorID != 0 {
+		book.AuthorIDs = []int{stored.AuthorID}
+	}
+	return nil
+}
+
+// clone copies the slices of book too, the memory repositories hand out
+// clones so a caller changing a book can't change what they store.
+func (book Book) clone() Book {
+	if book.AuthorIDs != nil {
+		book.AuthorIDs = append([]int{}, book.AuthorIDs...)
+	}
+	if book.Genres != nil {
+		book.Genres = append([]string{}, book.Genres...)
+	}
+	return book
+}
+
+// hasAuthor tells whether id is one of the authors of book
+func (book Book) hasAuthor(id int) bool {
+	for _, authorID := range book.AuthorIDs {
+		if authorID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// firstAuthor is the author credited first, 0 for a book without authors.
+// It is the authorId of the API versions which only know one author.
+func (book Book) firstAuthor() int {
+	if len(book.AuthorIDs) == 0 {
+		return 0
+	}
+	return book.AuthorIDs[0]
+}
+
+// sameAuthors compares two lists of author IDs, the order of the credits counts
+func sameAuthors(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sameGenres tells whether a and b are the same genres in the same order
+func sameGenres(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// validateBook checks the fields of book which don't depend on the rest of
+// the catalog and brings them to the form they are stored in: the ISBN
+// without hyphens and the genres trimmed and without duplicates. Whether the
+// authors exist is checked by the integrity repositories.
+func validateBook(book *Book) error {
+	var fields []FieldError
+	if book.ISBN != "" {
+		isbn, ok := normalizeISBN(book.ISBN)
+		if !ok {
+			fields = append(fields, FieldError{"isbn", "must be an ISBN-10 or ISBN-13 with a valid check digit"})
+		}
+		book.ISBN = isbn
+	}
+	if book.Year < 0 || book.Year > time.Now().Year()+1 {
+		fields = append(fields, FieldError{"year", "must be a year up to the next one"})
+	}
+	seen := make(map[int]bool, len(book.AuthorIDs))
+	for _, id := range book.AuthorIDs {
+		if id <= 0 || seen[id] {
+			fields = append(fields, FieldError{"authorIds", "must be distinct positive IDs"})
+			break
+		}
+		seen[id] = true
+	}
+	genres := make([]string, 0, len(book.Genres))
+	known := make(map[string]bool, len(book.Genres))
+	for _, genre := range book.Genres {
+		genre = strings.TrimSpace(genre)
+		if genre == "" {
+			fields = append(fields, FieldError{"genres", "cannot contain an empty genre"})
+			break
+		}
+		if !known[strings.ToLower(genre)] {
+			known[strings.ToLower(genre)] = true
+			genres = append(genres, genre)
+		}
+	}
+	if len(fields) > 0 {
+		return invalidEntity("Invalid book", fields...)
+	}
+	book.Genres = nil
+	if len(genres) > 0 {
+		book.Genres = genres
+	}
+	return nil
+}
+
+// normalizeISBN strips the hyphens and spaces of isbn and checks its check
+// digit, the last one. ISBN-10 weighs the digits 10 down to 1 and the sum
+// has to be a multiple of 11, X standing for 10. ISBN-13 weighs them 1 and 3
+// in turn and the sum has to be a multiple of 10.
+func normalizeISBN(isbn string) (string, bool) {
+	isbn = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(isbn))
+	switch len(isbn) {
+	case 10:
+		sum := 0
+		for i, r := range isbn {
+			digit := int(r - '0')
+			if r == 'X' && i == 9 {
+				digit = 10
+			} else if r < '0' || r > '9' {
+				return isbn, false
+			}
+			sum += (10 - i) * digit
+		}
+		return isbn, sum%11 == 0
+	case 13:
+		sum := 0
+		for i, r := range isbn {
+			if r < '0' || r > '9' {
+				return isbn, false
+			}
+			sum += int(r-'0') * (1 + 2*(i%2))
+		}
+		return isbn, sum%10 == 0
+	}
+	return isbn, false
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNormalizeISBN(t *testing.T) {
+	cases := []struct {
+		isbn, expected string
+		valid          bool
+	}{
+		{"0-306-40615-2", "0306406152", true},
+		{"080442957x", "080442957X", true},
+		{"978-0-306-40615-7", "9780306406157", true},
+		{"978 0134190440", "9780134190440", true},
+		{"0-306-40615-3", "0306406153", false},
+		{"978-0-306-40615-8", "9780306406158", false},
+		{"X306406152", "X306406152", false},
+		{"12345", "12345", false},
+	}
+	for _, c := range cases {
+		isbn, valid := normalizeISBN(c.isbn)
+		if isbn != c.expected || valid != c.valid {
+			t.Errorf("%s: Expected %s and %v, found %s and %v", c.isbn, c.expected, c.valid, isbn, valid)
+		}
+	}
+}
+
+func TestValidateBook(t *testing.T) {
+	book := &Book{Name: "Book 1", ISBN: "0-306-40615-2", Year: 1999, Genres: []string{" Go ", "go", "Programming"}}
+	if err := validateBook(book); err != nil {
+		t.Fatal(err)
+	}
+	if book.ISBN != "0306406152" || !reflect.DeepEqual(book.Genres, []string{"Go", "Programming"}) {
+		t.Errorf("Unexpected book %+v", book)
+	}
+
+	next := time.Now().Year() + 1
+	cases := []struct {
+		book  Book
+		field string
+	}{
+		{Book{ISBN: "0-306-40615-3"}, "isbn"},
+		{Book{Year: -1}, "year"},
+		{Book{Year: next + 1}, "year"},
+		{Book{AuthorIDs: []int{1, 1}}, "authorIds"},
+		{Book{AuthorIDs: []int{0}}, "authorIds"},
+		{Book{Genres: []string{"Go", " "}}, "genres"},
+	}
+	for _, c := range cases {
+		err := validateBook(&c.book)
+		var repoErr *RepositoryError
+		if !errors.As(err, &repoErr) || repoErr.Kind != ErrInvalid || len(repoErr.Fields) != 1 || repoErr.Fields[0].Field != c.field {
+			t.Errorf("%+v: Expected an error on %s, found %v", c.book, c.field, err)
+		}
+	}
+	if err := validateBook(&Book{Year: next}); err != nil {
+		t.Errorf("Expected next year to be valid, found %v", err)
+	}
+}
+
+// Books stored with a single authorId by the bolt and file backends
+func TestBookDecodesStoredAuthorID(t *testing.T) {
+	var book Book
+	if err := json.Unmarshal([]byte(`{"id":1,"name":"Book 1","authorId":3}`), &book); err != nil {
+		t.Fatal(err)
+	}
+	if !sameAuthors(book.AuthorIDs, []int{3}) {
+		t.Errorf("Incorrect authors - Expected %v, found %v", []int{3}, book.AuthorIDs)
+	}
+	// Once written again the book only has authorIds
+	data, _ := json.Marshal(book)
+	var stored map[string]interface{}
+	json.Unmarshal(data, &stored)
+	if _, ok := stored["authorId"]; ok || stored["authorIds"] == nil {
+		t.Errorf("Incorrect encoding, found %s", data)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CatalogVersion identifies the state of a repository. Counter grows with
+// every write and Modified is the time of the last one, or of the creation
+// of the storage. The pair tells two states apart even when a memory
+// repository starts counting from 0 again after a restart.
+type CatalogVersion struct {
+	Counter  uint64
+	Modified time.Time
+}
+
+// bump records a write
+func (v *CatalogVersion) bump() {
+	v.Counter++
+	v.Modified = time.Now().UTC()
+}
+
+func newCatalogVersion() CatalogVersion {
+	return CatalogVersion{Modified: time.Now().UTC()}
+}
+
+// validators are the ETag and Last-Modified of a response built from the
+// repositories with the given versions. Read the versions before the data:
+// a write in between then gives an older tag than the data, so the client
+// fetches again next time instead of keeping stale data under a current tag.
+type validators struct {
+	etag     string
+	modified time.Time
+}
+
+// versioned is implemented by every repository
+type versioned interface {
+	Version(ctx context.Context) (CatalogVersion, error)
+}
+
+// readValidators builds the validators of a response made from repositories.
+// variant names the representation, a URL serving several of them must
+// not give them the same tag.
+func readValidators(ctx context.Context, variant string, repositories ...versioned) (validators, error) {
+	versions := make([]CatalogVersion, len(repositories))
+	for i, repo := range repositories {
+		var err error
+		if versions[i], err = repo.Version(ctx); err != nil {
+			return validators{}, err
+		}
+	}
+	return newValidators(variant, versions...), nil
+}
+
+func newValidators(variant string, versions ...CatalogVersion) validators {
+	parts := []string{variant}
+	var modified time.Time
+	for _, v := range versions {
+		parts = append(parts, strconv.FormatUint(v.Counter, 10)+"."+strconv.FormatInt(v.Modified.UnixNano(), 36))
+		if v.Modified.After(modified) {
+			modified = v.Modified
+		}
+	}
+	// HTTP dates have no fraction of a second
+	return validators{etag: `"` + strings.Join(parts, "-") + `"`, modified: modified.Truncate(time.Second)}
+}
+
+func (v validators) set(header http.Header) {
+	header.Set("ETag", v.etag)
+	header.Set("Last-Modified", v.modified.UTC().Format(http.TimeFormat))
+}
+
+// notModified answers 304 when the copy of the client is current. The ETag
+// is the precise validator, If-Modified-Since is only looked at without
+// If-None-Match as two writes within a second share their Last-Modified.
+func (v validators) notModified(w http.ResponseWriter, r *http.Request) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if !etagListContains(match, v.etag) {
+			return false
+		}
+	} else {
+		since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+		if err != nil || v.modified.After(since) {
+			return false
+		}
+	}
+	v.set(w.Header())
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagListContains compares the tags of an If-None-Match header with tag,
+// weakly as RFC 7232 asks for GET.
+func etagListContains(list, tag string) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRepositoryVersion(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, books BookRepository, authors AuthorRepository) {
+		last, err := books.Version(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		authorVersion, _ := authors.Version(ctx)
+		expectChange := func(what string, changed bool) {
+			t.Helper()
+			current, err := books.Version(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (current != last) != changed {
+				t.Errorf("%s: Expected a change %v, found %+v after %+v", what, changed, current, last)
+			}
+			if current.Counter < last.Counter || current.Modified.Before(last.Modified) {
+				t.Errorf("%s: Expected the version to move forward, found %+v after %+v", what, current, last)
+			}
+			last = current
+		}
+
+		book := &Book{Name: "Book 1"}
+		books.Create(ctx, book)
+		expectChange("Create", true)
+		books.GetAll(ctx)
+		books.GetByID(ctx, book.ID)
+		expectChange("reads", false)
+		books.Create(ctx, &Book{Name: "Book 1"})
+		expectChange("failed Create", false)
+		book.Name = "Book 2"
+		books.Update(ctx, book, AnyVersion)
+		expectChange("Update", true)
+		books.Delete(ctx, book.ID, AnyVersion)
+		expectChange("Delete", true)
+		books.Delete(ctx, book.ID, AnyVersion)
+		expectChange("failed Delete", false)
+
+		if current, _ := authors.Version(ctx); current != authorVersion {
+			t.Errorf("Expected the authors to keep their version, found %+v after %+v", current, authorVersion)
+		}
+	})
+}
+
+func TestRepositoryVersionIsStored(t *testing.T) {
+	t.Run("bolt", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "bookstore.db")
+		db := openTestBolt(t, path)
+		books, _ := NewBoltBackedBookRepository(db)
+		books.Create(ctx, &Book{Name: "Book 1"})
+		before, _ := books.Version(ctx)
+		db.Close()
+
+		db = openTestBolt(t, path)
+		defer db.Close()
+		books, _ = NewBoltBackedBookRepository(db)
+		if after, _ := books.Version(ctx); after != before || after.Counter != 1 {
+			t.Errorf("Incorrect version - Expected %+v, found %+v", before, after)
+		}
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		db := openTestSQLite(t)
+		books := NewSQLiteBackedBookRepository(db)
+		// Writes which bypass the repository are counted by the triggers
+		if _, err := db.Exec("INSERT INTO books (name) VALUES ('Book 1')"); err != nil {
+			t.Fatal(err)
+		}
+		if version, _ := books.Version(ctx); version.Counter != 1 || time.Since(version.Modified) > time.Minute {
+			t.Errorf("Unexpected version %+v", version)
+		}
+	})
+}
+
+func conditionalGet(router http.Handler, target string, header, value string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	if header != "" {
+		req.Header.Set(header, value)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestConditionalGet(t *testing.T) {
+	router := newRouter(newTestAPI())
+	do(router, http.MethodPost, "/authors", strings.NewReader(`{"name":"Author 1"}`))
+	do(router, http.MethodPost, "/books", strings.NewReader(`{"name":"Book 1","authorId":1}`))
+
+	for _, target := range []string{"/books", "/authors", "/books-authors?group=author"} {
+		rr := conditionalGet(router, target, "", "")
+		etag, lastModified := rr.Header().Get("ETag"), rr.Header().Get("Last-Modified")
+		if rr.Code != http.StatusOK || !strings.HasPrefix(etag, `"`) || lastModified == "" {
+			t.Fatalf("%s: Unexpected response %d with headers %v", target, rr.Code, rr.Header())
+		}
+
+		cases := []struct {
+			header, value string
+			status        int
+		}{
+			{"If-None-Match", etag, http.StatusNotModified},
+			{"If-None-Match", `"other", W/` + etag, http.StatusNotModified},
+			{"If-None-Match", "*", http.StatusNotModified},
+			{"If-None-Match", `"other"`, http.StatusOK},
+			{"If-Modified-Since", lastModified, http.StatusNotModified},
+			{"If-Modified-Since", "Sat, 01 Jan 2000 00:00:00 GMT", http.StatusOK},
+			{"If-Modified-Since", "yesterday", http.StatusOK},
+		}
+		for _, c := range cases {
+			rr := conditionalGet(router, target, c.header, c.value)
+			if rr.Code != c.status {
+				t.Errorf("%s with %s %s: Invalid code! I want %d but get %d", target, c.header, c.value, c.status, rr.Code)
+			}
+			if rr.Code == http.StatusNotModified && (rr.Body.Len() != 0 || rr.Header().Get("ETag") != etag) {
+				t.Errorf("%s: Unexpected 304 %q with headers %v", target, rr.Body, rr.Header())
+			}
+		}
+	}
+
+	// A mismatched ETag wins over a current date
+	etag := conditionalGet(router, "/books", "", "").Header().Get("ETag")
+	req := httptest.NewRequest(http.MethodGet, "/books", nil)
+	req.Header.Set("If-None-Match", `"other"`)
+	req.Header.Set("If-Modified-Since", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Invalid code! I want %d but get %d", http.StatusOK, rr.Code)
+	}
+
+	// Every write changes the tag of the responses made from its repository
+	joined := conditionalGet(router, "/books-authors", "", "").Header().Get("ETag")
+	do(router, http.MethodPatch, "/authors/1", strings.NewReader(`{"name":"Author 2"}`))
+	if rr := conditionalGet(router, "/books", "If-None-Match", etag); rr.Code != http.StatusNotModified {
+		t.Errorf("Expected books to be unchanged by an author, found %d", rr.Code)
+	}
+	rr = conditionalGet(router, "/books-authors", "If-None-Match", joined)
+	if rr.Code != http.StatusOK || rr.Header().Get("ETag") == joined {
+		t.Errorf("Expected a new tag after the author changed, found %d %s", rr.Code, rr.Header().Get("ETag"))
+	}
+	do(router, http.MethodDelete, "/books/1", nil)
+	if rr := conditionalGet(router, "/books", "If-None-Match", etag); rr.Code != http.StatusOK || rr.Body.String() != "[]\n" {
+		t.Errorf("Expected the new list after a delete, found %d %s", rr.Code, rr.Body)
+	}
+}
+
+func TestConditionalGetIsDocumented(t *testing.T) {
+	router := newRouter(newTestAPI())
+	// An empty list would match both schemas of /books-authors
+	do(router, http.MethodPost, "/authors", strings.NewReader(`{"name":"Author 1"}`))
+	do(router, http.MethodPost, "/books", strings.NewReader(`{"name":"Book 1","authorId":1}`))
+	c := newContract(t, router)
+	for _, path := range []string{"/books", "/authors", "/books-authors"} {
+		if lookup(c.doc, "paths", path, "get", "responses", "304") == nil {
+			t.Errorf("Expected a 304 response for %s", path)
+		}
+		c.do(http.MethodGet, path, path, "")
+	}
+}
@@ -3,23 +3,66 @@ package main
 type CombinationServiceImpl struct {
 }
 
-func (cb *CombinationServiceImpl) GenerateResponse(books []Book, authors []Author) []CombinedResponse {
-	combinedResponse := make([]CombinedResponse, 0)
+// GenerateResponse pairs every book with its authors, books without any
+// author that exists are left out. Authors are indexed by ID first, so the
+// join is O(books + authors) instead of a loop over authors for every book.
+func (cb *CombinationServiceImpl) GenerateResponse(books []Book, authors []Author) []BookWithAuthors {
+	return cb.join(books, authors, false)
+}
+
+// GenerateLeftJoin works like GenerateResponse but keeps the books without
+// an author, their list of authors is empty.
+func (cb *CombinationServiceImpl) GenerateLeftJoin(books []Book, authors []Author) []BookWithAuthors {
+	return cb.join(books, authors, true)
+}
+
+func (cb *CombinationServiceImpl) join(books []Book, authors []Author, keepOrphans bool) []BookWithAuthors {
+	index := indexAuthors(authors)
+	joined := make([]BookWithAuthors, 0, len(books))
 	// Iterate over books
 	for _, book := range books {
-		// Find author for every book
-		for _, author := range authors {
-			if author.ID == book.AuthorID {
-				book.AuthorID = 0
-				singleResponse := CombinedResponse{
-					book,
-					author,
-				}
-				combinedResponse = append(combinedResponse, singleResponse)
+		bookAuthors := make([]Author, 0, len(book.AuthorIDs))
+		for _, id := range book.AuthorIDs {
+			if author, ok := index[id]; ok {
+				bookAuthors = append(bookAuthors, *author)
 			}
 		}
+		if len(bookAuthors) == 0 && !keepOrphans {
+			continue
+		}
+		joined = append(joined, BookWithAuthors{book, bookAuthors})
+	}
+	return joined
+}
+
+// GroupByAuthor nests the books under their authors, in the order of authors.
+// A book with several authors is listed under each of them. Authors without
+// books get an empty list, books without author are left out.
+func (cb *CombinationServiceImpl) GroupByAuthor(books []Book, authors []Author) []AuthorWithBooks {
+	grouped := make([]AuthorWithBooks, len(authors))
+	position := make(map[int]int, len(authors))
+	for i, author := range authors {
+		grouped[i] = AuthorWithBooks{author, make([]Book, 0)}
+		position[author.ID] = i
+	}
+	for _, book := range books {
+		for _, id := range book.AuthorIDs {
+			i, ok := position[id]
+			if !ok {
+				continue
+			}
+			grouped[i].Books = append(grouped[i].Books, book)
+		}
+	}
+	return grouped
+}
+
+func indexAuthors(authors []Author) map[int]*Author {
+	index := make(map[int]*Author, len(authors))
+	for i := range authors {
+		index[authors[i].ID] = &authors[i]
 	}
-	return combinedResponse
+	return index
 }
 
 func NewCombinationService() CombinationService {
@@ -1,23 +1,24 @@
 package main
 
 import (
+	"fmt"
 	"testing"
 )
 
 func TestBasic(t *testing.T) {
 
 	books := []Book{Book{
-		Name:     "Book 1",
-		AuthorID: 1,
-		ID:       1,
+		Name:      "Book 1",
+		AuthorIDs: []int{1},
+		ID:        1,
 	}, Book{
-		Name:     "Book 2",
-		AuthorID: 1,
-		ID:       2,
+		Name:      "Book 2",
+		AuthorIDs: []int{1},
+		ID:        2,
 	}, Book{
-		Name:     "Book 3",
-		AuthorID: 2,
-		ID:       3,
+		Name:      "Book 3",
+		AuthorIDs: []int{2},
+		ID:        3,
 	}}
 
 	authors := []Author{Author{
@@ -33,7 +34,131 @@ func TestBasic(t *testing.T) {
 	if len(response) != 3 {
 		t.Errorf("Incorrect length - Expected %d, found %d", 3, len(response))
 	}
-	if response[0].AuthorID != 0 {
-		t.Error("Author ID should be zero so it could be omitted from response")
+	// The join keeps the book as it is, the shapes of the API version hide what they don't send
+	if response[0].firstAuthor() != 1 || len(response[0].Authors) != 1 || response[0].Authors[0].ID != 1 {
+		t.Errorf("Incorrect author - Expected %d, found %+v", 1, response[0])
+	}
+}
+
+func TestLeftJoinKeepsOrphans(t *testing.T) {
+	books := []Book{{ID: 1, Name: "Book 1", AuthorIDs: []int{1}}, {ID: 2, Name: "Book 2", AuthorIDs: []int{9}}}
+	authors := []Author{{ID: 1, Name: "Author 1"}}
+
+	service := NewCombinationService()
+	if response := service.GenerateResponse(books, authors); len(response) != 1 {
+		t.Errorf("Incorrect length - Expected %d, found %d", 1, len(response))
+	}
+	response := service.GenerateLeftJoin(books, authors)
+	if len(response) != 2 {
+		t.Fatalf("Incorrect length - Expected %d, found %d", 2, len(response))
+	}
+	if len(response[0].Authors) != 1 || response[0].Authors[0].Name != "Author 1" {
+		t.Errorf("Expected Author 1, found %+v", response[0].Authors)
+	}
+	if len(response[1].Authors) != 0 || response[1].Name != "Book 2" {
+		t.Errorf("Expected Book 2 without author, found %+v", response[1])
+	}
+}
+
+func TestGroupByAuthor(t *testing.T) {
+	books := []Book{{ID: 1, AuthorIDs: []int{2}}, {ID: 2, AuthorIDs: []int{1}}, {ID: 3, AuthorIDs: []int{2}}, {ID: 4, AuthorIDs: []int{9}}}
+	authors := []Author{{ID: 1, Name: "Author 1"}, {ID: 2, Name: "Author 2"}, {ID: 3, Name: "Author 3"}}
+
+	grouped := NewCombinationService().GroupByAuthor(books, authors)
+	if len(grouped) != 3 {
+		t.Fatalf("Incorrect length - Expected %d, found %d", 3, len(grouped))
+	}
+	expected := map[int][]int{1: {2}, 2: {1, 3}, 3: {}}
+	for _, group := range grouped {
+		if len(group.Books) != len(expected[group.ID]) {
+			t.Errorf("Author %d: Expected books %v, found %+v", group.ID, expected[group.ID], group.Books)
+			continue
+		}
+		for i, book := range group.Books {
+			if book.ID != expected[group.ID][i] || !book.hasAuthor(group.ID) {
+				t.Errorf("Author %d: Expected books %v, found %+v", group.ID, expected[group.ID], group.Books)
+			}
+		}
+	}
+}
+
+func TestCoAuthors(t *testing.T) {
+	books := []Book{{ID: 1, Name: "Book 1", AuthorIDs: []int{2, 1}}, {ID: 2, Name: "Book 2", AuthorIDs: []int{9, 1}}}
+	authors := []Author{{ID: 1, Name: "Author 1"}, {ID: 2, Name: "Author 2"}}
+	service := NewCombinationService()
+
+	response := service.GenerateResponse(books, authors)
+	if len(response) != 2 {
+		t.Fatalf("Incorrect length - Expected %d, found %d", 2, len(response))
+	}
+	// The authors keep the order of the credits, the ones which don't exist are left out
+	if len(response[0].Authors) != 2 || response[0].Authors[0].ID != 2 || response[0].Authors[1].ID != 1 {
+		t.Errorf("Incorrect authors - Expected %v, found %+v", []int{2, 1}, response[0].Authors)
+	}
+	if len(response[1].Authors) != 1 || response[1].Authors[0].ID != 1 {
+		t.Errorf("Incorrect authors - Expected %v, found %+v", []int{1}, response[1].Authors)
+	}
+
+	grouped := service.GroupByAuthor(books, authors)
+	if len(grouped[0].Books) != 2 || len(grouped[1].Books) != 1 || grouped[1].Books[0].ID != 1 {
+		t.Errorf("Incorrect groups - Expected books %v and %v, found %+v", []int{1, 2}, []int{1}, grouped)
+	}
+}
+
+// nestedLoopJoin is the join we had before the author index, kept to compare against
+func nestedLoopJoin(books []Book, authors []Author) []BookWithAuthors {
+	combinedResponse := make([]BookWithAuthors, 0)
+	for _, book := range books {
+		var bookAuthors []Author
+		for _, id := range book.AuthorIDs {
+			for i := range authors {
+				if authors[i].ID == id {
+					bookAuthors = append(bookAuthors, authors[i])
+				}
+			}
+		}
+		if len(bookAuthors) > 0 {
+			combinedResponse = append(combinedResponse, BookWithAuthors{book, bookAuthors})
+		}
+	}
+	return combinedResponse
+}
+
+func benchmarkCatalog() ([]Book, []Author) {
+	authors := make([]Author, 1000)
+	for i := range authors {
+		authors[i] = Author{ID: i + 1, Name: fmt.Sprintf("Author %d", i+1)}
+	}
+	books := make([]Book, 100000)
+	for i := range books {
+		books[i] = Book{ID: i + 1, Name: fmt.Sprintf("Book %d", i+1), AuthorIDs: []int{i%len(authors) + 1}}
+	}
+	return books, authors
+}
+
+// go test -bench Join -benchmem
+func BenchmarkIndexedJoin(b *testing.B) {
+	books, authors := benchmarkCatalog()
+	service := NewCombinationService()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		service.GenerateResponse(books, authors)
+	}
+}
+
+func BenchmarkNestedLoopJoin(b *testing.B) {
+	books, authors := benchmarkCatalog()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		nestedLoopJoin(books, authors)
+	}
+}
+
+func BenchmarkGroupByAuthorJoin(b *testing.B) {
+	books, authors := benchmarkCatalog()
+	service := NewCombinationService()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		service.GroupByAuthor(books, authors)
 	}
 }
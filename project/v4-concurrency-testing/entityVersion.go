@@ -0,0 +1,100 @@
+package main
+
+import (
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// A single book or author is tagged with its stored Version instead of the
+// version of the whole repository, so a client can send the tag back in
+// If-Match and have the write refused when somebody else wrote in between.
+// A read adds what shaped the body to the tag, see shapeTag, but If-Match
+// only looks at the version: a tag read from /v1 is good for a write to /v2.
+
+var errPreconditionFailed = &APIError{Status: http.StatusPreconditionFailed, Code: "precondition_failed", Message: "If-Match does not name the current version"}
+
+// entityTag is the ETag of an entity at version
+func entityTag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+func setEntityTag(w http.ResponseWriter, version int) {
+	w.Header().Set("ETag", entityTag(version))
+}
+
+// shapeTag is the ETag of a read of an entity at version, shape is what else
+// went into the body: the representation, fields, include and the versions
+// of the entities embedded. They are hashed after the version, so a client
+// holding one shape doesn't get a 304 for another.
+func shapeTag(version int, shape ...string) string {
+	hash := fnv.New64a()
+	for _, part := range shape {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	return `"` + strconv.Itoa(version) + "-" + strconv.FormatUint(hash.Sum64(), 36) + `"`
+}
+
+// entityNotModified sets tag, made by shapeTag, and answers 304 when
+// If-None-Match names it, like validators.notModified for the lists
+func entityNotModified(w http.ResponseWriter, r *http.Request, tag string) bool {
+	w.Header().Set("ETag", tag)
+	match := r.Header.Get("If-None-Match")
+	if match == "" || !etagListContains(match, tag) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// expectedVersion reads the If-Match header of a write. Without it, or with
+// *, the write doesn't depend on the version. Otherwise it returns the
+// version to pass to Update or Delete. Weak tags never match, RFC 7232 asks
+// for the strong comparison. current reads the stored version, it is only
+// needed for a list of several tags.
+func expectedVersion(r *http.Request, current func() (int, error)) (int, error) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return AnyVersion, nil
+	}
+	var versions []int
+	for _, tag := range strings.Split(header, ",") {
+		if version, ok := parseEntityTag(strings.TrimSpace(tag)); ok {
+			versions = append(versions, version)
+		}
+	}
+	switch len(versions) {
+	case 0:
+		return 0, errPreconditionFailed
+	case 1:
+		return versions[0], nil
+	}
+	stored, err := current()
+	if err != nil {
+		return 0, err
+	}
+	for _, version := range versions {
+		if version == stored {
+			return stored, nil
+		}
+	}
+	return 0, errPreconditionFailed
+}
+
+// parseEntityTag is the counterpart of entityTag and shapeTag
+func parseEntityTag(tag string) (int, bool) {
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return 0, false
+	}
+	value := tag[1 : len(tag)-1]
+	if i := strings.IndexByte(value, '-'); i >= 0 {
+		value = value[:i]
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil || version < 0 {
+		return 0, false
+	}
+	return version, true
+}
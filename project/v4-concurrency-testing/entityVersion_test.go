@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEntityVersion(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, books BookRepository, authors AuthorRepository) {
+		author := &Author{Name: "Author 1"}
+		if err := authors.Create(ctx, author); err != nil {
+			t.Fatal(err)
+		}
+		book := &Book{Name: "Book 1", AuthorIDs: []int{author.ID}}
+		if err := books.Create(ctx, book); err != nil {
+			t.Fatal(err)
+		}
+		if book.Version != 1 || author.Version != 1 {
+			t.Fatalf("Incorrect versions - Expected 1 and 1, found %d and %d", book.Version, author.Version)
+		}
+
+		// Two editors read version 1, the second one to write loses
+		first, second := *book, *book
+		first.Name = "Book 1, first edit"
+		if err := books.Update(ctx, &first, 1); err != nil {
+			t.Fatal(err)
+		}
+		if first.Version != 2 {
+			t.Errorf("Incorrect version - Expected %d, found %d", 2, first.Version)
+		}
+		second.Name = "Book 1, second edit"
+		err := books.Update(ctx, &second, 1)
+		var conflict *ConflictError
+		if !errors.Is(err, ErrConflict) || !errors.As(err, &conflict) {
+			t.Fatalf("Expected a ConflictError, found %v", err)
+		}
+		if *conflict != (ConflictError{Entity: "Book", ID: book.ID, Expected: 1, Actual: 2}) {
+			t.Errorf("Incorrect conflict - Expected version 1 against 2, found %+v", *conflict)
+		}
+		if found, _ := books.GetByID(ctx, book.ID); found.Name != first.Name || found.Version != 2 {
+			t.Errorf("Expected the first edit at version 2, found %+v", found)
+		}
+
+		// AnyVersion writes whatever is stored
+		if err := books.Update(ctx, &second, AnyVersion); err != nil || second.Version != 3 {
+			t.Errorf("Expected version 3, found %d and %v", second.Version, err)
+		}
+		if err := books.Delete(ctx, book.ID, 2); !errors.Is(err, ErrConflict) {
+			t.Errorf("Expected ErrConflict, found %v", err)
+		}
+		if _, err := books.GetByID(ctx, book.ID); err != nil {
+			t.Errorf("Expected the book to survive a stale delete, found %v", err)
+		}
+		if err := books.Delete(ctx, book.ID, 3); err != nil {
+			t.Fatal(err)
+		}
+		// A missing entity is not found, whatever the version
+		if err := books.Delete(ctx, book.ID, 3); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, found %v", err)
+		}
+		if err := books.Update(ctx, &Book{ID: book.ID, Name: "Book 1"}, 3); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, found %v", err)
+		}
+
+		author.Name = "Author 1 renamed"
+		if err := authors.Update(ctx, author, 1); err != nil || author.Version != 2 {
+			t.Fatalf("Expected version 2, found %d and %v", author.Version, err)
+		}
+		if err := authors.Update(ctx, &Author{ID: author.ID, Name: "Author 1"}, 1); !errors.Is(err, ErrConflict) {
+			t.Errorf("Expected ErrConflict, found %v", err)
+		}
+		if err := authors.Delete(ctx, author.ID, 1); !errors.Is(err, ErrConflict) {
+			t.Errorf("Expected ErrConflict, found %v", err)
+		}
+		if err := authors.Delete(ctx, author.ID, 2); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// A stale delete of an author leaves the books it would have changed alone
+func TestIntegrityStaleDeleteDoesNotCascade(t *testing.T) {
+	for _, policy := range []DeletePolicy{DeleteCascade, DeleteNullify} {
+		t.Run(string(policy), func(t *testing.T) {
+			books, authors := NewIntegrityRepositories(NewMemoryBackedBookRepository(), NewMemoryBackedAuthorRepository(), policy)
+			author := &Author{Name: "Author 1"}
+			authors.Create(ctx, author)
+			books.Create(ctx, &Book{Name: "Book 1", AuthorIDs: []int{author.ID}})
+			authors.Update(ctx, author, AnyVersion)
+
+			if err := authors.Delete(ctx, author.ID, 1); !errors.Is(err, ErrConflict) {
+				t.Errorf("Expected ErrConflict, found %v", err)
+			}
+			remaining, _ := books.GetAll(ctx)
+			if len(remaining) != 1 || remaining[0].Version != 1 || !sameAuthors(remaining[0].AuthorIDs, []int{author.ID}) {
+				t.Errorf("Expected the book to be unchanged, found %+v", remaining)
+			}
+		})
+	}
+}
+
+func doIfMatch(router http.Handler, method, target, ifMatch string, body io.Reader) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, body)
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestIfMatch(t *testing.T) {
+	router := newRouter(newTestAPI())
+	rr := do(router, http.MethodPost, "/authors", strings.NewReader(`{"name":"Author 1"}`))
+	if etag := rr.Header().Get("ETag"); etag != `"1"` {
+		t.Errorf("Incorrect ETag - Expected %s, found %s", `"1"`, etag)
+	}
+	do(router, http.MethodPost, "/books", strings.NewReader(`{"name":"Book 1","authorId":1}`))
+	// The tag of a read names the shape after the version
+	etag := do(router, http.MethodGet, "/books/1", nil).Header().Get("ETag")
+	if !strings.HasPrefix(etag, `"1-`) {
+		t.Fatalf("Incorrect ETag - Expected %s, found %s", `"1-..."`, etag)
+	}
+
+	cases := []struct {
+		method, ifMatch, body string
+		status                int
+		etag                  string
+	}{
+		{http.MethodPut, etag, `{"name":"Book 1, first edit","authorId":1}`, http.StatusOK, `"2"`},
+		// The second editor still has the first tag
+		{http.MethodPut, etag, `{"name":"Book 1, second edit","authorId":1}`, http.StatusPreconditionFailed, ""},
+		{http.MethodPatch, etag, `{"name":"Book 1, second edit"}`, http.StatusPreconditionFailed, ""},
+		{http.MethodPatch, `W/"2"`, `{"name":"Book 1, second edit"}`, http.StatusPreconditionFailed, ""},
+		{http.MethodPatch, `"not a version"`, `{"name":"Book 1, second edit"}`, http.StatusPreconditionFailed, ""},
+		{http.MethodPatch, `"1", "2"`, `{"name":"Book 1, second edit"}`, http.StatusOK, `"3"`},
+		{http.MethodPatch, "*", `{"year":2015}`, http.StatusOK, `"4"`},
+		{http.MethodPatch, "", `{"year":2016}`, http.StatusOK, `"5"`},
+		{http.MethodDelete, `"4"`, "", http.StatusPreconditionFailed, ""},
+		{http.MethodDelete, `"5"`, "", http.StatusNoContent, ""},
+		{http.MethodDelete, `"5"`, "", http.StatusNotFound, ""},
+	}
+	for _, c := range cases {
+		rr := doIfMatch(router, c.method, "/books/1", c.ifMatch, strings.NewReader(c.body))
+		if rr.Code != c.status {
+			t.Errorf("%s with If-Match %s: Invalid code! I want %d but get %d", c.method, c.ifMatch, c.status, rr.Code)
+		}
+		if rr.Code == http.StatusPreconditionFailed && !strings.Contains(rr.Body.String(), `"precondition_failed"`) {
+			t.Errorf("Incorrect body - Expected a precondition_failed error, found %s", rr.Body)
+		}
+		if c.etag != "" && rr.Header().Get("ETag") != c.etag {
+			t.Errorf("%s with If-Match %s: Incorrect ETag - Expected %s, found %s", c.method, c.ifMatch, c.etag, rr.Header().Get("ETag"))
+		}
+	}
+
+	// A tag is good for every shape of the same author
+	doIfMatch(router, http.MethodPut, "/v2/authors/1", `"1"`, strings.NewReader(`{"name":"Author 2"}`))
+	if rr := doIfMatch(router, http.MethodPut, "/v1/authors/1", `"1"`, strings.NewReader(`{"name":"Author 3"}`)); rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("Invalid code! I want %d but get %d", http.StatusPreconditionFailed, rr.Code)
+	}
+	if rr := doIfMatch(router, http.MethodDelete, "/authors/1", `"2"`, nil); rr.Code != http.StatusNoContent {
+		t.Errorf("Invalid code! I want %d but get %d", http.StatusNoContent, rr.Code)
+	}
+}
+
+func doIfNoneMatch(router http.Handler, target, ifNoneMatch string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("If-None-Match", ifNoneMatch)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestGetBookNotModified(t *testing.T) {
+	router := newRouter(newTestAPI())
+	do(router, http.MethodPost, "/authors", strings.NewReader(`{"name":"Author 1"}`))
+	do(router, http.MethodPost, "/books", strings.NewReader(`{"name":"Book 1","authorId":1}`))
+
+	// Every shape of the same version has its own tag
+	tags := make(map[string]string)
+	for _, target := range []string{"/v1/books/1", "/v2/books/1", "/v2/books/1?fields=id,name", "/v2/books/1?fields=name,id", "/v1/books/1?include=author"} {
+		tags[target] = do(router, http.MethodGet, target, nil).Header().Get("ETag")
+	}
+	if tags["/v1/books/1"] == tags["/v2/books/1"] || tags["/v2/books/1"] == tags["/v2/books/1?fields=id,name"] || tags["/v1/books/1"] == tags["/v1/books/1?include=author"] {
+		t.Errorf("Expected a tag for every shape, found %v", tags)
+	}
+	if tags["/v2/books/1?fields=id,name"] != tags["/v2/books/1?fields=name,id"] {
+		t.Errorf("Expected the order of fields not to matter, found %v", tags)
+	}
+
+	etag := tags["/v2/books/1"]
+	rr := doIfNoneMatch(router, "/v2/books/1", `"0-other", `+etag)
+	if rr.Code != http.StatusNotModified {
+		t.Fatalf("Invalid code! I want %d but get %d", http.StatusNotModified, rr.Code)
+	}
+	if rr.Header().Get("ETag") != etag || rr.Body.Len() != 0 {
+		t.Errorf("Expected the tag %s without body, found %s and %q", etag, rr.Header().Get("ETag"), rr.Body)
+	}
+	if rr := doIfNoneMatch(router, "/v1/books/1", etag); rr.Code != http.StatusOK {
+		t.Errorf("Invalid code! I want %d but get %d", http.StatusOK, rr.Code)
+	}
+
+	// v2 nests the authors, renaming one changes the book it reads
+	do(router, http.MethodPatch, "/authors/1", strings.NewReader(`{"name":"Author 1 renamed"}`))
+	rr = doIfNoneMatch(router, "/v2/books/1", etag)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "Author 1 renamed") {
+		t.Errorf("Expected the renamed author, found %d %s", rr.Code, rr.Body)
+	}
+	if rr.Header().Get("ETag") == etag {
+		t.Errorf("Expected a new tag, found %s", etag)
+	}
+}
+
+func TestIfMatchIsDocumented(t *testing.T) {
+	c := newContract(t, newRouter(newTestAPI()))
+	c.do(http.MethodPost, "/authors", "/authors", `{"name":"Author 1"}`)
+	for _, path := range []string{"/authors/{id}", "/books/{id}"} {
+		operations := lookup(c.doc, "paths", path).(map[string]interface{})
+		for _, method := range []string{"put", "patch", "delete"} {
+			responses := lookup(operations, method, "responses").(map[string]interface{})
+			if _, ok := responses["412"]; !ok {
+				t.Errorf("%s %s: Expected a documented 412", method, path)
+			}
+		}
+		if lookup(operations, "get", "responses", "200", "headers", "ETag") == nil {
+			t.Errorf("get %s: Expected a documented ETag", path)
+		}
+	}
+	if lookup(c.doc, "paths", "/books/{id}", "get", "responses", "304") == nil {
+		t.Error("get /books/{id}: Expected a documented 304")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kinds of failures shared by every repository implementation, callers
+// check them with errors.Is instead of matching on driver messages.
+var (
+	ErrDuplicate  = errors.New("duplicate")
+	ErrNotFound   = errors.New("not found")
+	ErrInvalid    = errors.New("invalid")
+	ErrConstraint = errors.New("constraint violation")
+	ErrConflict   = errors.New("version conflict")
+)
+
+// RepositoryError is a failure reported by a repository. Kind is one of the
+// sentinel errors above, Message and Fields are safe to show to the client.
+type RepositoryError struct {
+	Kind    error
+	Message string
+	Fields  []FieldError
+}
+
+// FieldError tells which field of an entity caused an error
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *RepositoryError) Error() string {
+	return e.Message
+}
+
+func (e *RepositoryError) Unwrap() error {
+	return e.Kind
+}
+
+// AnyVersion given to Update or Delete skips the version check, for writes
+// which don't come from an earlier read, like an import or a cascade.
+const AnyVersion = -1
+
+// ConflictError is returned by Update and Delete when the entity was written
+// since the client read it, Expected is the version it read.
+type ConflictError struct {
+	Entity   string
+	ID       int
+	Expected int
+	Actual   int
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s %d was changed, it is at version %d instead of %d", e.Entity, e.ID, e.Actual, e.Expected)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return ErrConflict
+}
+
+// checkVersion compares the stored version of an entity with the expected one
+func checkVersion(entity string, id, stored, expected int) error {
+	if expected == AnyVersion || expected == stored {
+		return nil
+	}
+	return &ConflictError{Entity: entity, ID: id, Expected: expected, Actual: stored}
+}
+
+var (
+	errDuplicateBook   = &RepositoryError{Kind: ErrDuplicate, Message: "Duplicate book Found", Fields: []FieldError{{"name", "is already taken"}}}
+	errDuplicateAuthor = &RepositoryError{Kind: ErrDuplicate, Message: "Duplicate Author Found", Fields: []FieldError{{"name", "is already taken"}}}
+	errBookNotFound    = &RepositoryError{Kind: ErrNotFound, Message: "Book not found"}
+	errAuthorNotFound  = &RepositoryError{Kind: ErrNotFound, Message: "Author not found"}
+
+	errDeletedBookNotFound   = &RepositoryError{Kind: ErrNotFound, Message: "No deleted book with this ID"}
+	errDeletedAuthorNotFound = &RepositoryError{Kind: ErrNotFound, Message: "No deleted author with this ID"}
+
+	errWebhookNotFound = &RepositoryError{Kind: ErrNotFound, Message: "Webhook not found"}
+)
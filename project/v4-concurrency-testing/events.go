@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Event is a write of a book or an author in the shape of the notifications
+// built by docker/postgresql/init.sql: the table, INSERT, UPDATE or DELETE
+// and the row, as it was before a DELETE.
+type Event struct {
+	ID     int64           `json:"-"` // sent as the id of the SSE event, see Last-Event-ID
+	Table  string          `json:"table"`
+	Action string          `json:"action"`
+	Data   json.RawMessage `json:"data"`
+}
+
+const (
+	eventBacklog   = 1000             // events kept for the subscribers resuming with Last-Event-ID
+	eventBuffer    = 64               // events a subscriber may fall behind before it is cut off
+	eventHeartbeat = 15 * time.Second // between comments keeping an idle stream open through proxies
+)
+
+// EventBroker fans the events out to the subscribers of /events. Publish
+// never waits for a subscriber: one whose buffer is full is cut off, and
+// when it reconnects with Last-Event-ID it gets what it missed from the
+// backlog.
+type EventBroker struct {
+	mu          sync.Mutex
+	backlog     []Event // oldest first, at most size
+	size        int
+	lastID      int64
+	subscribers map[*eventSubscription]bool
+	listeners   []func(Event)
+	closed      bool
+}
+
+// eventSubscription receives the events published after Subscribe, its
+// channel is closed when it is cut off or the broker is closed.
+type eventSubscription struct {
+	events chan Event
+}
+
+// Constructor Function, backlog is the number of events kept for resuming.
+// IDs start at the current time so the IDs of an earlier process are older
+// than the backlog and get a reset.
+func NewEventBroker(backlog int) *EventBroker {
+	return &EventBroker{
+		size:        backlog,
+		lastID:      time.Now().UnixNano(),
+		subscribers: make(map[*eventSubscription]bool),
+	}
+}
+
+func (b *EventBroker) Publish(table, action string, data json.RawMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastID++
+	event := Event{ID: b.lastID, Table: table, Action: action, Data: data}
+	b.backlog = append(b.backlog, event)
+	if len(b.backlog) > b.size {
+		b.backlog = b.backlog[len(b.backlog)-b.size:]
+	}
+	for _, listener := range b.listeners {
+		listener(event)
+	}
+	for sub := range b.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			b.drop(sub)
+		}
+	}
+}
+
+// Notify calls listener with every event, in the order they are published.
+// Unlike a subscriber it gets all of them, so it must not block.
+func (b *EventBroker) Notify(listener func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.listeners = append(b.listeners, listener)
+}
+
+// Subscribe returns the events after lastID and the subscription to the
+// ones to come, lastID 0 only wants the latter. When the backlog doesn't
+// reach back to lastID anymore, missed is empty and reset is the ID the
+// subscriber has to continue from after reloading. It is 0 otherwise.
+func (b *EventBroker) Subscribe(lastID int64) (missed []Event, sub *eventSubscription, reset int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sub = &eventSubscription{make(chan Event, eventBuffer)}
+	if b.closed {
+		close(sub.events)
+	} else {
+		b.subscribers[sub] = true
+	}
+	if lastID == 0 || lastID == b.lastID {
+		return nil, sub, 0
+	}
+	oldest := b.lastID + 1
+	if len(b.backlog) > 0 {
+		oldest = b.backlog[0].ID
+	}
+	if lastID < oldest-1 || lastID > b.lastID {
+		return nil, sub, b.lastID
+	}
+	for _, event := range b.backlog {
+		if event.ID > lastID {
+			missed = append(missed, event)
+		}
+	}
+	return missed, sub, 0
+}
+
+func (b *EventBroker) Unsubscribe(sub *eventSubscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscribers[sub] {
+		b.drop(sub)
+	}
+}
+
+// Close ends every subscription, the streams of /events would keep the
+// server from shutting down otherwise.
+func (b *EventBroker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for sub := range b.subscribers {
+		b.drop(sub)
+	}
+}
+
+func (b *EventBroker) drop(sub *eventSubscription) {
+	delete(b.subscribers, sub)
+	close(sub.events)
+}
+
+// eventActions maps the actions of the history to those of the events, an
+// undeleted row appears again like an inserted one.
+var eventActions = map[string]string{
+	HistoryCreate:   "INSERT",
+	HistoryUpdate:   "UPDATE",
+	HistoryDelete:   "DELETE",
+	HistoryUndelete: "INSERT",
+}
+
+// NewPublishingHistoryRepository publishes every entry appended to history
+// to events. The history already has the state written, or deleted, by each
+// write, cascades included, so the events don't have to read it again.
+func NewPublishingHistoryRepository(history HistoryRepository, events *EventBroker) HistoryRepository {
+	return &publishingHistoryRepository{history, events}
+}
+
+type publishingHistoryRepository struct {
+	HistoryRepository
+	events *EventBroker
+}
+
+func (repo *publishingHistoryRepository) Append(ctx context.Context, entry *HistoryEntry) error {
+	if err := repo.HistoryRepository.Append(ctx, entry); err != nil {
+		return err
+	}
+	data := entry.After
+	if entry.Action == HistoryDelete {
+		data = entry.Before
+	}
+	repo.events.Publish(entry.Entity, eventActions[entry.Action], data)
+	return nil
+}
+
+// Events streams the writes of books and authors as Server-Sent Events with
+// an Event as data. A client reconnecting with Last-Event-ID gets the events
+// it missed first, or a reset event when they are no longer kept and it has
+// to reload what it shows. A client too slow to keep up is disconnected.
+func (h *Handler) Events(w http.ResponseWriter, r *http.Request) {
+	var lastID int64
+	if header := r.Header.Get("Last-Event-ID"); header != "" {
+		id, err := strconv.ParseInt(header, 10, 64)
+		if err != nil || id <= 0 {
+			writeError(w, badRequest("Last-Event-ID", "must be the id of an event"))
+			return
+		}
+		lastID = id
+	}
+	missed, sub, reset := h.events.Subscribe(lastID)
+	defer h.events.Unsubscribe(sub)
+
+	// The stream outlives the write timeout of the server
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if reset != 0 {
+		fmt.Fprintf(w, "id: %d\nevent: reset\ndata: {}\n\n", reset)
+	}
+	for _, event := range missed {
+		writeEvent(w, event)
+	}
+	rc.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case event, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			writeEvent(w, event)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event Event) {
+	// Compact JSON has no newlines, it fits on one data line
+	data, _ := json.Marshal(event)
+	fmt.Fprintf(w, "id: %d\ndata: %s\n\n", event.ID, data)
+}
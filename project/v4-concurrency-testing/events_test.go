@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func publishSome(b *EventBroker, n int) []int64 {
+	var ids []int64
+	for i := 1; i <= n; i++ {
+		b.Publish("books", "INSERT", json.RawMessage(fmt.Sprintf(`{"id":%d}`, i)))
+		ids = append(ids, b.lastID)
+	}
+	return ids
+}
+
+func TestEventBrokerResume(t *testing.T) {
+	b := NewEventBroker(3)
+	ids := publishSome(b, 5)
+	cases := []struct {
+		name    string
+		lastID  int64
+		missed  []int64
+		resetTo int64
+	}{
+		{"new subscriber", 0, nil, 0},
+		{"up to date", ids[4], nil, 0},
+		{"missed two", ids[2], ids[3:], 0},
+		{"missed all kept", ids[1], ids[2:], 0},
+		{"older than the backlog", ids[0], nil, ids[4]},
+		{"from another process", ids[4] + 10, nil, ids[4]},
+	}
+	for _, c := range cases {
+		missed, sub, reset := b.Subscribe(c.lastID)
+		b.Unsubscribe(sub)
+		var found []int64
+		for _, event := range missed {
+			found = append(found, event.ID)
+		}
+		if fmt.Sprint(found) != fmt.Sprint(c.missed) || reset != c.resetTo {
+			t.Errorf("%s: Incorrect resume - Expected %v and reset %d, found %v and %d", c.name, c.missed, c.resetTo, found, reset)
+		}
+	}
+}
+
+func TestEventBrokerCutsOffSlowSubscriber(t *testing.T) {
+	b := NewEventBroker(eventBacklog)
+	_, slow, _ := b.Subscribe(0)
+	_, fast, _ := b.Subscribe(0)
+
+	// Nobody reads the slow one, the writer goes on regardless
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < eventBuffer+10; i++ {
+			publishSome(b, 1)
+			if _, ok := <-fast.events; !ok {
+				t.Error("Expected the subscriber keeping up to stay")
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Publish not to wait for a slow subscriber")
+	}
+	n := 0
+	for range slow.events {
+		n++
+	}
+	if n != eventBuffer {
+		t.Errorf("Incorrect events before the cut off - Expected %d, found %d", eventBuffer, n)
+	}
+	b.Close()
+	if !isClosed(fast) {
+		t.Error("Expected Close to end the subscription")
+	}
+	if _, sub, _ := b.Subscribe(0); !isClosed(sub) {
+		t.Error("Expected a closed subscription once the broker is closed")
+	}
+}
+
+func isClosed(sub *eventSubscription) bool {
+	_, ok := <-sub.events
+	return !ok
+}
+
+// sseEvent is one event read from a stream
+type sseEvent struct {
+	id, name string
+	data     Event
+}
+
+// readEvents reads a stream until n events came, comments are skipped
+func readEvents(t *testing.T, reader *bufio.Reader, n int) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	var current sseEvent
+	for len(events) < n {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Stream ended after %d events: %v", len(events), err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			events = append(events, current)
+			current = sseEvent{}
+		case strings.HasPrefix(line, "id: "):
+			current.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			current.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &current.data); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return events
+}
+
+func subscribeEvents(t *testing.T, url, lastEventID string) (*http.Response, *bufio.Reader) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url+"/events", nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected a stream, found %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	return resp, bufio.NewReader(resp.Body)
+}
+
+func TestEventsEndpoint(t *testing.T) {
+	api := newTestAPI()
+	router := newRouter(api)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	defer api.events.Close()
+
+	resp, reader := subscribeEvents(t, server.URL, "")
+	do(router, http.MethodPost, "/authors", strings.NewReader(`{"name":"Author 1"}`))
+	do(router, http.MethodPost, "/books", strings.NewReader(`{"name":"Book 1","authorId":1}`))
+	do(router, http.MethodPatch, "/books/1", strings.NewReader(`{"year":2015}`))
+	do(router, http.MethodDelete, "/books/1", nil)
+	events := readEvents(t, reader, 4)
+	resp.Body.Close()
+
+	expected := []struct{ table, action, name string }{
+		{"authors", "INSERT", "Author 1"},
+		{"books", "INSERT", "Book 1"},
+		{"books", "UPDATE", "Book 1"},
+		{"books", "DELETE", "Book 1"},
+	}
+	for i, e := range expected {
+		var row struct {
+			Name string `json:"name"`
+			Year int    `json:"year"`
+		}
+		json.Unmarshal(events[i].data.Data, &row)
+		if events[i].data.Table != e.table || events[i].data.Action != e.action || row.Name != e.name {
+			t.Errorf("Incorrect event %d - Expected %+v, found %+v", i, e, events[i].data)
+		}
+		// The deleted row is the one the update left
+		if i >= 2 && row.Year != 2015 {
+			t.Errorf("Incorrect event %d - Expected the year 2015, found %s", i, events[i].data.Data)
+		}
+	}
+
+	// Resuming after the second event replays the two that followed
+	resp, reader = subscribeEvents(t, server.URL, events[1].id)
+	resumed := readEvents(t, reader, 2)
+	resp.Body.Close()
+	if resumed[0].id != events[2].id || resumed[1].id != events[3].id {
+		t.Errorf("Incorrect resume - Expected %s and %s, found %s and %s", events[2].id, events[3].id, resumed[0].id, resumed[1].id)
+	}
+
+	resp, reader = subscribeEvents(t, server.URL, "1")
+	reset := readEvents(t, reader, 1)
+	resp.Body.Close()
+	if reset[0].name != "reset" || reset[0].id != events[3].id {
+		t.Errorf("Expected a reset to %s, found %+v", events[3].id, reset[0])
+	}
+
+	if rr := doLastEventID(router, "not an id"); rr.Code != http.StatusBadRequest {
+		t.Errorf("Invalid code! I want %d but get %d", http.StatusBadRequest, rr.Code)
+	}
+}
+
+func doLastEventID(router http.Handler, lastEventID string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/events", nil)
+	req.Header.Set("Last-Event-ID", lastEventID)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+// The streams of /events end with the shutdown instead of holding it up
+func TestServeEndsEventStreams(t *testing.T) {
+	api := newTestAPI()
+	server := &http.Server{Handler: newRouter(api)}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveCtx, shutdown := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(serveCtx, server, listener, &closeRecorder{}, 5*time.Second, shutdownHooks{stop: api.events.Close})
+	}()
+
+	resp, _ := subscribeEvents(t, "http://"+listener.Addr().String(), "")
+	defer resp.Body.Close()
+	start := time.Now()
+	shutdown()
+	if err := <-done; err != nil {
+		t.Errorf("Expected a clean shutdown, found %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the stream to end right away, the shutdown took %s", elapsed)
+	}
+}
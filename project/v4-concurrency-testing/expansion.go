@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// relation is an entity another one can embed with include
+type relation struct {
+	name  string // the value of include
+	field string // the field it is embedded as
+}
+
+var (
+	bookAuthors = relation{"author", "authors"}
+	authorBooks = relation{"books", "books"}
+)
+
+// expansion is what the fields and include parameters ask of a read endpoint.
+// Both work on the shapes of the representation, so they don't depend on the
+// repository backend: the related entities are read through the repositories
+// and joined by the CombinationService, like /books-authors does, and the
+// fields left out are dropped from the encoded shape.
+type expansion struct {
+	fields  map[string]bool // nil sends every field
+	include bool
+}
+
+// parseExpansion reads fields=id,name and include=rel.name, a zero rel
+// ignores include. shape and included are samples of what the endpoint
+// sends without and with include, the fields must be fields of it.
+func parseExpansion(query url.Values, rel relation, shape, included interface{}) (expansion, error) {
+	var e expansion
+	if include := query.Get("include"); include != "" && rel.name != "" {
+		if include != rel.name {
+			return e, badRequest("include", "must be "+rel.name)
+		}
+		e.include, shape = true, included
+	}
+	if _, ok := query["fields"]; !ok {
+		return e, nil
+	}
+	known := jsonFields(reflect.TypeOf(shape))
+	e.fields = make(map[string]bool)
+	for _, field := range strings.Split(query.Get("fields"), ",") {
+		field = strings.TrimSpace(field)
+		if !known[field] {
+			return e, badRequest("fields", fmt.Sprintf("unknown field %q", field))
+		}
+		e.fields[field] = true
+	}
+	// What include asks for is sent even when fields doesn't name it
+	if e.include {
+		e.fields[rel.field] = true
+	}
+	return e, nil
+}
+
+// jsonFields are the names encoding/json gives to the fields of the struct
+// behind t, or of its elements. Embedded structs are flattened.
+func jsonFields(t reflect.Type) map[string]bool {
+	for t.Kind() == reflect.Slice || t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	names := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		switch {
+		case name == "-" || (field.PkgPath != "" && !field.Anonymous):
+		case field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct:
+			for embedded := range jsonFields(field.Type) {
+				names[embedded] = true
+			}
+		case name == "":
+			names[field.Name] = true
+		default:
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// key names what e asks for, it goes into the ETag of a single entity
+func (e expansion) key() string {
+	fields := make([]string, 0, len(e.fields))
+	for field := range e.fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return "fields=" + strings.Join(fields, ",") + "&include=" + strconv.FormatBool(e.include)
+}
+
+// write sends value, one of the shapes of rep, with only the fields asked for
+func (e expansion) write(w http.ResponseWriter, rep representation, value interface{}) {
+	if e.fields == nil {
+		writeRepresentation(w, rep, value)
+		return
+	}
+	data, _ := json.Marshal(value)
+	// Numbers stay as they were written, float64 would round large IDs
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var decoded interface{}
+	decoder.Decode(&decoded)
+	writeRepresentation(w, rep, e.trim(decoded))
+}
+
+// trim drops the fields not asked for from an entity or a list of them
+func (e expansion) trim(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		for i := range v {
+			v[i] = e.trim(v[i])
+		}
+	case map[string]interface{}:
+		for field := range v {
+			if !e.fields[field] {
+				delete(v, field)
+			}
+		}
+	}
+	return value
+}
+
+// withAuthors embeds the authors of books found in authors, books without
+// any keep an empty list as with /books-authors?join=left.
+func (h *Handler) withAuthors(books []Book, authors map[int]*Author) []BookWithAuthors {
+	found := make([]Author, 0, len(authors))
+	for _, author := range authors {
+		if author != nil {
+			found = append(found, *author)
+		}
+	}
+	return h.combinationService.GenerateLeftJoin(books, found)
+}
+
+// withBooks embeds the books of authors as with /books-authors?group=author.
+// Only the books of these authors are read, with one query for all of them.
+func (h *Handler) withBooks(ctx context.Context, authors []Author) ([]AuthorWithBooks, error) {
+	if len(authors) == 0 {
+		return h.combinationService.GroupByAuthor(nil, authors), nil
+	}
+	ids := make(map[int]bool, len(authors))
+	for _, author := range authors {
+		ids[author.ID] = true
+	}
+	books, _, err := h.bookRepository.Find(ctx, QueryOptions{AuthorIDs: ids})
+	if err != nil {
+		return nil, err
+	}
+	return h.combinationService.GroupByAuthor(books, authors), nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// seedCatalog stores two authors and three books, Book 2 by both of them
+func seedCatalog(router http.Handler) {
+	do(router, http.MethodPost, "/authors", strings.NewReader(`{"name":"Author 1"}`))
+	do(router, http.MethodPost, "/authors", strings.NewReader(`{"name":"Author 2"}`))
+	do(router, http.MethodPost, "/books", strings.NewReader(`{"name":"Book 1","authorIds":[1]}`))
+	do(router, http.MethodPost, "/books", strings.NewReader(`{"name":"Book 2","authorIds":[2,1]}`))
+	do(router, http.MethodPost, "/books", strings.NewReader(`{"name":"Book 3","authorIds":[2]}`))
+}
+
+// keysOf lists the fields of every object of a JSON list, or of one object
+func keysOf(t *testing.T, body []byte) [][]string {
+	t.Helper()
+	var list []map[string]interface{}
+	if err := json.Unmarshal(body, &list); err != nil {
+		var object map[string]interface{}
+		if err := json.Unmarshal(body, &object); err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, object)
+	}
+	keys := make([][]string, len(list))
+	for i, object := range list {
+		for key := range object {
+			keys[i] = append(keys[i], key)
+		}
+		sort.Strings(keys[i])
+	}
+	return keys
+}
+
+func TestSparseFieldsets(t *testing.T) {
+	router := newRouter(newTestAPI())
+	seedCatalog(router)
+	cases := []struct {
+		target string
+		fields []string
+	}{
+		{"/books?fields=id,name", []string{"id", "name"}},
+		{"/v2/books?fields=name,links&limit=1", []string{"links", "name"}},
+		{"/books/2?fields=authorIds", []string{"authorIds"}},
+		{"/authors/1?fields=name", []string{"name"}},
+		{"/v2/authors?fields=id", []string{"id"}},
+		{"/books?fields=id&include=author", []string{"authors", "id"}},
+		{"/v2/books?fields=id&include=author", []string{"authors", "id"}},
+		{"/authors?fields=name&include=books", []string{"books", "name"}},
+		{"/books-authors?fields=name,author", []string{"author", "name"}},
+		{"/v2/books-authors?group=author&fields=books", []string{"books"}},
+	}
+	for _, c := range cases {
+		rr := do(router, http.MethodGet, c.target, nil)
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: Invalid code! I want %d but get %d", c.target, http.StatusOK, rr.Code)
+			continue
+		}
+		for _, keys := range keysOf(t, rr.Body.Bytes()) {
+			if !reflect.DeepEqual(keys, c.fields) {
+				t.Errorf("%s: Incorrect fields - Expected %v, found %v", c.target, c.fields, keys)
+			}
+		}
+	}
+	// The numbers are sent as they are
+	if body := do(router, http.MethodGet, "/books/2?fields=id,authorIds", nil).Body.String(); body != `{"authorIds":[2,1],"id":2}`+"\n" {
+		t.Errorf("Incorrect body, found %s", body)
+	}
+
+	for _, target := range []string{"/books?fields=age", "/books?fields=", "/v2/books/1?fields=authorId", "/authors?fields=books", "/books?include=publisher", "/authors/1?include=author", "/books-authors?fields=isbn"} {
+		rr := do(router, http.MethodGet, target, nil)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: Invalid code! I want %d but get %d", target, http.StatusBadRequest, rr.Code)
+		}
+	}
+}
+
+func TestIncludeEmbedsRelatedResources(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, books BookRepository, authors AuthorRepository) {
+		api, err := newAPI(ctx, books, authors, NewMemoryBackedHistoryRepository(), DeleteRestrict, WebhookOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer api.webhooks.Close()
+		router := newRouter(api)
+		seedCatalog(router)
+
+		var withAuthors []BookWithAuthorsV1
+		json.Unmarshal(do(router, http.MethodGet, "/books?include=author&sort=-id", nil).Body.Bytes(), &withAuthors)
+		if len(withAuthors) != 3 || withAuthors[1].Name != "Book 2" || withAuthors[1].ISBN != "" ||
+			!reflect.DeepEqual(withAuthors[1].Authors, []AuthorV1{{"Author 2", 2}, {"Author 1", 1}}) {
+			t.Errorf("Expected the books with every author in credit order, found %+v", withAuthors)
+		}
+		var one BookWithAuthorsV1
+		json.Unmarshal(do(router, http.MethodGet, "/books/3?include=author", nil).Body.Bytes(), &one)
+		if one.Name != "Book 3" || !reflect.DeepEqual(one.Authors, []AuthorV1{{"Author 2", 2}}) {
+			t.Errorf("Expected Book 3 by Author 2, found %+v", one)
+		}
+
+		rr := do(router, http.MethodGet, "/authors?include=books&limit=1", nil)
+		var withBooks []AuthorWithBooksV1
+		json.Unmarshal(rr.Body.Bytes(), &withBooks)
+		if len(withBooks) != 1 || !reflect.DeepEqual(withBooks[0].Books, []BookSummaryV1{{1, "Book 1"}, {2, "Book 2"}}) {
+			t.Errorf("Expected Author 1 with Book 1 and Book 2, found %+v", withBooks)
+		}
+		if total := rr.Header().Get("X-Total-Count"); total != "2" {
+			t.Errorf("Incorrect total - Expected %s, found %s", "2", total)
+		}
+		var author AuthorWithBooksV2
+		json.Unmarshal(do(router, http.MethodGet, "/v2/authors/2?include=books", nil).Body.Bytes(), &author)
+		if author.Name != "Author 2" || len(author.Books) != 2 || author.Books[0].Name != "Book 2" || author.Books[1].Name != "Book 3" ||
+			author.Books[0].Authors[0].Name != "Author 2" {
+			t.Errorf("Expected Author 2 with Book 2 and Book 3, found %+v", author)
+		}
+
+		// /books-authors is the whole catalog of include=author
+		joined := do(router, http.MethodGet, "/v2/books-authors?join=left&fields=id,name,authors", nil).Body.String()
+		included := do(router, http.MethodGet, "/v2/books?include=author&fields=id,name", nil).Body.String()
+		if joined != included {
+			t.Errorf("Expected the same books, found %s and %s", joined, included)
+		}
+		included = do(router, http.MethodGet, "/books?include=author&fields=id,name", nil).Body.String()
+		if !strings.Contains(included, `{"authors":[{"id":2,"name":"Author 2"},{"id":1,"name":"Author 1"}],"id":2,"name":"Book 2"}`) {
+			t.Errorf("Incorrect books, found %s", included)
+		}
+	})
+}
+
+// countingBookRepository counts the calls to Find
+type countingBookRepository struct {
+	BookRepository
+	finds int
+}
+
+func (repo *countingBookRepository) Find(ctx context.Context, opts QueryOptions) ([]Book, int, error) {
+	repo.finds++
+	return repo.BookRepository.Find(ctx, opts)
+}
+
+func TestIncludeBooksReadsThemOnce(t *testing.T) {
+	api := newTestAPI()
+	router := newRouter(api)
+	seedCatalog(router)
+	books := &countingBookRepository{BookRepository: api.bookRepository}
+	api.bookRepository = books
+
+	var withBooks []AuthorWithBooksV1
+	json.Unmarshal(do(router, http.MethodGet, "/authors?include=books", nil).Body.Bytes(), &withBooks)
+	if books.finds != 1 {
+		t.Errorf("Incorrect number of queries - Expected %d, found %d", 1, books.finds)
+	}
+	if len(withBooks) != 2 || len(withBooks[0].Books) != 2 || len(withBooks[1].Books) != 2 {
+		t.Errorf("Expected two authors with two books each, found %+v", withBooks)
+	}
+
+	books.finds = 0
+	rr := do(router, http.MethodGet, "/authors?include=books&offset=5", nil)
+	if rr.Code != http.StatusOK || rr.Body.String() != "[]\n" || books.finds != 0 {
+		t.Errorf("Expected no authors and no query, found %s after %d", rr.Body, books.finds)
+	}
+}
+
+// countingAuthorRepository counts the calls reading authors
+type countingAuthorRepository struct {
+	AuthorRepository
+	reads int
+}
+
+func (repo *countingAuthorRepository) Find(ctx context.Context, opts QueryOptions) ([]Author, int, error) {
+	repo.reads++
+	return repo.AuthorRepository.Find(ctx, opts)
+}
+
+func (repo *countingAuthorRepository) GetByID(ctx context.Context, id int) (*Author, error) {
+	repo.reads++
+	return repo.AuthorRepository.GetByID(ctx, id)
+}
+
+func TestIncludeAuthorReadsThemOnce(t *testing.T) {
+	api := newTestAPI()
+	router := newRouter(api)
+	seedCatalog(router)
+	authors := &countingAuthorRepository{AuthorRepository: api.authorRepository}
+	api.authorRepository = authors
+
+	for _, target := range []string{"/books?include=author", "/v2/books", "/v2/books/2"} {
+		authors.reads = 0
+		if rr := do(router, http.MethodGet, target, nil); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "Author 2") {
+			t.Errorf("%s: Expected the books with their authors, found %d %s", target, rr.Code, rr.Body)
+		}
+		if authors.reads != 1 {
+			t.Errorf("%s: Incorrect number of queries - Expected %d, found %d", target, 1, authors.reads)
+		}
+	}
+}
+
+func TestIncludeChangesTheValidators(t *testing.T) {
+	router := newRouter(newTestAPI())
+	seedCatalog(router)
+	authors := do(router, http.MethodGet, "/authors", nil).Header().Get("ETag")
+	withBooks := do(router, http.MethodGet, "/authors?include=books", nil).Header().Get("ETag")
+
+	do(router, http.MethodPost, "/books", strings.NewReader(`{"name":"Book 4","authorIds":[1]}`))
+	if etag := do(router, http.MethodGet, "/authors", nil).Header().Get("ETag"); etag != authors {
+		t.Errorf("Expected the authors to keep their tag %s, found %s", authors, etag)
+	}
+	if etag := do(router, http.MethodGet, "/authors?include=books", nil).Header().Get("ETag"); etag == withBooks {
+		t.Errorf("Expected a new book to change the tag of the authors with their books, found %s", etag)
+	}
+
+	books := do(router, http.MethodGet, "/books", nil).Header().Get("ETag")
+	withAuthors := do(router, http.MethodGet, "/books?include=author", nil).Header().Get("ETag")
+	do(router, http.MethodPatch, "/authors/1", strings.NewReader(`{"name":"Author One"}`))
+	if etag := do(router, http.MethodGet, "/books", nil).Header().Get("ETag"); etag != books {
+		t.Errorf("Expected the books to keep their tag %s, found %s", books, etag)
+	}
+	if etag := do(router, http.MethodGet, "/books?include=author", nil).Header().Get("ETag"); etag == withAuthors {
+		t.Errorf("Expected a renamed author to change the tag of the books with their authors, found %s", etag)
+	}
+}
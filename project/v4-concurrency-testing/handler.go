@@ -0,0 +1,586 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Handler serves every API version with the same methods, they read and
+// write the shapes of the representation versionMiddleware picked.
+type Handler struct {
+	bookRepository     BookRepository
+	authorRepository   AuthorRepository
+	historyRepository  HistoryRepository
+	events             *EventBroker
+	webhooks           *Webhooks
+	combinationService CombinationService
+	searchIndex        *SearchIndex
+	authenticator      *Authenticator // nil leaves the write endpoints open
+	rateLimits         *RateLimits    // nil doesn't limit anything
+	metrics            *Metrics       // nil serves no /metrics
+}
+
+func (h *Handler) SaveBook(w http.ResponseWriter, r *http.Request) {
+	rep := representationOf(r)
+	reqBody, _ := ioutil.ReadAll(r.Body)
+	var book Book
+	err := rep.decodeBook(reqBody, &book)
+	// Error handling Read 10-errors-panics.md
+	if err != nil {
+		writeError(w, errUnreadableBody)
+		return
+	}
+	if len(book.Name) == 0 {
+		writeError(w, invalidEntity("Book name cannot be empty", FieldError{"name", "cannot be empty"}))
+		return
+	}
+	if err := validateBook(&book); err != nil {
+		writeError(w, err)
+		return
+	}
+	// Save
+	err = h.bookRepository.Create(r.Context(), &book)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	h.writeBook(w, r, rep, book)
+}
+
+// GetAllBooks lists books, see parseQueryOptions for paging, sorting and
+// filtering and parseExpansion for fields and include=author.
+func (h *Handler) GetAllBooks(w http.ResponseWriter, r *http.Request) {
+	rep := representationOf(r)
+	opts, err := parseQueryOptions(r.URL.Query(), bookSortFields)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	shapes := rep.samples()
+	expand, err := parseExpansion(r.URL.Query(), bookAuthors, shapes.books, shapes.booksWithAuthors)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	nest := rep.nestsAuthors() || expand.include
+	repositories := []versioned{h.bookRepository}
+	if nest {
+		repositories = append(repositories, h.authorRepository)
+	}
+	cache, err := readValidators(r.Context(), rep.name(), repositories...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if cache.notModified(w, r) {
+		return
+	}
+	response, total, err := h.bookRepository.Find(r.Context(), opts)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	authors, err := h.authorsOf(r.Context(), nest, response)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	cache.set(w.Header())
+	w.Header().Add("X-Total-Count", strconv.Itoa(total))
+	value := rep.books(response, authors)
+	if expand.include {
+		value = rep.booksWithAuthors(h.withAuthors(response, authors))
+	}
+	// Responding with JSON Array
+	expand.write(w, rep, value)
+}
+
+func (h *Handler) GetBook(w http.ResponseWriter, r *http.Request) {
+	id, ok := idFromPath(w, r, "/books/")
+	if !ok {
+		return
+	}
+	rep := representationOf(r)
+	shapes := rep.samples()
+	expand, err := parseExpansion(r.URL.Query(), bookAuthors, shapes.book, shapes.bookWithAuthors)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	book, err := h.bookRepository.GetByID(r.Context(), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	authors, err := h.authorsOf(r.Context(), rep.nestsAuthors() || expand.include, []Book{*book})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	shape := []string{rep.name(), expand.key()}
+	for _, id := range book.AuthorIDs {
+		if author := authors[id]; author != nil {
+			shape = append(shape, strconv.Itoa(id)+"."+strconv.Itoa(author.Version))
+		}
+	}
+	if entityNotModified(w, r, shapeTag(book.Version, shape...)) {
+		return
+	}
+	value := rep.book(*book, authors)
+	if expand.include {
+		value = rep.bookWithAuthors(h.withAuthors([]Book{*book}, authors)[0])
+	}
+	expand.write(w, rep, value)
+}
+
+// UpdateBook replaces the whole book, fields missing from the body are reset
+func (h *Handler) UpdateBook(w http.ResponseWriter, r *http.Request) {
+	id, ok := idFromPath(w, r, "/books/")
+	if !ok {
+		return
+	}
+	version, err := expectedVersion(r, h.bookVersion(r, id))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	h.updateBook(w, r, &Book{ID: id}, version)
+}
+
+// PatchBook only changes the fields present in the body
+func (h *Handler) PatchBook(w http.ResponseWriter, r *http.Request) {
+	id, ok := idFromPath(w, r, "/books/")
+	if !ok {
+		return
+	}
+	book, err := h.bookRepository.GetByID(r.Context(), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	version, err := expectedVersion(r, func() (int, error) { return book.Version, nil })
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	h.updateBook(w, r, book, version)
+}
+
+// updateBook decodes the body on top of book, the fields which are not in
+// the JSON are kept so the same code serves PUT and PATCH. The book is only
+// stored while it is at version, see expectedVersion.
+func (h *Handler) updateBook(w http.ResponseWriter, r *http.Request, book *Book, version int) {
+	rep := representationOf(r)
+	id := book.ID
+	reqBody, _ := ioutil.ReadAll(r.Body)
+	if err := rep.decodeBook(reqBody, book); err != nil {
+		writeError(w, errUnreadableBody)
+		return
+	}
+	// The ID always comes from the URL
+	book.ID = id
+	if len(book.Name) == 0 {
+		writeError(w, invalidEntity("Book name cannot be empty", FieldError{"name", "cannot be empty"}))
+		return
+	}
+	if err := validateBook(book); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := h.bookRepository.Update(r.Context(), book, version); err != nil {
+		writeError(w, err)
+		return
+	}
+	h.writeBook(w, r, rep, *book)
+}
+
+// writeBook sends book along with its authors when rep nests them
+func (h *Handler) writeBook(w http.ResponseWriter, r *http.Request, rep representation, book Book) {
+	authors, err := h.authorsOf(r.Context(), rep.nestsAuthors(), []Book{book})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	setEntityTag(w, book.Version)
+	writeRepresentation(w, rep, rep.book(book, authors))
+}
+
+// bookVersion reads the stored version of a book for expectedVersion
+func (h *Handler) bookVersion(r *http.Request, id int) func() (int, error) {
+	return func() (int, error) {
+		book, err := h.bookRepository.GetByID(r.Context(), id)
+		if err != nil {
+			return 0, err
+		}
+		return book.Version, nil
+	}
+}
+
+// authorsOf fetches the authors of books with one query, only when they are
+// nested into the books. An author which doesn't exist is left out.
+func (h *Handler) authorsOf(ctx context.Context, nest bool, books []Book) (map[int]*Author, error) {
+	ids := make(map[int]bool)
+	if nest {
+		for _, book := range books {
+			for _, id := range book.AuthorIDs {
+				ids[id] = true
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return make(map[int]*Author), nil
+	}
+	authors, _, err := h.authorRepository.Find(ctx, QueryOptions{IDs: ids})
+	if err != nil {
+		return nil, err
+	}
+	return indexAuthors(authors), nil
+}
+
+func (h *Handler) DeleteBook(w http.ResponseWriter, r *http.Request) {
+	id, ok := idFromPath(w, r, "/books/")
+	if !ok {
+		return
+	}
+	version, err := expectedVersion(r, h.bookVersion(r, id))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := h.bookRepository.Delete(r.Context(), id, version); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) SaveAuthor(w http.ResponseWriter, r *http.Request) {
+	rep := representationOf(r)
+	reqBody, _ := ioutil.ReadAll(r.Body)
+	var author Author
+	err := rep.decodeAuthor(reqBody, &author)
+	// Error handling Read 10-errors-panics.md
+	if err != nil {
+		writeError(w, errUnreadableBody)
+		return
+	}
+	if len(author.Name) == 0 {
+		writeError(w, invalidEntity("Author name cannot be empty", FieldError{"name", "cannot be empty"}))
+		return
+	}
+	err = h.authorRepository.Create(r.Context(), &author)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeAuthor(w, rep, author)
+}
+
+// GetAllAuthors lists authors, see parseQueryOptions for paging, sorting and
+// filtering and parseExpansion for fields and include=books.
+func (h *Handler) GetAllAuthors(w http.ResponseWriter, r *http.Request) {
+	rep := representationOf(r)
+	opts, err := parseQueryOptions(r.URL.Query(), authorSortFields)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	shapes := rep.samples()
+	expand, err := parseExpansion(r.URL.Query(), authorBooks, shapes.authors, shapes.grouped)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	repositories := []versioned{h.authorRepository}
+	if expand.include {
+		repositories = append(repositories, h.bookRepository)
+	}
+	cache, err := readValidators(r.Context(), rep.name(), repositories...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if cache.notModified(w, r) {
+		return
+	}
+	response, total, err := h.authorRepository.Find(r.Context(), opts)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	value := rep.authors(response)
+	if expand.include {
+		grouped, err := h.withBooks(r.Context(), response)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		value = rep.grouped(grouped)
+	}
+	cache.set(w.Header())
+	w.Header().Add("X-Total-Count", strconv.Itoa(total))
+	// Responding with JSON Array
+	expand.write(w, rep, value)
+}
+
+func (h *Handler) GetAuthor(w http.ResponseWriter, r *http.Request) {
+	id, ok := idFromPath(w, r, "/authors/")
+	if !ok {
+		return
+	}
+	rep := representationOf(r)
+	shapes := rep.samples()
+	expand, err := parseExpansion(r.URL.Query(), authorBooks, shapes.author, shapes.authorWithBooks)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	author, err := h.authorRepository.GetByID(r.Context(), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	value := rep.author(*author)
+	if expand.include {
+		grouped, err := h.withBooks(r.Context(), []Author{*author})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		value = rep.authorWithBooks(grouped[0])
+	}
+	setEntityTag(w, author.Version)
+	expand.write(w, rep, value)
+}
+
+// UpdateAuthor replaces the whole author, fields missing from the body are reset
+func (h *Handler) UpdateAuthor(w http.ResponseWriter, r *http.Request) {
+	id, ok := idFromPath(w, r, "/authors/")
+	if !ok {
+		return
+	}
+	version, err := expectedVersion(r, h.authorVersion(r, id))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	h.updateAuthor(w, r, &Author{ID: id}, version)
+}
+
+// PatchAuthor only changes the fields present in the body
+func (h *Handler) PatchAuthor(w http.ResponseWriter, r *http.Request) {
+	id, ok := idFromPath(w, r, "/authors/")
+	if !ok {
+		return
+	}
+	author, err := h.authorRepository.GetByID(r.Context(), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	version, err := expectedVersion(r, func() (int, error) { return author.Version, nil })
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	h.updateAuthor(w, r, author, version)
+}
+
+// updateAuthor works like updateBook
+func (h *Handler) updateAuthor(w http.ResponseWriter, r *http.Request, author *Author, version int) {
+	rep := representationOf(r)
+	id := author.ID
+	reqBody, _ := ioutil.ReadAll(r.Body)
+	if err := rep.decodeAuthor(reqBody, author); err != nil {
+		writeError(w, errUnreadableBody)
+		return
+	}
+	author.ID = id
+	if len(author.Name) == 0 {
+		writeError(w, invalidEntity("Author name cannot be empty", FieldError{"name", "cannot be empty"}))
+		return
+	}
+	if err := h.authorRepository.Update(r.Context(), author, version); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeAuthor(w, rep, *author)
+}
+
+func writeAuthor(w http.ResponseWriter, rep representation, author Author) {
+	setEntityTag(w, author.Version)
+	writeRepresentation(w, rep, rep.author(author))
+}
+
+// authorVersion works like bookVersion
+func (h *Handler) authorVersion(r *http.Request, id int) func() (int, error) {
+	return func() (int, error) {
+		author, err := h.authorRepository.GetByID(r.Context(), id)
+		if err != nil {
+			return 0, err
+		}
+		return author.Version, nil
+	}
+}
+
+func (h *Handler) DeleteAuthor(w http.ResponseWriter, r *http.Request) {
+	id, ok := idFromPath(w, r, "/authors/")
+	if !ok {
+		return
+	}
+	version, err := expectedVersion(r, h.authorVersion(r, id))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := h.authorRepository.Delete(r.Context(), id, version); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetBooksAndAuthors joins books with their author. join=left keeps the books
+// without author and group=author nests the books under their author instead.
+// It is the whole catalog of /books?include=author or /authors?include=books,
+// fields trims it the same way.
+func (h *Handler) GetBooksAndAuthors(w http.ResponseWriter, r *http.Request) {
+	rep := representationOf(r)
+	query := r.URL.Query()
+	join, group := query.Get("join"), query.Get("group")
+	if join != "" && join != "inner" && join != "left" {
+		writeError(w, badRequest("join", "must be inner or left"))
+		return
+	}
+	if group != "" && group != "author" {
+		writeError(w, badRequest("group", "must be author"))
+		return
+	}
+	if group != "" && join == "left" {
+		writeError(w, badRequest("group", "cannot be combined with join=left"))
+		return
+	}
+	shape := rep.samples().joined
+	if group == "author" {
+		shape = rep.samples().grouped
+	}
+	expand, err := parseExpansion(query, relation{}, shape, nil)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	cache, err := readValidators(r.Context(), rep.name(), h.bookRepository, h.authorRepository)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if cache.notModified(w, r) {
+		return
+	}
+	books, authors, err := fetchCatalog(r.Context(), h.bookRepository, h.authorRepository)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	cache.set(w.Header())
+	var response interface{}
+	switch {
+	case group == "author":
+		response = rep.grouped(h.combinationService.GroupByAuthor(books, authors))
+	case join == "left":
+		response = rep.joined(h.combinationService.GenerateLeftJoin(books, authors))
+	default:
+		response = rep.joined(h.combinationService.GenerateResponse(books, authors))
+	}
+	// Responding with JSON Array
+	expand.write(w, rep, response)
+}
+
+// fetchCatalog loads books and authors concurrently using 2 goroutines.
+// The first failure cancels the other fetch, and so does ctx when the client
+// goes away. The error channel is buffered for both goroutines so they can
+// always finish, even when nobody is receiving anymore.
+func fetchCatalog(ctx context.Context, bookRepository BookRepository, authorRepository AuthorRepository) ([]Book, []Author, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var books []Book
+	var authors []Author
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- recovered(func() (err error) {
+			books, err = bookRepository.GetAll(ctx)
+			return err
+		})
+	}()
+	go func() {
+		errCh <- recovered(func() (err error) {
+			authors, err = authorRepository.GetAll(ctx)
+			return err
+		})
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errCh:
+			if err != nil {
+				return nil, nil, err
+			}
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+	return books, authors, nil
+}
+
+// recovered runs fn and turns a panic into an error, a panicking goroutine
+// would otherwise take the whole server down. Read 10-errors-panics.md
+func recovered(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("recovered from panic: %v", r)
+		}
+	}()
+	return fn()
+}
+
+// Search finds books by words of their name or their author's name, q=go act
+// matches "Go in Action". limit defaults to 20.
+func (h *Handler) Search(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := query.Get("q")
+	if len(tokenize(q)) == 0 {
+		writeError(w, badRequest("q", "cannot be empty"))
+		return
+	}
+	limit, err := nonNegative(query, "limit")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if limit == 0 {
+		limit = 20
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.searchIndex.Search(q, limit))
+}
+
+// idFromPath reads the ID following prefix in the URL, e.g. 3 in /books/3.
+// It writes the error response itself, callers only have to return.
+func idFromPath(w http.ResponseWriter, r *http.Request, prefix string) (int, bool) {
+	return idFromSubresourcePath(w, r, prefix, "")
+}
+
+// idFromSubresourcePath reads the ID between prefix and suffix, e.g. 3 in
+// /books/3/history.
+func idFromSubresourcePath(w http.ResponseWriter, r *http.Request, prefix, suffix string) (int, bool) {
+	id, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, prefix), suffix))
+	if err != nil || id <= 0 {
+		writeError(w, errInvalidPathID)
+		return 0, false
+	}
+	return id, true
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAPI wires memory repositories the way main does, webhooks may reach
+// the receivers the tests start on loopback
+func newTestAPI() *Handler {
+	api, err := newAPI(context.Background(), NewMemoryBackedBookRepository(), NewMemoryBackedAuthorRepository(), NewMemoryBackedHistoryRepository(), DeleteRestrict, WebhookOptions{AllowInternal: true})
+	if err != nil {
+		panic(err)
+	}
+	return api
+}
+
+// do sends a request through the router and returns the recorded response
+func do(router http.Handler, method, target string, body io.Reader) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, body)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestBookCRUDEndpoints(t *testing.T) {
+	router := newRouter(newTestAPI())
+	do(router, http.MethodPost, "/authors", strings.NewReader(`{"name":"Author 1"}`))
+
+	w := do(router, http.MethodPost, "/books", strings.NewReader(`{"name":"Book 1","authorId":1}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Invalid code! I want %d but get %d", http.StatusOK, w.Code)
+	}
+
+	w = do(router, http.MethodGet, "/books/1", nil)
+	var book Book
+	json.NewDecoder(w.Body).Decode(&book)
+	if w.Code != http.StatusOK || book.Name != "Book 1" {
+		t.Errorf("Unexpected response %d %+v", w.Code, book)
+	}
+
+	// PATCH keeps the author, PUT without it clears it
+	w = do(router, http.MethodPatch, "/books/1", strings.NewReader(`{"name":"Book 1 patched"}`))
+	json.NewDecoder(w.Body).Decode(&book)
+	if w.Code != http.StatusOK || book.Name != "Book 1 patched" || book.firstAuthor() != 1 {
+		t.Errorf("Unexpected response %d %+v", w.Code, book)
+	}
+	w = do(router, http.MethodPut, "/books/1", strings.NewReader(`{"name":"Book 1 replaced"}`))
+	book = Book{}
+	json.NewDecoder(w.Body).Decode(&book)
+	if w.Code != http.StatusOK || book.ID != 1 || len(book.AuthorIDs) != 0 {
+		t.Errorf("Unexpected response %d %+v", w.Code, book)
+	}
+
+	w = do(router, http.MethodDelete, "/books/1", nil)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Invalid code! I want %d but get %d", http.StatusNoContent, w.Code)
+	}
+	for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		w = do(router, method, "/books/1", strings.NewReader(`{"name":"Book 1"}`))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: Invalid code! I want %d but get %d", method, http.StatusNotFound, w.Code)
+		}
+	}
+	w = do(router, http.MethodGet, "/books/abc", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Invalid code! I want %d but get %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestAuthorCRUDEndpoints(t *testing.T) {
+	router := newRouter(newTestAPI())
+	do(router, http.MethodPost, "/authors", strings.NewReader(`{"name":"Author 1"}`))
+	do(router, http.MethodPost, "/authors", strings.NewReader(`{"name":"Author 2"}`))
+
+	w := do(router, http.MethodPatch, "/authors/2", strings.NewReader(`{"name":"Author 1"}`))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Invalid code! I want %d but get %d", http.StatusConflict, w.Code)
+	}
+	w = do(router, http.MethodPut, "/authors/2", strings.NewReader(`{"name":"Author 3"}`))
+	if w.Code != http.StatusOK {
+		t.Errorf("Invalid code! I want %d but get %d", http.StatusOK, w.Code)
+	}
+	w = do(router, http.MethodDelete, "/authors/2", nil)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Invalid code! I want %d but get %d", http.StatusNoContent, w.Code)
+	}
+	w = do(router, http.MethodGet, "/authors/2", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Invalid code! I want %d but get %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestListQueryParameters(t *testing.T) {
+	router := newRouter(newTestAPI())
+	do(router, http.MethodPost, "/authors", strings.NewReader(`{"name":"Author 1"}`))
+	for _, name := range []string{"C", "A", "B"} {
+		do(router, http.MethodPost, "/books", strings.NewReader(`{"name":"`+name+`","authorId":1}`))
+	}
+
+	w := do(router, http.MethodGet, "/books?sort=-name&page=1&size=2", nil)
+	var books []Book
+	json.NewDecoder(w.Body).Decode(&books)
+	if w.Code != http.StatusOK || len(books) != 2 || books[0].Name != "C" || books[1].Name != "B" {
+		t.Errorf("Unexpected response %d %+v", w.Code, books)
+	}
+	if total := w.Header().Get("X-Total-Count"); total != "3" {
+		t.Errorf("Incorrect total - Expected %s, found %s", "3", total)
+	}
+
+	w = do(router, http.MethodGet, "/books?name~=b", nil)
+	if total := w.Header().Get("X-Total-Count"); total != "1" {
+		t.Errorf("Incorrect total - Expected %s, found %s", "1", total)
+	}
+
+	// Huge pages don't overflow
+	w = do(router, http.MethodGet, "/books?limit=9223372036854775807&offset=1", nil)
+	books = nil
+	json.NewDecoder(w.Body).Decode(&books)
+	if w.Code != http.StatusOK || len(books) != 2 {
+		t.Errorf("Unexpected response %d %+v", w.Code, books)
+	}
+
+	for _, query := range []string{"sort=price", "limit=-1", "offset=x", "page=2", "page=3&size=9223372036854775807"} {
+		w = do(router, http.MethodGet, "/books?"+query, nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: Invalid code! I want %d but get %d", query, http.StatusBadRequest, w.Code)
+		}
+	}
+	w = do(router, http.MethodGet, "/authors?sort=authorId", nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Invalid code! I want %d but get %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestUnknownAuthorIsUnprocessable(t *testing.T) {
+	router := newRouter(newTestAPI())
+
+	w := do(router, http.MethodPost, "/books", strings.NewReader(`{"name":"Book 1","authorId":7}`))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Invalid code! I want %d but get %d", http.StatusUnprocessableEntity, w.Code)
+	}
+	do(router, http.MethodPost, "/authors", strings.NewReader(`{"name":"Author 1"}`))
+	do(router, http.MethodPost, "/books", strings.NewReader(`{"name":"Book 1","authorId":1}`))
+	w = do(router, http.MethodPatch, "/books/1", strings.NewReader(`{"authorId":7}`))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Invalid code! I want %d but get %d", http.StatusUnprocessableEntity, w.Code)
+	}
+	w = do(router, http.MethodDelete, "/authors/1", nil)
+	if w.Code != http.StatusConflict {
+		t.Errorf("Invalid code! I want %d but get %d", http.StatusConflict, w.Code)
+	}
+}
+
+func TestBookFieldsAreValidated(t *testing.T) {
+	router := newRouter(newTestAPI())
+	w := do(router, http.MethodPost, "/books", strings.NewReader(`{"name":"Book 1","isbn":"978-0-306-40615-8","year":3000}`))
+	var apiErr APIError
+	json.NewDecoder(w.Body).Decode(&apiErr)
+	if w.Code != http.StatusUnprocessableEntity || len(apiErr.Details) != 2 {
+		t.Errorf("Expected errors on isbn and year, found %d %+v", w.Code, apiErr)
+	}
+
+	w = do(router, http.MethodPost, "/books", strings.NewReader(`{"name":"Book 1","isbn":"978-0-306-40615-7","year":1999,"genres":["Go","go "]}`))
+	var book BookV1
+	json.NewDecoder(w.Body).Decode(&book)
+	if w.Code != http.StatusOK || book.ISBN != "9780306406157" || book.Year != 1999 || len(book.Genres) != 1 {
+		t.Errorf("Unexpected response %d %+v", w.Code, book)
+	}
+}
+
+// failingBookRepository fails every call like a backend whose disk is gone
+type failingBookRepository struct {
+	BookRepository
+}
+
+func (failingBookRepository) Find(ctx context.Context, opts QueryOptions) ([]Book, int, error) {
+	return nil, 0, errors.New("disk I/O error")
+}
+
+func (failingBookRepository) Version(ctx context.Context) (CatalogVersion, error) {
+	return CatalogVersion{}, errors.New("disk I/O error")
+}
+
+func TestErrorResponses(t *testing.T) {
+	router := newRouter(newTestAPI())
+	do(router, http.MethodPost, "/books", strings.NewReader(`{"name":"Book 1"}`))
+
+	cases := []struct {
+		method, target, body string
+		status               int
+		code                 string
+		field                string
+	}{
+		{http.MethodPost, "/books", `{"name":"Book 1"}`, http.StatusConflict, "duplicate", "name"},
+		{http.MethodPost, "/books", `{"name":""}`, http.StatusUnprocessableEntity, "invalid", "name"},
+		{http.MethodPost, "/authors", `{`, http.StatusBadRequest, "bad_request", ""},
+		{http.MethodGet, "/books?limit=x", "", http.StatusBadRequest, "bad_request", "limit"},
+		{http.MethodGet, "/books/9", "", http.StatusNotFound, "not_found", ""},
+		{http.MethodDelete, "/books", "", http.StatusMethodNotAllowed, "method_not_allowed", ""},
+	}
+	for _, c := range cases {
+		w := do(router, c.method, c.target, strings.NewReader(c.body))
+		var response APIError
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatalf("%s %s: body is not JSON: %v", c.method, c.target, err)
+		}
+		if w.Code != c.status || response.Code != c.code || response.Message == "" {
+			t.Errorf("%s %s: Expected %d %s, found %d %+v", c.method, c.target, c.status, c.code, w.Code, response)
+		}
+		if c.field != "" && (len(response.Details) != 1 || response.Details[0].Field != c.field) {
+			t.Errorf("%s %s: Expected details for %s, found %+v", c.method, c.target, c.field, response.Details)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s %s: Incorrect content type %s", c.method, c.target, ct)
+		}
+	}
+
+	w := do(router, http.MethodPost, "/books/1", nil)
+	if allow := w.Header().Get("Allow"); allow != "DELETE, GET, PATCH, PUT" {
+		t.Errorf("Incorrect Allow header %q", allow)
+	}
+
+	// Storage failures are not leaked to the client
+	router = newRouter(&Handler{
+		bookRepository:     failingBookRepository{},
+		authorRepository:   NewMemoryBackedAuthorRepository(),
+		combinationService: NewCombinationService(),
+	})
+	w = do(router, http.MethodGet, "/books", nil)
+	if w.Code != http.StatusInternalServerError || strings.Contains(w.Body.String(), "disk") {
+		t.Errorf("Unexpected response %d %s", w.Code, w.Body.String())
+	}
+}
+
+// stubBookRepository and stubAuthorRepository let a test decide how GetAll
+// behaves, their version never changes.
+type stubBookRepository struct {
+	BookRepository
+	getAll func(ctx context.Context) ([]Book, error)
+}
+
+func (s stubBookRepository) GetAll(ctx context.Context) ([]Book, error) {
+	return s.getAll(ctx)
+}
+
+func (s stubBookRepository) Version(ctx context.Context) (CatalogVersion, error) {
+	return CatalogVersion{}, nil
+}
+
+type stubAuthorRepository struct {
+	AuthorRepository
+	getAll func(ctx context.Context) ([]Author, error)
+}
+
+func (s stubAuthorRepository) GetAll(ctx context.Context) ([]Author, error) {
+	return s.getAll(ctx)
+}
+
+func (s stubAuthorRepository) Version(ctx context.Context) (CatalogVersion, error) {
+	return CatalogVersion{}, nil
+}
+
+// blockUntilCanceled waits like a slow backend and reports that it was canceled
+func blockUntilCanceled(canceled chan<- struct{}) func(ctx context.Context) ([]Book, error) {
+	return func(ctx context.Context) ([]Book, error) {
+		<-ctx.Done()
+		canceled <- struct{}{}
+		return nil, ctx.Err()
+	}
+}
+
+// expectNoLeak waits for the goroutines started by a test to finish
+func expectNoLeak(t *testing.T, before int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Errorf("Goroutines leaked, %d before and %d after", before, runtime.NumGoroutine())
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBooksAndAuthorsFailures(t *testing.T) {
+	cases := []struct {
+		name    string
+		authors func(ctx context.Context) ([]Author, error)
+	}{
+		{"error", func(ctx context.Context) ([]Author, error) {
+			return nil, errors.New("connection refused")
+		}},
+		{"panic", func(ctx context.Context) ([]Author, error) {
+			panic("nil map")
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			before := runtime.NumGoroutine()
+			canceled := make(chan struct{}, 1)
+			api := &Handler{
+				bookRepository:     stubBookRepository{getAll: blockUntilCanceled(canceled)},
+				authorRepository:   stubAuthorRepository{getAll: c.authors},
+				combinationService: NewCombinationService(),
+			}
+			w := do(newRouter(api), http.MethodGet, "/books-authors", nil)
+			if w.Code != http.StatusInternalServerError {
+				t.Errorf("Invalid code! I want %d but get %d", http.StatusInternalServerError, w.Code)
+			}
+			select {
+			case <-canceled:
+			case <-time.After(time.Second):
+				t.Error("The book fetch was not canceled")
+			}
+			expectNoLeak(t, before)
+		})
+	}
+}
+
+func TestBooksAndAuthorsClientGone(t *testing.T) {
+	before := runtime.NumGoroutine()
+	canceled := make(chan struct{}, 2)
+	api := &Handler{
+		bookRepository: stubBookRepository{getAll: blockUntilCanceled(canceled)},
+		authorRepository: stubAuthorRepository{getAll: func(ctx context.Context) ([]Author, error) {
+			<-ctx.Done()
+			canceled <- struct{}{}
+			return nil, ctx.Err()
+		}},
+		combinationService: NewCombinationService(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/books-authors", nil).WithContext(ctx)
+	done := make(chan struct{})
+	go func() {
+		newRouter(api).ServeHTTP(httptest.NewRecorder(), req)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("The handler kept running after the client disconnected")
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-canceled:
+		case <-time.After(time.Second):
+			t.Fatal("A fetch was not canceled")
+		}
+	}
+	expectNoLeak(t, before)
+}
+
+func TestBooksAndAuthorsDeadline(t *testing.T) {
+	canceled := make(chan struct{}, 1)
+	api := &Handler{
+		bookRepository:     stubBookRepository{getAll: blockUntilCanceled(canceled)},
+		authorRepository:   NewMemoryBackedAuthorRepository(),
+		combinationService: NewCombinationService(),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodGet, "/books-authors", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	newRouter(api).ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Invalid code! I want %d but get %d", http.StatusServiceUnavailable, w.Code)
+	}
+}
+
+func TestBooksAndAuthorsModes(t *testing.T) {
+	// Without the integrity rules so we can store an orphan
+	router := newRouter(&Handler{
+		bookRepository:     NewMemoryBackedBookRepository(),
+		authorRepository:   NewMemoryBackedAuthorRepository(),
+		combinationService: NewCombinationService(),
+	})
+	do(router, http.MethodPost, "/authors", strings.NewReader(`{"name":"Author 1"}`))
+	do(router, http.MethodPost, "/books", strings.NewReader(`{"name":"Book 1","authorId":1}`))
+	do(router, http.MethodPost, "/books", strings.NewReader(`{"name":"Book 2","authorId":5}`))
+
+	w := do(router, http.MethodGet, "/books-authors?join=left", nil)
+	if body := w.Body.String(); !strings.Contains(body, `"name":"Book 2","author":null`) {
+		t.Errorf("Expected the orphan with a null author, found %s", body)
+	}
+	w = do(router, http.MethodGet, "/books-authors?group=author", nil)
+	var grouped []AuthorWithBooks
+	json.NewDecoder(w.Body).Decode(&grouped)
+	if len(grouped) != 1 || len(grouped[0].Books) != 1 || grouped[0].Books[0].Name != "Book 1" {
+		t.Errorf("Unexpected groups %+v", grouped)
+	}
+	for _, query := range []string{"join=outer", "group=name", "group=author&join=left"} {
+		w = do(router, http.MethodGet, "/books-authors?"+query, nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: Invalid code! I want %d but get %d", query, http.StatusBadRequest, w.Code)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// HistoryEntry is one write of a book or an author. Before and After are
+// the JSON of the entity as it was stored, Before is null for a create and
+// an undelete, After for a delete.
+type HistoryEntry struct {
+	ID       int             `json:"id"`
+	Entity   string          `json:"entity"` // books or authors
+	EntityID int             `json:"entityId"`
+	Action   string          `json:"action"`
+	Actor    string          `json:"actor"` // subject of the credentials, see actorOf
+	At       time.Time       `json:"at"`
+	Before   json.RawMessage `json:"before"`
+	After    json.RawMessage `json:"after"`
+}
+
+// Actions of a HistoryEntry
+const (
+	HistoryCreate   = "create"
+	HistoryUpdate   = "update"
+	HistoryDelete   = "delete"
+	HistoryUndelete = "undelete"
+)
+
+// HistoryRepository is implemented by every storage backend next to its
+// BookRepository and AuthorRepository. Append sets the ID of entry, IDs
+// grow with every entry. Find returns the entries of one entity oldest
+// first, an empty list for an entity which was never written.
+type HistoryRepository interface {
+	Append(ctx context.Context, entry *HistoryEntry) error
+	Find(ctx context.Context, entity string, id int) ([]HistoryEntry, error)
+}
+
+// anonymousActor writes when the server runs without credentials
+const anonymousActor = "anonymous"
+
+// actorOf is who the history records for a write made with ctx
+func actorOf(ctx context.Context) string {
+	if principal, ok := PrincipalFromContext(ctx); ok {
+		return principal.Subject
+	}
+	return anonymousActor
+}
+
+// NewAuditingRepositories appends a HistoryEntry to history for every write
+// which succeeded. The entry is appended after the write, see record for
+// what happens when that fails. Before is the exact state the write
+// replaced: an update or delete without version is made with the version
+// read for Before and retried when it was stale.
+func NewAuditingRepositories(books BookRepository, authors AuthorRepository, history HistoryRepository, now func() time.Time) (BookRepository, AuthorRepository) {
+	a := &audit{history, timestamps{now}}
+	return &auditingBookRepository{books, a}, &auditingAuthorRepository{authors, a}
+}
+
+// historyAppendTimeout bounds an append which no longer ends with its request
+const historyAppendTimeout = 10 * time.Second
+
+type audit struct {
+	history HistoryRepository
+	timestamps
+}
+
+// record appends the entry of a write, before and after are nil pointers
+// when the entity didn't exist on that side of the write. The write is
+// stored already: a client going away must not keep it from the history,
+// and the events and webhooks published from there, so the entry is
+// appended without the cancellation of ctx. An append which fails anyway
+// is logged, answering with an error would have the client retry a write
+// which was made.
+func (a *audit) record(ctx context.Context, entity string, id int, action string, before, after interface{}) {
+	entry := HistoryEntry{Entity: entity, EntityID: id, Action: action, Actor: actorOf(ctx), At: a.current()}
+	// Entities always encode
+	entry.Before, _ = json.Marshal(before)
+	entry.After, _ = json.Marshal(after)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), historyAppendTimeout)
+	defer cancel()
+	if err := a.history.Append(ctx, &entry); err != nil {
+		log.Printf("history of %s %d lost the %s: %v", entity, id, action, err)
+	}
+}
+
+// retryWrite tells whether a write made with the version read for Before
+// failed because of a write in between and has to be made again.
+func retryWrite(err error, version int) bool {
+	return errors.Is(err, ErrConflict) && version == AnyVersion
+}
+
+type auditingBookRepository struct {
+	BookRepository
+	*audit
+}
+
+func (repo *auditingBookRepository) Create(ctx context.Context, book *Book) error {
+	if err := repo.BookRepository.Create(ctx, book); err != nil {
+		return err
+	}
+	repo.record(ctx, "books", book.ID, HistoryCreate, (*Book)(nil), book)
+	return nil
+}
+
+func (repo *auditingBookRepository) Update(ctx context.Context, book *Book, version int) error {
+	for {
+		before, err := repo.BookRepository.GetByID(ctx, book.ID)
+		if err != nil {
+			return err
+		}
+		if err := checkVersion("Book", book.ID, before.Version, version); err != nil {
+			return err
+		}
+		err = repo.BookRepository.Update(ctx, book, before.Version)
+		if retryWrite(err, version) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		repo.record(ctx, "books", book.ID, HistoryUpdate, before, book)
+		return nil
+	}
+}
+
+func (repo *auditingBookRepository) Delete(ctx context.Context, id int, version int) error {
+	for {
+		before, err := repo.BookRepository.GetByID(ctx, id)
+		if err != nil {
+			return err
+		}
+		if err := checkVersion("Book", id, before.Version, version); err != nil {
+			return err
+		}
+		err = repo.BookRepository.Delete(ctx, id, before.Version)
+		if retryWrite(err, version) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		repo.record(ctx, "books", id, HistoryDelete, before, (*Book)(nil))
+		return nil
+	}
+}
+
+func (repo *auditingBookRepository) Undelete(ctx context.Context, id int) (*Book, error) {
+	book, err := repo.BookRepository.Undelete(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	repo.record(ctx, "books", id, HistoryUndelete, (*Book)(nil), book)
+	return book, nil
+}
+
+type auditingAuthorRepository struct {
+	AuthorRepository
+	*audit
+}
+
+func (repo *auditingAuthorRepository) Create(ctx context.Context, author *Author) error {
+	if err := repo.AuthorRepository.Create(ctx, author); err != nil {
+		return err
+	}
+	repo.record(ctx, "authors", author.ID, HistoryCreate, (*Author)(nil), author)
+	return nil
+}
+
+func (repo *auditingAuthorRepository) Update(ctx context.Context, author *Author, version int) error {
+	for {
+		before, err := repo.AuthorRepository.GetByID(ctx, author.ID)
+		if err != nil {
+			return err
+		}
+		if err := checkVersion("Author", author.ID, before.Version, version); err != nil {
+			return err
+		}
+		err = repo.AuthorRepository.Update(ctx, author, before.Version)
+		if retryWrite(err, version) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		repo.record(ctx, "authors", author.ID, HistoryUpdate, before, author)
+		return nil
+	}
+}
+
+func (repo *auditingAuthorRepository) Delete(ctx context.Context, id int, version int) error {
+	for {
+		before, err := repo.AuthorRepository.GetByID(ctx, id)
+		if err != nil {
+			return err
+		}
+		if err := checkVersion("Author", id, before.Version, version); err != nil {
+			return err
+		}
+		err = repo.AuthorRepository.Delete(ctx, id, before.Version)
+		if retryWrite(err, version) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		repo.record(ctx, "authors", id, HistoryDelete, before, (*Author)(nil))
+		return nil
+	}
+}
+
+func (repo *auditingAuthorRepository) Undelete(ctx context.Context, id int) (*Author, error) {
+	author, err := repo.AuthorRepository.Undelete(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	repo.record(ctx, "authors", id, HistoryUndelete, (*Author)(nil), author)
+	return author, nil
+}
+
+// GetBookHistory lists the writes of a book oldest first, a deleted book
+// still has its history.
+func (h *Handler) GetBookHistory(w http.ResponseWriter, r *http.Request) {
+	id, ok := idFromSubresourcePath(w, r, "/books/", "/history")
+	if !ok {
+		return
+	}
+	h.writeHistory(w, r, "books", id, func() error {
+		_, err := h.bookRepository.GetByID(r.Context(), id)
+		if errors.Is(err, ErrNotFound) {
+			_, err = h.bookRepository.GetDeletedByID(r.Context(), id)
+		}
+		if errors.Is(err, ErrNotFound) {
+			return errBookNotFound
+		}
+		return err
+	})
+}
+
+// UndeleteBook brings back a deleted book, its authors have to exist
+func (h *Handler) UndeleteBook(w http.ResponseWriter, r *http.Request) {
+	id, ok := idFromSubresourcePath(w, r, "/books/", "/undelete")
+	if !ok {
+		return
+	}
+	book, err := h.bookRepository.Undelete(r.Context(), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	h.writeBook(w, r, representationOf(r), *book)
+}
+
+// GetAuthorHistory works like GetBookHistory
+func (h *Handler) GetAuthorHistory(w http.ResponseWriter, r *http.Request) {
+	id, ok := idFromSubresourcePath(w, r, "/authors/", "/history")
+	if !ok {
+		return
+	}
+	h.writeHistory(w, r, "authors", id, func() error {
+		_, err := h.authorRepository.GetByID(r.Context(), id)
+		if errors.Is(err, ErrNotFound) {
+			_, err = h.authorRepository.GetDeletedByID(r.Context(), id)
+		}
+		if errors.Is(err, ErrNotFound) {
+			return errAuthorNotFound
+		}
+		return err
+	})
+}
+
+// UndeleteAuthor brings back a deleted author, the books a cascade deleted
+// along with it have to be undeleted one by one.
+func (h *Handler) UndeleteAuthor(w http.ResponseWriter, r *http.Request) {
+	id, ok := idFromSubresourcePath(w, r, "/authors/", "/undelete")
+	if !ok {
+		return
+	}
+	author, err := h.authorRepository.Undelete(r.Context(), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeAuthor(w, representationOf(r), *author)
+}
+
+// writeHistory sends the entries of an entity. exists is only asked when
+// there are none, to tell an entity never written since the history was
+// kept from one which never existed.
+func (h *Handler) writeHistory(w http.ResponseWriter, r *http.Request, entity string, id int, exists func() error) {
+	entries, err := h.historyRepository.Find(r.Context(), entity, id)
+	if err == nil && len(entries) == 0 {
+		err = exists()
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSoftDelete(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, books BookRepository, authors AuthorRepository) {
+		author := &Author{Name: "Author 1"}
+		authors.Create(ctx, author)
+		book := &Book{Name: "Book 1", AuthorIDs: []int{author.ID}, Year: 2015}
+		books.Create(ctx, book)
+		if err := books.Delete(ctx, book.ID, AnyVersion); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := books.GetByID(ctx, book.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, found %v", err)
+		}
+		deleted, err := books.GetDeletedByID(ctx, book.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted.Name != book.Name || deleted.Year != 2015 || deleted.Version != 1 || !sameAuthors(deleted.AuthorIDs, book.AuthorIDs) {
+			t.Errorf("Incorrect deleted book - Expected %+v, found %+v", book, deleted)
+		}
+
+		// The name is free again until the book comes back
+		clash := &Book{Name: "Book 1"}
+		if err := books.Create(ctx, clash); err != nil {
+			t.Fatal(err)
+		}
+		if clash.ID == book.ID {
+			t.Errorf("Expected a new ID, found %d again", clash.ID)
+		}
+		if _, err := books.Undelete(ctx, book.ID); !errors.Is(err, ErrDuplicate) {
+			t.Errorf("Expected ErrDuplicate, found %v", err)
+		}
+		books.Delete(ctx, clash.ID, AnyVersion)
+
+		undeleted, err := books.Undelete(ctx, book.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if undeleted.Version != 2 {
+			t.Errorf("Incorrect version - Expected %d, found %d", 2, undeleted.Version)
+		}
+		if found, err := books.GetByID(ctx, book.ID); err != nil || found.Version != 2 || !sameAuthors(found.AuthorIDs, book.AuthorIDs) {
+			t.Errorf("Expected the book back at version 2, found %+v and %v", found, err)
+		}
+		if _, err := books.GetDeletedByID(ctx, book.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, found %v", err)
+		}
+		if _, err := books.Undelete(ctx, book.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, found %v", err)
+		}
+
+		other := &Author{Name: "Author 2"}
+		authors.Create(ctx, other)
+		if err := authors.Delete(ctx, other.ID, 1); err != nil {
+			t.Fatal(err)
+		}
+		if all, _ := authors.GetAll(ctx); len(all) != 1 {
+			t.Errorf("Expected the deleted author to be left out, found %+v", all)
+		}
+		if undeleted, err := authors.Undelete(ctx, other.ID); err != nil || undeleted.Name != "Author 2" || undeleted.Version != 2 {
+			t.Errorf("Expected the author back at version 2, found %+v and %v", undeleted, err)
+		}
+	})
+}
+
+func TestIntegrityUndeleteNeedsAuthors(t *testing.T) {
+	books, authors := NewIntegrityRepositories(NewMemoryBackedBookRepository(), NewMemoryBackedAuthorRepository(), DeleteCascade)
+	author := &Author{Name: "Author 1"}
+	authors.Create(ctx, author)
+	books.Create(ctx, &Book{Name: "Book 1", AuthorIDs: []int{author.ID}})
+	authors.Delete(ctx, author.ID, AnyVersion)
+
+	if _, err := books.Undelete(ctx, 1); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Expected ErrInvalid, found %v", err)
+	}
+	authors.Undelete(ctx, author.ID)
+	if _, err := books.Undelete(ctx, 1); err != nil {
+		t.Errorf("Expected the book back with its author, found %v", err)
+	}
+}
+
+func TestAuditingRepositories(t *testing.T) {
+	history := NewMemoryBackedHistoryRepository()
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	books, authors := NewAuditingRepositories(NewMemoryBackedBookRepository(), NewMemoryBackedAuthorRepository(), history, func() time.Time { return now })
+	alice := context.WithValue(ctx, principalKey{}, &Principal{Subject: "alice"})
+
+	author := &Author{Name: "Author 1"}
+	authors.Create(alice, author)
+	book := &Book{Name: "Book 1", AuthorIDs: []int{author.ID}}
+	books.Create(alice, book)
+	book.Name = "Book One"
+	books.Update(ctx, book, 1)
+	if err := books.Delete(alice, book.ID, 1); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict, found %v", err)
+	}
+	books.Delete(alice, book.ID, 2)
+	books.Undelete(ctx, book.ID)
+
+	entries, err := history.Find(ctx, "books", book.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct{ action, actor, before, after string }{
+		{HistoryCreate, "alice", "", "Book 1"},
+		{HistoryUpdate, anonymousActor, "Book 1", "Book One"},
+		{HistoryDelete, "alice", "Book One", ""},
+		{HistoryUndelete, anonymousActor, "", "Book One"},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("Incorrect number of entries - Expected %d, found %d: %+v", len(expected), len(entries), entries)
+	}
+	nameOf := func(data json.RawMessage) string {
+		var stored *Book
+		if err := json.Unmarshal(data, &stored); err != nil {
+			t.Fatal(err)
+		}
+		if stored == nil {
+			return ""
+		}
+		return stored.Name
+	}
+	for i, e := range expected {
+		entry := entries[i]
+		if entry.Action != e.action || entry.Actor != e.actor || nameOf(entry.Before) != e.before || nameOf(entry.After) != e.after {
+			t.Errorf("Incorrect entry %d - Expected %+v, found %s by %s from %s to %s", i, e, entry.Action, entry.Actor, entry.Before, entry.After)
+		}
+		if entry.Entity != "books" || entry.EntityID != book.ID || !entry.At.Equal(now) {
+			t.Errorf("Incorrect entry %d - Expected book %d at %v, found %+v", i, book.ID, now, entry)
+		}
+		if i > 0 && entry.ID <= entries[i-1].ID {
+			t.Errorf("Expected growing IDs, found %d after %d", entry.ID, entries[i-1].ID)
+		}
+	}
+	if entries, _ := history.Find(ctx, "authors", author.ID); len(entries) != 1 || entries[0].Action != HistoryCreate {
+		t.Errorf("Expected the create of the author, found %+v", entries)
+	}
+	if entries, _ := history.Find(ctx, "books", 42); entries == nil || len(entries) != 0 {
+		t.Errorf("Expected an empty list, found %#v", entries)
+	}
+}
+
+// racingBookRepository lets another editor write right before the first
+// Update it is asked for
+type racingBookRepository struct {
+	BookRepository
+	raced bool
+}
+
+func (repo *racingBookRepository) Update(ctx context.Context, book *Book, version int) error {
+	if !repo.raced {
+		repo.raced = true
+		other, _ := repo.GetByID(ctx, book.ID)
+		other.Year = 2016
+		repo.BookRepository.Update(ctx, other, AnyVersion)
+	}
+	return repo.BookRepository.Update(ctx, book, version)
+}
+
+// An update without version records exactly the state it replaced
+func TestAuditingRetriesUpdateAfterRace(t *testing.T) {
+	history := NewMemoryBackedHistoryRepository()
+	inner := &racingBookRepository{BookRepository: NewMemoryBackedBookRepository()}
+	books, _ := NewAuditingRepositories(inner, NewMemoryBackedAuthorRepository(), history, time.Now)
+	book := &Book{Name: "Book 1"}
+	books.Create(ctx, book)
+	book.Name = "Book One"
+	if err := books.Update(ctx, book, AnyVersion); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := history.Find(ctx, "books", book.ID)
+	if len(entries) != 2 {
+		t.Fatalf("Incorrect number of entries - Expected %d, found %d", 2, len(entries))
+	}
+	var before Book
+	json.Unmarshal(entries[1].Before, &before)
+	if before.Version != 2 || before.Year != 2016 {
+		t.Errorf("Expected the raced write as before, found %+v", before)
+	}
+}
+
+// cancelingBookRepository cancels the request right after each write, as a
+// client going away between the write and its history would
+type cancelingBookRepository struct {
+	BookRepository
+	cancel context.CancelFunc
+}
+
+func (repo *cancelingBookRepository) Create(ctx context.Context, book *Book) error {
+	defer repo.cancel()
+	return repo.BookRepository.Create(ctx, book)
+}
+
+type failingHistoryRepository struct {
+	HistoryRepository
+}
+
+func (failingHistoryRepository) Append(ctx context.Context, entry *HistoryEntry) error {
+	return errors.New("disk full")
+}
+
+// A stored write is recorded, and published, even when its request ends
+func TestAuditingRecordsAfterTheClientLeft(t *testing.T) {
+	history := NewMemoryBackedHistoryRepository()
+	events := NewEventBroker(eventBacklog)
+	_, sub, _ := events.Subscribe(0)
+	requestCtx, cancel := context.WithCancel(ctx)
+	inner := &cancelingBookRepository{NewMemoryBackedBookRepository(), cancel}
+	books, _ := NewAuditingRepositories(inner, NewMemoryBackedAuthorRepository(), NewPublishingHistoryRepository(history, events), time.Now)
+	book := &Book{Name: "Book 1"}
+	if err := books.Create(requestCtx, book); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := history.Find(ctx, "books", book.ID); len(entries) != 1 {
+		t.Errorf("Incorrect number of entries - Expected %d, found %d", 1, len(entries))
+	}
+	select {
+	case event := <-sub.events:
+		if event.Table != "books" || event.Action != "INSERT" {
+			t.Errorf("Unexpected event %+v", event)
+		}
+	default:
+		t.Error("Expected the write to be published")
+	}
+}
+
+// A history which fails doesn't turn a stored write into an error
+func TestAuditingKeepsWritesWhenTheHistoryFails(t *testing.T) {
+	inner := NewMemoryBackedBookRepository()
+	books, _ := NewAuditingRepositories(inner, NewMemoryBackedAuthorRepository(), failingHistoryRepository{NewMemoryBackedHistoryRepository()}, time.Now)
+	book := &Book{Name: "Book 1"}
+	if err := books.Create(ctx, book); err != nil {
+		t.Fatal(err)
+	}
+	book.Name = "Book One"
+	if err := books.Update(ctx, book, AnyVersion); err != nil {
+		t.Fatal(err)
+	}
+	if err := books.Delete(ctx, book.ID, AnyVersion); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inner.GetDeletedByID(ctx, book.ID); err != nil {
+		t.Errorf("Expected the book to be deleted, found %v", err)
+	}
+}
+
+func TestHistorySurvivesRestart(t *testing.T) {
+	backends := []struct {
+		name string
+		open func(t *testing.T, dir string) (HistoryRepository, func())
+	}{
+		{"persistent memory", func(t *testing.T, dir string) (HistoryRepository, func()) {
+			_, _, p := openTestPersistence(t, dir, PersistenceOptions{Fsync: FsyncNever, SnapshotEvery: 2})
+			return p.History(), func() { p.Close() }
+		}},
+		{"bolt", func(t *testing.T, dir string) (HistoryRepository, func()) {
+			db := openTestBolt(t, filepath.Join(dir, "bookstore.db"))
+			history, err := NewBoltBackedHistoryRepository(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return history, func() { db.Close() }
+		}},
+		{"sqlite", func(t *testing.T, dir string) (HistoryRepository, func()) {
+			db := openTestSQLiteAt(t, filepath.Join(dir, "bookstore.sqlite"))
+			return NewSQLiteBackedHistoryRepository(db), func() { db.Close() }
+		}},
+	}
+	at := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			dir := t.TempDir()
+			history, close := backend.open(t, dir)
+			var written []HistoryEntry
+			for i, action := range []string{HistoryCreate, HistoryUpdate, HistoryDelete} {
+				entry := HistoryEntry{Entity: "books", EntityID: 1, Action: action, Actor: "alice", At: at.Add(time.Duration(i) * time.Minute),
+					Before: json.RawMessage(`null`), After: json.RawMessage(`{"id":1}`)}
+				if err := history.Append(ctx, &entry); err != nil {
+					t.Fatal(err)
+				}
+				written = append(written, entry)
+				// Another entity in between
+				history.Append(ctx, &HistoryEntry{Entity: "authors", EntityID: 1, Action: HistoryCreate, Actor: "bob", At: at,
+					Before: json.RawMessage(`null`), After: json.RawMessage(`{"id":1}`)})
+			}
+			close()
+
+			history, close = backend.open(t, dir)
+			defer close()
+			found, err := history.Find(ctx, "books", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(found) != len(written) {
+				t.Fatalf("Incorrect number of entries - Expected %d, found %d", len(written), len(found))
+			}
+			for i := range written {
+				if found[i].ID != written[i].ID || found[i].Action != written[i].Action || !found[i].At.Equal(written[i].At) ||
+					string(found[i].Before) != "null" || string(found[i].After) != `{"id":1}` {
+					t.Errorf("Incorrect entry - Expected %+v, found %+v", written[i], found[i])
+				}
+			}
+			next := HistoryEntry{Entity: "books", EntityID: 1, Action: HistoryUndelete, Actor: "alice", At: at,
+				Before: json.RawMessage(`null`), After: json.RawMessage(`{"id":1}`)}
+			history.Append(ctx, &next)
+			if next.ID <= written[len(written)-1].ID+1 {
+				t.Errorf("Expected an ID after %d, found %d", written[len(written)-1].ID+1, next.ID)
+			}
+		})
+	}
+}
+
+func TestPersistenceKeepsDeletedEntities(t *testing.T) {
+	dir := t.TempDir()
+	books, _, p := openTestPersistence(t, dir, PersistenceOptions{Fsync: FsyncNever})
+	books.Create(ctx, &Book{Name: "Book 1"})
+	books.Create(ctx, &Book{Name: "Book 2"})
+	books.Delete(ctx, 1, AnyVersion)
+	books.Delete(ctx, 2, AnyVersion)
+	books.Undelete(ctx, 2)
+	expected := stateOf(p)
+	p.Close()
+
+	books, _, p = openTestPersistence(t, dir, PersistenceOptions{Fsync: FsyncNever})
+	defer p.Close()
+	if state := stateOf(p); len(state.DeletedBooks) != 1 || len(state.Books) != 1 || state.Books[0].Version != 2 {
+		t.Errorf("Incorrect state - Expected %+v, found %+v", expected, state)
+	}
+	if _, err := books.Undelete(ctx, 1); err != nil {
+		t.Errorf("Expected the deleted book to survive the restart, found %v", err)
+	}
+}
+
+func TestHistoryEndpoints(t *testing.T) {
+	router := newRouter(newTestAPI())
+	do(router, http.MethodPost, "/authors", strings.NewReader(`{"name":"Author 1"}`))
+	do(router, http.MethodPost, "/books", strings.NewReader(`{"name":"Book 1","authorId":1}`))
+	do(router, http.MethodPatch, "/books/1", strings.NewReader(`{"year":2015}`))
+	if rr := do(router, http.MethodDelete, "/books/1", nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("Invalid code! I want %d but get %d", http.StatusNoContent, rr.Code)
+	}
+	if rr := do(router, http.MethodGet, "/books/1", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Invalid code! I want %d but get %d", http.StatusNotFound, rr.Code)
+	}
+
+	// The history of a deleted book is still there
+	historyOf := func(target string) []HistoryEntry {
+		rr := do(router, http.MethodGet, target, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Invalid code! I want %d but get %d", http.StatusOK, rr.Code)
+		}
+		var entries []HistoryEntry
+		if err := json.Unmarshal(rr.Body.Bytes(), &entries); err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+	entries := historyOf("/books/1/history")
+	if len(entries) != 3 || entries[0].Action != HistoryCreate || entries[1].Action != HistoryUpdate || entries[2].Action != HistoryDelete {
+		t.Fatalf("Expected create, update and delete, found %+v", entries)
+	}
+	if entries[2].Actor != anonymousActor || string(entries[2].After) != "null" || !strings.Contains(string(entries[2].Before), `"year":2015`) {
+		t.Errorf("Incorrect delete entry, found %+v", entries[2])
+	}
+
+	rr := do(router, http.MethodPost, "/v2/books/1/undelete", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Invalid code! I want %d but get %d", http.StatusOK, rr.Code)
+	}
+	if etag := rr.Header().Get("ETag"); etag != `"3"` {
+		t.Errorf("Incorrect ETag - Expected %s, found %s", `"3"`, etag)
+	}
+	if !strings.Contains(rr.Body.String(), `"name":"Author 1"`) {
+		t.Errorf("Expected the v2 shape with the author, found %s", rr.Body)
+	}
+	if rr := do(router, http.MethodPost, "/books/1/undelete", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Invalid code! I want %d but get %d", http.StatusNotFound, rr.Code)
+	}
+	if entries := historyOf("/v1/books/1/history"); len(entries) != 4 || entries[3].Action != HistoryUndelete {
+		t.Errorf("Expected the undelete last, found %+v", entries)
+	}
+	if entries := historyOf("/authors/1/history"); len(entries) != 1 {
+		t.Errorf("Expected the create of the author, found %+v", entries)
+	}
+	if rr := do(router, http.MethodGet, "/authors/2/history", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Invalid code! I want %d but get %d", http.StatusNotFound, rr.Code)
+	}
+}
+
+func TestHistoryRecordsTheActor(t *testing.T) {
+	api := newTestAPI()
+	api.authenticator = NewAuthenticator([]APIKey{{Key: "writer-key", Principal: Principal{Subject: "alice", Scopes: []string{ScopeAuthorsWrite}}}}, nil)
+	router := newRouter(api)
+	req := httptest.NewRequest(http.MethodPost, "/authors", strings.NewReader(`{"name":"Author 1"}`))
+	req.Header.Set("X-API-Key", "writer-key")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	rr := do(router, http.MethodGet, "/authors/1/history", nil)
+	var entries []HistoryEntry
+	json.Unmarshal(rr.Body.Bytes(), &entries)
+	if len(entries) != 1 || entries[0].Actor != "alice" {
+		t.Errorf("Expected the create by alice, found %s", rr.Body)
+	}
+}
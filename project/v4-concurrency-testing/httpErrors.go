@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// APIError is the body of every error response. Code is stable so clients
+// can branch on it, Message is meant for humans.
+type APIError struct {
+	Status  int          `json:"-"`
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Details []FieldError `json:"details,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+var (
+	errUnreadableBody = &APIError{Status: http.StatusBadRequest, Code: "bad_request", Message: "Unable to parse request body"}
+	errInvalidPathID  = &APIError{Status: http.StatusNotFound, Code: "not_found", Message: "Invalid ID in path"}
+)
+
+// badRequest reports a malformed request, field is the offending parameter
+func badRequest(field, message string) *APIError {
+	return &APIError{
+		Status:  http.StatusBadRequest,
+		Code:    "bad_request",
+		Message: "Invalid " + field,
+		Details: []FieldError{{field, message}},
+	}
+}
+
+// invalidEntity reports a body which parsed fine but can't be stored
+func invalidEntity(message string, fields ...FieldError) *RepositoryError {
+	return &RepositoryError{Kind: ErrInvalid, Message: message, Fields: fields}
+}
+
+// toAPIError maps repository errors to their status code, anything unknown
+// is a failure on our side and its message is not shown to the client.
+func toAPIError(err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	response := &APIError{Message: err.Error()}
+	var repoErr *RepositoryError
+	if errors.As(err, &repoErr) {
+		response.Details = repoErr.Fields
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		response.Status, response.Code, response.Message = http.StatusServiceUnavailable, "timeout", "Request timed out"
+	case errors.Is(err, ErrNotFound):
+		response.Status, response.Code = http.StatusNotFound, "not_found"
+	case errors.Is(err, ErrDuplicate):
+		response.Status, response.Code = http.StatusConflict, "duplicate"
+	case errors.Is(err, ErrConstraint):
+		response.Status, response.Code = http.StatusConflict, "conflict"
+	case errors.Is(err, ErrInvalid):
+		response.Status, response.Code = http.StatusUnprocessableEntity, "invalid"
+	case errors.Is(err, ErrConflict):
+		response.Status, response.Code = http.StatusPreconditionFailed, "precondition_failed"
+	default:
+		log.Printf("internal error: %v", err)
+		response = &APIError{Status: http.StatusInternalServerError, Code: "internal", Message: "Internal server error"}
+	}
+	return response
+}
+
+// writeError responds with the JSON envelope of err. A canceled context means
+// the client went away, there is nobody left to respond to.
+func writeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	response := toAPIError(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(response.Status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// subresourceHandlers dispatches the routes sharing a ServeMux pattern, like
+// /books/{id} and /books/{id}/history, on what follows the ID. The route
+// without suffix serves everything else.
+type subresourceHandlers map[string]http.Handler
+
+func (s subresourceHandlers) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for suffix, handler := range s {
+		if suffix != "" && strings.HasSuffix(r.URL.Path, suffix) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+	}
+	s[""].ServeHTTP(w, r)
+}
+
+// methodHandlers dispatches a route on the request method, other methods
+// get a 405 with the Allow header listing the ones we serve.
+type methodHandlers map[string]http.HandlerFunc
+
+func (m methodHandlers) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if handler, ok := m[r.Method]; ok {
+		handler(w, r)
+		return
+	}
+	allowed := make([]string, 0, len(m))
+	for method := range m {
+		allowed = append(allowed, method)
+	}
+	sort.Strings(allowed)
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, &APIError{Status: http.StatusMethodNotAllowed, Code: "method_not_allowed", Message: "Invalid request method."})
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Formats of /import and /export, both carry one ImportRow per line
+const (
+	csvMediaType    = "text/csv"
+	ndjsonMediaType = "application/x-ndjson"
+)
+
+var catalogMediaTypes = []string{csvMediaType, ndjsonMediaType}
+
+// csvHeader is the first line of a CSV file, the columns may come in any order
+var csvHeader = []string{"type", "name", "author", "isbn", "year", "genres"}
+
+// ImportRow is an author or a book, books reference their author by name so
+// a catalog can be moved between backends which number things differently.
+// The fields after Author only apply to books too, the zero value is unset.
+type ImportRow struct {
+	Type   string `json:"type"` // author or book
+	Name   string `json:"name"`
+	Author string `json:"author,omitempty"` // empty means no author, see listSeparator
+	ISBN   string `json:"isbn,omitempty"`
+	Year   int    `json:"year,omitempty"`
+	Genres string `json:"genres,omitempty"` // see listSeparator
+}
+
+// csvRecord is row in the columns of csvHeader
+func (row ImportRow) csvRecord() []string {
+	year := ""
+	if row.Year != 0 {
+		year = strconv.Itoa(row.Year)
+	}
+	return []string{row.Type, row.Name, row.Author, row.ISBN, year, row.Genres}
+}
+
+// listSeparator separates the names of co-authors in ImportRow.Author and
+// the genres in ImportRow.Genres, a value containing it or listEscape has
+// them escaped with listEscape
+const (
+	listSeparator = ';'
+	listEscape    = '\\'
+)
+
+var listEscaper = strings.NewReplacer(string(listEscape), string(listEscape)+string(listEscape),
+	string(listSeparator), string(listEscape)+string(listSeparator))
+
+// joinList builds ImportRow.Author or ImportRow.Genres from values
+func joinList(values []string) string {
+	escaped := make([]string, len(values))
+	for i, value := range values {
+		escaped[i] = listEscaper.Replace(value)
+	}
+	return strings.Join(escaped, string(listSeparator)+" ")
+}
+
+// splitList reads the values of ImportRow.Author or ImportRow.Genres, blank
+// ones are left out
+func splitList(value string) []string {
+	var names []string
+	var name strings.Builder
+	cut := func() {
+		if trimmed := strings.TrimSpace(name.String()); trimmed != "" {
+			names = append(names, trimmed)
+		}
+		name.Reset()
+	}
+	escaped := false
+	for _, r := range value {
+		switch {
+		case escaped:
+			name.WriteRune(r)
+			escaped = false
+		case r == listEscape:
+			escaped = true
+		case r == listSeparator:
+			cut()
+		default:
+			name.WriteRune(r)
+		}
+	}
+	cut()
+	return names
+}
+
+// ImportReport sums up an import. Rows already in the catalog are unchanged,
+// books with other authors, ISBN, year or genres are updated. Errors lists the first
+// maxImportErrors failed rows, Failed counts all of them.
+type ImportReport struct {
+	DryRun    bool          `json:"dryRun"`
+	Created   int           `json:"created"`
+	Updated   int           `json:"updated"`
+	Unchanged int           `json:"unchanged"`
+	Failed    int           `json:"failed"`
+	Errors    []ImportError `json:"errors"`
+}
+
+// ImportError is the error of one row, Line counts from 1 and includes the CSV header
+type ImportError struct {
+	Line int `json:"line"`
+	APIError
+}
+
+const maxImportErrors = 100
+
+// Import reads a CSV or NDJSON stream of authors and books, the format comes
+// from Content-Type or format=csv|ndjson. Bad rows are reported and skipped,
+// with dryRun=true nothing is written but the report is the same.
+func (h *Handler) Import(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	format, err := catalogFormat(query.Get("format"), r.Header.Get("Content-Type"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	dryRun := false
+	if value := query.Get("dryRun"); value != "" {
+		if dryRun, err = strconv.ParseBool(value); err != nil {
+			writeError(w, badRequest("dryRun", "must be true or false"))
+			return
+		}
+	}
+	importer, err := newCatalogImporter(r.Context(), h.bookRepository, h.authorRepository, dryRun)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if format == csvMediaType {
+		err = readCSVRows(r.Body, importer.add)
+	} else {
+		err = readNDJSONRows(r.Body, importer.add)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(importer.report)
+}
+
+// catalogFormat picks the media type from the format parameter, falling back
+// to header which is a Content-Type or an Accept header.
+func catalogFormat(format, header string) (string, error) {
+	switch format {
+	case "csv":
+		return csvMediaType, nil
+	case "ndjson":
+		return ndjsonMediaType, nil
+	case "":
+	default:
+		return "", badRequest("format", "must be csv or ndjson")
+	}
+	for _, accepted := range strings.Split(header, ",") {
+		mediaType, _, _ := mime.ParseMediaType(strings.TrimSpace(accepted))
+		switch mediaType {
+		case csvMediaType:
+			return csvMediaType, nil
+		case ndjsonMediaType, "application/ndjson":
+			return ndjsonMediaType, nil
+		}
+	}
+	return "", &APIError{
+		Status:  http.StatusUnsupportedMediaType,
+		Code:    "unsupported_media_type",
+		Message: "Use " + strings.Join(catalogMediaTypes, " or ") + ", or set format",
+	}
+}
+
+// readCSVRows calls add for each record after the header. A malformed record
+// is passed on as a row error, add decides whether to go on.
+func readCSVRows(body io.Reader, add func(line int, row ImportRow, err error) error) error {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return badRequest("body", err.Error())
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	for _, name := range csvHeader[:2] {
+		if _, ok := columns[name]; !ok {
+			return badRequest("body", fmt.Sprintf("the CSV header has no %s column", name))
+		}
+	}
+	column := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		// FieldPos only knows the fields of a record read without error
+		var line int
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			err = invalidEntity(parseErr.Err.Error())
+			line = parseErr.Line
+		} else if err != nil {
+			return err
+		} else {
+			line, _ = reader.FieldPos(0)
+		}
+		row := ImportRow{Type: column(record, "type"), Name: column(record, "name"), Author: column(record, "author"),
+			ISBN: column(record, "isbn"), Genres: column(record, "genres")}
+		if year := column(record, "year"); year != "" && err == nil {
+			if row.Year, err = strconv.Atoi(year); err != nil {
+				err = invalidEntity(fmt.Sprintf("Year %q is not a number", year), FieldError{"year", "must be a number"})
+			}
+		}
+		if err := add(line, row, err); err != nil {
+			return err
+		}
+	}
+}
+
+// readNDJSONRows calls add for each non blank line
+func readNDJSONRows(body io.Reader, add func(line int, row ImportRow, err error) error) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var row ImportRow
+		var err error
+		if json.Unmarshal([]byte(text), &row) != nil {
+			err = invalidEntity("Unable to parse the line as JSON")
+		}
+		if err := add(line, row, err); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return badRequest("body", err.Error())
+	}
+	return nil
+}
+
+// catalogImporter applies rows through the repositories, it keeps the names
+// it has seen so books can reference authors created earlier in the file,
+// which also works in a dry run where nothing is created.
+type catalogImporter struct {
+	ctx       context.Context
+	books     BookRepository
+	authors   AuthorRepository
+	dryRun    bool
+	authorIDs map[string]int
+	bookNames map[string]Book
+	dryRunID  int // the last one handed out instead of a real ID, above those of the catalog so they never clash
+	report    *ImportReport
+}
+
+func newCatalogImporter(ctx context.Context, bookRepository BookRepository, authorRepository AuthorRepository, dryRun bool) (*catalogImporter, error) {
+	books, authors, err := fetchCatalog(ctx, bookRepository, authorRepository)
+	if err != nil {
+		return nil, err
+	}
+	importer := &catalogImporter{
+		ctx:       ctx,
+		books:     bookRepository,
+		authors:   authorRepository,
+		dryRun:    dryRun,
+		authorIDs: make(map[string]int, len(authors)),
+		bookNames: make(map[string]Book, len(books)),
+		report:    &ImportReport{DryRun: dryRun, Errors: []ImportError{}},
+	}
+	for _, author := range authors {
+		importer.authorIDs[author.Name] = author.ID
+		if author.ID > importer.dryRunID {
+			importer.dryRunID = author.ID
+		}
+	}
+	for _, book := range books {
+		importer.bookNames[book.Name] = book
+		if book.ID > importer.dryRunID {
+			importer.dryRunID = book.ID
+		}
+	}
+	return importer, nil
+}
+
+// add imports one row, rowErr is set when the row could not be read. Only
+// failures of the import itself are returned, a bad row is reported.
+func (i *catalogImporter) add(line int, row ImportRow, rowErr error) error {
+	if rowErr == nil {
+		rowErr = i.apply(row)
+	}
+	if rowErr == nil {
+		return nil
+	}
+	// A version conflict means the row lost a race with another write, it
+	// failed like an invalid one and the rows after it can still go in
+	var repoErr *RepositoryError
+	var conflict *ConflictError
+	if !errors.As(rowErr, &repoErr) && !errors.As(rowErr, &conflict) {
+		return rowErr
+	}
+	i.report.Failed++
+	if len(i.report.Errors) < maxImportErrors {
+		i.report.Errors = append(i.report.Errors, ImportError{Line: line, APIError: *toAPIError(rowErr)})
+	}
+	return nil
+}
+
+func (i *catalogImporter) apply(row ImportRow) error {
+	if row.Name == "" {
+		return invalidEntity("Name cannot be empty", FieldError{"name", "cannot be empty"})
+	}
+	switch row.Type {
+	case "author":
+		var fields []FieldError
+		for _, f := range []struct {
+			name string
+			set  bool
+		}{{"author", row.Author != ""}, {"isbn", row.ISBN != ""}, {"year", row.Year != 0}, {"genres", row.Genres != ""}} {
+			if f.set {
+				fields = append(fields, FieldError{f.name, "must be empty for authors"})
+			}
+		}
+		if len(fields) > 0 {
+			return invalidEntity("Only books have an author, an ISBN, a year or genres", fields...)
+		}
+		return i.applyAuthor(row)
+	case "book":
+		return i.applyBook(row)
+	}
+	return invalidEntity(fmt.Sprintf("Unknown type %q", row.Type), FieldError{"type", "must be author or book"})
+}
+
+func (i *catalogImporter) applyAuthor(row ImportRow) error {
+	if _, ok := i.authorIDs[row.Name]; ok {
+		i.report.Unchanged++
+		return nil
+	}
+	author := &Author{Name: row.Name}
+	if err := i.create(func() error { return i.authors.Create(i.ctx, author) }, &author.ID); err != nil {
+		return err
+	}
+	i.authorIDs[author.Name] = author.ID
+	i.report.Created++
+	return nil
+}
+
+func (i *catalogImporter) applyBook(row ImportRow) error {
+	var authorIDs []int
+	for _, name := range splitList(row.Author) {
+		authorID, ok := i.authorIDs[name]
+		if !ok {
+			return invalidEntity(fmt.Sprintf("Author %q does not exist", name), FieldError{"author", "does not name an existing author"})
+		}
+		authorIDs = append(authorIDs, authorID)
+	}
+	// Checked first, so the row is compared once normalized
+	imported := Book{Name: row.Name, AuthorIDs: authorIDs, ISBN: row.ISBN, Year: row.Year, Genres: splitList(row.Genres)}
+	if err := validateBook(&imported); err != nil {
+		return err
+	}
+	book, ok := i.bookNames[row.Name]
+	switch {
+	case ok && sameAuthors(book.AuthorIDs, imported.AuthorIDs) && book.ISBN == imported.ISBN &&
+		book.Year == imported.Year && sameGenres(book.Genres, imported.Genres):
+		i.report.Unchanged++
+		return nil
+	case ok:
+		book.AuthorIDs, book.ISBN, book.Year, book.Genres = imported.AuthorIDs, imported.ISBN, imported.Year, imported.Genres
+		if !i.dryRun {
+			if err := i.books.Update(i.ctx, &book, book.Version); err != nil {
+				return err
+			}
+		}
+		i.report.Updated++
+	default:
+		book = imported
+		if err := i.create(func() error { return i.books.Create(i.ctx, &book) }, &book.ID); err != nil {
+			return err
+		}
+		i.report.Created++
+	}
+	i.bookNames[book.Name] = book
+	return nil
+}
+
+// create runs the repository call or, in a dry run, makes up the ID
+func (i *catalogImporter) create(fn func() error, id *int) error {
+	if i.dryRun {
+		i.dryRunID++
+		*id = i.dryRunID
+		return nil
+	}
+	return fn()
+}
+
+// exportBatchSize is how many entities are read from the repository at a time
+const exportBatchSize = 500
+
+// Export streams every author followed by every book in the format of Import,
+// chosen by format=csv|ndjson or the Accept header. NDJSON is the default.
+func (h *Handler) Export(w http.ResponseWriter, r *http.Request) {
+	format, err := catalogFormat(r.URL.Query().Get("format"), r.Header.Get("Accept"))
+	if apiErr, ok := err.(*APIError); ok && apiErr.Status == http.StatusUnsupportedMediaType {
+		format, err = ndjsonMediaType, nil
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var write func(ImportRow) error
+	var flush func()
+	var writer *csv.Writer
+	if format == csvMediaType {
+		writer = csv.NewWriter(w)
+		write = func(row ImportRow) error { return writer.Write(row.csvRecord()) }
+		flush = writer.Flush
+	} else {
+		encoder := json.NewEncoder(w)
+		write = func(row ImportRow) error { return encoder.Encode(row) }
+		flush = func() {}
+	}
+	if flusher, ok := w.(http.Flusher); ok {
+		flushWriter := flush
+		flush = func() {
+			flushWriter()
+			flusher.Flush()
+		}
+	}
+
+	// Until the first batch is written the status can still tell about errors
+	started := false
+	fail := func(err error) {
+		if !started {
+			writeError(w, err)
+			return
+		}
+		if !errors.Is(err, context.Canceled) {
+			log.Printf("export aborted: %v", err)
+		}
+	}
+	begin := func() {
+		if started {
+			return
+		}
+		started = true
+		w.Header().Set("Content-Type", format)
+		if writer != nil {
+			writer.Write(csvHeader)
+		}
+	}
+
+	// Both listings are paged by ID rather than by offset, rows written during
+	// the export don't shift the pages so none is skipped or sent twice
+	ctx := r.Context()
+	names := make(map[int]string)
+	writeAuthor := func(author Author) error {
+		names[author.ID] = author.Name
+		return write(ImportRow{Type: "author", Name: author.Name})
+	}
+	for afterID := 0; ; {
+		authors, _, err := h.authorRepository.Find(ctx, QueryOptions{Limit: exportBatchSize, AfterID: afterID})
+		if err != nil {
+			fail(err)
+			return
+		}
+		begin()
+		for _, author := range authors {
+			if err := writeAuthor(author); err != nil {
+				return
+			}
+			afterID = author.ID
+		}
+		flush()
+		if len(authors) < exportBatchSize {
+			break
+		}
+	}
+	for afterID := 0; ; {
+		books, _, err := h.bookRepository.Find(ctx, QueryOptions{Limit: exportBatchSize, AfterID: afterID})
+		if err != nil {
+			fail(err)
+			return
+		}
+		for _, book := range books {
+			authors := make([]string, 0, len(book.AuthorIDs))
+			for _, id := range book.AuthorIDs {
+				if _, ok := names[id]; !ok {
+					// Created since the authors were sent, it comes before its book
+					author, err := h.authorRepository.GetByID(ctx, id)
+					if errors.Is(err, ErrNotFound) {
+						continue
+					}
+					if err != nil {
+						fail(err)
+						return
+					}
+					if err := writeAuthor(*author); err != nil {
+						return
+					}
+				}
+				authors = append(authors, names[id])
+			}
+			row := ImportRow{Type: "book", Name: book.Name, Author: joinList(authors), ISBN: book.ISBN, Year: book.Year, Genres: joinList(book.Genres)}
+			if err := write(row); err != nil {
+				return
+			}
+			afterID = book.ID
+		}
+		flush()
+		if len(books) < exportBatchSize {
+			break
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func importCatalog(t *testing.T, router http.Handler, target, contentType, body string) ImportReport {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Invalid code! I want %d but get %d: %s", http.StatusOK, rr.Code, rr.Body)
+	}
+	var report ImportReport
+	json.NewDecoder(rr.Body).Decode(&report)
+	return report
+}
+
+func errorLines(report ImportReport) []int {
+	lines := []int{}
+	for _, e := range report.Errors {
+		lines = append(lines, e.Line)
+	}
+	return lines
+}
+
+const testCatalogCSV = `type,name,author
+author,Alan Donovan,
+book,The Go Programming Language,Alan Donovan
+book,Go in Action,William Kennedy
+author,William Kennedy
+book,Go in Action,William Kennedy
+magazine,Go Weekly,
+book,,Alan Donovan
+book,"Unterminated,
+`
+
+func TestImportCSV(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, books BookRepository, authors AuthorRepository) {
+		api, err := newAPI(ctx, books, authors, NewMemoryBackedHistoryRepository(), DeleteRestrict, WebhookOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		router := newRouter(api)
+
+		report := importCatalog(t, router, "/import?dryRun=true", "text/csv; charset=utf-8", testCatalogCSV)
+		if !report.DryRun || report.Created != 4 || report.Failed != 4 {
+			t.Errorf("Unexpected dry run report %+v", report)
+		}
+		if all, _ := api.authorRepository.GetAll(ctx); len(all) != 0 {
+			t.Errorf("Expected the dry run to write nothing, found %v", all)
+		}
+
+		report = importCatalog(t, router, "/import", "text/csv", testCatalogCSV)
+		if report.DryRun || report.Created != 4 || report.Updated != 0 || report.Unchanged != 0 || report.Failed != 4 {
+			t.Errorf("Unexpected report %+v", report)
+		}
+		// The book comes before its author, then the type, the name and the quote are wrong
+		if lines := errorLines(report); !reflect.DeepEqual(lines, []int{4, 7, 8, 9}) {
+			t.Errorf("Incorrect error lines - Expected %v, found %v", []int{4, 7, 8, 9}, lines)
+		}
+		if report.Errors[0].Code != "invalid" || report.Errors[0].Details[0].Field != "author" {
+			t.Errorf("Unexpected error %+v", report.Errors[0])
+		}
+
+		rr := do(router, http.MethodGet, "/books-authors", nil)
+		var combined []CombinedResponse
+		json.NewDecoder(rr.Body).Decode(&combined)
+		if len(combined) != 2 || combined[1].Name != "Go in Action" || combined[1].AuthorDetails.Name != "William Kennedy" {
+			t.Errorf("Unexpected catalog %+v", combined)
+		}
+
+		// Importing again changes nothing, moving a book updates it
+		report = importCatalog(t, router, "/import", "text/csv", "name,type,author\nAlan Donovan,author\nGo in Action,book,Alan Donovan\n")
+		if report.Created != 0 || report.Updated != 1 || report.Unchanged != 1 || report.Failed != 0 {
+			t.Errorf("Unexpected report %+v", report)
+		}
+		book, _ := api.bookRepository.GetByID(ctx, combined[1].ID)
+		if !sameAuthors(book.AuthorIDs, []int{combined[0].AuthorDetails.ID}) {
+			t.Errorf("Incorrect author - Expected %d, found %v", combined[0].AuthorDetails.ID, book.AuthorIDs)
+		}
+	})
+}
+
+// A malformed first field is a bad row too
+func TestImportMalformedCSV(t *testing.T) {
+	router := newRouter(newTestAPI())
+	body := "type,name,author\nauthor,Author 1\nbo\"ok,Book 1,Author 1\nbook,Book 2,Author 1\n\"book,Book 3\n"
+	report := importCatalog(t, router, "/import", "text/csv", body)
+	if report.Created != 2 || report.Failed != 2 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	if lines := errorLines(report); !reflect.DeepEqual(lines, []int{3, 5}) {
+		t.Errorf("Incorrect error lines - Expected %v, found %v", []int{3, 5}, lines)
+	}
+}
+
+// The books of a file are checked like those sent to /books
+func TestImportValidatesBooks(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, books BookRepository, authors AuthorRepository) {
+		api, err := newAPI(ctx, books, authors, NewMemoryBackedHistoryRepository(), DeleteRestrict, WebhookOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		router := newRouter(api)
+		body := `{"type":"author","name":"Author 1"}
+{"type":"book","name":"Book 1","author":"Author 1"}
+{"type":"book","name":"Book 2","author":"Author 1; Author 1"}
+{"type":"book","name":"Book 1","author":"Author 1;Author 1"}
+`
+		report := importCatalog(t, router, "/import?format=ndjson", "", body)
+		if report.Created != 2 || report.Failed != 2 {
+			t.Errorf("Unexpected report %+v", report)
+		}
+		if lines := errorLines(report); !reflect.DeepEqual(lines, []int{3, 4}) {
+			t.Errorf("Incorrect error lines - Expected %v, found %v", []int{3, 4}, lines)
+		}
+		for _, e := range report.Errors {
+			if e.Code != "invalid" || len(e.Details) != 1 || e.Details[0].Field != "authorIds" {
+				t.Errorf("Unexpected error %+v", e)
+			}
+		}
+		book, _ := api.bookRepository.GetByID(ctx, 1)
+		if book == nil || len(book.AuthorIDs) != 1 {
+			t.Errorf("Expected Book 1 by one author, found %+v", book)
+		}
+	})
+}
+
+func TestImportNDJSON(t *testing.T) {
+	router := newRouter(newTestAPI())
+	body := `{"type":"author","name":"Author 1"}
+
+{"type":"book","name":"Book 1","author":"Author 1"}
+{"type":"book",
+{"type":"author","name":"Author 2","author":"Author 1"}
+{"type":"book","name":"Book 2"}
+`
+	report := importCatalog(t, router, "/import?format=ndjson", "text/plain", body)
+	if report.Created != 3 || report.Failed != 2 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	if lines := errorLines(report); !reflect.DeepEqual(lines, []int{4, 5}) {
+		t.Errorf("Incorrect error lines - Expected %v, found %v", []int{4, 5}, lines)
+	}
+
+	for _, c := range []struct {
+		target, contentType string
+		code                int
+	}{
+		{"/import", "application/json", http.StatusUnsupportedMediaType},
+		{"/import?format=xml", "text/csv", http.StatusBadRequest},
+		{"/import?dryRun=maybe", "text/csv", http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest(http.MethodPost, c.target, strings.NewReader(""))
+		req.Header.Set("Content-Type", c.contentType)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != c.code {
+			t.Errorf("Invalid code for %s! I want %d but get %d", c.target, c.code, rr.Code)
+		}
+	}
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	source := newRouter(newTestAPI())
+	importCatalog(t, source, "/import", "text/csv", testCatalogCSV)
+	importCatalog(t, source, "/import", "application/x-ndjson", `{"type":"book","name":"Orphan"}`)
+	// The separator and the escape can be part of a name
+	importCatalog(t, source, "/import", "application/x-ndjson", `{"type":"author","name":"Kernighan; Ritchie \\ Co"}
+{"type":"book","name":"The C Programming Language","author":"Kernighan\\; Ritchie \\\\ Co; Alan Donovan"}
+{"type":"book","name":"The Go Programming Language","author":"Alan Donovan","isbn":"978-0134190440","year":2015,"genres":"Programming; Go"}`)
+
+	for _, format := range []string{"csv", "ndjson"} {
+		req := httptest.NewRequest(http.MethodGet, "/export", nil)
+		req.Header.Set("Accept", "text/html, "+map[string]string{"csv": csvMediaType, "ndjson": ndjsonMediaType}[format])
+		rr := httptest.NewRecorder()
+		source.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Invalid code! I want %d but get %d", http.StatusOK, rr.Code)
+		}
+		if format == "csv" && !strings.HasPrefix(rr.Body.String(), "type,name,author,isbn,year,genres\nauthor,Alan Donovan,,,,\n") {
+			t.Errorf("Unexpected CSV export %q", rr.Body)
+		}
+
+		db := openTestSQLite(t)
+		target := newRouter(&Handler{
+			bookRepository:     NewSQLiteBackedBookRepository(db),
+			authorRepository:   NewSQLiteBackedAuthorRepository(db),
+			combinationService: NewCombinationService(),
+		})
+		report := importCatalog(t, target, "/import?format="+format, "", rr.Body.String())
+		if report.Created != 7 || report.Failed != 0 {
+			t.Errorf("Unexpected %s report %+v", format, report)
+		}
+		for _, listing := range []string{"/books-authors?join=left", "/v2/books?fields=name,isbn,year,genres"} {
+			expected := do(source, http.MethodGet, listing, nil).Body.String()
+			if found := do(target, http.MethodGet, listing, nil).Body.String(); found != expected {
+				t.Errorf("Incorrect %s round trip of %s - Expected %s, found %s", format, listing, expected, found)
+			}
+		}
+		// Nothing is left to change once imported
+		if report := importCatalog(t, target, "/import?format="+format, "", rr.Body.String()); report.Unchanged != 7 || report.Updated != 0 {
+			t.Errorf("Unexpected %s report of the second import %+v", format, report)
+		}
+	}
+}
+
+func TestImportBookFields(t *testing.T) {
+	router := newRouter(newTestAPI())
+	body := `type,genres,name,year,isbn
+author,,Author 1,,
+book,Go; Programming,Book 1,2015,0-306-40615-2
+book,,Book 2,soon,
+author,,Author 2,,0306406152
+book,,Book 3,,0-306-40615-3
+`
+	report := importCatalog(t, router, "/import", "text/csv", body)
+	if report.Created != 2 || report.Failed != 3 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	fields := []string{}
+	for _, e := range report.Errors {
+		fields = append(fields, e.Details[0].Field)
+	}
+	if expected := []string{"year", "isbn", "isbn"}; !reflect.DeepEqual(fields, expected) {
+		t.Errorf("Incorrect fields - Expected %v, found %v", expected, fields)
+	}
+	if body := do(router, http.MethodGet, "/v2/books/1?fields=isbn,year,genres", nil).Body.String(); body != `{"genres":["Go","Programming"],"isbn":"0306406152","year":2015}`+"\n" {
+		t.Errorf("Incorrect book, found %s", body)
+	}
+
+	// The same book in another spelling is unchanged, another year updates it
+	report = importCatalog(t, router, "/import", "text/csv", "type,name,isbn,year,genres\nbook,Book 1,0306406152,2015,Go;Programming\n")
+	if report.Unchanged != 1 || report.Updated != 0 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	report = importCatalog(t, router, "/import", "text/csv", "type,name,isbn,year,genres\nbook,Book 1,0306406152,2016,Go;Programming\n")
+	if report.Unchanged != 0 || report.Updated != 1 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+}
+
+func TestImportEscapedLists(t *testing.T) {
+	cases := map[string][]string{
+		"":              nil,
+		"Alan Donovan":  {"Alan Donovan"},
+		" A ; ;B;":      {"A", "B"},
+		`A\; B; C \\ D`: {"A; B", `C \ D`},
+		`A\`:            {"A"},
+	}
+	for value, expected := range cases {
+		if names := splitList(value); !reflect.DeepEqual(names, expected) {
+			t.Errorf("Incorrect names of %q - Expected %q, found %q", value, expected, names)
+		}
+	}
+	names := []string{"A; B", `C \ D`, "E"}
+	if joined := joinList(names); joined != `A\; B; C \\ D; E` || !reflect.DeepEqual(splitList(joined), names) {
+		t.Errorf("Incorrect round trip of %q, found %q", names, joined)
+	}
+}
+
+// A row losing a race with another write is reported, the rows after it go in
+func TestImportReportsConflicts(t *testing.T) {
+	books, authors := NewMemoryBackedBookRepository(), NewMemoryBackedAuthorRepository()
+	first, second := &Author{Name: "Author 1"}, &Author{Name: "Author 2"}
+	authors.Create(ctx, first)
+	authors.Create(ctx, second)
+	book := &Book{Name: "Book 1", AuthorIDs: []int{first.ID}}
+	books.Create(ctx, book)
+
+	importer, err := newCatalogImporter(ctx, books, authors, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Written after the importer read the catalog
+	books.Update(ctx, book, AnyVersion)
+	body := `{"type":"book","name":"Book 1","author":"Author 2"}
+{"type":"book","name":"Book 2","author":"Author 1"}`
+	if err := readNDJSONRows(strings.NewReader(body), importer.add); err != nil {
+		t.Fatal(err)
+	}
+	report := importer.report
+	if report.Created != 1 || report.Failed != 1 || report.Errors[0].Line != 1 || report.Errors[0].Code != "precondition_failed" {
+		t.Errorf("Unexpected report %+v", report)
+	}
+}
+
+// writingBookRepository changes the catalog after the first page of books
+// was read, as other clients would during a long export
+type writingBookRepository struct {
+	BookRepository
+	authors AuthorRepository
+	once    sync.Once
+}
+
+func (repo *writingBookRepository) Find(ctx context.Context, opts QueryOptions) ([]Book, int, error) {
+	books, total, err := repo.BookRepository.Find(ctx, opts)
+	repo.once.Do(func() {
+		repo.BookRepository.Delete(ctx, books[0].ID, AnyVersion)
+		author := &Author{Name: "Late Author"}
+		repo.authors.Create(ctx, author)
+		repo.BookRepository.Create(ctx, &Book{Name: "Late Book", AuthorIDs: []int{author.ID}})
+	})
+	return books, total, err
+}
+
+func TestExportDuringWrites(t *testing.T) {
+	books, authors := NewMemoryBackedBookRepository(), NewMemoryBackedAuthorRepository()
+	author := &Author{Name: "Author 1"}
+	authors.Create(ctx, author)
+	count := exportBatchSize + 10
+	for i := 1; i <= count; i++ {
+		books.Create(ctx, &Book{Name: fmt.Sprintf("Book %d", i), AuthorIDs: []int{author.ID}})
+	}
+	router := newRouter(&Handler{
+		bookRepository:     &writingBookRepository{BookRepository: books, authors: authors},
+		authorRepository:   authors,
+		combinationService: NewCombinationService(),
+	})
+
+	rr := do(router, http.MethodGet, "/export?format=ndjson", nil)
+	seen := make(map[string]int)
+	var late []string
+	decoder := json.NewDecoder(rr.Body)
+	for decoder.More() {
+		var row ImportRow
+		if err := decoder.Decode(&row); err != nil {
+			t.Fatal(err)
+		}
+		seen[row.Name]++
+		if strings.HasPrefix(row.Name, "Late") {
+			late = append(late, row.Type+" "+row.Name+" "+row.Author)
+		}
+	}
+	// Every book that was there throughout is sent once
+	for i := 1; i <= count; i++ {
+		if name := fmt.Sprintf("Book %d", i); seen[name] != 1 {
+			t.Errorf("Expected %s once, found it %d times", name, seen[name])
+		}
+	}
+	// The author of a new book is sent before it
+	if expected := []string{"author Late Author ", "book Late Book Late Author"}; !reflect.DeepEqual(late, expected) {
+		t.Errorf("Incorrect rows - Expected %q, found %q", expected, late)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// DeletePolicy decides what happens to the books of an author being deleted
+type DeletePolicy string
+
+const (
+	// DeleteRestrict refuses to delete an author who still has books
+	DeleteRestrict DeletePolicy = "restrict"
+	// DeleteCascade deletes the books together with their author, the books
+	// with co-authors only lose the author
+	DeleteCascade DeletePolicy = "cascade"
+	// DeleteNullify keeps the books but takes the author off them
+	DeleteNullify DeletePolicy = "nullify"
+)
+
+// ParseDeletePolicy validates a policy read from configuration
+func ParseDeletePolicy(value string) (DeletePolicy, error) {
+	switch policy := DeletePolicy(value); policy {
+	case DeleteRestrict, DeleteCascade, DeleteNullify:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown delete policy %q, use restrict, cascade or nullify", value)
+}
+
+// integrity is shared by the two wrappers below. The lock makes the check
+// and the write one step, so an author can't vanish between them.
+type integrity struct {
+	mu      sync.Mutex
+	books   BookRepository
+	authors AuthorRepository
+	policy  DeletePolicy
+}
+
+// NewIntegrityRepositories wraps the repositories of one backend so that books
+// only reference existing authors and deleting an author follows policy.
+// Doing it here instead of in every backend keeps the rules identical for all of them.
+func NewIntegrityRepositories(books BookRepository, authors AuthorRepository, policy DeletePolicy) (BookRepository, AuthorRepository) {
+	i := &integrity{books: books, authors: authors, policy: policy}
+	return &integrityBookRepository{books, i}, &integrityAuthorRepository{authors, i}
+}
+
+// checkAuthor fails with ErrInvalid when a book points to a missing author
+func (i *integrity) checkAuthor(ctx context.Context, book *Book) error {
+	for _, id := range book.AuthorIDs {
+		_, err := i.authors.GetByID(ctx, id)
+		if errors.Is(err, ErrNotFound) {
+			return &RepositoryError{
+				Kind:    ErrInvalid,
+				Message: fmt.Sprintf("Author %d does not exist", id),
+				Fields:  []FieldError{{"authorIds", "does not reference an existing author"}},
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type integrityBookRepository struct {
+	BookRepository
+	*integrity
+}
+
+func (repo *integrityBookRepository) Create(ctx context.Context, book *Book) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if err := repo.checkAuthor(ctx, book); err != nil {
+		return err
+	}
+	return repo.BookRepository.Create(ctx, book)
+}
+
+func (repo *integrityBookRepository) Update(ctx context.Context, book *Book, version int) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if err := repo.checkAuthor(ctx, book); err != nil {
+		return err
+	}
+	return repo.BookRepository.Update(ctx, book, version)
+}
+
+// Undelete refuses to bring back a book whose authors were deleted since,
+// undelete them first.
+func (repo *integrityBookRepository) Undelete(ctx context.Context, id int) (*Book, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	book, err := repo.BookRepository.GetDeletedByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := repo.checkAuthor(ctx, book); err != nil {
+		return nil, err
+	}
+	return repo.BookRepository.Undelete(ctx, id)
+}
+
+type integrityAuthorRepository struct {
+	AuthorRepository
+	*integrity
+}
+
+// Delete checks the version before it touches the books of the author, a
+// stale delete must not cascade. The backends can't share a transaction with
+// the wrappers around them, so when a step fails the books already changed
+// are put back as they were.
+func (repo *integrityAuthorRepository) Delete(ctx context.Context, id int, version int) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	author, err := repo.AuthorRepository.GetByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := checkVersion("Author", id, author.Version, version); err != nil {
+		return err
+	}
+	books, _, err := repo.books.Find(ctx, QueryOptions{AuthorID: id})
+	if err != nil {
+		return err
+	}
+	var undo []func(context.Context) error
+	for _, book := range books {
+		book := book
+		switch {
+		case repo.policy == DeleteCascade && len(book.AuthorIDs) == 1:
+			err = repo.books.Delete(ctx, book.ID, book.Version)
+			undo = append(undo, func(ctx context.Context) error {
+				_, err := repo.books.Undelete(ctx, book.ID)
+				return err
+			})
+		case repo.policy == DeleteCascade || repo.policy == DeleteNullify:
+			// A book keeps its co-authors
+			changed := book
+			changed.AuthorIDs = withoutAuthor(book.AuthorIDs, id)
+			err = repo.books.Update(ctx, &changed, book.Version)
+			undo = append(undo, func(ctx context.Context) error {
+				return repo.books.Update(ctx, &book, changed.Version)
+			})
+		default:
+			return &RepositoryError{Kind: ErrConstraint, Message: fmt.Sprintf("Author %d still has %d books", id, len(books))}
+		}
+		if err != nil {
+			// The failed step changed nothing
+			repo.rollBack(ctx, id, undo[:len(undo)-1])
+			return err
+		}
+	}
+	if err := repo.AuthorRepository.Delete(ctx, id, version); err != nil {
+		repo.rollBack(ctx, id, undo)
+		return err
+	}
+	return nil
+}
+
+// rollBack undoes the changes to the books of author id in reverse order.
+// It goes on when the request is canceled, half a delete is worse than none.
+func (repo *integrityAuthorRepository) rollBack(ctx context.Context, id int, undo []func(context.Context) error) {
+	ctx = context.WithoutCancel(ctx)
+	for i := len(undo) - 1; i >= 0; i-- {
+		if err := undo[i](ctx); err != nil {
+			log.Printf("rolling back the delete of author %d: %v", id, err)
+		}
+	}
+}
+
+// withoutAuthor returns ids without id, nil when no author is left
+func withoutAuthor(ids []int, id int) []int {
+	var rest []int
+	for _, authorID := range ids {
+		if authorID != id {
+			rest = append(rest, authorID)
+		}
+	}
+	return rest
+}
@@ -1,175 +1,443 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/boltdb/bolt"
 )
 
+var addr = flag.String("addr", ":8080", "Address the server listens on")
+var readTimeout = flag.Duration("read_timeout", 10*time.Second, "Time allowed to read a whole request, body included")
+var readHeaderTimeout = flag.Duration("read_header_timeout", 5*time.Second, "Time allowed to read the headers of a request")
+var writeTimeout = flag.Duration("write_timeout", 30*time.Second, "Time allowed to write a response, counted from the end of the request headers")
+var idleTimeout = flag.Duration("idle_timeout", 2*time.Minute, "How long a keep-alive connection waits for the next request")
+var shutdownTimeout = flag.Duration("shutdown_timeout", 15*time.Second, "How long in-flight requests may take to finish on SIGINT or SIGTERM")
+
+// storage selects the repository implementations used by the Handler
+var storage = flag.String("storage", "memory", "Storage backend for books and authors: memory, bolt or sqlite")
+var boltPath = flag.String("bolt_path", "bookstore.db", "Path of the bolt file used by the bolt storage")
+var sqlitePath = flag.String("sqlite_path", "bookstore.sqlite", "Path of the database used by the sqlite storage")
+var memoryDir = flag.String("memory_dir", "", "Directory where the memory storage keeps its snapshot and write-ahead log, empty keeps nothing")
+var fsyncPolicy = flag.String("fsync", "always", "When the write-ahead log of the memory storage is synced: always, interval or never")
+var fsyncInterval = flag.Duration("fsync_interval", time.Second, "How often the write-ahead log is synced with -fsync=interval")
+var snapshotEvery = flag.Int("snapshot_every", 1000, "Writes logged between two snapshots of the memory storage, 0 never compacts")
+var apiKeys = flag.String("api_keys", "", "API keys allowed to write as subject:key:scope,scope entries separated by semicolons")
+var tokenSecret = flag.String("token_secret", "", "Secret the HS256 bearer tokens are signed with, empty disables tokens")
+var rateLimits = flag.String("rate_limits", "", "Requests allowed per client as route=requests/period entries separated by semicolons, e.g. POST /books=10/1m;*=600/1m")
+var webhookAllowInternal = flag.Bool("webhook_allow_internal", false, "Let webhooks reach loopback, private and link-local addresses, only when every client is trusted")
+var authorDeletePolicy = flag.String("author_delete_policy", "restrict", "What deleting an author does to their books: restrict, cascade or nullify")
+
+// Book and Author are what the repositories store. They are never sent as
+// they are, every API version has its own shapes, see representation.
 type Book struct {
-	ID       int    `json:"id"` // Auto
-	Name     string `json:"name"`
-	AuthorID int    `json:"authorId,omitempty"`
+	ID        int       `json:"id"` // Auto
+	Name      string    `json:"name"`
+	AuthorIDs []int     `json:"authorIds,omitempty"` // in the order of the credits, see validateBook
+	ISBN      string    `json:"isbn,omitempty"`      // ISBN-10 or ISBN-13 without hyphens
+	Year      int       `json:"year,omitempty"`      // of publication, 0 when unknown
+	Genres    []string  `json:"genres,omitempty"`
+	Version   int       `json:"version"`   // 1 once created, grows with every update
+	CreatedAt time.Time `json:"createdAt"` // zero for books stored before timestamps
+	UpdatedAt time.Time `json:"updatedAt"`
 }
 
 type Author struct {
-	Name string `json:"name"`
-	ID   int    `json:"id"`
+	Name      string    `json:"name"`
+	ID        int       `json:"id"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
 }
 
+// BookRepository is implemented by every storage backend. GetAll and Find
+// return books ordered by ID unless asked otherwise, Find also returns the
+// number of matches before the limit and offset were applied. GetByID,
+// Update and Delete return an error wrapping ErrNotFound for an unknown ID.
+// They only write when the stored Version of the entity is version, or
+// version is AnyVersion, and return a *ConflictError otherwise. Create sets
+// Version to 1 and Update increments it, entities stored before versions
+// have 0. Version() changes with every write, see CatalogVersion.
+//
+// Delete is soft, the entity is put aside with its ID and GetDeletedByID
+// still finds it, while the others and the unique name check don't see it.
+// Undelete puts it back at the next Version, it fails with ErrDuplicate when
+// the name was taken in between.
 type BookRepository interface {
-	GetAll() ([]Book, error)
-	Create(book *Book) error
+	GetAll(ctx context.Context) ([]Book, error)
+	Find(ctx context.Context, opts QueryOptions) ([]Book, int, error)
+	GetByID(ctx context.Context, id int) (*Book, error)
+	Create(ctx context.Context, book *Book) error
+	Update(ctx context.Context, book *Book, version int) error
+	Delete(ctx context.Context, id int, version int) error
+	GetDeletedByID(ctx context.Context, id int) (*Book, error)
+	Undelete(ctx context.Context, id int) (*Book, error)
+	Version(ctx context.Context) (CatalogVersion, error)
 }
 
 type AuthorRepository interface {
-	GetAll() ([]Author, error)
-	Create(author *Author) error
+	GetAll(ctx context.Context) ([]Author, error)
+	Find(ctx context.Context, opts QueryOptions) ([]Author, int, error)
+	GetByID(ctx context.Context, id int) (*Author, error)
+	Create(ctx context.Context, author *Author) error
+	Update(ctx context.Context, author *Author, version int) error
+	Delete(ctx context.Context, id int, version int) error
+	GetDeletedByID(ctx context.Context, id int) (*Author, error)
+	Undelete(ctx context.Context, id int) (*Author, error)
+	Version(ctx context.Context) (CatalogVersion, error)
 }
 
-type CombinedResponse struct {
+// BookWithAuthors is a book joined with its authors in the order of the
+// credits. The authors which don't exist are left out, so Authors is empty
+// for the orphans of a left join.
+type BookWithAuthors struct {
 	Book
-	AuthorDetails Author `json:"author"`
+	Authors []Author
+}
+
+type AuthorWithBooks struct {
+	Author
+	Books []Book `json:"books"`
 }
 
 type CombinationService interface {
-	GenerateResponse(books []Book, authors []Author) []CombinedResponse
+	GenerateResponse(books []Book, authors []Author) []BookWithAuthors
+	GenerateLeftJoin(books []Book, authors []Author) []BookWithAuthors
+	GroupByAuthor(books []Book, authors []Author) []AuthorWithBooks
 }
 
-type Handler struct {
-	bookRepository     BookRepository
-	authorRepository   AuthorRepository
-	combinationService CombinationService
+// newRepositories builds the repositories for the selected storage backend,
+// the Handler only depends on the interfaces so it doesn't care which one it gets.
+// The closer releases the storage once the server is done with it.
+func newRepositories(storage string) (BookRepository, AuthorRepository, HistoryRepository, io.Closer, error) {
+	switch storage {
+	case "memory":
+		if *memoryDir == "" {
+			return NewMemoryBackedBookRepository(), NewMemoryBackedAuthorRepository(), NewMemoryBackedHistoryRepository(), ioutil.NopCloser(nil), nil
+		}
+		policy, err := ParseFsyncPolicy(*fsyncPolicy)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		bookRepository, authorRepository, p, err := NewPersistentMemoryRepositories(PersistenceOptions{
+			Dir:           *memoryDir,
+			Fsync:         policy,
+			FsyncInterval: *fsyncInterval,
+			SnapshotEvery: *snapshotEvery,
+		})
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		return bookRepository, authorRepository, p.History(), p, nil
+	case "bolt":
+		db, err := bolt.Open(*boltPath, 0600, nil)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		bookRepository, err := NewBoltBackedBookRepository(db)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		authorRepository, err := NewBoltBackedAuthorRepository(db)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		historyRepository, err := NewBoltBackedHistoryRepository(db)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		return bookRepository, authorRepository, historyRepository, db, nil
+	case "sqlite":
+		// Migrations run here so the schema is current before the first request
+		db, err := openSQLite(*sqlitePath)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		return NewSQLiteBackedBookRepository(db), NewSQLiteBackedAuthorRepository(db), NewSQLiteBackedHistoryRepository(db), db, nil
+	default:
+		return nil, nil, nil, nil, fmt.Errorf("unknown storage %q", storage)
+	}
+}
+
+// main reads the configuration from flags, or BOOKSTORE_ environment
+// variables for the flags not given, and serves until SIGINT or SIGTERM.
+func main() {
+	flag.Parse()
+	if err := applyEnv(flag.CommandLine, envPrefix, os.LookupEnv); err != nil {
+		log.Fatal(err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := run(ctx); err != nil {
+		log.Fatal(err)
+	}
 }
 
-func (h *Handler) SaveBook(w http.ResponseWriter, r *http.Request) {
-	reqBody, _ := ioutil.ReadAll(r.Body)
-	var book *Book
-	err := json.Unmarshal(reqBody, &book)
-	// Error handling Read 10-errors-panics.md
+// run builds the api for the configured storage and serves it until ctx is done
+func run(ctx context.Context) error {
+	policy, err := ParseDeletePolicy(*authorDeletePolicy)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Unable to parse request body"))
-		return
+		return err
 	}
-	if len(book.Name) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Book name cannot be empty"))
-		return
+	keys, err := ParseAPIKeys(*apiKeys)
+	if err != nil {
+		return err
 	}
-	// Save
-	err = h.bookRepository.Create(book)
+	limits, err := ParseRateLimits(*rateLimits)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(err.Error()))
-		return
+		return err
 	}
-	json.NewEncoder(w).Encode(book)
-}
-
-func (h *Handler) GetAllBooks(w http.ResponseWriter, r *http.Request) {
-	// Covert books map to slice
-	response, err := h.bookRepository.GetAll()
+	bookRepository, authorRepository, historyRepository, store, err := newRepositories(*storage)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(err.Error()))
-		return
+		return err
 	}
-	w.Header().Add("Content-Type", "application/json")
-	// Responding with JSON Array
-	json.NewEncoder(w).Encode(response)
-}
-
-func (h *Handler) SaveAuthor(w http.ResponseWriter, r *http.Request) {
-	reqBody, _ := ioutil.ReadAll(r.Body)
-	var author *Author
-	err := json.Unmarshal(reqBody, &author)
-	// Error handling Read 10-errors-panics.md
+	metrics := NewMetrics()
+	bookRepository, authorRepository = NewInstrumentedRepositories(bookRepository, authorRepository, metrics, *storage)
+	api, err := newAPI(ctx, bookRepository, authorRepository, historyRepository, policy, WebhookOptions{AllowInternal: *webhookAllowInternal})
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Unable to parse request body"))
-		return
+		store.Close()
+		return err
 	}
-	if len(author.Name) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Author name cannot be empty"))
-		return
+	api.metrics = metrics
+	api.rateLimits = limits
+	if len(keys) > 0 || *tokenSecret != "" {
+		api.authenticator = NewAuthenticator(keys, []byte(*tokenSecret))
+	} else {
+		log.Print("no api_keys or token_secret, anyone can write")
 	}
-	err = h.authorRepository.Create(author)
+
+	listener, err := net.Listen("tcp", *addr)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(err.Error()))
-		return
+		store.Close()
+		return err
 	}
-	json.NewEncoder(w).Encode(author)
+	log.Printf("serving the %s storage on %s", *storage, listener.Addr())
+	server := newServer(newRouter(api))
+	// Shutdown waits for the connections to go idle, those streaming /events
+	// never do. The deliveries of the last writes go out before the exit.
+	return serve(ctx, server, listener, store, *shutdownTimeout, shutdownHooks{stop: api.events.Close, drain: api.webhooks.Close})
 }
 
-func (h *Handler) GetAllAuthors(w http.ResponseWriter, r *http.Request) {
-	// Covert books map to slice
-	response, err := h.authorRepository.GetAll()
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(err.Error()))
-		return
+// newAPI wraps the repositories of a backend with the behaviour shared by all
+// of them. The order matters: integrity is outermost, so the writes it makes
+// on its own, like cascading deletes, still go through the other wrappers,
+// and the history records the timestamps of a write.
+func newAPI(ctx context.Context, bookRepository BookRepository, authorRepository AuthorRepository, historyRepository HistoryRepository, policy DeletePolicy, webhookOpts WebhookOptions) (*Handler, error) {
+	events := NewEventBroker(eventBacklog)
+	webhooks := NewWebhooks(webhookOpts)
+	events.Notify(webhooks.Enqueue)
+	historyRepository = NewPublishingHistoryRepository(historyRepository, events)
+	index := NewSearchIndex()
+	if err := index.Rebuild(ctx, bookRepository, authorRepository); err != nil {
+		return nil, err
 	}
-	w.Header().Add("Content-Type", "application/json")
-	// Responding with JSON Array
-	json.NewEncoder(w).Encode(response)
+	bookRepository, authorRepository = NewTimestampingRepositories(bookRepository, authorRepository, time.Now)
+	bookRepository, authorRepository = NewAuditingRepositories(bookRepository, authorRepository, historyRepository, time.Now)
+	bookRepository, authorRepository = NewIndexingRepositories(bookRepository, authorRepository, index)
+	bookRepository, authorRepository = NewIntegrityRepositories(bookRepository, authorRepository, policy)
+	return &Handler{
+		bookRepository:     bookRepository,
+		authorRepository:   authorRepository,
+		historyRepository:  historyRepository,
+		events:             events,
+		webhooks:           webhooks,
+		combinationService: NewCombinationService(),
+		searchIndex:        index,
+	}, nil
 }
 
-func (h *Handler) GetBooksAndAuthors(w http.ResponseWriter, r *http.Request) {
-
-	bookCh := make(chan []Book)
-	authorCh := make(chan []Author)
-	go func(ch chan []Book) {
-		response, _ := h.bookRepository.GetAll()
-		ch <- response
-	}(bookCh)
-	go func(ch chan []Author) {
-		response, _ := h.authorRepository.GetAll()
-		ch <- response
-	}(authorCh)
-	response := h.combinationService.GenerateResponse(<-bookCh, <-authorCh)
-	w.Header().Add("Content-Type", "application/json")
-	// Responding with JSON Array
-	json.NewEncoder(w).Encode(response)
+// routes is the routing table of api, /books/{id} and /authors/{id} are
+// served by the prefix patterns ending with a slash.
+func routes(api *Handler) []route {
+	table := catalogRoutes(api, "", negotiated)
+	table = append(table, catalogRoutes(api, "/v1", apiV1)...)
+	table = append(table, catalogRoutes(api, "/v2", apiV2)...)
+	table = append(table, []route{
+		{pattern: "/import", path: "/import", operations: map[string]operation{
+			http.MethodPost: {handler: api.Import, summary: "Create or update authors and books from rows of type, name, author, isbn, year and genres",
+				query: []parameter{
+					{"format", "csv or ndjson, instead of Content-Type", ""},
+					{"dryRun", "true reports what would change without writing", "boolean"},
+				},
+				requestMediaTypes: catalogMediaTypes, responses: []interface{}{ImportReport{}}, status: http.StatusOK,
+				scopes: []string{ScopeBooksWrite, ScopeAuthorsWrite}},
+		}},
+		{pattern: "/export", path: "/export", operations: map[string]operation{
+			http.MethodGet: {handler: api.Export, summary: "Every author and book as rows for /import",
+				query:              []parameter{{"format", "csv or ndjson, instead of Accept", ""}},
+				responseMediaTypes: catalogMediaTypes, status: http.StatusOK},
+		}},
+		{pattern: "/events", path: "/events", operations: map[string]operation{
+			http.MethodGet: {handler: api.Events, summary: "Server-Sent Events of every insert, update and delete of a book or an author",
+				description:        "The data of an event is {table, action, data}. Last-Event-ID resumes after that event, a reset event tells the events in between are lost.",
+				responseMediaTypes: []string{"text/event-stream"}, status: http.StatusOK},
+		}},
+		{pattern: "/webhooks", path: "/webhooks", operations: map[string]operation{
+			http.MethodGet: {handler: api.GetAllWebhooks, summary: "List the webhook subscriptions, without their secrets",
+				responses: []interface{}{[]WebhookSubscription{}}, status: http.StatusOK, scopes: []string{ScopeWebhooks}},
+			http.MethodPost: {handler: api.SaveWebhook, summary: "Subscribe a URL to the events of some entities and actions",
+				description: "Every delivery is signed with the secret, " + webhookSignatureHeader + " is sha256= and the hex HMAC-SHA256 of the body. Redirects are not followed and receivers on loopback, private or link-local addresses are refused.",
+				request:     WebhookSubscription{}, responses: []interface{}{WebhookSubscription{}}, status: http.StatusOK, scopes: []string{ScopeWebhooks}},
+		}},
+		{pattern: "/webhooks/", path: "/webhooks/{id}", operations: map[string]operation{
+			http.MethodGet:    {handler: api.GetWebhook, summary: "Get a webhook subscription", responses: []interface{}{WebhookSubscription{}}, status: http.StatusOK, scopes: []string{ScopeWebhooks}},
+			http.MethodDelete: {handler: api.DeleteWebhook, summary: "Unsubscribe, the deliveries not made yet are dropped", status: http.StatusNoContent, scopes: []string{ScopeWebhooks}},
+		}},
+		{pattern: "/webhooks/dead-letters", path: "/webhooks/dead-letters", operations: map[string]operation{
+			http.MethodGet: {handler: api.GetWebhookDeadLetters, summary: "The events which could not be delivered, oldest first",
+				responses: []interface{}{[]DeadLetter{}}, status: http.StatusOK, scopes: []string{ScopeWebhooks}},
+		}},
+		{pattern: "/search", path: "/search", operations: map[string]operation{
+			http.MethodGet: {handler: api.Search, summary: "Find books by words of their name or their author's name",
+				query: []parameter{
+					{"q", "Words to look for, each one matches as a prefix", ""},
+					{"limit", "Maximum number of results, 20 by default", "integer"},
+				},
+				responses: []interface{}{[]SearchResult{}}, status: http.StatusOK},
+		}},
+	}...)
+	if api.metrics != nil {
+		table = append(table, route{pattern: "/metrics", path: "/metrics", operations: map[string]operation{
+			http.MethodGet: {handler: api.metrics.ServeHTTP, summary: "Metrics in the Prometheus text format",
+				responseMediaTypes: []string{"text/plain"}, status: http.StatusOK},
+		}})
+	}
+	return table
 }
 
-// ListenAndServe start listening for client connections on given port
-func main() {
-	api := &Handler{NewMemoryBackedBookRepository(), NewMemoryBackedAuthorRepository(), NewCombinationService()}
-	http.HandleFunc("/authors", func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodGet:
-			api.GetAllAuthors(w, r)
-		case http.MethodPost:
-			api.SaveAuthor(w, r)
-		default:
-			// Give an error message.
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("Invalid request method."))
+// catalogRoutes serves books and authors in the shapes of version under
+// prefix. The handlers are the same for every version, versionMiddleware
+// tells them which representation to use.
+func catalogRoutes(api *Handler, prefix string, version apiVersion) []route {
+	includeAuthors := parameter{"include", "author embeds the authors of the book", ""}
+	includeBooks := parameter{"include", "books embeds the books of the author", ""}
+	listBooks := append([]parameter{{"authorId", "Only the books of this author", "integer"}}, listParameters...)
+	listBooks = append(listBooks, fieldsParameter, includeAuthors)
+	listAuthors := append(append([]parameter{}, listParameters...), fieldsParameter, includeBooks)
+	shapes := representationFor(version).samples()
+	table := []route{
+		{pattern: prefix + "/authors", path: prefix + "/authors", operations: map[string]operation{
+			http.MethodGet:  {handler: api.GetAllAuthors, summary: "List authors", query: listAuthors, responses: []interface{}{shapes.authors, shapes.grouped}, status: http.StatusOK, headers: []parameter{totalCountHeader}, conditional: true},
+			http.MethodPost: {handler: api.SaveAuthor, summary: "Create an author", request: shapes.author, responses: []interface{}{shapes.author}, status: http.StatusOK, headers: []parameter{entityTagHeader}, scopes: []string{ScopeAuthorsWrite}},
+		}},
+		{pattern: prefix + "/authors/", path: prefix + "/authors/{id}", operations: map[string]operation{
+			http.MethodGet:    {handler: api.GetAuthor, summary: "Get an author", query: []parameter{fieldsParameter, includeBooks}, responses: []interface{}{shapes.author, shapes.authorWithBooks}, status: http.StatusOK, headers: []parameter{entityTagHeader}},
+			http.MethodPut:    {handler: api.UpdateAuthor, summary: "Replace an author", request: shapes.author, responses: []interface{}{shapes.author}, status: http.StatusOK, headers: []parameter{entityTagHeader}, versioned: true, scopes: []string{ScopeAuthorsWrite}},
+			http.MethodPatch:  {handler: api.PatchAuthor, summary: "Change the given fields of an author", request: shapes.author, responses: []interface{}{shapes.author}, status: http.StatusOK, headers: []parameter{entityTagHeader}, versioned: true, scopes: []string{ScopeAuthorsWrite}},
+			http.MethodDelete: {handler: api.DeleteAuthor, summary: "Delete an author", status: http.StatusNoContent, versioned: true, scopes: []string{ScopeAuthorsWrite}},
+		}},
+		{pattern: prefix + "/authors/", suffix: "/history", path: prefix + "/authors/{id}/history", operations: map[string]operation{
+			http.MethodGet: {handler: api.GetAuthorHistory, summary: "The creates, updates and deletes of an author, oldest first", responses: []interface{}{[]HistoryEntry{}}, status: http.StatusOK},
+		}},
+		{pattern: prefix + "/authors/", suffix: "/undelete", path: prefix + "/authors/{id}/undelete", operations: map[string]operation{
+			http.MethodPost: {handler: api.UndeleteAuthor, summary: "Bring back a deleted author", responses: []interface{}{shapes.author}, status: http.StatusOK, headers: []parameter{entityTagHeader}, scopes: []string{ScopeAuthorsWrite}},
+		}},
+		{pattern: prefix + "/books", path: prefix + "/books", operations: map[string]operation{
+			http.MethodGet:  {handler: api.GetAllBooks, summary: "List books", query: listBooks, responses: []interface{}{shapes.books, shapes.booksWithAuthors}, status: http.StatusOK, headers: []parameter{totalCountHeader}, conditional: true},
+			http.MethodPost: {handler: api.SaveBook, summary: "Create a book", request: shapes.book, responses: []interface{}{shapes.book}, status: http.StatusOK, headers: []parameter{entityTagHeader}, scopes: []string{ScopeBooksWrite}},
+		}},
+		{pattern: prefix + "/books/", path: prefix + "/books/{id}", operations: map[string]operation{
+			http.MethodGet:    {handler: api.GetBook, summary: "Get a book", query: []parameter{fieldsParameter, includeAuthors}, responses: []interface{}{shapes.book, shapes.bookWithAuthors}, status: http.StatusOK, headers: []parameter{entityTagHeader}, revalidated: true},
+			http.MethodPut:    {handler: api.UpdateBook, summary: "Replace a book", request: shapes.book, responses: []interface{}{shapes.book}, status: http.StatusOK, headers: []parameter{entityTagHeader}, versioned: true, scopes: []string{ScopeBooksWrite}},
+			http.MethodPatch:  {handler: api.PatchBook, summary: "Change the given fields of a book", request: shapes.book, responses: []interface{}{shapes.book}, status: http.StatusOK, headers: []parameter{entityTagHeader}, versioned: true, scopes: []string{ScopeBooksWrite}},
+			http.MethodDelete: {handler: api.DeleteBook, summary: "Delete a book", status: http.StatusNoContent, versioned: true, scopes: []string{ScopeBooksWrite}},
+		}},
+		{pattern: prefix + "/books/", suffix: "/history", path: prefix + "/books/{id}/history", operations: map[string]operation{
+			http.MethodGet: {handler: api.GetBookHistory, summary: "The creates, updates and deletes of a book, oldest first", responses: []interface{}{[]HistoryEntry{}}, status: http.StatusOK},
+		}},
+		{pattern: prefix + "/books/", suffix: "/undelete", path: prefix + "/books/{id}/undelete", operations: map[string]operation{
+			http.MethodPost: {handler: api.UndeleteBook, summary: "Bring back a deleted book", responses: []interface{}{shapes.book}, status: http.StatusOK, headers: []parameter{entityTagHeader}, scopes: []string{ScopeBooksWrite}},
+		}},
+		{pattern: prefix + "/books-authors", path: prefix + "/books-authors", operations: map[string]operation{
+			http.MethodGet: {handler: api.GetBooksAndAuthors, summary: "Books with their author, or authors with their books for group=author",
+				query: []parameter{
+					{"join", "inner drops the books without author, left keeps them", ""},
+					{"group", "author nests the books under their author", ""},
+					fieldsParameter,
+				},
+				responses: []interface{}{shapes.joined, shapes.grouped}, status: http.StatusOK, conditional: true},
+		}},
+	}
+	for i := range table {
+		table[i].prefix = prefix
+		for method, op := range table[i].operations {
+			if version == negotiated {
+				op.description = "Accept: application/json; version=2 picks the shapes of /v2, it is v1 otherwise"
+			}
+			op.handler = versionMiddleware(op.handler, version, prefix)
+			table[i].operations[method] = op
 		}
-	})
-	http.HandleFunc("/books", func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodGet:
-			api.GetAllBooks(w, r)
-		case http.MethodPost:
-			api.SaveBook(w, r)
-		default:
-			// Give an error message.
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("Invalid request method."))
+	}
+	return table
+}
+
+// newRouter registers the routes of api along with /openapi.json describing them.
+// Without an authenticator every route is public, without rate limits unlimited.
+func newRouter(api *Handler) *http.ServeMux {
+	table := routes(api)
+	document := route{pattern: "/openapi.json", path: "/openapi.json", operations: map[string]operation{
+		http.MethodGet: {summary: "This document", responses: []interface{}{map[string]interface{}{}}, status: http.StatusOK},
+	}}
+	table = append(table, document)
+	for _, r := range table {
+		for method, op := range r.operations {
+			if api.authenticator == nil {
+				op.scopes = nil
+			}
+			if api.rateLimits != nil {
+				op.rateLimit, _ = api.rateLimits.forRoute(method, strings.TrimPrefix(r.path, r.prefix))
+			}
+			r.operations[method] = op
 		}
-	})
-	http.HandleFunc("/books-authors", func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodGet:
-			api.GetBooksAndAuthors(w, r)
-		default:
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("Invalid request method."))
+	}
+	// The document describes itself too, so its handler is set last
+	op := document.operations[http.MethodGet]
+	op.handler = serveJSON(newOpenAPIDocument(table))
+	document.operations[http.MethodGet] = op
+
+	mux := http.NewServeMux()
+	// The versions of a route share their limiter, or each would have its own limit
+	limiters := make(map[string]*RateLimiter)
+	subtrees := make(map[string]subresourceHandlers)
+	for _, r := range table {
+		handlers := make(methodHandlers)
+		for method, op := range r.operations {
+			handler := op.handler
+			if len(op.scopes) > 0 {
+				handler = authMiddleware(handler, api.authenticator, op.scopes...)
+			}
+			// Floods of bad credentials are limited too
+			if op.rateLimit.Requests > 0 {
+				key := method + " " + strings.TrimPrefix(r.path, r.prefix)
+				if limiters[key] == nil {
+					limiters[key] = NewRateLimiter(op.rateLimit, api.rateLimits.now)
+				}
+				handler = rateLimitMiddleware(handler, limiters[key], api.authenticator)
+			}
+			// Outermost, so every response is counted
+			if api.metrics != nil {
+				handler = metricsMiddleware(handler, api.metrics, r.path)
+			}
+			handlers[method] = handler
+		}
+		if subtrees[r.pattern] == nil {
+			subtrees[r.pattern] = make(subresourceHandlers)
 		}
-	})
-	http.ListenAndServe(":8080", nil)
+		subtrees[r.pattern][r.suffix] = handlers
+	}
+	for pattern, handlers := range subtrees {
+		mux.Handle(pattern, handlers)
+	}
+	return mux
 }
@@ -1,31 +1,244 @@
 package main
 
-import "errors"
+import (
+	"context"
+	"sync"
+)
 
+// MemoryBackedAuthorRepository works like MemoryBackedBookRepository
 type MemoryBackedAuthorRepository struct {
-	authors map[string]Author
+	mu      sync.RWMutex
+	authors map[int]Author
+	deleted map[int]Author // by Delete, until Undelete
+	names   map[string]int // name -> ID, keeps names unique
+	lastID  int
+	version CatalogVersion
 }
 
-func (repo *MemoryBackedAuthorRepository) GetAll() ([]Author, error) {
+func (repo *MemoryBackedAuthorRepository) GetAll(ctx context.Context) ([]Author, error) {
+	response, _, err := repo.Find(ctx, QueryOptions{})
+	return response, err
+}
+
+func (repo *MemoryBackedAuthorRepository) Find(ctx context.Context, opts QueryOptions) ([]Author, int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	repo.mu.RLock()
 	response := make([]Author, 0)
 	for _, v := range repo.authors {
-		response = append(response, v)
+		if opts.matchesAuthor(v) {
+			response = append(response, v)
+		}
+	}
+	repo.mu.RUnlock()
+	// Map iteration order is random, always sort so pages are stable
+	sortAuthors(response, opts.Sort)
+	start, end := opts.window(len(response))
+	return response[start:end], len(response), nil
+}
+
+func (repo *MemoryBackedAuthorRepository) GetByID(ctx context.Context, id int) (*Author, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	author, ok := repo.authors[id]
+	if !ok {
+		return nil, errAuthorNotFound
 	}
-	return response, nil
+	return &author, nil
 }
 
-func (repo *MemoryBackedAuthorRepository) Create(author *Author) error {
+func (repo *MemoryBackedAuthorRepository) Create(ctx context.Context, author *Author) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
 	// Check for duplicacy
-	if _, ok := repo.authors[author.Name]; ok {
-		return errors.New("Duplicate Author Found")
+	if _, ok := repo.names[author.Name]; ok {
+		return errDuplicateAuthor
 	}
 	// Generate an ID
-	author.ID = len(repo.authors) + 1
-	repo.authors[author.Name] = *author
+	repo.lastID++
+	author.ID, author.Version = repo.lastID, 1
+	repo.authors[author.ID] = *author
+	repo.names[author.Name] = author.ID
+	repo.version.bump()
 	return nil
 }
 
+func (repo *MemoryBackedAuthorRepository) Update(ctx context.Context, author *Author, version int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	existing, ok := repo.authors[author.ID]
+	if !ok {
+		return errAuthorNotFound
+	}
+	if err := checkVersion("Author", author.ID, existing.Version, version); err != nil {
+		return err
+	}
+	// Renaming must not clash with another author
+	if existing.Name != author.Name {
+		if _, ok := repo.names[author.Name]; ok {
+			return errDuplicateAuthor
+		}
+		delete(repo.names, existing.Name)
+		repo.names[author.Name] = author.ID
+	}
+	author.Version = existing.Version + 1
+	repo.authors[author.ID] = *author
+	repo.version.bump()
+	return nil
+}
+
+func (repo *MemoryBackedAuthorRepository) Delete(ctx context.Context, id int, version int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	existing, ok := repo.authors[id]
+	if !ok {
+		return errAuthorNotFound
+	}
+	if err := checkVersion("Author", id, existing.Version, version); err != nil {
+		return err
+	}
+	delete(repo.names, existing.Name)
+	delete(repo.authors, id)
+	repo.deleted[id] = existing
+	repo.version.bump()
+	return nil
+}
+
+func (repo *MemoryBackedAuthorRepository) GetDeletedByID(ctx context.Context, id int) (*Author, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	author, ok := repo.deleted[id]
+	if !ok {
+		return nil, errDeletedAuthorNotFound
+	}
+	return &author, nil
+}
+
+func (repo *MemoryBackedAuthorRepository) Undelete(ctx context.Context, id int) (*Author, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	author, ok := repo.deleted[id]
+	if !ok {
+		return nil, errDeletedAuthorNotFound
+	}
+	if _, ok := repo.names[author.Name]; ok {
+		return nil, errDuplicateAuthor
+	}
+	author.Version++
+	delete(repo.deleted, id)
+	repo.authors[id] = author
+	repo.names[author.Name] = id
+	repo.version.bump()
+	return &author, nil
+}
+
+// Version counts the writes, restore and forget included
+func (repo *MemoryBackedAuthorRepository) Version(ctx context.Context) (CatalogVersion, error) {
+	if err := ctx.Err(); err != nil {
+		return CatalogVersion{}, err
+	}
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	return repo.version, nil
+}
+
+// restore stores author as is, ID included. Used to load persisted state
+// and to undo a write which could not be persisted.
+func (repo *MemoryBackedAuthorRepository) restore(author Author) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if existing, ok := repo.authors[author.ID]; ok {
+		delete(repo.names, existing.Name)
+	}
+	delete(repo.deleted, author.ID)
+	repo.authors[author.ID] = author
+	repo.names[author.Name] = author.ID
+	repo.version.bump()
+	if author.ID > repo.lastID {
+		repo.lastID = author.ID
+	}
+}
+
+// restoreDeleted is restore for a author which was deleted
+func (repo *MemoryBackedAuthorRepository) restoreDeleted(author Author) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if existing, ok := repo.authors[author.ID]; ok {
+		delete(repo.names, existing.Name)
+		delete(repo.authors, author.ID)
+	}
+	repo.deleted[author.ID] = author
+	repo.version.bump()
+	if author.ID > repo.lastID {
+		repo.lastID = author.ID
+	}
+}
+
+// forget is the counterpart of restore, the ID is still never reused
+func (repo *MemoryBackedAuthorRepository) forget(id int) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if existing, ok := repo.authors[id]; ok {
+		delete(repo.names, existing.Name)
+		delete(repo.authors, id)
+		repo.version.bump()
+	}
+}
+
+// contents returns every author ordered by ID and the last ID handed out
+func (repo *MemoryBackedAuthorRepository) contents() ([]Author, int) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	response := make([]Author, 0, len(repo.authors))
+	for _, v := range repo.authors {
+		response = append(response, v)
+	}
+	sortAuthors(response, nil)
+	return response, repo.lastID
+}
+
+// deletedContents returns every deleted author ordered by ID
+func (repo *MemoryBackedAuthorRepository) deletedContents() []Author {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	response := make([]Author, 0, len(repo.deleted))
+	for _, v := range repo.deleted {
+		response = append(response, v)
+	}
+	sortAuthors(response, nil)
+	return response
+}
+
+// setLastID moves the sequence forward, a snapshot keeps it even when the
+// author with the last ID was deleted.
+func (repo *MemoryBackedAuthorRepository) setLastID(id int) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if id > repo.lastID {
+		repo.lastID = id
+	}
+}
+
 // Constructor Function
 func NewMemoryBackedAuthorRepository() AuthorRepository {
-	return &MemoryBackedAuthorRepository{make(map[string]Author)}
+	return &MemoryBackedAuthorRepository{authors: make(map[int]Author), deleted: make(map[int]Author), names: make(map[string]int), version: newCatalogVersion()}
 }
@@ -1,31 +1,248 @@
 package main
 
-import "errors"
+import (
+	"context"
+	"sync"
+)
 
+// MemoryBackedBookRepository is safe for concurrent use, handlers run in their own goroutines.
+// IDs come from lastID which only ever grows, so deleted IDs are never handed out again.
 type MemoryBackedBookRepository struct {
-	books map[string]Book
+	mu      sync.RWMutex
+	books   map[int]Book
+	deleted map[int]Book   // by Delete, until Undelete
+	names   map[string]int // name -> ID, keeps names unique
+	lastID  int
+	version CatalogVersion
 }
 
-func (repo *MemoryBackedBookRepository) GetAll() ([]Book, error) {
+func (repo *MemoryBackedBookRepository) GetAll(ctx context.Context) ([]Book, error) {
+	response, _, err := repo.Find(ctx, QueryOptions{})
+	return response, err
+}
+
+func (repo *MemoryBackedBookRepository) Find(ctx context.Context, opts QueryOptions) ([]Book, int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	repo.mu.RLock()
 	response := make([]Book, 0)
 	for _, v := range repo.books {
-		response = append(response, v)
+		if opts.matchesBook(v) {
+			response = append(response, v.clone())
+		}
+	}
+	repo.mu.RUnlock()
+	// Map iteration order is random, always sort so pages are stable
+	sortBooks(response, opts.Sort)
+	start, end := opts.window(len(response))
+	return response[start:end], len(response), nil
+}
+
+func (repo *MemoryBackedBookRepository) GetByID(ctx context.Context, id int) (*Book, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	book, ok := repo.books[id]
+	if !ok {
+		return nil, errBookNotFound
 	}
-	return response, nil
+	book = book.clone()
+	return &book, nil
 }
 
-func (repo *MemoryBackedBookRepository) Create(book *Book) error {
+func (repo *MemoryBackedBookRepository) Create(ctx context.Context, book *Book) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
 	// Check for duplicacy
-	if _, ok := repo.books[book.Name]; ok {
-		return errors.New("Duplicate book Found")
+	if _, ok := repo.names[book.Name]; ok {
+		return errDuplicateBook
 	}
 	// Generate an ID
-	book.ID = len(repo.books) + 1
-	repo.books[book.Name] = *book
+	repo.lastID++
+	book.ID, book.Version = repo.lastID, 1
+	repo.books[book.ID] = book.clone()
+	repo.names[book.Name] = book.ID
+	repo.version.bump()
 	return nil
 }
 
+func (repo *MemoryBackedBookRepository) Update(ctx context.Context, book *Book, version int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	existing, ok := repo.books[book.ID]
+	if !ok {
+		return errBookNotFound
+	}
+	if err := checkVersion("Book", book.ID, existing.Version, version); err != nil {
+		return err
+	}
+	// Renaming must not clash with another book
+	if existing.Name != book.Name {
+		if _, ok := repo.names[book.Name]; ok {
+			return errDuplicateBook
+		}
+		delete(repo.names, existing.Name)
+		repo.names[book.Name] = book.ID
+	}
+	book.Version = existing.Version + 1
+	repo.books[book.ID] = book.clone()
+	repo.version.bump()
+	return nil
+}
+
+func (repo *MemoryBackedBookRepository) Delete(ctx context.Context, id int, version int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	existing, ok := repo.books[id]
+	if !ok {
+		return errBookNotFound
+	}
+	if err := checkVersion("Book", id, existing.Version, version); err != nil {
+		return err
+	}
+	delete(repo.names, existing.Name)
+	delete(repo.books, id)
+	repo.deleted[id] = existing
+	repo.version.bump()
+	return nil
+}
+
+func (repo *MemoryBackedBookRepository) GetDeletedByID(ctx context.Context, id int) (*Book, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	book, ok := repo.deleted[id]
+	if !ok {
+		return nil, errDeletedBookNotFound
+	}
+	book = book.clone()
+	return &book, nil
+}
+
+func (repo *MemoryBackedBookRepository) Undelete(ctx context.Context, id int) (*Book, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	book, ok := repo.deleted[id]
+	if !ok {
+		return nil, errDeletedBookNotFound
+	}
+	if _, ok := repo.names[book.Name]; ok {
+		return nil, errDuplicateBook
+	}
+	book.Version++
+	delete(repo.deleted, id)
+	repo.books[id] = book
+	repo.names[book.Name] = id
+	repo.version.bump()
+	book = book.clone()
+	return &book, nil
+}
+
+// Version counts the writes, restore and forget included
+func (repo *MemoryBackedBookRepository) Version(ctx context.Context) (CatalogVersion, error) {
+	if err := ctx.Err(); err != nil {
+		return CatalogVersion{}, err
+	}
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	return repo.version, nil
+}
+
+// restore stores book as is, ID included. Used to load persisted state
+// and to undo a write which could not be persisted.
+func (repo *MemoryBackedBookRepository) restore(book Book) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if existing, ok := repo.books[book.ID]; ok {
+		delete(repo.names, existing.Name)
+	}
+	delete(repo.deleted, book.ID)
+	repo.books[book.ID] = book.clone()
+	repo.names[book.Name] = book.ID
+	repo.version.bump()
+	if book.ID > repo.lastID {
+		repo.lastID = book.ID
+	}
+}
+
+// restoreDeleted is restore for a book which was deleted
+func (repo *MemoryBackedBookRepository) restoreDeleted(book Book) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if existing, ok := repo.books[book.ID]; ok {
+		delete(repo.names, existing.Name)
+		delete(repo.books, book.ID)
+	}
+	repo.deleted[book.ID] = book.clone()
+	repo.version.bump()
+	if book.ID > repo.lastID {
+		repo.lastID = book.ID
+	}
+}
+
+// forget is the counterpart of restore, the ID is still never reused
+func (repo *MemoryBackedBookRepository) forget(id int) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if existing, ok := repo.books[id]; ok {
+		delete(repo.names, existing.Name)
+		delete(repo.books, id)
+		repo.version.bump()
+	}
+}
+
+// contents returns every book ordered by ID and the last ID handed out
+func (repo *MemoryBackedBookRepository) contents() ([]Book, int) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	response := make([]Book, 0, len(repo.books))
+	for _, v := range repo.books {
+		response = append(response, v.clone())
+	}
+	sortBooks(response, nil)
+	return response, repo.lastID
+}
+
+// deletedContents returns every deleted book ordered by ID
+func (repo *MemoryBackedBookRepository) deletedContents() []Book {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	response := make([]Book, 0, len(repo.deleted))
+	for _, v := range repo.deleted {
+		response = append(response, v.clone())
+	}
+	sortBooks(response, nil)
+	return response
+}
+
+// setLastID moves the sequence forward, a snapshot keeps it even when the
+// book with the last ID was deleted.
+func (repo *MemoryBackedBookRepository) setLastID(id int) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if id > repo.lastID {
+		repo.lastID = id
+	}
+}
+
 // Constructor Function
 func NewMemoryBackedBookRepository() BookRepository {
-	return &MemoryBackedBookRepository{make(map[string]Book)}
+	return &MemoryBackedBookRepository{books: make(map[int]Book), deleted: make(map[int]Book), names: make(map[string]int), version: newCatalogVersion()}
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// MemoryBackedHistoryRepository keeps the entries of every entity in the
+// order they were appended.
+type MemoryBackedHistoryRepository struct {
+	mu      sync.RWMutex
+	entries map[historyKey][]HistoryEntry
+	lastID  int
+}
+
+type historyKey struct {
+	entity string
+	id     int
+}
+
+func (repo *MemoryBackedHistoryRepository) Append(ctx context.Context, entry *HistoryEntry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	repo.lastID++
+	entry.ID = repo.lastID
+	key := historyKey{entry.Entity, entry.EntityID}
+	repo.entries[key] = append(repo.entries[key], *entry)
+	return nil
+}
+
+func (repo *MemoryBackedHistoryRepository) Find(ctx context.Context, entity string, id int) ([]HistoryEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	entries := repo.entries[historyKey{entity, id}]
+	return append(make([]HistoryEntry, 0, len(entries)), entries...), nil
+}
+
+// restore appends entry as is, ID included. An entry which is there
+// already is skipped, so replaying a log twice is fine.
+func (repo *MemoryBackedHistoryRepository) restore(entry HistoryEntry) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	key := historyKey{entry.Entity, entry.EntityID}
+	if entries := repo.entries[key]; len(entries) > 0 && entries[len(entries)-1].ID >= entry.ID {
+		return
+	}
+	repo.entries[key] = append(repo.entries[key], entry)
+	if entry.ID > repo.lastID {
+		repo.lastID = entry.ID
+	}
+}
+
+// forget drops the entry appended last, to undo an append which could not
+// be persisted.
+func (repo *MemoryBackedHistoryRepository) forget(entry HistoryEntry) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	key := historyKey{entry.Entity, entry.EntityID}
+	if entries := repo.entries[key]; len(entries) > 0 && entries[len(entries)-1].ID == entry.ID {
+		repo.entries[key] = entries[:len(entries)-1]
+	}
+}
+
+// contents returns every entry ordered by ID
+func (repo *MemoryBackedHistoryRepository) contents() []HistoryEntry {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	var response []HistoryEntry
+	for _, entries := range repo.entries {
+		response = append(response, entries...)
+	}
+	sort.Slice(response, func(i, j int) bool { return response[i].ID < response[j].ID })
+	return response
+}
+
+// Constructor Function
+func NewMemoryBackedHistoryRepository() HistoryRepository {
+	return &MemoryBackedHistoryRepository{entries: make(map[historyKey][]HistoryEntry)}
+}
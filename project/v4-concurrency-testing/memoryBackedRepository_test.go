@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// Run these with make race, they are meant to catch unsynchronised map access.
+// The vendored bolt 1.3.1 trips checkptr under -race, the Makefile turns it off.
+
+func TestMemoryBookRepositoryConcurrentCreate(t *testing.T) {
+	repo := NewMemoryBackedBookRepository()
+	const writers, perWriter = 20, 50
+
+	var wg sync.WaitGroup
+	ids := make(chan int, writers*perWriter)
+	for w := 0; w < writers; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				book := &Book{Name: fmt.Sprintf("Book %d-%d", w, i)}
+				if err := repo.Create(ctx, book); err != nil {
+					t.Error(err)
+					return
+				}
+				ids <- book.ID
+			}
+		}(w)
+		// Readers race the writers
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				if _, err := repo.GetAll(ctx); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[int]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("ID %d was handed out twice", id)
+		}
+		seen[id] = true
+	}
+	books, _ := repo.GetAll(ctx)
+	if len(books) != writers*perWriter {
+		t.Errorf("Incorrect length - Expected %d, found %d", writers*perWriter, len(books))
+	}
+}
+
+func TestMemoryBookRepositoryConcurrentDuplicates(t *testing.T) {
+	repo := NewMemoryBackedBookRepository()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created := 0
+	for w := 0; w < 50; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := repo.Create(ctx, &Book{Name: "Same Book"}); err == nil {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if created != 1 {
+		t.Errorf("Expected exactly one create to win, %d did", created)
+	}
+}
+
+func TestMemoryRepositoriesNeverReuseIDs(t *testing.T) {
+	books := NewMemoryBackedBookRepository()
+	authors := NewMemoryBackedAuthorRepository()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 10; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				book := &Book{Name: fmt.Sprintf("Book %d-%d", w, i)}
+				author := &Author{Name: fmt.Sprintf("Author %d-%d", w, i)}
+				if err := books.Create(ctx, book); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := authors.Create(ctx, author); err != nil {
+					t.Error(err)
+					return
+				}
+				// Deleting every other entity would make len+1 IDs collide
+				if i%2 == 0 {
+					books.Delete(ctx, book.ID, AnyVersion)
+					authors.Delete(ctx, author.ID, AnyVersion)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	book := &Book{Name: "Last Book"}
+	author := &Author{Name: "Last Author"}
+	books.Create(ctx, book)
+	authors.Create(ctx, author)
+	if book.ID != 1001 || author.ID != 1001 {
+		t.Errorf("Expected the sequence to continue at %d, found %d and %d", 1001, book.ID, author.ID)
+	}
+	all, _ := books.GetAll(ctx)
+	if len(all) != 501 {
+		t.Errorf("Incorrect length - Expected %d, found %d", 501, len(all))
+	}
+}
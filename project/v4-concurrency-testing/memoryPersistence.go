@@ -0,0 +1,633 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FsyncPolicy decides when the write-ahead log is flushed to disk
+type FsyncPolicy string
+
+const (
+	// FsyncAlways syncs before a write returns, nothing acknowledged is lost
+	FsyncAlways FsyncPolicy = "always"
+	// FsyncInterval syncs in the background, a crash loses at most one interval
+	FsyncInterval FsyncPolicy = "interval"
+	// FsyncNever leaves it to the OS, a crash of the machine loses what it buffered
+	FsyncNever FsyncPolicy = "never"
+)
+
+// ParseFsyncPolicy validates a policy read from configuration
+func ParseFsyncPolicy(value string) (FsyncPolicy, error) {
+	switch policy := FsyncPolicy(value); policy {
+	case FsyncAlways, FsyncInterval, FsyncNever:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown fsync policy %q, use always, interval or never", value)
+}
+
+// PersistenceOptions configures NewPersistentMemoryRepositories
+type PersistenceOptions struct {
+	Dir           string
+	Fsync         FsyncPolicy
+	FsyncInterval time.Duration // for FsyncInterval, a second when not set
+	SnapshotEvery int           // log records between snapshots, 0 never compacts
+}
+
+const (
+	snapshotFile = "snapshot.json"
+	walFile      = "wal.log"
+)
+
+// A log record is framed as a big endian payload length and the CRC-32C of
+// the payload, followed by the JSON payload.
+const walHeaderSize = 8
+
+var walTable = crc32.MakeTable(crc32.Castagnoli)
+
+// walRecord is one mutation, Data is the whole entity after a put and
+// before a delete. Deletes logged before they were soft have no Data.
+type walRecord struct {
+	Table  string          `json:"table"` // books, authors or history
+	Action string          `json:"action"`
+	ID     int             `json:"id"`
+	Data   json.RawMessage `json:"data,omitempty"`
+}
+
+const (
+	walPut    = "put"
+	walDelete = "delete"
+)
+
+// memorySnapshot is the whole state at the point the log was compacted. The
+// last IDs are kept so deleted IDs are not handed out again after a restart.
+type memorySnapshot struct {
+	LastBookID     int            `json:"lastBookId"`
+	LastAuthorID   int            `json:"lastAuthorId"`
+	Books          []Book         `json:"books"`
+	Authors        []Author       `json:"authors"`
+	DeletedBooks   []Book         `json:"deletedBooks,omitempty"`
+	DeletedAuthors []Author       `json:"deletedAuthors,omitempty"`
+	History        []HistoryEntry `json:"history,omitempty"`
+}
+
+// Persistence keeps the memory repositories on disk as a snapshot plus a log
+// of the writes since. Writes are serialised so the log has the order in
+// which they were applied.
+type Persistence struct {
+	mu      sync.Mutex
+	opts    PersistenceOptions
+	books   *MemoryBackedBookRepository
+	authors *MemoryBackedAuthorRepository
+	history *MemoryBackedHistoryRepository
+	wal     *os.File
+	size    int64 // of the log, a failed append is cut off here
+	records int   // appended since the last snapshot
+	dirty   bool  // appended since the last sync
+	err     error // once the log can't be repaired every write fails with it
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewPersistentMemoryRepositories loads the snapshot and replays the log found
+// in opts.Dir into new memory repositories, then logs every write they take.
+// A torn record at the end of the log, left by a crash, is dropped.
+func NewPersistentMemoryRepositories(opts PersistenceOptions) (BookRepository, AuthorRepository, *Persistence, error) {
+	if err := os.MkdirAll(opts.Dir, 0700); err != nil {
+		return nil, nil, nil, err
+	}
+	p := &Persistence{
+		opts:    opts,
+		books:   NewMemoryBackedBookRepository().(*MemoryBackedBookRepository),
+		authors: NewMemoryBackedAuthorRepository().(*MemoryBackedAuthorRepository),
+		history: NewMemoryBackedHistoryRepository().(*MemoryBackedHistoryRepository),
+	}
+	if err := p.loadSnapshot(); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := p.replay(); err != nil {
+		return nil, nil, nil, err
+	}
+	if opts.Fsync == FsyncInterval {
+		p.stop, p.done = make(chan struct{}), make(chan struct{})
+		go p.syncEvery(opts.FsyncInterval)
+	}
+	return &persistentBookRepository{p.books, p}, &persistentAuthorRepository{p.authors, p}, p, nil
+}
+
+func (p *Persistence) path(name string) string {
+	return filepath.Join(p.opts.Dir, name)
+}
+
+func (p *Persistence) loadSnapshot() error {
+	data, err := ioutil.ReadFile(p.path(snapshotFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// The snapshot is renamed into place once complete, so it is never torn
+	var snapshot memorySnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("corrupt snapshot %s: %v", p.path(snapshotFile), err)
+	}
+	for _, book := range snapshot.Books {
+		p.books.restore(book)
+	}
+	for _, author := range snapshot.Authors {
+		p.authors.restore(author)
+	}
+	for _, book := range snapshot.DeletedBooks {
+		p.books.restoreDeleted(book)
+	}
+	for _, author := range snapshot.DeletedAuthors {
+		p.authors.restoreDeleted(author)
+	}
+	for _, entry := range snapshot.History {
+		p.history.restore(entry)
+	}
+	p.books.setLastID(snapshot.LastBookID)
+	p.authors.setLastID(snapshot.LastAuthorID)
+	return nil
+}
+
+// replay applies the log and opens it for appending. Records are applied in
+// order up to the first one which is incomplete or fails its checksum, the
+// log is truncated there so new records don't end up behind garbage.
+func (p *Persistence) replay() error {
+	wal, err := os.OpenFile(p.path(walFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(wal)
+	var good int64
+	for {
+		record, n, err := readWALRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			info, statErr := wal.Stat()
+			if statErr != nil {
+				wal.Close()
+				return statErr
+			}
+			log.Printf("dropping %d bytes at the end of %s: %v", info.Size()-good, p.path(walFile), err)
+			break
+		}
+		if err := p.apply(record); err != nil {
+			wal.Close()
+			return fmt.Errorf("replaying %s at offset %d: %v", p.path(walFile), good, err)
+		}
+		good += n
+		p.records++
+	}
+	if err := wal.Truncate(good); err != nil {
+		wal.Close()
+		return err
+	}
+	if _, err := wal.Seek(good, io.SeekStart); err != nil {
+		wal.Close()
+		return err
+	}
+	p.wal, p.size = wal, good
+	return nil
+}
+
+// errTornRecord marks the end of the usable log
+var errTornRecord = errors.New("torn record")
+
+// readWALRecord returns io.EOF at a clean end of the log and errTornRecord
+// when the log ends in the middle of a record or the record is damaged.
+func readWALRecord(reader io.Reader) (walRecord, int64, error) {
+	var record walRecord
+	header := make([]byte, walHeaderSize)
+	if n, err := io.ReadFull(reader, header); err != nil {
+		if err == io.EOF && n == 0 {
+			return record, 0, io.EOF
+		}
+		return record, 0, fmt.Errorf("%w: short header", errTornRecord)
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	checksum := binary.BigEndian.Uint32(header[4:])
+	// The limit keeps a damaged length from allocating gigabytes
+	if length > 64<<20 {
+		return record, 0, fmt.Errorf("%w: length %d", errTornRecord, length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return record, 0, fmt.Errorf("%w: short payload", errTornRecord)
+	}
+	if crc32.Checksum(payload, walTable) != checksum {
+		return record, 0, fmt.Errorf("%w: checksum mismatch", errTornRecord)
+	}
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return record, 0, fmt.Errorf("%w: %v", errTornRecord, err)
+	}
+	return record, int64(walHeaderSize + length), nil
+}
+
+func encodeWALRecord(record walRecord) ([]byte, error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, walHeaderSize, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:], crc32.Checksum(payload, walTable))
+	return append(frame, payload...), nil
+}
+
+// apply replays one record, puts and deletes are idempotent so a log which
+// overlaps the snapshot after a crash during compaction is fine.
+func (p *Persistence) apply(record walRecord) error {
+	switch {
+	case record.Table == "books" && record.Action == walPut:
+		var book Book
+		if err := json.Unmarshal(record.Data, &book); err != nil {
+			return err
+		}
+		p.books.restore(book)
+	case record.Table == "books" && record.Action == walDelete && record.Data == nil:
+		p.books.forget(record.ID)
+	case record.Table == "books" && record.Action == walDelete:
+		var book Book
+		if err := json.Unmarshal(record.Data, &book); err != nil {
+			return err
+		}
+		p.books.restoreDeleted(book)
+	case record.Table == "authors" && record.Action == walPut:
+		var author Author
+		if err := json.Unmarshal(record.Data, &author); err != nil {
+			return err
+		}
+		p.authors.restore(author)
+	case record.Table == "authors" && record.Action == walDelete && record.Data == nil:
+		p.authors.forget(record.ID)
+	case record.Table == "authors" && record.Action == walDelete:
+		var author Author
+		if err := json.Unmarshal(record.Data, &author); err != nil {
+			return err
+		}
+		p.authors.restoreDeleted(author)
+	case record.Table == "history" && record.Action == walPut:
+		var entry HistoryEntry
+		if err := json.Unmarshal(record.Data, &entry); err != nil {
+			return err
+		}
+		p.history.restore(entry)
+	default:
+		return fmt.Errorf("unknown record %s %s", record.Table, record.Action)
+	}
+	return nil
+}
+
+// append logs a write which was already applied in memory. When it fails
+// the caller undoes the write, a partial record is cut off the log.
+func (p *Persistence) append(table, action string, id int, entity interface{}) error {
+	if p.err != nil {
+		return p.err
+	}
+	record := walRecord{Table: table, Action: action, ID: id}
+	if entity != nil {
+		data, err := json.Marshal(entity)
+		if err != nil {
+			return err
+		}
+		record.Data = data
+	}
+	frame, err := encodeWALRecord(record)
+	if err != nil {
+		return err
+	}
+	if _, err := p.wal.Write(frame); err != nil {
+		return p.cutOff(err)
+	}
+	if p.opts.Fsync == FsyncAlways {
+		if err := p.wal.Sync(); err != nil {
+			return p.cutOff(err)
+		}
+	}
+	p.size += int64(len(frame))
+	p.dirty = true
+	p.records++
+	if p.opts.SnapshotEvery > 0 && p.records >= p.opts.SnapshotEvery {
+		// The record is safe in the log, a failed compaction is retried next time
+		if err := p.compact(); err != nil {
+			log.Printf("snapshot failed: %v", err)
+		}
+	}
+	return nil
+}
+
+func (p *Persistence) cutOff(err error) error {
+	if truncErr := p.wal.Truncate(p.size); truncErr != nil {
+		p.err = fmt.Errorf("write-ahead log is damaged: %v", truncErr)
+		return p.err
+	}
+	if _, seekErr := p.wal.Seek(p.size, io.SeekStart); seekErr != nil {
+		p.err = fmt.Errorf("write-ahead log is damaged: %v", seekErr)
+		return p.err
+	}
+	return err
+}
+
+// compact writes a snapshot of the current state and empties the log. The
+// snapshot is written aside and renamed, so a crash leaves either the old
+// snapshot and the full log or the new snapshot and a log it already covers.
+func (p *Persistence) compact() error {
+	books, lastBookID := p.books.contents()
+	authors, lastAuthorID := p.authors.contents()
+	data, err := json.Marshal(memorySnapshot{
+		LastBookID:     lastBookID,
+		LastAuthorID:   lastAuthorID,
+		Books:          books,
+		Authors:        authors,
+		DeletedBooks:   p.books.deletedContents(),
+		DeletedAuthors: p.authors.deletedContents(),
+		History:        p.history.contents(),
+	})
+	if err != nil {
+		return err
+	}
+	tmp := p.path(snapshotFile + ".tmp")
+	if err := writeFileSync(tmp, data); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p.path(snapshotFile)); err != nil {
+		return err
+	}
+	if err := syncDir(p.opts.Dir); err != nil {
+		return err
+	}
+	if err := p.wal.Truncate(0); err != nil {
+		return p.cutOff(err)
+	}
+	if _, err := p.wal.Seek(0, io.SeekStart); err != nil {
+		return p.cutOff(err)
+	}
+	p.size, p.records = 0, 0
+	return p.wal.Sync()
+}
+
+func writeFileSync(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir makes a rename within dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (p *Persistence) syncEvery(interval time.Duration) {
+	defer close(p.done)
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.Sync(); err != nil {
+				log.Printf("fsync failed: %v", err)
+			}
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// Sync flushes the log to disk whatever the policy
+func (p *Persistence) Sync() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.dirty {
+		return nil
+	}
+	if err := p.wal.Sync(); err != nil {
+		return err
+	}
+	p.dirty = false
+	return nil
+}
+
+// Snapshot compacts the log now, e.g. before a planned shutdown
+func (p *Persistence) Snapshot() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.compact()
+}
+
+// Close syncs and closes the log, the repositories can't be written afterwards
+func (p *Persistence) Close() error {
+	if p.stop != nil {
+		close(p.stop)
+		<-p.done
+		p.stop = nil
+	}
+	if err := p.Sync(); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err = errors.New("persistence is closed")
+	return p.wal.Close()
+}
+
+// The wrappers apply a write in memory and log it under the persistence
+// lock, a write which can't be logged is undone and reported.
+
+type persistentBookRepository struct {
+	*MemoryBackedBookRepository
+	p *Persistence
+}
+
+func (repo *persistentBookRepository) Create(ctx context.Context, book *Book) error {
+	repo.p.mu.Lock()
+	defer repo.p.mu.Unlock()
+	if err := repo.MemoryBackedBookRepository.Create(ctx, book); err != nil {
+		return err
+	}
+	if err := repo.p.append("books", walPut, book.ID, book); err != nil {
+		repo.forget(book.ID)
+		return err
+	}
+	return nil
+}
+
+func (repo *persistentBookRepository) Update(ctx context.Context, book *Book, version int) error {
+	repo.p.mu.Lock()
+	defer repo.p.mu.Unlock()
+	previous, err := repo.GetByID(ctx, book.ID)
+	if err != nil {
+		return err
+	}
+	if err := repo.MemoryBackedBookRepository.Update(ctx, book, version); err != nil {
+		return err
+	}
+	if err := repo.p.append("books", walPut, book.ID, book); err != nil {
+		repo.restore(*previous)
+		return err
+	}
+	return nil
+}
+
+func (repo *persistentBookRepository) Delete(ctx context.Context, id int, version int) error {
+	repo.p.mu.Lock()
+	defer repo.p.mu.Unlock()
+	previous, err := repo.GetByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := repo.MemoryBackedBookRepository.Delete(ctx, id, version); err != nil {
+		return err
+	}
+	if err := repo.p.append("books", walDelete, id, previous); err != nil {
+		repo.restore(*previous)
+		return err
+	}
+	return nil
+}
+
+func (repo *persistentBookRepository) Undelete(ctx context.Context, id int) (*Book, error) {
+	repo.p.mu.Lock()
+	defer repo.p.mu.Unlock()
+	previous, err := repo.GetDeletedByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	book, err := repo.MemoryBackedBookRepository.Undelete(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := repo.p.append("books", walPut, id, book); err != nil {
+		repo.restoreDeleted(*previous)
+		return nil, err
+	}
+	return book, nil
+}
+
+type persistentAuthorRepository struct {
+	*MemoryBackedAuthorRepository
+	p *Persistence
+}
+
+func (repo *persistentAuthorRepository) Create(ctx context.Context, author *Author) error {
+	repo.p.mu.Lock()
+	defer repo.p.mu.Unlock()
+	if err := repo.MemoryBackedAuthorRepository.Create(ctx, author); err != nil {
+		return err
+	}
+	if err := repo.p.append("authors", walPut, author.ID, author); err != nil {
+		repo.forget(author.ID)
+		return err
+	}
+	return nil
+}
+
+func (repo *persistentAuthorRepository) Update(ctx context.Context, author *Author, version int) error {
+	repo.p.mu.Lock()
+	defer repo.p.mu.Unlock()
+	previous, err := repo.GetByID(ctx, author.ID)
+	if err != nil {
+		return err
+	}
+	if err := repo.MemoryBackedAuthorRepository.Update(ctx, author, version); err != nil {
+		return err
+	}
+	if err := repo.p.append("authors", walPut, author.ID, author); err != nil {
+		repo.restore(*previous)
+		return err
+	}
+	return nil
+}
+
+func (repo *persistentAuthorRepository) Delete(ctx context.Context, id int, version int) error {
+	repo.p.mu.Lock()
+	defer repo.p.mu.Unlock()
+	previous, err := repo.GetByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := repo.MemoryBackedAuthorRepository.Delete(ctx, id, version); err != nil {
+		return err
+	}
+	if err := repo.p.append("authors", walDelete, id, previous); err != nil {
+		repo.restore(*previous)
+		return err
+	}
+	return nil
+}
+
+func (repo *persistentAuthorRepository) Undelete(ctx context.Context, id int) (*Author, error) {
+	repo.p.mu.Lock()
+	defer repo.p.mu.Unlock()
+	previous, err := repo.GetDeletedByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	author, err := repo.MemoryBackedAuthorRepository.Undelete(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := repo.p.append("authors", walPut, id, author); err != nil {
+		repo.restoreDeleted(*previous)
+		return nil, err
+	}
+	return author, nil
+}
+
+// History returns the repository of the history kept with the books and
+// authors, its entries are logged like their writes.
+func (p *Persistence) History() HistoryRepository {
+	return &persistentHistoryRepository{p.history, p}
+}
+
+type persistentHistoryRepository struct {
+	*MemoryBackedHistoryRepository
+	p *Persistence
+}
+
+func (repo *persistentHistoryRepository) Append(ctx context.Context, entry *HistoryEntry) error {
+	repo.p.mu.Lock()
+	defer repo.p.mu.Unlock()
+	if err := repo.MemoryBackedHistoryRepository.Append(ctx, entry); err != nil {
+		return err
+	}
+	if err := repo.p.append("history", walPut, entry.ID, entry); err != nil {
+		repo.forget(*entry)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func openTestPersistence(t *testing.T, dir string, opts PersistenceOptions) (BookRepository, AuthorRepository, *Persistence) {
+	t.Helper()
+	opts.Dir = dir
+	books, authors, p, err := NewPersistentMemoryRepositories(opts)
+	if err != nil {
+		t.Fatalf("Unable to open the persistence in %s: %v", dir, err)
+	}
+	return books, authors, p
+}
+
+// persistedState is everything which has to survive a restart
+type persistedState struct {
+	Books          []Book
+	LastBookID     int
+	Authors        []Author
+	LastAuthorID   int
+	DeletedBooks   []Book
+	DeletedAuthors []Author
+}
+
+func stateOf(p *Persistence) persistedState {
+	var state persistedState
+	state.Books, state.LastBookID = p.books.contents()
+	state.Authors, state.LastAuthorID = p.authors.contents()
+	state.DeletedBooks, state.DeletedAuthors = p.books.deletedContents(), p.authors.deletedContents()
+	return state
+}
+
+// writeSomeHistory runs creates, updates and deletes, after each one it calls
+// logged with the size of the log and the state it describes.
+func writeSomeHistory(t *testing.T, books BookRepository, authors AuthorRepository, logged func()) {
+	for i := 1; i <= 3; i++ {
+		if err := authors.Create(ctx, &Author{Name: fmt.Sprintf("Author %d", i)}); err != nil {
+			t.Fatal(err)
+		}
+		logged()
+		if err := books.Create(ctx, &Book{Name: fmt.Sprintf("Book %d", i), AuthorIDs: []int{i}}); err != nil {
+			t.Fatal(err)
+		}
+		logged()
+	}
+	steps := []func() error{
+		func() error { return books.Update(ctx, &Book{ID: 1, Name: "Book One", AuthorIDs: []int{2}}, 1) },
+		func() error { return authors.Update(ctx, &Author{ID: 3, Name: "Author Three"}, 1) },
+		func() error { return books.Delete(ctx, 3, 1) },
+		func() error { return authors.Delete(ctx, 3, 2) },
+		func() error { return books.Create(ctx, &Book{Name: "Book 3"}) },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+		logged()
+	}
+}
+
+func TestPersistenceSurvivesRestart(t *testing.T) {
+	for _, opts := range []PersistenceOptions{
+		{Fsync: FsyncAlways},
+		{Fsync: FsyncInterval, SnapshotEvery: 4},
+		{Fsync: FsyncNever, SnapshotEvery: 1},
+	} {
+		t.Run(string(opts.Fsync), func(t *testing.T) {
+			dir := t.TempDir()
+			books, authors, p := openTestPersistence(t, dir, opts)
+			writeSomeHistory(t, books, authors, func() {})
+			expected := stateOf(p)
+			if err := p.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := books.Create(ctx, &Book{Name: "Too late"}); err == nil {
+				t.Error("Expected writes after Close to fail")
+			}
+
+			books, _, p = openTestPersistence(t, dir, opts)
+			defer p.Close()
+			if state := stateOf(p); !reflect.DeepEqual(state, expected) {
+				t.Errorf("Incorrect state - Expected %+v, found %+v", expected, state)
+			}
+			// Book 3 was deleted, its ID is not handed out again
+			book := &Book{Name: "Book 4"}
+			books.Create(ctx, book)
+			if book.ID != 5 {
+				t.Errorf("Incorrect ID - Expected %d, found %d", 5, book.ID)
+			}
+		})
+	}
+}
+
+// TestPersistenceCrashAtEveryOffset cuts the log after every byte, as a crash
+// in the middle of an append would, and checks the state replayed from it is
+// the one of the last complete record.
+func TestPersistenceCrashAtEveryOffset(t *testing.T) {
+	dir := t.TempDir()
+	books, authors, p := openTestPersistence(t, dir, PersistenceOptions{Fsync: FsyncNever})
+	sizes := []int64{0}
+	states := []persistedState{stateOf(p)}
+	writeSomeHistory(t, books, authors, func() {
+		sizes = append(sizes, p.size)
+		states = append(states, stateOf(p))
+	})
+	p.Close()
+	wal, err := ioutil.ReadFile(filepath.Join(dir, walFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(wal)) != sizes[len(sizes)-1] {
+		t.Fatalf("Incorrect log size - Expected %d, found %d", sizes[len(sizes)-1], len(wal))
+	}
+
+	record := 0
+	for offset := 0; offset <= len(wal); offset++ {
+		for record+1 < len(sizes) && sizes[record+1] <= int64(offset) {
+			record++
+		}
+		crashed := t.TempDir()
+		if err := ioutil.WriteFile(filepath.Join(crashed, walFile), wal[:offset], 0600); err != nil {
+			t.Fatal(err)
+		}
+		books, _, p := openTestPersistence(t, crashed, PersistenceOptions{Fsync: FsyncNever})
+		if state := stateOf(p); !reflect.DeepEqual(state, states[record]) {
+			t.Fatalf("Crash at offset %d: incorrect state - Expected %+v, found %+v", offset, states[record], state)
+		}
+		// The torn record is gone, so what comes next is replayed too
+		if err := books.Create(ctx, &Book{Name: "After the crash"}); err != nil {
+			t.Fatal(err)
+		}
+		expected := stateOf(p)
+		p.Close()
+		_, _, p = openTestPersistence(t, crashed, PersistenceOptions{Fsync: FsyncNever})
+		if state := stateOf(p); !reflect.DeepEqual(state, expected) {
+			t.Fatalf("Crash at offset %d: write after recovery lost - Expected %+v, found %+v", offset, expected, state)
+		}
+		p.Close()
+	}
+}
+
+func TestPersistenceDropsDamagedRecord(t *testing.T) {
+	dir := t.TempDir()
+	books, authors, p := openTestPersistence(t, dir, PersistenceOptions{Fsync: FsyncNever})
+	var before persistedState
+	var size int64
+	writeSomeHistory(t, books, authors, func() {
+		before, size = stateOf(p), p.size
+	})
+	p.Close()
+	path := filepath.Join(dir, walFile)
+	wal, _ := ioutil.ReadFile(path)
+	// Flip a byte in the payload of the last record, the length still fits
+	wal[len(wal)-2] ^= 0xff
+	ioutil.WriteFile(path, wal, 0600)
+
+	_, _, p = openTestPersistence(t, dir, PersistenceOptions{Fsync: FsyncNever})
+	defer p.Close()
+	if state := stateOf(p); reflect.DeepEqual(state, before) || len(state.Books) != 2 {
+		t.Errorf("Expected the last create to be dropped, found %+v", state)
+	}
+	if p.size >= size {
+		t.Errorf("Expected the log to be cut before %d, found %d", size, p.size)
+	}
+}
+
+func TestPersistenceCrashDuringSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	books, authors, p := openTestPersistence(t, dir, PersistenceOptions{Fsync: FsyncNever})
+	writeSomeHistory(t, books, authors, func() {})
+	expected := stateOf(p)
+	wal, _ := ioutil.ReadFile(filepath.Join(dir, walFile))
+	if err := p.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	if info, _ := os.Stat(filepath.Join(dir, walFile)); info.Size() != 0 {
+		t.Errorf("Expected an empty log after the snapshot, found %d bytes", info.Size())
+	}
+
+	// The snapshot was renamed but the log not emptied yet, and an
+	// unfinished snapshot of a later compaction is lying around
+	ioutil.WriteFile(filepath.Join(dir, walFile), wal, 0600)
+	ioutil.WriteFile(filepath.Join(dir, snapshotFile+".tmp"), []byte(`{"books":[{"id"`), 0600)
+	_, _, p = openTestPersistence(t, dir, PersistenceOptions{Fsync: FsyncNever})
+	defer p.Close()
+	if state := stateOf(p); !reflect.DeepEqual(state, expected) {
+		t.Errorf("Incorrect state - Expected %+v, found %+v", expected, state)
+	}
+}
+
+func TestPersistenceUndoesUnloggedWrites(t *testing.T) {
+	dir := t.TempDir()
+	books, _, p := openTestPersistence(t, dir, PersistenceOptions{Fsync: FsyncAlways})
+	books.Create(ctx, &Book{Name: "Book 1"})
+	// A log which can't be written to, like a full disk
+	readOnly, err := os.Open(filepath.Join(dir, walFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.wal.Close()
+	p.wal = readOnly
+	defer p.Close()
+
+	if err := books.Create(ctx, &Book{Name: "Book 2"}); err == nil {
+		t.Error("Expected the create to fail")
+	}
+	if err := books.Update(ctx, &Book{ID: 1, Name: "Book One"}, AnyVersion); err == nil {
+		t.Error("Expected the update to fail")
+	}
+	if err := books.Delete(ctx, 1, AnyVersion); err == nil {
+		t.Error("Expected the delete to fail")
+	}
+	all, _ := books.GetAll(ctx)
+	if len(all) != 1 || all[0].Name != "Book 1" {
+		t.Errorf("Expected only the logged create to remain, found %+v", all)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics is a registry of counters, gauges and histograms written in the
+// Prometheus text format by ServeHTTP. Series are created on first use.
+type Metrics struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+}
+
+type metricFamily struct {
+	name, help, kind string
+	buckets          []float64 // upper bounds, for histograms
+	series           map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labels string // rendered, e.g. method="GET",route="/books"
+	value  float64
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+}
+
+// Constructor Function
+func NewMetrics() *Metrics {
+	m := &Metrics{families: make(map[string]*metricFamily)}
+	m.register("http_requests_total", "HTTP requests served by route, method and status code.", "counter", nil)
+	m.register("http_request_duration_seconds", "Time taken to serve HTTP requests.", "histogram", httpBuckets)
+	m.register("http_requests_in_flight", "HTTP requests being served.", "gauge", nil)
+	m.register("repository_calls_total", "Repository calls by backend, repository and method.", "counter", nil)
+	m.register("repository_errors_total", "Failed repository calls by kind of error.", "counter", nil)
+	m.register("repository_call_duration_seconds", "Time taken by repository calls.", "histogram", repositoryBuckets)
+	return m
+}
+
+var (
+	httpBuckets       = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	repositoryBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1}
+)
+
+func (m *Metrics) register(name, help, kind string, buckets []float64) {
+	m.families[name] = &metricFamily{name: name, help: help, kind: kind, buckets: buckets, series: make(map[string]*metricSeries)}
+}
+
+// labels are name and value pairs, e.g. "method", "GET", "route", "/books"
+func renderLabels(labels []string) string {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+labelEscaper.Replace(labels[i+1])+`"`)
+	}
+	return strings.Join(pairs, ",")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *Metrics) series(name string, labels []string) *metricSeries {
+	family := m.families[name]
+	rendered := renderLabels(labels)
+	s, ok := family.series[rendered]
+	if !ok {
+		s = &metricSeries{labels: rendered, counts: make([]uint64, len(family.buckets))}
+		family.series[rendered] = s
+	}
+	return s
+}
+
+// Add adds v to the counter or gauge name
+func (m *Metrics) Add(name string, v float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.series(name, labels).value += v
+}
+
+// Observe records v in the histogram name
+func (m *Metrics) Observe(name string, v float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.series(name, labels)
+	buckets := m.families[name].buckets
+	if i := sort.SearchFloat64s(buckets, v); i < len(buckets) {
+		s.counts[i]++
+	}
+	s.value++
+	s.sum += v
+}
+
+// ServeHTTP writes every series in the text exposition format 0.0.4
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		family := m.families[name]
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, family.help, name, family.kind)
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := family.series[key]
+			if family.kind != "histogram" {
+				fmt.Fprintf(out, "%s%s %s\n", name, braces(s.labels), formatFloat(s.value))
+				continue
+			}
+			var cumulative uint64
+			for i, bound := range family.buckets {
+				cumulative += s.counts[i]
+				fmt.Fprintf(out, "%s_bucket%s %d\n", name, braces(join(s.labels, `le="`+formatFloat(bound)+`"`)), cumulative)
+			}
+			fmt.Fprintf(out, "%s_bucket%s %s\n", name, braces(join(s.labels, `le="+Inf"`)), formatFloat(s.value))
+			fmt.Fprintf(out, "%s_sum%s %s\n", name, braces(s.labels), formatFloat(s.sum))
+			fmt.Fprintf(out, "%s_count%s %s\n", name, braces(s.labels), formatFloat(s.value))
+		}
+	}
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func join(labels, label string) string {
+	if labels == "" {
+		return label
+	}
+	return labels + "," + label
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// statusRecorder remembers the status code written by a handler. Flush is
+// passed on so streaming responses like /export still stream.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Middleware Function, the successor of timed: counts the requests of route
+// by status code, measures how long they take and how many are in flight.
+func metricsMiddleware(handler http.HandlerFunc, metrics *Metrics, route string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		metrics.Add("http_requests_in_flight", 1, "method", r.Method, "route", route)
+		defer metrics.Add("http_requests_in_flight", -1, "method", r.Method, "route", route)
+		recorder := &statusRecorder{ResponseWriter: w}
+		handler.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		metrics.Observe("http_request_duration_seconds", time.Since(start).Seconds(), "method", r.Method, "route", route)
+		metrics.Add("http_requests_total", 1, "method", r.Method, "route", route, "code", strconv.Itoa(recorder.status))
+	}
+}
+
+// errorKind names the kind of a repository error for the errors_total label
+func errorKind(err error) string {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return "not_found"
+	case errors.Is(err, ErrDuplicate):
+		return "duplicate"
+	case errors.Is(err, ErrInvalid):
+		return "invalid"
+	case errors.Is(err, ErrConstraint):
+		return "constraint"
+	case errors.Is(err, ErrConflict):
+		return "conflict"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "canceled"
+	}
+	return "internal"
+}
+
+// instrumentation is shared by the two wrappers below, backend is the
+// storage name, e.g. memory, so every implementation is told apart.
+type instrumentation struct {
+	metrics *Metrics
+	backend string
+}
+
+// NewInstrumentedRepositories wraps the repositories of a backend so every
+// call is counted and timed.
+func NewInstrumentedRepositories(books BookRepository, authors AuthorRepository, metrics *Metrics, backend string) (BookRepository, AuthorRepository) {
+	i := &instrumentation{metrics: metrics, backend: backend}
+	return &instrumentedBookRepository{books, i}, &instrumentedAuthorRepository{authors, i}
+}
+
+func (i *instrumentation) record(repository, method string, start time.Time, err error) {
+	labels := []string{"backend", i.backend, "repository", repository, "method", method}
+	i.metrics.Add("repository_calls_total", 1, labels...)
+	i.metrics.Observe("repository_call_duration_seconds", time.Since(start).Seconds(), labels...)
+	if err != nil {
+		i.metrics.Add("repository_errors_total", 1, append(labels, "kind", errorKind(err))...)
+	}
+}
+
+type instrumentedBookRepository struct {
+	BookRepository
+	*instrumentation
+}
+
+func (repo *instrumentedBookRepository) GetAll(ctx context.Context) (books []Book, err error) {
+	defer func(start time.Time) { repo.record("books", "GetAll", start, err) }(time.Now())
+	return repo.BookRepository.GetAll(ctx)
+}
+
+func (repo *instrumentedBookRepository) Find(ctx context.Context, opts QueryOptions) (books []Book, total int, err error) {
+	defer func(start time.Time) { repo.record("books", "Find", start, err) }(time.Now())
+	return repo.BookRepository.Find(ctx, opts)
+}
+
+func (repo *instrumentedBookRepository) GetByID(ctx context.Context, id int) (book *Book, err error) {
+	defer func(start time.Time) { repo.record("books", "GetByID", start, err) }(time.Now())
+	return repo.BookRepository.GetByID(ctx, id)
+}
+
+func (repo *instrumentedBookRepository) Create(ctx context.Context, book *Book) (err error) {
+	defer func(start time.Time) { repo.record("books", "Create", start, err) }(time.Now())
+	return repo.BookRepository.Create(ctx, book)
+}
+
+func (repo *instrumentedBookRepository) Update(ctx context.Context, book *Book, version int) (err error) {
+	defer func(start time.Time) { repo.record("books", "Update", start, err) }(time.Now())
+	return repo.BookRepository.Update(ctx, book, version)
+}
+
+func (repo *instrumentedBookRepository) Delete(ctx context.Context, id int, version int) (err error) {
+	defer func(start time.Time) { repo.record("books", "Delete", start, err) }(time.Now())
+	return repo.BookRepository.Delete(ctx, id, version)
+}
+
+func (repo *instrumentedBookRepository) GetDeletedByID(ctx context.Context, id int) (book *Book, err error) {
+	defer func(start time.Time) { repo.record("books", "GetDeletedByID", start, err) }(time.Now())
+	return repo.BookRepository.GetDeletedByID(ctx, id)
+}
+
+func (repo *instrumentedBookRepository) Undelete(ctx context.Context, id int) (book *Book, err error) {
+	defer func(start time.Time) { repo.record("books", "Undelete", start, err) }(time.Now())
+	return repo.BookRepository.Undelete(ctx, id)
+}
+
+func (repo *instrumentedBookRepository) Version(ctx context.Context) (version CatalogVersion, err error) {
+	defer func(start time.Time) { repo.record("books", "Version", start, err) }(time.Now())
+	return repo.BookRepository.Version(ctx)
+}
+
+type instrumentedAuthorRepository struct {
+	AuthorRepository
+	*instrumentation
+}
+
+func (repo *instrumentedAuthorRepository) GetAll(ctx context.Context) (authors []Author, err error) {
+	defer func(start time.Time) { repo.record("authors", "GetAll", start, err) }(time.Now())
+	return repo.AuthorRepository.GetAll(ctx)
+}
+
+func (repo *instrumentedAuthorRepository) Find(ctx context.Context, opts QueryOptions) (authors []Author, total int, err error) {
+	defer func(start time.Time) { repo.record("authors", "Find", start, err) }(time.Now())
+	return repo.AuthorRepository.Find(ctx, opts)
+}
+
+func (repo *instrumentedAuthorRepository) GetByID(ctx context.Context, id int) (author *Author, err error) {
+	defer func(start time.Time) { repo.record("authors", "GetByID", start, err) }(time.Now())
+	return repo.AuthorRepository.GetByID(ctx, id)
+}
+
+func (repo *instrumentedAuthorRepository) Create(ctx context.Context, author *Author) (err error) {
+	defer func(start time.Time) { repo.record("authors", "Create", start, err) }(time.Now())
+	return repo.AuthorRepository.Create(ctx, author)
+}
+
+func (repo *instrumentedAuthorRepository) Update(ctx context.Context, author *Author, version int) (err error) {
+	defer func(start time.Time) { repo.record("authors", "Update", start, err) }(time.Now())
+	return repo.AuthorRepository.Update(ctx, author, version)
+}
+
+func (repo *instrumentedAuthorRepository) Delete(ctx context.Context, id int, version int) (err error) {
+	defer func(start time.Time) { repo.record("authors", "Delete", start, err) }(time.Now())
+	return repo.AuthorRepository.Delete(ctx, id, version)
+}
+
+func (repo *instrumentedAuthorRepository) GetDeletedByID(ctx context.Context, id int) (author *Author, err error) {
+	defer func(start time.Time) { repo.record("authors", "GetDeletedByID", start, err) }(time.Now())
+	return repo.AuthorRepository.GetDeletedByID(ctx, id)
+}
+
+func (repo *instrumentedAuthorRepository) Undelete(ctx context.Context, id int) (author *Author, err error) {
+	defer func(start time.Time) { repo.record("authors", "Undelete", start, err) }(time.Now())
+	return repo.AuthorRepository.Undelete(ctx, id)
+}
+
+func (repo *instrumentedAuthorRepository) Version(ctx context.Context) (version CatalogVersion, err error) {
+	defer func(start time.Time) { repo.record("authors", "Version", start, err) }(time.Now())
+	return repo.AuthorRepository.Version(ctx)
+}
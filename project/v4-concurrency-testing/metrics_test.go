@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrape(t *testing.T, handler http.Handler) string {
+	t.Helper()
+	rr := do(handler, http.MethodGet, "/metrics", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Invalid code! I want %d but get %d", http.StatusOK, rr.Code)
+	}
+	return rr.Body.String()
+}
+
+func expectLines(t *testing.T, body string, lines ...string) {
+	t.Helper()
+	for _, line := range lines {
+		if !strings.Contains(body, "\n"+line+"\n") {
+			t.Errorf("Expected the line %s in\n%s", line, body)
+		}
+	}
+}
+
+func TestMetricsExposition(t *testing.T) {
+	m := &Metrics{families: make(map[string]*metricFamily)}
+	m.register("b_seconds", "A histogram.", "histogram", []float64{0.1, 1})
+	m.register("a_total", "A counter.", "counter", nil)
+	m.Add("a_total", 1, "path", `C:\new "dir"`+"\n")
+	m.Add("a_total", 2, "path", `C:\new "dir"`+"\n")
+	m.Add("a_total", 1)
+	m.Observe("b_seconds", 0.1, "op", "x")
+	m.Observe("b_seconds", 0.5, "op", "x")
+	m.Observe("b_seconds", 3, "op", "x")
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	expected := `# HELP a_total A counter.
+# TYPE a_total counter
+a_total 1
+a_total{path="C:\\new \"dir\"\n"} 3
+# HELP b_seconds A histogram.
+# TYPE b_seconds histogram
+b_seconds_bucket{op="x",le="0.1"} 1
+b_seconds_bucket{op="x",le="1"} 2
+b_seconds_bucket{op="x",le="+Inf"} 3
+b_seconds_sum{op="x"} 3.6
+b_seconds_count{op="x"} 3
+`
+	if rr.Body.String() != expected {
+		t.Errorf("Incorrect exposition - Expected\n%s\nfound\n%s", expected, rr.Body)
+	}
+	if contentType := rr.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("Incorrect Content-Type %q", contentType)
+	}
+}
+
+func TestHTTPMetrics(t *testing.T) {
+	api := newTestAPI()
+	api.metrics = NewMetrics()
+	router := newRouter(api)
+	do(router, http.MethodPost, "/authors", strings.NewReader(`{"name":"Author 1"}`))
+	do(router, http.MethodGet, "/authors/1", nil)
+	do(router, http.MethodGet, "/authors/2", nil)
+	do(router, http.MethodGet, "/authors/2", nil)
+
+	body := scrape(t, router)
+	expectLines(t, body,
+		`http_requests_total{method="POST",route="/authors",code="200"} 1`,
+		`http_requests_total{method="GET",route="/authors/{id}",code="200"} 1`,
+		`http_requests_total{method="GET",route="/authors/{id}",code="404"} 2`,
+		`http_request_duration_seconds_count{method="GET",route="/authors/{id}"} 3`,
+		`http_requests_in_flight{method="GET",route="/authors/{id}"} 0`,
+		// The scrape itself is in flight
+		`http_requests_in_flight{method="GET",route="/metrics"} 1`,
+	)
+
+	c := newContract(t, router)
+	c.do(http.MethodGet, "/metrics", "/metrics", "")
+}
+
+func TestHTTPMetricsInFlight(t *testing.T) {
+	metrics := NewMetrics()
+	entered, release := make(chan struct{}), make(chan struct{})
+	handler := metricsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	}, metrics, "/slow")
+	done := make(chan struct{})
+	go func() {
+		handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/slow", nil))
+		close(done)
+	}()
+	<-entered
+	expectLines(t, "\n"+scrape(t, metrics), `http_requests_in_flight{method="DELETE",route="/slow"} 1`)
+	close(release)
+	<-done
+	expectLines(t, "\n"+scrape(t, metrics),
+		`http_requests_in_flight{method="DELETE",route="/slow"} 0`,
+		`http_requests_total{method="DELETE",route="/slow",code="204"} 1`,
+	)
+}
+
+func TestRepositoryMetrics(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, books BookRepository, authors AuthorRepository) {
+		metrics := NewMetrics()
+		books, authors = NewInstrumentedRepositories(books, authors, metrics, "test")
+		authors.Create(ctx, &Author{Name: "Author 1"})
+		if err := authors.Create(ctx, &Author{Name: "Author 1"}); !errors.Is(err, ErrDuplicate) {
+			t.Fatalf("Expected ErrDuplicate, found %v", err)
+		}
+		books.GetByID(ctx, 42)
+		books.Find(ctx, QueryOptions{})
+
+		expectLines(t, scrape(t, metrics),
+			`repository_calls_total{backend="test",repository="authors",method="Create"} 2`,
+			`repository_errors_total{backend="test",repository="authors",method="Create",kind="duplicate"} 1`,
+			`repository_errors_total{backend="test",repository="books",method="GetByID",kind="not_found"} 1`,
+			`repository_calls_total{backend="test",repository="books",method="Find"} 1`,
+			`repository_call_duration_seconds_count{backend="test",repository="books",method="Find"} 1`,
+		)
+	})
+}
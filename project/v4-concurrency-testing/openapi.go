@@ -0,0 +1,467 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// route is one entry of the routing table, newRouter registers it on the mux
+// and openAPIDocument describes it, so the two can't disagree.
+type route struct {
+	pattern    string // ServeMux pattern, /books/ serves /books/{id}
+	suffix     string // after the ID for a subresource of pattern, e.g. /history
+	path       string // OpenAPI path template
+	prefix     string // of the API version, e.g. /v2, stripped before the handler runs
+	operations map[string]operation
+}
+
+// operation describes what one method of a route reads and writes. Bodies are
+// given as sample values of the Go types, their schema comes from reflection.
+type operation struct {
+	handler     http.HandlerFunc
+	summary     string
+	description string
+	query       []parameter
+	request     interface{}   // nil when there is no body
+	responses   []interface{} // one of these is returned on success, none means no body
+	status      int           // of the success response
+	headers     []parameter   // sent with the success response
+	scopes      []string      // required by authMiddleware, none means public
+	rateLimit   RateLimit     // per client, zero means unlimited
+	// Answers 304 to If-None-Match and If-Modified-Since, see validators
+	conditional bool
+	// Answers 304 to If-None-Match naming its ETag, see shapeTag
+	revalidated bool
+	// Takes If-Match and answers 412 to a stale one, see expectedVersion
+	versioned bool
+	// Media types of bodies which are not JSON, they are described as strings
+	requestMediaTypes  []string
+	responseMediaTypes []string
+}
+
+type parameter struct {
+	name        string
+	description string
+	kind        string // JSON schema type, string when empty
+}
+
+var (
+	listParameters = []parameter{
+		{"limit", "Maximum number of results, 0 means all", "integer"},
+		{"offset", "Number of results to skip", "integer"},
+		{"page", "Page number starting at 1, requires size", "integer"},
+		{"size", "Page size, replaces limit and offset", "integer"},
+		{"sort", "Comma separated fields, prefixed with - for descending order e.g. name,-id", ""},
+		{"name~", "Case insensitive substring of the name", ""},
+	}
+	fieldsParameter  = parameter{"fields", "Comma separated fields to send, the others are left out even when they are required e.g. id,name", ""}
+	totalCountHeader = parameter{"X-Total-Count", "Number of matches before paging", "integer"}
+	entityTagHeader  = parameter{"ETag", "Version of the entity, send it back in If-Match to write it only while it is current", ""}
+)
+
+// The OpenAPI 3 document, limited to the parts we use
+
+type openAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIComponents struct {
+	Schemas         map[string]*schema               `json:"schemas"`
+	SecuritySchemes map[string]openAPISecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+type openAPISecurityScheme struct {
+	Type         string `json:"type"`
+	Scheme       string `json:"scheme,omitempty"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+	In           string `json:"in,omitempty"`
+	Name         string `json:"name,omitempty"`
+}
+
+type openAPIOperation struct {
+	Summary     string                      `json:"summary,omitempty"`
+	Description string                      `json:"description,omitempty"`
+	Security    []map[string][]string       `json:"security,omitempty"`
+	Parameters  []openAPIParameter          `json:"parameters,omitempty"`
+	RequestBody *openAPIBody                `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"`
+}
+
+type openAPIParameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *schema `json:"schema"`
+}
+
+type openAPIBody struct {
+	Required bool                        `json:"required,omitempty"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Headers     map[string]openAPIHeader    `json:"headers,omitempty"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIHeader struct {
+	Description string  `json:"description,omitempty"`
+	Schema      *schema `json:"schema"`
+}
+
+type openAPIMediaType struct {
+	Schema *schema `json:"schema"`
+}
+
+// schema is a JSON schema as understood by OpenAPI 3.0
+type schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Items                *schema            `json:"items,omitempty"`
+	Properties           map[string]*schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	ReadOnly             bool               `json:"readOnly,omitempty"`
+	AllOf                []*schema          `json:"allOf,omitempty"`
+	OneOf                []*schema          `json:"oneOf,omitempty"`
+}
+
+// newOpenAPIDocument describes routes, every operation may also answer with
+// the APIError envelope.
+func newOpenAPIDocument(routes []route) *openAPIDocument {
+	doc := &openAPIDocument{
+		OpenAPI:    "3.0.3",
+		Info:       openAPIInfo{Title: "Bookstore", Version: "1"},
+		Paths:      make(map[string]map[string]*openAPIOperation),
+		Components: openAPIComponents{Schemas: make(map[string]*schema)},
+	}
+	apiError := doc.schemaOf(reflect.TypeOf(APIError{}))
+	for _, r := range routes {
+		operations := make(map[string]*openAPIOperation)
+		for method, op := range r.operations {
+			o := &openAPIOperation{
+				Summary:     op.summary,
+				Description: op.description,
+				Responses: map[string]*openAPIResponse{
+					"default": {Description: "Error", Content: jsonContent(apiError)},
+				},
+			}
+			if len(op.scopes) > 0 {
+				doc.secure(o, op.scopes, apiError)
+			}
+			if strings.Contains(r.path, "{id}") {
+				o.Parameters = append(o.Parameters, openAPIParameter{Name: "id", In: "path", Required: true, Schema: &schema{Type: "integer"}})
+			}
+			for _, p := range op.query {
+				o.Parameters = append(o.Parameters, openAPIParameter{Name: p.name, In: "query", Description: p.description, Schema: p.schema()})
+			}
+			if op.request != nil {
+				o.RequestBody = &openAPIBody{Required: true, Content: jsonContent(doc.schemaOf(reflect.TypeOf(op.request)))}
+			}
+			if len(op.requestMediaTypes) > 0 {
+				o.RequestBody = &openAPIBody{Required: true, Content: textContent(op.requestMediaTypes)}
+			}
+			success := &openAPIResponse{Description: http.StatusText(op.status)}
+			if len(op.responseMediaTypes) > 0 {
+				success.Content = textContent(op.responseMediaTypes)
+			}
+			// The shapes may coincide, a book of /v2 nests its authors with or without include
+			var responses []reflect.Type
+			for _, response := range op.responses {
+				if t := reflect.TypeOf(response); !containsType(responses, t) {
+					responses = append(responses, t)
+				}
+			}
+			switch len(responses) {
+			case 0:
+			case 1:
+				success.Content = jsonContent(doc.schemaOf(responses[0]))
+			default:
+				success.Content = jsonContent(doc.oneOf(responses))
+			}
+			for _, h := range op.headers {
+				if success.Headers == nil {
+					success.Headers = make(map[string]openAPIHeader)
+				}
+				success.Headers[h.name] = openAPIHeader{Description: h.description, Schema: h.schema()}
+			}
+			if op.conditional {
+				doc.conditional(o, success)
+			}
+			if op.revalidated {
+				doc.revalidated(o)
+			}
+			if op.versioned {
+				doc.versioned(o, apiError)
+			}
+			if op.rateLimit.Requests > 0 {
+				doc.limit(o, success, op.rateLimit, apiError)
+			}
+			o.Responses[strconv.Itoa(op.status)] = success
+			operations[strings.ToLower(method)] = o
+		}
+		doc.Paths[r.path] = operations
+	}
+	return doc
+}
+
+// secure documents the credentials authMiddleware asks for. Scopes only
+// exist for OAuth in OpenAPI 3.0, so they are listed in the description.
+func (doc *openAPIDocument) secure(o *openAPIOperation, scopes []string, apiError *schema) {
+	doc.Components.SecuritySchemes = map[string]openAPISecurityScheme{
+		"apiKey": {Type: "apiKey", In: "header", Name: "X-API-Key"},
+		"bearer": {Type: "http", Scheme: "bearer", BearerFormat: "JWT"},
+	}
+	if o.Description != "" {
+		o.Description += ". "
+	}
+	o.Description += "Requires the scopes " + strings.Join(scopes, ", ")
+	o.Security = []map[string][]string{{"apiKey": {}}, {"bearer": {}}}
+	o.Responses["401"] = &openAPIResponse{Description: "Missing or invalid credentials", Content: jsonContent(apiError)}
+	o.Responses["403"] = &openAPIResponse{Description: "Missing scope", Content: jsonContent(apiError)}
+}
+
+var rateLimitHeaders = []parameter{
+	{"RateLimit-Limit", "Requests allowed per period", "integer"},
+	{"RateLimit-Remaining", "Requests left right now", "integer"},
+	{"RateLimit-Reset", "Seconds until all requests are available again", "integer"},
+	{"RateLimit-Policy", "The limit and its period in seconds, e.g. 10;w=60", ""},
+}
+
+// limit documents rateLimitMiddleware, its headers come with every response
+func (doc *openAPIDocument) limit(o *openAPIOperation, success *openAPIResponse, limit RateLimit, apiError *schema) {
+	throttled := &openAPIResponse{
+		Description: "Rate limit of " + limit.String() + " exceeded",
+		Headers:     map[string]openAPIHeader{"Retry-After": {Description: "Seconds to wait", Schema: &schema{Type: "integer"}}},
+		Content:     jsonContent(apiError),
+	}
+	for _, h := range rateLimitHeaders {
+		if success.Headers == nil {
+			success.Headers = make(map[string]openAPIHeader)
+		}
+		success.Headers[h.name] = openAPIHeader{Description: h.description, Schema: h.schema()}
+		throttled.Headers[h.name] = openAPIHeader{Description: h.description, Schema: h.schema()}
+	}
+	o.Responses["429"] = throttled
+}
+
+var (
+	conditionalParameters = []parameter{
+		{"If-None-Match", "ETags of the copies the client has", ""},
+		{"If-Modified-Since", "Last-Modified of the copy the client has, ignored with If-None-Match", ""},
+	}
+	validatorHeaders = []parameter{
+		{"ETag", "Changes with every write to the data of the response", ""},
+		{"Last-Modified", "Time of the last write to the data of the response", ""},
+	}
+)
+
+// conditional documents the validators of a response and the 304 they allow
+func (doc *openAPIDocument) conditional(o *openAPIOperation, success *openAPIResponse) {
+	for _, p := range conditionalParameters {
+		o.Parameters = append(o.Parameters, openAPIParameter{Name: p.name, In: "header", Description: p.description, Schema: p.schema()})
+	}
+	notModified := &openAPIResponse{Description: "The copy of the client is current", Headers: make(map[string]openAPIHeader)}
+	for _, h := range validatorHeaders {
+		if success.Headers == nil {
+			success.Headers = make(map[string]openAPIHeader)
+		}
+		success.Headers[h.name] = openAPIHeader{Description: h.description, Schema: h.schema()}
+		notModified.Headers[h.name] = openAPIHeader{Description: h.description, Schema: h.schema()}
+	}
+	o.Responses["304"] = notModified
+}
+
+// revalidated documents the 304 of a read of one entity, which only has
+// its ETag as validator
+func (doc *openAPIDocument) revalidated(o *openAPIOperation) {
+	p := conditionalParameters[0]
+	o.Parameters = append(o.Parameters, openAPIParameter{Name: p.name, In: "header", Description: p.description, Schema: p.schema()})
+	o.Responses["304"] = &openAPIResponse{
+		Description: "The copy of the client is current",
+		Headers:     map[string]openAPIHeader{entityTagHeader.name: {Description: entityTagHeader.description, Schema: entityTagHeader.schema()}},
+	}
+}
+
+// versioned documents If-Match and the 412 of a write to a stale version
+func (doc *openAPIDocument) versioned(o *openAPIOperation, apiError *schema) {
+	o.Parameters = append(o.Parameters, openAPIParameter{Name: "If-Match", In: "header", Description: "ETags of the versions the write may replace, * or none for any", Schema: &schema{Type: "string"}})
+	o.Responses["412"] = &openAPIResponse{Description: "The entity is at another version", Content: jsonContent(apiError)}
+}
+
+func jsonContent(s *schema) map[string]openAPIMediaType {
+	return map[string]openAPIMediaType{"application/json": {Schema: s}}
+}
+
+func textContent(mediaTypes []string) map[string]openAPIMediaType {
+	content := make(map[string]openAPIMediaType)
+	for _, mediaType := range mediaTypes {
+		content[mediaType] = openAPIMediaType{Schema: &schema{Type: "string"}}
+	}
+	return content
+}
+
+// oneOf describes a body of one of types. Lists become a list of one of their
+// items, an empty list would match every one of them otherwise.
+func (doc *openAPIDocument) oneOf(types []reflect.Type) *schema {
+	items := make([]reflect.Type, len(types))
+	for i, t := range types {
+		if t.Kind() != reflect.Slice {
+			items = nil
+			break
+		}
+		items[i] = t.Elem()
+	}
+	if items != nil {
+		return &schema{Type: "array", Items: doc.oneOf(items), Nullable: true}
+	}
+	s := &schema{}
+	for _, t := range types {
+		s.OneOf = append(s.OneOf, doc.schemaOf(t))
+	}
+	return s
+}
+
+func containsType(types []reflect.Type, t reflect.Type) bool {
+	for _, candidate := range types {
+		if candidate == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (p parameter) schema() *schema {
+	if p.kind == "" {
+		return &schema{Type: "string"}
+	}
+	return &schema{Type: p.kind}
+}
+
+// schemaOf follows the rules of encoding/json: embedded structs are flattened,
+// json tags rename or hide fields and omitempty makes them optional. Named
+// structs become components so they are described once and referenced.
+// A field tagged openapi:"readOnly" is set by the server and ignored in requests.
+func (doc *openAPIDocument) schemaOf(t reflect.Type) *schema {
+	// Encoded by its MarshalJSON as an RFC 3339 string
+	if t == reflect.TypeOf(time.Time{}) {
+		return &schema{Type: "string", Format: "date-time"}
+	}
+	// Any JSON, kept as it was written, null too
+	if t == reflect.TypeOf(json.RawMessage{}) {
+		return &schema{Nullable: true}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return nullable(doc.schemaOf(t.Elem()))
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &schema{Type: "string"}
+		}
+		// A nil slice is encoded as null
+		return &schema{Type: "array", Items: doc.schemaOf(t.Elem()), Nullable: t.Kind() == reflect.Slice}
+	case reflect.Map:
+		return &schema{Type: "object", AdditionalProperties: boolPtr(true)}
+	case reflect.Interface:
+		return &schema{}
+	case reflect.Bool:
+		return &schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &schema{Type: "number"}
+	case reflect.String:
+		return &schema{Type: "string"}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return doc.structSchema(t)
+		}
+		ref := &schema{Ref: "#/components/schemas/" + t.Name()}
+		if _, ok := doc.Components.Schemas[t.Name()]; !ok {
+			// Registered before the fields so recursive types terminate
+			doc.Components.Schemas[t.Name()] = nil
+			doc.Components.Schemas[t.Name()] = doc.structSchema(t)
+		}
+		return ref
+	}
+	return &schema{}
+}
+
+func (doc *openAPIDocument) structSchema(t reflect.Type) *schema {
+	s := &schema{Type: "object", Properties: make(map[string]*schema), AdditionalProperties: boolPtr(false)}
+	doc.addFields(s, t)
+	sort.Strings(s.Required)
+	return s
+}
+
+func (doc *openAPIDocument) addFields(s *schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" || (field.PkgPath != "" && !field.Anonymous) {
+			continue
+		}
+		name, options := tag, ""
+		if comma := strings.Index(tag, ","); comma >= 0 {
+			name, options = tag[:comma], tag[comma:]
+		}
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			doc.addFields(s, field.Type)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		property := doc.schemaOf(field.Type)
+		if field.Tag.Get("openapi") == "readOnly" {
+			property.ReadOnly = true
+		}
+		s.Properties[name] = property
+		if !strings.Contains(options, ",omitempty") {
+			s.Required = append(s.Required, name)
+		}
+	}
+}
+
+// nullable allows null next to s, a $ref can't have siblings so it is wrapped
+func nullable(s *schema) *schema {
+	if s.Ref != "" {
+		return &schema{AllOf: []*schema{s}, Nullable: true}
+	}
+	s.Nullable = true
+	return s
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+// serveJSON responds with a document encoded once up front
+func serveJSON(document interface{}) http.HandlerFunc {
+	body, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
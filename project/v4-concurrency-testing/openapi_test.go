@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// contract checks responses against the document served on /openapi.json
+// and remembers which operations were exercised.
+type contract struct {
+	t       *testing.T
+	router  http.Handler
+	doc     map[string]interface{}
+	covered map[string]bool
+}
+
+func newContract(t *testing.T, router http.Handler) *contract {
+	rr := do(router, http.MethodGet, "/openapi.json", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Invalid code! I want %d but get %d", http.StatusOK, rr.Code)
+	}
+	c := &contract{t: t, router: router, covered: make(map[string]bool)}
+	if err := json.Unmarshal(rr.Body.Bytes(), &c.doc); err != nil {
+		t.Fatal(err)
+	}
+	c.covered["get /openapi.json"] = true
+	return c
+}
+
+// do sends the request and fails the test when the response isn't one the
+// document allows for path, the template the target belongs to.
+func (c *contract) do(method, target, path, body string) *httptest.ResponseRecorder {
+	c.t.Helper()
+	rr := do(c.router, method, target, strings.NewReader(body))
+	name := strings.ToLower(method) + " " + path
+	c.covered[name] = true
+
+	op, ok := lookup(c.doc, "paths", path, strings.ToLower(method)).(map[string]interface{})
+	if !ok {
+		c.t.Fatalf("%s is not documented", name)
+	}
+	response := lookup(op, "responses", strconv.Itoa(rr.Code))
+	if response == nil {
+		response = lookup(op, "responses", "default")
+	}
+	content, _ := lookup(response, "content").(map[string]interface{})
+	if content == nil {
+		if rr.Body.Len() != 0 {
+			c.t.Errorf("%s %s answered %d with a body %q, none is documented", method, target, rr.Code, rr.Body)
+		}
+		return rr
+	}
+	contentType, _, _ := mime.ParseMediaType(rr.Header().Get("Content-Type"))
+	if _, ok := content[contentType]; !ok {
+		c.t.Errorf("%s %s answered %d with the undocumented Content-Type %q", method, target, rr.Code, contentType)
+		return rr
+	}
+	headers, _ := lookup(response, "headers").(map[string]interface{})
+	for header := range headers {
+		if rr.Header().Get(header) == "" {
+			c.t.Errorf("%s %s answered %d without the %s header", method, target, rr.Code, header)
+		}
+	}
+	if contentType != "application/json" {
+		return rr
+	}
+	s := lookup(content, contentType, "schema")
+	var value interface{}
+	decoder := json.NewDecoder(rr.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		c.t.Fatalf("%s %s answered %d with invalid JSON: %v", method, target, rr.Code, err)
+	}
+	if err := c.validate(value, s, "body"); err != nil {
+		c.t.Errorf("%s %s answered %d against the schema: %v", method, target, rr.Code, err)
+	}
+	return rr
+}
+
+func (c *contract) checkCoverage() {
+	var missing []string
+	for path, operations := range c.doc["paths"].(map[string]interface{}) {
+		for method := range operations.(map[string]interface{}) {
+			if !c.covered[method+" "+path] {
+				missing = append(missing, method+" "+path)
+			}
+		}
+	}
+	sort.Strings(missing)
+	if len(missing) > 0 {
+		c.t.Errorf("Operations without a contract test: %v", missing)
+	}
+}
+
+func lookup(node interface{}, keys ...string) interface{} {
+	for _, key := range keys {
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		node = m[key]
+	}
+	return node
+}
+
+// validate implements the parts of JSON schema newOpenAPIDocument produces
+func (c *contract) validate(value, s interface{}, at string) error {
+	if ref, ok := lookup(s, "$ref").(string); ok {
+		return c.validate(value, lookup(c.doc, strings.Split(strings.TrimPrefix(ref, "#/"), "/")...), at)
+	}
+	if value == nil {
+		if lookup(s, "nullable") == true {
+			return nil
+		}
+		return fmt.Errorf("%s is null", at)
+	}
+	if all, ok := lookup(s, "allOf").([]interface{}); ok {
+		for _, sub := range all {
+			if err := c.validate(value, sub, at); err != nil {
+				return err
+			}
+		}
+	}
+	if one, ok := lookup(s, "oneOf").([]interface{}); ok {
+		matches := 0
+		for _, sub := range one {
+			if c.validate(value, sub, at) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fmt.Errorf("%s matches %d of the oneOf schemas instead of 1", at, matches)
+		}
+	}
+
+	switch lookup(s, "type") {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s is not an object", at)
+		}
+		properties, _ := lookup(s, "properties").(map[string]interface{})
+		required, _ := lookup(s, "required").([]interface{})
+		for _, name := range required {
+			if _, ok := object[name.(string)]; !ok {
+				return fmt.Errorf("%s misses the required %s", at, name)
+			}
+		}
+		for name, field := range object {
+			property, ok := properties[name]
+			if !ok {
+				if lookup(s, "additionalProperties") == false {
+					return fmt.Errorf("%s has the undocumented %s", at, name)
+				}
+				continue
+			}
+			if err := c.validate(field, property, at+"."+name); err != nil {
+				return err
+			}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s is not an array", at)
+		}
+		for i, item := range array {
+			if err := c.validate(item, lookup(s, "items"), fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case "integer":
+		if n, ok := value.(json.Number); !ok || strings.ContainsAny(n.String(), ".eE") {
+			return fmt.Errorf("%s is not an integer", at)
+		}
+	case "number":
+		if _, ok := value.(json.Number); !ok {
+			return fmt.Errorf("%s is not a number", at)
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("%s is not a string", at)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s is not a boolean", at)
+		}
+	}
+	return nil
+}
+
+func TestHandlersMatchOpenAPIDocument(t *testing.T) {
+	c := newContract(t, newRouter(newTestAPI()))
+	// Every version gets a fresh catalog, the document is the same for all
+	for _, prefix := range []string{"", "/v1", "/v2"} {
+		c.router = newRouter(newTestAPI())
+		// v2 nests the author, v1 and the negotiated routes take its id
+		withAuthor := func(name string, id int) string {
+			if prefix == "/v2" {
+				return fmt.Sprintf(`{"name":%q,"author":{"id":%d}}`, name, id)
+			}
+			return fmt.Sprintf(`{"name":%q,"authorId":%d}`, name, id)
+		}
+
+		c.do(http.MethodGet, prefix+"/authors", prefix+"/authors", "")
+		c.do(http.MethodPost, prefix+"/authors", prefix+"/authors", `{"name":"Author 1"}`)
+		c.do(http.MethodPost, prefix+"/authors", prefix+"/authors", `{"name":"Author 2"}`)
+		c.do(http.MethodPost, prefix+"/authors", prefix+"/authors", `{"name":"Author 1"}`)
+		c.do(http.MethodPost, prefix+"/authors", prefix+"/authors", `{"name":""}`)
+		c.do(http.MethodPost, prefix+"/books", prefix+"/books", withAuthor("Book 1", 1))
+		c.do(http.MethodPost, prefix+"/books", prefix+"/books", withAuthor("Book 2", 1))
+		c.do(http.MethodPost, prefix+"/books", prefix+"/books", `{"name":"Book 3"}`)
+		c.do(http.MethodPost, prefix+"/books", prefix+"/books", withAuthor("Book 4", 42))
+		c.do(http.MethodPost, prefix+"/books", prefix+"/books", `not json`)
+
+		c.do(http.MethodGet, prefix+"/authors?sort=-name&limit=1", prefix+"/authors", "")
+		c.do(http.MethodGet, prefix+"/authors?sort=age", prefix+"/authors", "")
+		c.do(http.MethodGet, prefix+"/authors/1", prefix+"/authors/{id}", "")
+		c.do(http.MethodGet, prefix+"/authors/9", prefix+"/authors/{id}", "")
+		c.do(http.MethodPut, prefix+"/authors/2", prefix+"/authors/{id}", `{"name":"Author Two"}`)
+		c.do(http.MethodPatch, prefix+"/authors/2", prefix+"/authors/{id}", `{"name":"Author 2"}`)
+		c.do(http.MethodPatch, prefix+"/authors/9", prefix+"/authors/{id}", `{"name":"Author 9"}`)
+
+		c.do(http.MethodGet, prefix+"/books?authorId=1&page=1&size=1", prefix+"/books", "")
+		c.do(http.MethodGet, prefix+"/books?page=1", prefix+"/books", "")
+		c.do(http.MethodGet, prefix+"/books/1", prefix+"/books/{id}", "")
+		c.do(http.MethodGet, prefix+"/books/x", prefix+"/books/{id}", "")
+		c.do(http.MethodPut, prefix+"/books/3", prefix+"/books/{id}", `{"name":"Book Three"}`)
+		c.do(http.MethodPatch, prefix+"/books/3", prefix+"/books/{id}", withAuthor("Book 3", 1))
+		c.do(http.MethodPatch, prefix+"/books/3", prefix+"/books/{id}", `{"name":""}`)
+
+		for _, query := range []string{"", "?join=left", "?group=author", "?join=outer"} {
+			c.do(http.MethodGet, prefix+"/books-authors"+query, prefix+"/books-authors", "")
+		}
+		c.do(http.MethodGet, prefix+"/books?include=author", prefix+"/books", "")
+		c.do(http.MethodGet, prefix+"/books?include=publisher", prefix+"/books", "")
+		c.do(http.MethodGet, prefix+"/books/1?include=author", prefix+"/books/{id}", "")
+		c.do(http.MethodGet, prefix+"/books/1?fields=age", prefix+"/books/{id}", "")
+		c.do(http.MethodGet, prefix+"/authors?include=books", prefix+"/authors", "")
+		c.do(http.MethodGet, prefix+"/authors/1?include=books", prefix+"/authors/{id}", "")
+		c.do(http.MethodDelete, prefix+"/authors/1", prefix+"/authors/{id}", "")
+		c.do(http.MethodDelete, prefix+"/authors/2", prefix+"/authors/{id}", "")
+		c.do(http.MethodDelete, prefix+"/books/2", prefix+"/books/{id}", "")
+		c.do(http.MethodDelete, prefix+"/books/2", prefix+"/books/{id}", "")
+
+		c.do(http.MethodGet, prefix+"/books/2/history", prefix+"/books/{id}/history", "")
+		c.do(http.MethodGet, prefix+"/books/9/history", prefix+"/books/{id}/history", "")
+		c.do(http.MethodPost, prefix+"/books/2/undelete", prefix+"/books/{id}/undelete", "")
+		c.do(http.MethodPost, prefix+"/books/2/undelete", prefix+"/books/{id}/undelete", "")
+		c.do(http.MethodGet, prefix+"/authors/2/history", prefix+"/authors/{id}/history", "")
+		c.do(http.MethodGet, prefix+"/authors/x/history", prefix+"/authors/{id}/history", "")
+		c.do(http.MethodPost, prefix+"/authors/2/undelete", prefix+"/authors/{id}/undelete", "")
+		c.do(http.MethodPost, prefix+"/authors/1/undelete", prefix+"/authors/{id}/undelete", "")
+	}
+	c.do(http.MethodPost, "/import?format=ndjson", "/import", `{"type":"author","name":"Author 3"}`+"\n"+`{"type":"magazine","name":"x"}`)
+	c.do(http.MethodPost, "/import", "/import", "type,name\n")
+	c.do(http.MethodGet, "/export?format=csv", "/export", "")
+	c.do(http.MethodGet, "/export", "/export", "")
+	c.do(http.MethodGet, "/search?q=book", "/search", "")
+	c.do(http.MethodGet, "/search?q=", "/search", "")
+	c.do(http.MethodPost, "/webhooks", "/webhooks", `{"url":"http://127.0.0.1:1/hook","entities":["books"],"secret":"s3cret"}`)
+	c.do(http.MethodPost, "/webhooks", "/webhooks", `{"url":"not a url","actions":["TRUNCATE"]}`)
+	c.do(http.MethodGet, "/webhooks", "/webhooks", "")
+	c.do(http.MethodGet, "/webhooks/1", "/webhooks/{id}", "")
+	c.do(http.MethodGet, "/webhooks/dead-letters", "/webhooks/dead-letters", "")
+	c.do(http.MethodDelete, "/webhooks/1", "/webhooks/{id}", "")
+	c.do(http.MethodDelete, "/webhooks/1", "/webhooks/{id}", "")
+	// Closing the broker ends the stream, as a shutdown does
+	api := newTestAPI()
+	api.events.Close()
+	c.router = newRouter(api)
+	c.do(http.MethodGet, "/events", "/events", "")
+
+	c.checkCoverage()
+}
+
+func TestContractCatchesDrift(t *testing.T) {
+	c := newContract(t, newRouter(newTestAPI()))
+	book := map[string]interface{}{"$ref": "#/components/schemas/BookV1"}
+	cases := []struct {
+		body  string
+		valid bool
+	}{
+		{`{"id":1,"name":"Book 1"}`, true},
+		{`{"id":1,"name":"Book 1","authorId":2}`, true},
+		{`{"id":1}`, false},
+		{`{"id":"1","name":"Book 1"}`, false},
+		{`{"id":1.5,"name":"Book 1"}`, false},
+		{`{"id":1,"name":"Book 1","publisher":"0"}`, false},
+		{`null`, false},
+	}
+	for _, test := range cases {
+		var value interface{}
+		decoder := json.NewDecoder(strings.NewReader(test.body))
+		decoder.UseNumber()
+		decoder.Decode(&value)
+		if err := c.validate(value, book, "body"); (err == nil) != test.valid {
+			t.Errorf("Validating %s - Expected valid %v, found %v", test.body, test.valid, err)
+		}
+	}
+}
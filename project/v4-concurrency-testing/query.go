@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SortField orders a listing by one field, fields use the JSON names e.g. authorId
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+// QueryOptions narrows and orders the result of Find. The zero value returns
+// everything ordered by ID, which is also the tie breaker for any other order.
+type QueryOptions struct {
+	Limit  int // 0 means no limit
+	Offset int
+	Sort   []SortField
+	// Filters, zero values match everything
+	IDs          map[int]bool // only these
+	AuthorID     int          // only used for books
+	AuthorIDs    map[int]bool // only used for books, the books of any of them
+	NameContains string       // case insensitive
+	AfterID      int          // only IDs above it, pages by ID stay stable under writes
+}
+
+// sortsByIDOnly tells backends that the natural ID order can be used as is
+func (opts QueryOptions) sortsByIDOnly() bool {
+	return len(opts.Sort) == 0 || (len(opts.Sort) == 1 && opts.Sort[0].Field == "id" && !opts.Sort[0].Desc)
+}
+
+func (opts QueryOptions) matchesName(name string) bool {
+	return opts.NameContains == "" || strings.Contains(strings.ToLower(name), strings.ToLower(opts.NameContains))
+}
+
+func (opts QueryOptions) matchesID(id int) bool {
+	return id > opts.AfterID && (len(opts.IDs) == 0 || opts.IDs[id])
+}
+
+func (opts QueryOptions) matchesAuthor(author Author) bool {
+	return opts.matchesID(author.ID) && opts.matchesName(author.Name)
+}
+
+func (opts QueryOptions) matchesBook(book Book) bool {
+	return opts.matchesID(book.ID) && (opts.AuthorID == 0 || book.hasAuthor(opts.AuthorID)) &&
+		opts.matchesAuthorIDs(book) && opts.matchesName(book.Name)
+}
+
+func (opts QueryOptions) matchesAuthorIDs(book Book) bool {
+	if len(opts.AuthorIDs) == 0 {
+		return true
+	}
+	for _, id := range book.AuthorIDs {
+		if opts.AuthorIDs[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// window returns the bounds of the requested page within total results
+func (opts QueryOptions) window(total int) (int, int) {
+	start := opts.Offset
+	if start > total {
+		start = total
+	}
+	end := total
+	// Compared without adding, a huge limit would overflow
+	if opts.Limit > 0 && opts.Limit < total-start {
+		end = start + opts.Limit
+	}
+	return start, end
+}
+
+var (
+	bookSortFields   = map[string]bool{"id": true, "name": true, "authorId": true, "year": true}
+	authorSortFields = map[string]bool{"id": true, "name": true}
+)
+
+// parseQueryOptions reads limit/offset (or page/size), sort=name,-id and
+// the authorId= and name~= filters from the query string of a listing.
+func parseQueryOptions(query url.Values, sortFields map[string]bool) (QueryOptions, error) {
+	var opts QueryOptions
+	var err error
+	if opts.Limit, err = nonNegative(query, "limit"); err != nil {
+		return opts, err
+	}
+	if opts.Offset, err = nonNegative(query, "offset"); err != nil {
+		return opts, err
+	}
+	if query.Get("page") != "" || query.Get("size") != "" {
+		page, err := nonNegative(query, "page")
+		if err != nil {
+			return opts, err
+		}
+		size, err := nonNegative(query, "size")
+		if err != nil {
+			return opts, err
+		}
+		if page == 0 {
+			page = 1
+		}
+		if size == 0 {
+			return opts, badRequest("size", "is required with page")
+		}
+		if page-1 > math.MaxInt/size {
+			return opts, badRequest("page", "is beyond the last possible page")
+		}
+		opts.Limit, opts.Offset = size, (page-1)*size
+	}
+	if sort := query.Get("sort"); sort != "" {
+		for _, field := range strings.Split(sort, ",") {
+			desc := strings.HasPrefix(field, "-")
+			field = strings.TrimPrefix(field, "-")
+			if !sortFields[field] {
+				return opts, badRequest("sort", fmt.Sprintf("cannot sort by %q", field))
+			}
+			opts.Sort = append(opts.Sort, SortField{field, desc})
+		}
+	}
+	if sortFields["authorId"] {
+		if opts.AuthorID, err = nonNegative(query, "authorId"); err != nil {
+			return opts, err
+		}
+	}
+	// name~=foo arrives as the key "name~"
+	opts.NameContains = query.Get("name~")
+	return opts, nil
+}
+
+func nonNegative(query url.Values, key string) (int, error) {
+	value := query.Get(key)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, badRequest(key, "must be a non negative number")
+	}
+	return n, nil
+}
+
+// lessBy compares two entities field by field, compare returns the ordering
+// of a single field. The ID comparison settles ties so the order is stable.
+func lessBy(fields []SortField, compare func(field string) int, idA, idB int) bool {
+	for _, f := range fields {
+		c := compare(f.Field)
+		if f.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c < 0
+		}
+	}
+	return idA < idB
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// sortBooks and sortAuthors are used by the backends which can't sort for us
+func sortBooks(books []Book, fields []SortField) {
+	sort.Slice(books, func(i, j int) bool {
+		a, b := books[i], books[j]
+		return lessBy(fields, func(field string) int {
+			switch field {
+			case "name":
+				return strings.Compare(a.Name, b.Name)
+			case "authorId":
+				return compareInts(a.firstAuthor(), b.firstAuthor())
+			case "year":
+				return compareInts(a.Year, b.Year)
+			}
+			return compareInts(a.ID, b.ID)
+		}, a.ID, b.ID)
+	})
+}
+
+func sortAuthors(authors []Author, fields []SortField) {
+	sort.Slice(authors, func(i, j int) bool {
+		a, b := authors[i], authors[j]
+		return lessBy(fields, func(field string) int {
+			if field == "name" {
+				return strings.Compare(a.Name, b.Name)
+			}
+			return compareInts(a.ID, b.ID)
+		}, a.ID, b.ID)
+	})
+}
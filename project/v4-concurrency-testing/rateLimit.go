@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit lets a client make Requests per Period, all of them at once if
+// it has been quiet for a Period. It is a token bucket of Requests tokens
+// refilled at a steady rate.
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+}
+
+func (l RateLimit) String() string {
+	return fmt.Sprintf("%d/%s", l.Requests, l.Period)
+}
+
+// RateLimits configures the limits per route, keyed like "POST /books" with
+// the path as it appears in /openapi.json. "*" is used for the other routes.
+type RateLimits struct {
+	Routes map[string]RateLimit
+	now    func() time.Time
+}
+
+// ParseRateLimits reads route=requests/period entries separated by semicolons,
+// e.g. POST /books=10/1m;*=600/1m
+func ParseRateLimits(value string) (*RateLimits, error) {
+	limits := &RateLimits{Routes: make(map[string]RateLimit), now: time.Now}
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		equals := strings.LastIndex(entry, "=")
+		slash := strings.LastIndex(entry, "/")
+		if equals < 0 || slash < equals {
+			return nil, fmt.Errorf("invalid rate limit %q, use route=requests/period", entry)
+		}
+		requests, err := strconv.Atoi(strings.TrimSpace(entry[equals+1 : slash]))
+		if err != nil || requests <= 0 {
+			return nil, fmt.Errorf("invalid rate limit %q, requests must be a positive number", entry)
+		}
+		period, err := time.ParseDuration(strings.TrimSpace(entry[slash+1:]))
+		if err != nil || period <= 0 {
+			return nil, fmt.Errorf("invalid rate limit %q, period must be a positive duration", entry)
+		}
+		route := strings.Join(strings.Fields(entry[:equals]), " ")
+		limits.Routes[route] = RateLimit{Requests: requests, Period: period}
+	}
+	return limits, nil
+}
+
+// forRoute returns the limit of method and path, false when there is none
+func (l *RateLimits) forRoute(method, path string) (RateLimit, bool) {
+	if limit, ok := l.Routes[method+" "+path]; ok {
+		return limit, true
+	}
+	limit, ok := l.Routes["*"]
+	return limit, ok
+}
+
+// RateLimiter keeps a bucket per client for one route. Buckets which have
+// filled up again are dropped, a client missing a bucket has a full one.
+type RateLimiter struct {
+	mu        sync.Mutex
+	limit     RateLimit
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Constructor Function
+func NewRateLimiter(limit RateLimit, now func() time.Time) *RateLimiter {
+	return &RateLimiter{limit: limit, buckets: make(map[string]*bucket), lastSweep: now(), now: now}
+}
+
+// rateDecision is what the middleware tells the client
+type rateDecision struct {
+	allowed    bool
+	remaining  int
+	reset      time.Duration // until the bucket is full
+	retryAfter time.Duration // until the next request is allowed
+}
+
+// Allow takes a token from the bucket of key if there is one
+func (l *RateLimiter) Allow(key string) rateDecision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	capacity := float64(l.limit.Requests)
+	perToken := l.limit.Period / time.Duration(l.limit.Requests)
+
+	if now.Sub(l.lastSweep) >= l.limit.Period {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, last: now}
+		l.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(capacity, b.tokens+float64(elapsed)/float64(perToken))
+		b.last = now
+	}
+	decision := rateDecision{allowed: b.tokens >= 1}
+	if decision.allowed {
+		b.tokens--
+	} else {
+		decision.retryAfter = time.Duration((1 - b.tokens) * float64(perToken))
+	}
+	decision.remaining = int(b.tokens)
+	decision.reset = time.Duration((capacity - b.tokens) * float64(perToken))
+	return decision
+}
+
+// sweep drops the buckets which are full by now
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= l.limit.Period {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// rateLimitKey identifies the client by the subject of its credentials when
+// auth accepts them, otherwise by IP. An unchecked credential can't be the
+// key: a client sending a new made up one with every request would get a
+// fresh bucket each time.
+func rateLimitKey(r *http.Request, auth *Authenticator) string {
+	if auth != nil {
+		if principal, err := auth.Authenticate(r); err == nil {
+			return "subject:" + principal.Subject
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// seconds rounds up, a client retrying after the advertised time must succeed
+func seconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
+
+// Middleware Function, answers 429 once the client used up the limit of the
+// route. The RateLimit headers follow the IETF draft. It runs before
+// authMiddleware so floods of bad credentials are limited too, by IP.
+func rateLimitMiddleware(handler http.HandlerFunc, limiter *RateLimiter, auth *Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		decision := limiter.Allow(rateLimitKey(r, auth))
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(limiter.limit.Requests))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(decision.remaining))
+		w.Header().Set("RateLimit-Reset", seconds(decision.reset))
+		w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%s", limiter.limit.Requests, seconds(limiter.limit.Period)))
+		if !decision.allowed {
+			w.Header().Set("Retry-After", seconds(decision.retryAfter))
+			writeError(w, &APIError{
+				Status:  http.StatusTooManyRequests,
+				Code:    "rate_limited",
+				Message: fmt.Sprintf("Too many requests, retry in %s seconds", seconds(decision.retryAfter)),
+			})
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}
+}
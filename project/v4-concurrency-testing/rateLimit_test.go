@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testClock only moves when the test says so
+type testClock struct {
+	now time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := ParseRateLimits(" POST  /books = 10/1m ; * = 600/1h;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]RateLimit{
+		"POST /books": {Requests: 10, Period: time.Minute},
+		"*":           {Requests: 600, Period: time.Hour},
+	}
+	if !reflect.DeepEqual(limits.Routes, expected) {
+		t.Errorf("Incorrect limits - Expected %v, found %v", expected, limits.Routes)
+	}
+	if limit, _ := limits.forRoute(http.MethodGet, "/books"); limit.Requests != 600 {
+		t.Errorf("Expected the default limit for other routes, found %v", limit)
+	}
+	for _, value := range []string{"POST /books", "POST /books=10", "*=0/1m", "*=10/soon", "*=10/-1s"} {
+		if _, err := ParseRateLimits(value); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestRateLimiterTokenBucket(t *testing.T) {
+	clock := newTestClock()
+	limiter := NewRateLimiter(RateLimit{Requests: 3, Period: 3 * time.Second}, clock.Now)
+
+	for i := 2; i >= 0; i-- {
+		if d := limiter.Allow("a"); !d.allowed || d.remaining != i {
+			t.Fatalf("Expected request to be allowed with %d remaining, found %+v", i, d)
+		}
+	}
+	d := limiter.Allow("a")
+	if d.allowed || d.retryAfter != time.Second || d.reset != 3*time.Second {
+		t.Errorf("Expected to wait a second, found %+v", d)
+	}
+	// Other clients have their own bucket
+	if d := limiter.Allow("b"); !d.allowed {
+		t.Error("Expected another client to be allowed")
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	if d := limiter.Allow("a"); d.allowed || d.retryAfter != 500*time.Millisecond {
+		t.Errorf("Expected to wait half a second more, found %+v", d)
+	}
+	clock.Advance(500 * time.Millisecond)
+	if d := limiter.Allow("a"); !d.allowed || d.remaining != 0 {
+		t.Errorf("Expected one refilled request, found %+v", d)
+	}
+	// Quiet clients get the whole burst back, but not more
+	clock.Advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		limiter.Allow("a")
+	}
+	if d := limiter.Allow("a"); d.allowed {
+		t.Error("Expected the bucket to hold no more than the limit")
+	}
+	// Idle buckets are dropped
+	clock.Advance(3 * time.Second)
+	limiter.Allow("c")
+	if len(limiter.buckets) != 1 {
+		t.Errorf("Incorrect buckets - Expected %d, found %d", 1, len(limiter.buckets))
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	clock := newTestClock()
+	api := newTestAPI()
+	api.rateLimits = &RateLimits{
+		Routes: map[string]RateLimit{
+			"POST /books": {Requests: 2, Period: time.Minute},
+			"*":           {Requests: 100, Period: time.Minute},
+		},
+		now: clock.Now,
+	}
+	router := newRouter(api)
+	post := func(name, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/books", strings.NewReader(`{"name":"`+name+`"}`))
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	post("Book 1", "")
+	rr := post("Book 2", "")
+	if rr.Code != http.StatusOK || rr.Header().Get("RateLimit-Remaining") != "0" || rr.Header().Get("RateLimit-Limit") != "2" {
+		t.Errorf("Unexpected response %d with headers %v", rr.Code, rr.Header())
+	}
+	rr = post("Book 3", "")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Invalid code! I want %d but get %d", http.StatusTooManyRequests, rr.Code)
+	}
+	var response APIError
+	json.NewDecoder(rr.Body).Decode(&response)
+	if response.Code != "rate_limited" || rr.Header().Get("Retry-After") != "30" || rr.Header().Get("RateLimit-Policy") != "2;w=60" {
+		t.Errorf("Unexpected throttled response %+v with headers %v", response, rr.Header())
+	}
+	if all, _ := api.bookRepository.GetAll(ctx); len(all) != 2 {
+		t.Errorf("Incorrect length - Expected %d, found %d", 2, len(all))
+	}
+
+	// Another client, and other routes, are not affected
+	req := httptest.NewRequest(http.MethodPost, "/books", strings.NewReader(`{"name":"Book 3"}`))
+	req.RemoteAddr = "198.51.100.7:1234"
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Invalid code! I want %d but get %d", http.StatusOK, rr.Code)
+	}
+	if rr := do(router, http.MethodGet, "/books", nil); rr.Code != http.StatusOK || rr.Header().Get("RateLimit-Limit") != "100" {
+		t.Errorf("Unexpected response %d with headers %v", rr.Code, rr.Header())
+	}
+
+	clock.Advance(30 * time.Second)
+	if rr := post("Book 4", ""); rr.Code != http.StatusOK {
+		t.Errorf("Invalid code after Retry-After! I want %d but get %d", http.StatusOK, rr.Code)
+	}
+}
+
+// Clients are told apart by their principal, made up credentials don't count
+func TestRateLimitKeysOnThePrincipal(t *testing.T) {
+	api := newTestAPI()
+	api.authenticator = NewAuthenticator([]APIKey{
+		{Key: "laptop-key", Principal: Principal{Subject: "ci", Scopes: []string{ScopeBooksWrite}}},
+		{Key: "server-key", Principal: Principal{Subject: "ci", Scopes: []string{ScopeBooksWrite}}},
+		{Key: "other-key", Principal: Principal{Subject: "reader", Scopes: []string{}}},
+	}, nil)
+	api.rateLimits = &RateLimits{Routes: map[string]RateLimit{"GET /books": {Requests: 2, Period: time.Minute}}, now: newTestClock().Now}
+	router := newRouter(api)
+	get := func(apiKey string) int {
+		req := httptest.NewRequest(http.MethodGet, "/books", nil)
+		req.Header.Set("X-API-Key", apiKey)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	codes := []int{get("bogus-1"), get("bogus-2"), get("bogus-3"), get("bogus-4")}
+	if codes[1] != http.StatusOK || codes[2] != http.StatusTooManyRequests || codes[3] != http.StatusTooManyRequests {
+		t.Errorf("Expected rotating bogus keys to be limited by IP, found %v", codes)
+	}
+	// The keys of one principal share its bucket
+	codes = []int{get("laptop-key"), get("server-key"), get("laptop-key")}
+	if codes[1] != http.StatusOK || codes[2] != http.StatusTooManyRequests {
+		t.Errorf("Expected the keys of ci to share a bucket, found %v", codes)
+	}
+	if code := get("other-key"); code != http.StatusOK {
+		t.Errorf("Invalid code! I want %d but get %d", http.StatusOK, code)
+	}
+}
+
+func TestRateLimitMatchesOpenAPIDocument(t *testing.T) {
+	api := newTestAPI()
+	api.rateLimits = &RateLimits{Routes: map[string]RateLimit{"GET /books/{id}": {Requests: 1, Period: time.Second}}, now: newTestClock().Now}
+	c := newContract(t, newRouter(api))
+	if lookup(c.doc, "paths", "/books", "get", "responses", "429") != nil {
+		t.Error("Expected unlimited routes to have no 429 response")
+	}
+	c.do(http.MethodGet, "/books/1", "/books/{id}", "")
+	if rr := c.do(http.MethodGet, "/books/1", "/books/{id}", ""); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Invalid code! I want %d but get %d", http.StatusTooManyRequests, rr.Code)
+	}
+}
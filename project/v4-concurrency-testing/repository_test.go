@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// ctx is used by the tests which don't exercise cancellation
+var ctx = context.Background()
+
+// forEachBackend runs test against a fresh pair of repositories of every storage backend
+func forEachBackend(t *testing.T, test func(t *testing.T, books BookRepository, authors AuthorRepository)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryBackedBookRepository(), NewMemoryBackedAuthorRepository())
+	})
+	t.Run("persistent memory", func(t *testing.T) {
+		books, authors, p := openTestPersistence(t, t.TempDir(), PersistenceOptions{Fsync: FsyncNever, SnapshotEvery: 5})
+		defer p.Close()
+		test(t, books, authors)
+	})
+	t.Run("bolt", func(t *testing.T) {
+		db := openTestBolt(t, filepath.Join(t.TempDir(), "bookstore.db"))
+		defer db.Close()
+		books, err := NewBoltBackedBookRepository(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		authors, err := NewBoltBackedAuthorRepository(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test(t, books, authors)
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		db := openTestSQLite(t)
+		test(t, NewSQLiteBackedBookRepository(db), NewSQLiteBackedAuthorRepository(db))
+	})
+}
+
+func TestRepositoryCRUD(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, books BookRepository, authors AuthorRepository) {
+		author, coauthor := &Author{Name: "Author 1"}, &Author{Name: "Coauthor 1"}
+		for _, a := range []*Author{author, coauthor} {
+			if err := authors.Create(ctx, a); err != nil {
+				t.Fatal(err)
+			}
+		}
+		first := &Book{Name: "Book 1", AuthorIDs: []int{author.ID}}
+		// Every backend keeps the order of the credits
+		second := &Book{Name: "Book 2", AuthorIDs: []int{coauthor.ID, author.ID}, ISBN: "9780134190440", Year: 2015, Genres: []string{"Programming", "Go"}}
+		for _, book := range []*Book{first, second} {
+			if err := books.Create(ctx, book); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		found, err := books.GetByID(ctx, second.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(*found, *second) {
+			t.Errorf("Incorrect book - Expected %+v, found %+v", *second, *found)
+		}
+		if _, err := books.GetByID(ctx, 42); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, found %v", err)
+		}
+
+		// Renaming onto an existing name keeps the unique rule
+		if err := books.Update(ctx, &Book{ID: second.ID, Name: "Book 1"}, AnyVersion); !errors.Is(err, ErrDuplicate) {
+			t.Errorf("Expected ErrDuplicate, found %v", err)
+		}
+		second.Name = "Book 2, second edition"
+		second.AuthorIDs, second.Genres = []int{author.ID}, nil
+		if err := books.Update(ctx, second, AnyVersion); err != nil {
+			t.Fatal(err)
+		}
+		if found, _ := books.GetByID(ctx, second.ID); !reflect.DeepEqual(*found, *second) {
+			t.Errorf("Incorrect book - Expected %+v, found %+v", *second, *found)
+		}
+		// The old name is free again
+		if err := books.Create(ctx, &Book{Name: "Book 2", AuthorIDs: []int{author.ID}}); err != nil {
+			t.Errorf("Expected old name to be reusable, found %v", err)
+		}
+		if err := books.Update(ctx, &Book{ID: 42, Name: "Book 42"}, AnyVersion); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, found %v", err)
+		}
+
+		if err := books.Delete(ctx, first.ID, AnyVersion); err != nil {
+			t.Fatal(err)
+		}
+		if err := books.Delete(ctx, first.ID, AnyVersion); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, found %v", err)
+		}
+		all, err := books.GetAll(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != 2 {
+			t.Errorf("Incorrect length - Expected %d, found %d", 2, len(all))
+		}
+
+		author.Name = "Author 1 renamed"
+		if err := authors.Update(ctx, author, AnyVersion); err != nil {
+			t.Fatal(err)
+		}
+		found2, err := authors.GetByID(ctx, author.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found2.Name != author.Name {
+			t.Errorf("Incorrect name - Expected %s, found %s", author.Name, found2.Name)
+		}
+		other := &Author{Name: "Author 2"}
+		if err := authors.Create(ctx, other); err != nil {
+			t.Fatal(err)
+		}
+		if err := authors.Update(ctx, &Author{ID: other.ID, Name: author.Name}, AnyVersion); !errors.Is(err, ErrDuplicate) {
+			t.Errorf("Expected ErrDuplicate, found %v", err)
+		}
+		if err := authors.Delete(ctx, other.ID, AnyVersion); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := authors.GetByID(ctx, other.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, found %v", err)
+		}
+	})
+}
+
+func TestRepositoryFind(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, books BookRepository, authors AuthorRepository) {
+		for _, name := range []string{"Author 1", "Author 2"} {
+			if err := authors.Create(ctx, &Author{Name: name}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, book := range []Book{
+			{Name: "Go in Action", AuthorIDs: []int{1}},
+			{Name: "Alpha", AuthorIDs: []int{2}},
+			{Name: "Learning GO", AuthorIDs: []int{1}},
+			{Name: "Beta", AuthorIDs: []int{1}},
+		} {
+			book := book
+			if err := books.Create(ctx, &book); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		ids := func(books []Book) []int {
+			response := make([]int, 0)
+			for _, book := range books {
+				response = append(response, book.ID)
+			}
+			return response
+		}
+		cases := []struct {
+			name  string
+			opts  QueryOptions
+			ids   []int
+			total int
+		}{
+			{"default order", QueryOptions{}, []int{1, 2, 3, 4}, 4},
+			{"page", QueryOptions{Limit: 2, Offset: 1}, []int{2, 3}, 4},
+			{"offset past end", QueryOptions{Offset: 10}, []int{}, 4},
+			{"huge limit", QueryOptions{Limit: math.MaxInt, Offset: 1}, []int{2, 3, 4}, 4},
+			{"huge limit sorted", QueryOptions{Limit: math.MaxInt, Offset: 3, Sort: []SortField{{"name", false}}}, []int{3}, 4},
+			{"sort by name", QueryOptions{Sort: []SortField{{"name", false}}}, []int{2, 4, 1, 3}, 4},
+			{"sort by author then id desc", QueryOptions{Sort: []SortField{{"authorId", false}, {"id", true}}}, []int{4, 3, 1, 2}, 4},
+			{"author filter", QueryOptions{AuthorID: 1, Limit: 2}, []int{1, 3}, 3},
+			{"ID filter", QueryOptions{IDs: map[int]bool{2: true, 4: true, 42: true}, Limit: 1}, []int{2}, 2},
+			{"authors filter", QueryOptions{AuthorIDs: map[int]bool{2: true, 42: true}}, []int{2}, 1},
+			{"authors and name filter", QueryOptions{AuthorIDs: map[int]bool{1: true, 2: true}, NameContains: "a"}, []int{1, 2, 3, 4}, 4},
+			{"name filter", QueryOptions{NameContains: "go"}, []int{1, 3}, 2},
+			{"after ID", QueryOptions{AfterID: 1, Limit: 2}, []int{2, 3}, 3},
+		}
+		for _, c := range cases {
+			found, total, err := books.Find(ctx, c.opts)
+			if err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+			if fmt.Sprint(ids(found)) != fmt.Sprint(c.ids) || total != c.total {
+				t.Errorf("%s: Expected %v of %d, found %v of %d", c.name, c.ids, c.total, ids(found), total)
+			}
+		}
+
+		found, total, err := authors.Find(ctx, QueryOptions{Sort: []SortField{{"name", true}}, Limit: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 2 || len(found) != 1 || found[0].Name != "Author 2" {
+			t.Errorf("Unexpected authors %+v of %d", found, total)
+		}
+		if found, _, err := authors.Find(ctx, QueryOptions{Limit: math.MaxInt, Offset: 1}); err != nil || len(found) != 1 || found[0].Name != "Author 2" {
+			t.Errorf("Unexpected authors %+v: %v", found, err)
+		}
+		if found, total, err := authors.Find(ctx, QueryOptions{AfterID: 1}); err != nil || total != 1 || len(found) != 1 || found[0].Name != "Author 2" {
+			t.Errorf("Unexpected authors %+v of %d: %v", found, total, err)
+		}
+		if found, total, err := authors.Find(ctx, QueryOptions{IDs: map[int]bool{2: true, 42: true}}); err != nil || total != 1 || len(found) != 1 || found[0].Name != "Author 2" {
+			t.Errorf("Unexpected authors %+v of %d: %v", found, total, err)
+		}
+	})
+}
+
+func TestIntegrityPolicies(t *testing.T) {
+	for _, policy := range []DeletePolicy{DeleteRestrict, DeleteCascade, DeleteNullify} {
+		t.Run(string(policy), func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, books BookRepository, authors AuthorRepository) {
+				books, authors = NewIntegrityRepositories(books, authors, policy)
+				author := &Author{Name: "Author 1"}
+				if err := authors.Create(ctx, author); err != nil {
+					t.Fatal(err)
+				}
+				book := &Book{Name: "Book 1", AuthorIDs: []int{author.ID}}
+				if err := books.Create(ctx, book); err != nil {
+					t.Fatal(err)
+				}
+				if err := books.Create(ctx, &Book{Name: "Book 2", AuthorIDs: []int{42}}); !errors.Is(err, ErrInvalid) {
+					t.Errorf("Expected ErrInvalid, found %v", err)
+				}
+				book.AuthorIDs = []int{author.ID, 42}
+				if err := books.Update(ctx, book, AnyVersion); !errors.Is(err, ErrInvalid) {
+					t.Errorf("Expected ErrInvalid, found %v", err)
+				}
+				if err := authors.Delete(ctx, 42, AnyVersion); !errors.Is(err, ErrNotFound) {
+					t.Errorf("Expected ErrNotFound, found %v", err)
+				}
+
+				err := authors.Delete(ctx, author.ID, AnyVersion)
+				remaining, _ := books.GetAll(ctx)
+				switch policy {
+				case DeleteRestrict:
+					if !errors.Is(err, ErrConstraint) || len(remaining) != 1 {
+						t.Errorf("Expected ErrConstraint and the book to stay, found %v and %+v", err, remaining)
+					}
+					return
+				case DeleteCascade:
+					if err != nil || len(remaining) != 0 {
+						t.Errorf("Expected the book to be deleted, found %v and %+v", err, remaining)
+					}
+				case DeleteNullify:
+					if err != nil || len(remaining) != 1 || len(remaining[0].AuthorIDs) != 0 {
+						t.Errorf("Expected the book without author, found %v and %+v", err, remaining)
+					}
+				}
+				if _, err := authors.GetByID(ctx, author.ID); !errors.Is(err, ErrNotFound) {
+					t.Errorf("Expected the author to be deleted, found %v", err)
+				}
+			})
+		})
+	}
+}
+
+// A book keeps its other authors whatever the policy, only restrict refuses the delete
+func TestIntegrityPoliciesWithCoAuthors(t *testing.T) {
+	for _, policy := range []DeletePolicy{DeleteRestrict, DeleteCascade, DeleteNullify} {
+		t.Run(string(policy), func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, books BookRepository, authors AuthorRepository) {
+				books, authors = NewIntegrityRepositories(books, authors, policy)
+				first, second := &Author{Name: "Author 1"}, &Author{Name: "Author 2"}
+				for _, author := range []*Author{first, second} {
+					if err := authors.Create(ctx, author); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := books.Create(ctx, &Book{Name: "Book 1", AuthorIDs: []int{first.ID, second.ID}}); err != nil {
+					t.Fatal(err)
+				}
+
+				err := authors.Delete(ctx, first.ID, AnyVersion)
+				remaining, _ := books.GetAll(ctx)
+				if policy == DeleteRestrict {
+					if !errors.Is(err, ErrConstraint) {
+						t.Errorf("Expected ErrConstraint, found %v", err)
+					}
+					return
+				}
+				if err != nil || len(remaining) != 1 || !sameAuthors(remaining[0].AuthorIDs, []int{second.ID}) {
+					t.Errorf("Expected the book with Author 2, found %v and %+v", err, remaining)
+				}
+			})
+		})
+	}
+}
+
+// brokenBookRepository fails the writes of one book like a backend losing its disk midway
+type brokenBookRepository struct {
+	BookRepository
+	id int
+}
+
+func (repo *brokenBookRepository) Update(ctx context.Context, book *Book, version int) error {
+	if book.ID == repo.id {
+		return errors.New("disk I/O error")
+	}
+	return repo.BookRepository.Update(ctx, book, version)
+}
+
+func (repo *brokenBookRepository) Delete(ctx context.Context, id int, version int) error {
+	if id == repo.id {
+		return errors.New("disk I/O error")
+	}
+	return repo.BookRepository.Delete(ctx, id, version)
+}
+
+// A delete failing on the last book puts the books before it back
+func TestIntegrityPoliciesRollBack(t *testing.T) {
+	for _, policy := range []DeletePolicy{DeleteCascade, DeleteNullify} {
+		t.Run(string(policy), func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, books BookRepository, authors AuthorRepository) {
+				books, authors = NewIntegrityRepositories(&brokenBookRepository{books, 3}, authors, policy)
+				first, second := &Author{Name: "Author 1"}, &Author{Name: "Author 2"}
+				for _, author := range []*Author{first, second} {
+					if err := authors.Create(ctx, author); err != nil {
+						t.Fatal(err)
+					}
+				}
+				expected := [][]int{{first.ID}, {first.ID, second.ID}, {first.ID}}
+				for i, authorIDs := range expected {
+					if err := books.Create(ctx, &Book{Name: fmt.Sprintf("Book %d", i+1), AuthorIDs: authorIDs}); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				if err := authors.Delete(ctx, first.ID, AnyVersion); err == nil {
+					t.Fatal("Expected the delete to fail")
+				}
+				remaining, _ := books.GetAll(ctx)
+				if len(remaining) != len(expected) {
+					t.Fatalf("Incorrect number of books - Expected %d, found %d", len(expected), len(remaining))
+				}
+				for i, book := range remaining {
+					if book.ID != i+1 || !sameAuthors(book.AuthorIDs, expected[i]) {
+						t.Errorf("Expected Book %d by %v, found %+v", i+1, expected[i], book)
+					}
+				}
+				if _, err := authors.GetByID(ctx, first.ID); err != nil {
+					t.Errorf("Expected the author to stay, found %v", err)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// SearchResult is a book with its first author and how well it matched the query
+type SearchResult struct {
+	CombinedResponse
+	Score float64 `json:"score"`
+}
+
+// SearchIndex is an inverted index from the terms of book and author names
+// to books. It lives in memory next to whatever backend stores the catalog
+// and is kept up to date by the indexing repositories below.
+type SearchIndex struct {
+	mu          sync.RWMutex
+	books       map[int]Book
+	authors     map[int]Author
+	authorBooks map[int]map[int]bool    // author ID -> book IDs
+	bookTerms   map[string]map[int]bool // term -> IDs of books with the term in their name
+	authorTerms map[string]map[int]bool // term -> IDs of authors with the term in their name
+	terms       []string                // terms of both maps, sorted for prefix lookups
+}
+
+// Constructor Function
+func NewSearchIndex() *SearchIndex {
+	return &SearchIndex{
+		books:       make(map[int]Book),
+		authors:     make(map[int]Author),
+		authorBooks: make(map[int]map[int]bool),
+		bookTerms:   make(map[string]map[int]bool),
+		authorTerms: make(map[string]map[int]bool),
+	}
+}
+
+// tokenize splits on anything which isn't a letter or a digit and folds case
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Rebuild indexes the whole catalog, used at startup
+func (idx *SearchIndex) Rebuild(ctx context.Context, bookRepository BookRepository, authorRepository AuthorRepository) error {
+	books, authors, err := fetchCatalog(ctx, bookRepository, authorRepository)
+	if err != nil {
+		return err
+	}
+	for _, author := range authors {
+		idx.PutAuthor(author)
+	}
+	for _, book := range books {
+		idx.PutBook(book)
+	}
+	return nil
+}
+
+// PutBook adds a book or replaces the indexed version of it
+func (idx *SearchIndex) PutBook(book Book) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.removeBook(book.ID)
+	idx.books[book.ID] = book.clone()
+	for _, term := range tokenize(book.Name) {
+		idx.addPosting(idx.bookTerms, term, book.ID)
+	}
+	for _, authorID := range book.AuthorIDs {
+		if idx.authorBooks[authorID] == nil {
+			idx.authorBooks[authorID] = make(map[int]bool)
+		}
+		idx.authorBooks[authorID][book.ID] = true
+	}
+}
+
+func (idx *SearchIndex) RemoveBook(id int) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.removeBook(id)
+}
+
+func (idx *SearchIndex) removeBook(id int) {
+	book, ok := idx.books[id]
+	if !ok {
+		return
+	}
+	for _, term := range tokenize(book.Name) {
+		idx.removePosting(idx.bookTerms, term, id)
+	}
+	for _, authorID := range book.AuthorIDs {
+		delete(idx.authorBooks[authorID], id)
+	}
+	delete(idx.books, id)
+}
+
+// PutAuthor adds an author or replaces the indexed version, the books of the
+// author are found through the new name right away.
+func (idx *SearchIndex) PutAuthor(author Author) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.removeAuthor(author.ID)
+	idx.authors[author.ID] = author
+	for _, term := range tokenize(author.Name) {
+		idx.addPosting(idx.authorTerms, term, author.ID)
+	}
+}
+
+func (idx *SearchIndex) RemoveAuthor(id int) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.removeAuthor(id)
+}
+
+func (idx *SearchIndex) removeAuthor(id int) {
+	author, ok := idx.authors[id]
+	if !ok {
+		return
+	}
+	for _, term := range tokenize(author.Name) {
+		idx.removePosting(idx.authorTerms, term, id)
+	}
+	delete(idx.authors, id)
+}
+
+func (idx *SearchIndex) addPosting(postings map[string]map[int]bool, term string, id int) {
+	if postings[term] == nil {
+		if !idx.known(term) {
+			i := sort.SearchStrings(idx.terms, term)
+			idx.terms = append(idx.terms, "")
+			copy(idx.terms[i+1:], idx.terms[i:])
+			idx.terms[i] = term
+		}
+		postings[term] = make(map[int]bool)
+	}
+	postings[term][id] = true
+}
+
+func (idx *SearchIndex) removePosting(postings map[string]map[int]bool, term string, id int) {
+	delete(postings[term], id)
+	if len(postings[term]) > 0 {
+		return
+	}
+	delete(postings, term)
+	if !idx.known(term) {
+		i := sort.SearchStrings(idx.terms, term)
+		idx.terms = append(idx.terms[:i], idx.terms[i+1:]...)
+	}
+}
+
+func (idx *SearchIndex) known(term string) bool {
+	return idx.bookTerms[term] != nil || idx.authorTerms[term] != nil
+}
+
+// Relevance weights, a term in the book name counts more than one in the author name
+const (
+	bookNameWeight   = 2.0
+	authorNameWeight = 1.0
+)
+
+// Search returns the books matching every term of query, best matches first.
+// A query term matches an indexed term it is a prefix of; the closer the
+// lengths, the higher the score, so exact matches rank above prefixes.
+func (idx *SearchIndex) Search(query string, limit int) []SearchResult {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	var scores map[int]float64
+	for _, token := range tokenize(query) {
+		tokenScores := make(map[int]float64)
+		keep := func(id int, score float64) {
+			if score > tokenScores[id] {
+				tokenScores[id] = score
+			}
+		}
+		for i := sort.SearchStrings(idx.terms, token); i < len(idx.terms) && strings.HasPrefix(idx.terms[i], token); i++ {
+			term := idx.terms[i]
+			closeness := float64(len(token)) / float64(len(term))
+			for id := range idx.bookTerms[term] {
+				keep(id, bookNameWeight*closeness)
+			}
+			for authorID := range idx.authorTerms[term] {
+				for id := range idx.authorBooks[authorID] {
+					keep(id, authorNameWeight*closeness)
+				}
+			}
+		}
+		if scores == nil {
+			scores = tokenScores
+			continue
+		}
+		for id := range scores {
+			if score, ok := tokenScores[id]; ok {
+				scores[id] += score
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+
+	results := make([]SearchResult, 0, len(scores))
+	for id, score := range scores {
+		book := idx.books[id]
+		var authors []Author
+		for _, authorID := range book.AuthorIDs {
+			if author, ok := idx.authors[authorID]; ok {
+				authors = append(authors, author)
+			}
+		}
+		results = append(results, SearchResult{combinedV1(BookWithAuthors{book, authors}), score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].ID < results[j].ID
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// NewIndexingRepositories keeps index in sync with every successful write.
+// Wrap the backend with them before the integrity repositories, so the
+// books deleted or changed by an author delete are reindexed too.
+func NewIndexingRepositories(books BookRepository, authors AuthorRepository, index *SearchIndex) (BookRepository, AuthorRepository) {
+	return &indexingBookRepository{BookRepository: books, index: index}, &indexingAuthorRepository{AuthorRepository: authors, index: index}
+}
+
+// The lock makes a write and its index update one step, so the index gets
+// the writes in the order the backend did them and a book deleted by one
+// request can't be put back by an update finishing after it.
+type indexingBookRepository struct {
+	BookRepository
+	mu    sync.Mutex
+	index *SearchIndex
+}
+
+func (repo *indexingBookRepository) Create(ctx context.Context, book *Book) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if err := repo.BookRepository.Create(ctx, book); err != nil {
+		return err
+	}
+	repo.index.PutBook(*book)
+	return nil
+}
+
+func (repo *indexingBookRepository) Update(ctx context.Context, book *Book, version int) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if err := repo.BookRepository.Update(ctx, book, version); err != nil {
+		return err
+	}
+	repo.index.PutBook(*book)
+	return nil
+}
+
+func (repo *indexingBookRepository) Delete(ctx context.Context, id int, version int) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if err := repo.BookRepository.Delete(ctx, id, version); err != nil {
+		return err
+	}
+	repo.index.RemoveBook(id)
+	return nil
+}
+
+func (repo *indexingBookRepository) Undelete(ctx context.Context, id int) (*Book, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	book, err := repo.BookRepository.Undelete(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	repo.index.PutBook(*book)
+	return book, nil
+}
+
+type indexingAuthorRepository struct {
+	AuthorRepository
+	mu    sync.Mutex
+	index *SearchIndex
+}
+
+func (repo *indexingAuthorRepository) Create(ctx context.Context, author *Author) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if err := repo.AuthorRepository.Create(ctx, author); err != nil {
+		return err
+	}
+	repo.index.PutAuthor(*author)
+	return nil
+}
+
+func (repo *indexingAuthorRepository) Update(ctx context.Context, author *Author, version int) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if err := repo.AuthorRepository.Update(ctx, author, version); err != nil {
+		return err
+	}
+	repo.index.PutAuthor(*author)
+	return nil
+}
+
+func (repo *indexingAuthorRepository) Delete(ctx context.Context, id int, version int) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if err := repo.AuthorRepository.Delete(ctx, id, version); err != nil {
+		return err
+	}
+	repo.index.RemoveAuthor(id)
+	return nil
+}
+
+func (repo *indexingAuthorRepository) Undelete(ctx context.Context, id int) (*Author, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	author, err := repo.AuthorRepository.Undelete(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	repo.index.PutAuthor(*author)
+	return author, nil
+}
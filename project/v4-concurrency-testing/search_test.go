@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTokenize(t *testing.T) {
+	tokens := tokenize("  Go in Action, 2nd-Édition!")
+	expected := []string{"go", "in", "action", "2nd", "édition"}
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("Incorrect tokens - Expected %v, found %v", expected, tokens)
+	}
+}
+
+func searchIDs(index *SearchIndex, query string) []int {
+	ids := []int{}
+	for _, result := range index.Search(query, 0) {
+		ids = append(ids, result.ID)
+	}
+	return ids
+}
+
+func TestSearchIndexRanking(t *testing.T) {
+	index := NewSearchIndex()
+	index.PutAuthor(Author{ID: 1, Name: "William Kennedy"})
+	index.PutAuthor(Author{ID: 2, Name: "Alan Donovan"})
+	index.PutBook(Book{ID: 1, Name: "Go in Action", AuthorIDs: []int{1}})
+	index.PutBook(Book{ID: 2, Name: "The Go Programming Language", AuthorIDs: []int{2}})
+	index.PutBook(Book{ID: 3, Name: "Gopher Guide", AuthorIDs: []int{2}})
+	index.PutBook(Book{ID: 4, Name: "Concurrency", AuthorIDs: []int{2}})
+
+	cases := []struct {
+		query    string
+		expected []int
+	}{
+		// Exact matches first, then the longer gopher
+		{"go", []int{1, 2, 3}},
+		{"GO", []int{1, 2, 3}},
+		// Every term has to match, the author name counts too
+		{"go donovan", []int{2, 3}},
+		{"conc alan", []int{4}},
+		// Matches on the author name alone tie and fall back to the ID
+		{"don", []int{2, 3, 4}},
+		{"rust", []int{}},
+		{"!!", []int{}},
+	}
+	for _, c := range cases {
+		if ids := searchIDs(index, c.query); !reflect.DeepEqual(ids, c.expected) {
+			t.Errorf("Incorrect results for %q - Expected %v, found %v", c.query, c.expected, ids)
+		}
+	}
+
+	results := index.Search("action", 1)
+	if len(results) != 1 || results[0].AuthorDetails == nil || results[0].AuthorDetails.Name != "William Kennedy" {
+		t.Errorf("Unexpected results %+v", results)
+	}
+}
+
+func TestSearchIndexFollowsWrites(t *testing.T) {
+	index := NewSearchIndex()
+	books, authors := NewIndexingRepositories(NewMemoryBackedBookRepository(), NewMemoryBackedAuthorRepository(), index)
+	books, authors = NewIntegrityRepositories(books, authors, DeleteCascade)
+
+	author := &Author{Name: "William Kennedy"}
+	authors.Create(ctx, author)
+	book := &Book{Name: "Go in Action", AuthorIDs: []int{author.ID}}
+	books.Create(ctx, book)
+	if ids := searchIDs(index, "kennedy action"); len(ids) != 1 {
+		t.Errorf("Incorrect length - Expected %d, found %d", 1, len(ids))
+	}
+
+	book.Name = "Rust in Action"
+	books.Update(ctx, book, AnyVersion)
+	if ids := searchIDs(index, "go"); len(ids) != 0 {
+		t.Errorf("Expected the old name to be gone, found %v", ids)
+	}
+	if ids := searchIDs(index, "rust"); len(ids) != 1 {
+		t.Errorf("Incorrect length - Expected %d, found %d", 1, len(ids))
+	}
+
+	author.Name = "Bill Kennedy"
+	authors.Update(ctx, author, AnyVersion)
+	if ids := searchIDs(index, "bill rust"); len(ids) != 1 {
+		t.Errorf("Expected the book to be found by the new author name, found %v", ids)
+	}
+
+	// Failed writes leave the index alone
+	if err := books.Create(ctx, &Book{Name: "Rust in Action"}); err == nil {
+		t.Fatal("Expected a duplicate error")
+	}
+	if ids := searchIDs(index, "rust"); len(ids) != 1 {
+		t.Errorf("Incorrect length - Expected %d, found %d", 1, len(ids))
+	}
+
+	// The cascade deletes the book through the indexing repository
+	if err := authors.Delete(ctx, author.ID, AnyVersion); err != nil {
+		t.Fatal(err)
+	}
+	if ids := searchIDs(index, "rust"); len(ids) != 0 {
+		t.Errorf("Expected the cascaded book to be gone, found %v", ids)
+	}
+	if len(index.terms) != 0 {
+		t.Errorf("Expected no terms left, found %v", index.terms)
+	}
+}
+
+// pausingBookRepository holds an Update after the backend stored it until
+// resume is closed, as a slow request would
+type pausingBookRepository struct {
+	BookRepository
+	updated chan struct{}
+	resume  chan struct{}
+}
+
+func (repo *pausingBookRepository) Update(ctx context.Context, book *Book, version int) error {
+	if err := repo.BookRepository.Update(ctx, book, version); err != nil {
+		return err
+	}
+	close(repo.updated)
+	<-repo.resume
+	return nil
+}
+
+func TestSearchIndexOrdersConcurrentWrites(t *testing.T) {
+	index := NewSearchIndex()
+	backend := &pausingBookRepository{NewMemoryBackedBookRepository(), make(chan struct{}), make(chan struct{})}
+	books, _ := NewIndexingRepositories(backend, NewMemoryBackedAuthorRepository(), index)
+	book := &Book{Name: "Go in Action"}
+	books.Create(ctx, book)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		books.Update(ctx, &Book{ID: book.ID, Name: "Rust in Action"}, AnyVersion)
+	}()
+	<-backend.updated
+	// The delete comes after the update in the backend, so the book must
+	// stay out of the index whenever the update gets to it
+	go func() {
+		defer wg.Done()
+		if err := books.Delete(ctx, book.ID, AnyVersion); err != nil {
+			t.Error(err)
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(backend.resume)
+	wg.Wait()
+
+	if _, err := books.GetByID(ctx, book.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, found %v", err)
+	}
+	if ids := searchIDs(index, "action"); len(ids) != 0 {
+		t.Errorf("Expected the deleted book to be gone from the index, found %v", ids)
+	}
+}
+
+func TestSearchEndpoint(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, books BookRepository, authors AuthorRepository) {
+		// Whatever is stored before startup is indexed by newAPI
+		author := &Author{Name: "Alan Donovan"}
+		authors.Create(ctx, author)
+		books.Create(ctx, &Book{Name: "The Go Programming Language", AuthorIDs: []int{author.ID}})
+
+		api, err := newAPI(ctx, books, authors, NewMemoryBackedHistoryRepository(), DeleteRestrict, WebhookOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		router := newRouter(api)
+		do(router, http.MethodPost, "/books", strings.NewReader(`{"name":"Go Web Programming","authorId":1}`))
+
+		rr := do(router, http.MethodGet, "/search?q=go+prog&limit=1", nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Invalid code! I want %d but get %d", http.StatusOK, rr.Code)
+		}
+		var results []SearchResult
+		json.NewDecoder(rr.Body).Decode(&results)
+		if len(results) != 1 || results[0].Name != "The Go Programming Language" || results[0].Score <= 0 {
+			t.Errorf("Unexpected results %+v", results)
+		}
+
+		for _, target := range []string{"/search", "/search?q=+,", "/search?q=go&limit=-1"} {
+			if rr := do(router, http.MethodGet, target, nil); rr.Code != http.StatusBadRequest {
+				t.Errorf("Invalid code for %s! I want %d but get %d", target, http.StatusBadRequest, rr.Code)
+			}
+		}
+	})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// envPrefix is put in front of the upper cased flag name, e.g. BOOKSTORE_BOLT_PATH
+const envPrefix = "BOOKSTORE_"
+
+// applyEnv sets the flags of fs which were not given on the command line from
+// the environment, so flags win over variables and variables over defaults.
+// lookup is os.LookupEnv, tests pass their own.
+func applyEnv(fs *flag.FlagSet, prefix string, lookup func(string) (string, bool)) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] || err != nil {
+			return
+		}
+		name := prefix + strings.ToUpper(f.Name)
+		if value, ok := lookup(name); ok {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %v", value, name, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// newServer applies the configured timeouts, http.ListenAndServe has none so a
+// slow client could hold a connection forever.
+func newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadTimeout:       *readTimeout,
+		ReadHeaderTimeout: *readHeaderTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+	}
+}
+
+// shutdownHooks are run by serve when it stops the server, either may be nil
+type shutdownHooks struct {
+	// stop runs as the shutdown starts, it ends what keeps requests busy
+	// for good, like the streams of /events
+	stop func()
+	// drain runs once no handler is left, before the store is closed, so
+	// what the last requests started, like webhook deliveries, can finish
+	drain func()
+}
+
+// serve runs server on listener until ctx is done, then stops accepting
+// connections, waits up to timeout for the requests in flight and closes
+// store, which flushes the persistence of the memory storage. The store is
+// closed even when the requests didn't finish in time, but only after their
+// handlers returned.
+func serve(ctx context.Context, server *http.Server, listener net.Listener, store io.Closer, timeout time.Duration, hooks shutdownHooks) error {
+	handlers := &handlersInFlight{}
+	server.Handler = handlers.track(server.Handler)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve(listener)
+	}()
+	select {
+	case err := <-errCh:
+		// Serve only returns early when it failed
+		handlers.wait()
+		store.Close()
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("shutting down, waiting up to %s for requests in flight", timeout)
+	if hooks.stop != nil {
+		hooks.stop()
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	shutdownErr := server.Shutdown(shutdownCtx)
+	if shutdownErr != nil {
+		// Cut off what is left, which cancels the contexts of the handlers
+		server.Close()
+		shutdownErr = fmt.Errorf("requests still in flight after %s: %w", timeout, shutdownErr)
+	}
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("server stopped: %v", err)
+	}
+	// Close doesn't wait for the handlers, they may still be writing
+	handlers.wait()
+	if hooks.drain != nil {
+		hooks.drain()
+	}
+	if err := store.Close(); err != nil {
+		return fmt.Errorf("closing the storage: %w", err)
+	}
+	return shutdownErr
+}
+
+// handlersInFlight counts the handlers running. Once wait was called new
+// requests are refused, a connection can still be read from after Close.
+type handlersInFlight struct {
+	mu      sync.RWMutex
+	stopped bool
+	running sync.WaitGroup
+}
+
+// Middleware Function
+func (h *handlersInFlight) track(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.mu.RLock()
+		if h.stopped {
+			h.mu.RUnlock()
+			http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		h.running.Add(1)
+		h.mu.RUnlock()
+		defer h.running.Done()
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// wait returns once every handler returned
+func (h *handlersInFlight) wait() {
+	h.mu.Lock()
+	h.stopped = true
+	h.mu.Unlock()
+	h.running.Wait()
+}
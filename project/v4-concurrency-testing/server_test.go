@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestApplyEnv(t *testing.T) {
+	fs := flag.NewFlagSet("bookstore", flag.ContinueOnError)
+	addr := fs.String("addr", ":8080", "")
+	storage := fs.String("storage", "memory", "")
+	timeout := fs.Duration("write_timeout", time.Second, "")
+	policy := fs.String("author_delete_policy", "restrict", "")
+	if err := fs.Parse([]string{"-addr", ":9090"}); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"BOOKSTORE_ADDR":          ":7070",
+		"BOOKSTORE_STORAGE":       "bolt",
+		"BOOKSTORE_WRITE_TIMEOUT": "2m",
+	}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+	if err := applyEnv(fs, envPrefix, lookup); err != nil {
+		t.Fatal(err)
+	}
+	// The flag wins, then the environment, then the default
+	if *addr != ":9090" || *storage != "bolt" || *timeout != 2*time.Minute || *policy != "restrict" {
+		t.Errorf("Unexpected configuration addr=%s storage=%s write_timeout=%s author_delete_policy=%s", *addr, *storage, *timeout, *policy)
+	}
+
+	// Set marks the flag as given, so check invalid values on a fresh set
+	fs = flag.NewFlagSet("bookstore", flag.ContinueOnError)
+	fs.Duration("write_timeout", time.Second, "")
+	env["BOOKSTORE_WRITE_TIMEOUT"] = "soon"
+	err := applyEnv(fs, envPrefix, lookup)
+	if err == nil || !strings.Contains(err.Error(), "BOOKSTORE_WRITE_TIMEOUT") {
+		t.Errorf("Expected the invalid variable to be named, found %v", err)
+	}
+}
+
+// closeRecorder stands in for the storage
+type closeRecorder struct {
+	closed int32
+}
+
+func (c *closeRecorder) Close() error {
+	atomic.AddInt32(&c.closed, 1)
+	return nil
+}
+
+func (c *closeRecorder) isClosed() bool {
+	return atomic.LoadInt32(&c.closed) == 1
+}
+
+func startServer(t *testing.T, handler http.Handler, store *closeRecorder, timeout time.Duration) (string, context.CancelFunc, chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(ctx, &http.Server{Handler: handler}, listener, store, timeout, shutdownHooks{})
+	}()
+	return "http://" + listener.Addr().String(), cancel, done
+}
+
+func TestServeDrainsRequestsInFlight(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	store := &closeRecorder{}
+	url, shutdown, done := startServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+		w.Write([]byte("finished"))
+	}), store, 5*time.Second)
+
+	response := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			response <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		response <- string(body)
+	}()
+	<-entered
+	shutdown()
+
+	// New connections are refused while the request in flight goes on
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the listener to be closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Expected serve to wait for the request, it returned %v", err)
+	default:
+	}
+	if store.isClosed() {
+		t.Error("Expected the store to stay open while requests are in flight")
+	}
+
+	close(release)
+	if body := <-response; body != "finished" {
+		t.Errorf("Incorrect response - Expected %q, found %q", "finished", body)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Expected a clean shutdown, found %v", err)
+	}
+	if !store.isClosed() {
+		t.Error("Expected the store to be closed")
+	}
+}
+
+func TestServeGivesUpAfterDeadline(t *testing.T) {
+	entered := make(chan struct{})
+	store := &closeRecorder{}
+	url, shutdown, done := startServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-r.Context().Done()
+	}), store, 50*time.Millisecond)
+	go http.Get(url)
+	<-entered
+
+	start := time.Now()
+	shutdown()
+	err := <-done
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline to be reported, found %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected serve to return soon after the deadline, it took %s", elapsed)
+	}
+	if !store.isClosed() {
+		t.Error("Expected the store to be closed anyway")
+	}
+}
+
+// steps records what happened in which order
+type steps struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (s *steps) add(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.names = append(s.names, name)
+}
+
+func (s *steps) list() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.names...)
+}
+
+// Close records the store being closed
+func (s *steps) Close() error {
+	s.add("store")
+	return nil
+}
+
+// A handler cut off by the deadline still returns before the store is closed
+func TestServeWaitsForHandlersCutOff(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	order := &steps{}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		// Deaf to the canceled context, like a write already under way
+		<-release
+		order.add("handler")
+	})
+	serveCtx, shutdown := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(serveCtx, &http.Server{Handler: handler}, listener, order, 20*time.Millisecond, shutdownHooks{
+			stop:  func() { order.add("stop") },
+			drain: func() { order.add("drain") },
+		})
+	}()
+	go http.Get("http://" + listener.Addr().String())
+	<-entered
+
+	shutdown()
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("Expected serve to wait for the handler, it returned %v", err)
+	default:
+	}
+	close(release)
+	if err := <-done; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline to be reported, found %v", err)
+	}
+	if expected := []string{"stop", "handler", "drain", "store"}; !reflect.DeepEqual(order.list(), expected) {
+		t.Errorf("Incorrect order - Expected %v, found %v", expected, order.list())
+	}
+}
+
+func TestServeFlushesPersistence(t *testing.T) {
+	dir := t.TempDir()
+	books, authors, p := openTestPersistence(t, dir, PersistenceOptions{Fsync: FsyncNever})
+	api, err := newAPI(ctx, books, authors, p.History(), DeleteRestrict, WebhookOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveCtx, shutdown := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(serveCtx, newServer(newRouter(api)), listener, p, time.Second, shutdownHooks{})
+	}()
+
+	resp, err := http.Post("http://"+listener.Addr().String()+"/books", "application/json", strings.NewReader(`{"name":"Book 1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	shutdown()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	books, _, p = openTestPersistence(t, dir, PersistenceOptions{Fsync: FsyncNever})
+	defer p.Close()
+	if all, _ := books.GetAll(ctx); len(all) != 1 || all[0].Name != "Book 1" {
+		t.Errorf("Expected the book to survive the restart, found %+v", all)
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// migration is a single schema step. Migrations run in order of version and
+// every version is recorded in schema_migrations so it only ever runs once.
+// Never edit a migration which was released, append a new one instead.
+type migration struct {
+	version     int
+	description string
+	statements  []string
+}
+
+var sqliteMigrations = []migration{
+	{
+		version:     1,
+		description: "create authors and books",
+		statements: []string{
+			`CREATE TABLE authors (
+				id   INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT NOT NULL,
+				CONSTRAINT authors_name_unique UNIQUE (name)
+			)`,
+			`CREATE TABLE books (
+				id        INTEGER PRIMARY KEY AUTOINCREMENT,
+				name      TEXT NOT NULL,
+				author_id INTEGER REFERENCES authors (id),
+				CONSTRAINT books_name_unique UNIQUE (name)
+			)`,
+			`CREATE INDEX books_author_id ON books (author_id)`,
+		},
+	},
+	{
+		version:     2,
+		description: "count writes to authors and books",
+		// The triggers count writes made outside of the repositories too
+		statements: []string{
+			`CREATE TABLE catalog_versions (
+				name        TEXT PRIMARY KEY,
+				version     INTEGER NOT NULL,
+				modified_at INTEGER NOT NULL -- Unix time in milliseconds
+			)`,
+			`INSERT INTO catalog_versions (name, version, modified_at)
+				SELECT name, 0, CAST((julianday('now') - 2440587.5) * 86400000 AS INTEGER)
+				FROM (SELECT 'authors' AS name UNION ALL SELECT 'books')`,
+			`CREATE TRIGGER authors_insert_version AFTER INSERT ON authors BEGIN
+				UPDATE catalog_versions SET version = version + 1, modified_at = CAST((julianday('now') - 2440587.5) * 86400000 AS INTEGER)
+				WHERE name = 'authors';
+			END`,
+			`CREATE TRIGGER authors_update_version AFTER UPDATE ON authors BEGIN
+				UPDATE catalog_versions SET version = version + 1, modified_at = CAST((julianday('now') - 2440587.5) * 86400000 AS INTEGER)
+				WHERE name = 'authors';
+			END`,
+			`CREATE TRIGGER authors_delete_version AFTER DELETE ON authors BEGIN
+				UPDATE catalog_versions SET version = version + 1, modified_at = CAST((julianday('now') - 2440587.5) * 86400000 AS INTEGER)
+				WHERE name = 'authors';
+			END`,
+			`CREATE TRIGGER books_insert_version AFTER INSERT ON books BEGIN
+				UPDATE catalog_versions SET version = version + 1, modified_at = CAST((julianday('now') - 2440587.5) * 86400000 AS INTEGER)
+				WHERE name = 'books';
+			END`,
+			`CREATE TRIGGER books_update_version AFTER UPDATE ON books BEGIN
+				UPDATE catalog_versions SET version = version + 1, modified_at = CAST((julianday('now') - 2440587.5) * 86400000 AS INTEGER)
+				WHERE name = 'books';
+			END`,
+			`CREATE TRIGGER books_delete_version AFTER DELETE ON books BEGIN
+				UPDATE catalog_versions SET version = version + 1, modified_at = CAST((julianday('now') - 2440587.5) * 86400000 AS INTEGER)
+				WHERE name = 'books';
+			END`,
+		},
+	},
+	{
+		version:     3,
+		description: "record when authors and books were created and updated",
+		// NULL for the rows written before, the API leaves the timestamps out for them
+		statements: []string{
+			`ALTER TABLE authors ADD COLUMN created_at TIMESTAMP`,
+			`ALTER TABLE authors ADD COLUMN updated_at TIMESTAMP`,
+			`ALTER TABLE books ADD COLUMN created_at TIMESTAMP`,
+			`ALTER TABLE books ADD COLUMN updated_at TIMESTAMP`,
+		},
+	},
+	{
+		version:     4,
+		description: "several authors, ISBN, year and genres for books",
+		// books.author_id is left NULL from now on, book_authors replaces it.
+		// genres holds a JSON array.
+		statements: []string{
+			`CREATE TABLE book_authors (
+				book_id   INTEGER NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+				author_id INTEGER NOT NULL REFERENCES authors (id),
+				position  INTEGER NOT NULL, -- in the credits, from 0
+				PRIMARY KEY (book_id, author_id)
+			)`,
+			`CREATE INDEX book_authors_author_id ON book_authors (author_id)`,
+			`INSERT INTO book_authors (book_id, author_id, position)
+				SELECT id, author_id, 0 FROM books WHERE author_id IS NOT NULL`,
+			`UPDATE books SET author_id = NULL WHERE author_id IS NOT NULL`,
+			`ALTER TABLE books ADD COLUMN isbn TEXT`,
+			`ALTER TABLE books ADD COLUMN year INTEGER`,
+			`ALTER TABLE books ADD COLUMN genres TEXT`,
+		},
+	},
+	{
+		version:     5,
+		description: "versions of books and authors",
+		// The rows written before count as version 0
+		statements: []string{
+			`ALTER TABLE books ADD COLUMN version INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE authors ADD COLUMN version INTEGER NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		version:     6,
+		description: "soft deletes and the history of books and authors",
+		// A deleted entity is kept as the JSON the repositories read back on
+		// undelete, a book with its authors, so nothing else has to skip it
+		statements: []string{
+			`CREATE TABLE deleted_books (
+				id   INTEGER PRIMARY KEY,
+				data TEXT NOT NULL
+			)`,
+			`CREATE TABLE deleted_authors (
+				id   INTEGER PRIMARY KEY,
+				data TEXT NOT NULL
+			)`,
+			`CREATE TABLE history (
+				id          INTEGER PRIMARY KEY AUTOINCREMENT,
+				entity      TEXT NOT NULL,
+				entity_id   INTEGER NOT NULL,
+				action      TEXT NOT NULL,
+				actor       TEXT NOT NULL,
+				at          TIMESTAMP NOT NULL,
+				before_json TEXT NOT NULL,
+				after_json  TEXT NOT NULL
+			)`,
+			`CREATE INDEX history_entity ON history (entity, entity_id, id)`,
+		},
+	},
+}
+
+// openSQLite opens the database at path with foreign keys switched on
+// and brings its schema up to date.
+func openSQLite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_foreign_keys=on&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	if err := migrate(db, sqliteMigrations); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// migrate applies every migration which isn't recorded yet, each one in its own transaction.
+func migrate(db *sql.DB, migrations []migration) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version     INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at  TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("create schema_migrations: %v", err)
+	}
+	var current int
+	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current)
+	if err != nil {
+		return fmt.Errorf("read schema version: %v", err)
+	}
+	previous := 0
+	for _, m := range migrations {
+		if m.version <= previous {
+			return fmt.Errorf("migration %d is out of order", m.version)
+		}
+		previous = m.version
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(db, m); err != nil {
+			return fmt.Errorf("migration %d (%s): %v", m.version, m.description, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, statement := range m.statements {
+		if _, err := tx.Exec(statement); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	_, err = tx.Exec("INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, ?, ?)",
+		m.version, m.description, time.Now().UTC())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// translateSQLiteError turns constraint failures reported by the driver into
+// repository errors, duplicate is the error to use for a unique violation.
+func translateSQLiteError(err error, duplicate *RepositoryError) error {
+	sqliteErr, ok := err.(sqlite3.Error)
+	if !ok || sqliteErr.Code != sqlite3.ErrConstraint {
+		return err
+	}
+	switch sqliteErr.ExtendedCode {
+	case sqlite3.ErrConstraintUnique:
+		return duplicate
+	case sqlite3.ErrConstraintForeignKey:
+		return &RepositoryError{Kind: ErrConstraint, Message: "Referenced entity does not exist or is still in use"}
+	default:
+		return &RepositoryError{Kind: ErrConstraint, Message: "Constraint violation"}
+	}
+}
+
+// sqliteColumns maps the sortable JSON field names to their columns, a book
+// is sorted by the author credited first.
+var sqliteColumns = map[string]string{
+	"id":       "id",
+	"name":     "name",
+	"authorId": "(SELECT author_id FROM book_authors WHERE book_id = books.id AND position = 0)",
+	"year":     "year",
+}
+
+// sqliteWhere builds the WHERE clause for the filters of opts
+func sqliteWhere(opts QueryOptions) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	if opts.AuthorID != 0 {
+		conditions = append(conditions, "id IN (SELECT book_id FROM book_authors WHERE author_id = ?)")
+		args = append(args, opts.AuthorID)
+	}
+	if len(opts.IDs) > 0 {
+		conditions = append(conditions, "id IN (SELECT value FROM json_each(?))")
+		args = append(args, sqliteIDList(opts.IDs))
+	}
+	if len(opts.AuthorIDs) > 0 {
+		conditions = append(conditions, "id IN (SELECT book_id FROM book_authors WHERE author_id IN (SELECT value FROM json_each(?)))")
+		args = append(args, sqliteIDList(opts.AuthorIDs))
+	}
+	if opts.AfterID != 0 {
+		conditions = append(conditions, "id > ?")
+		args = append(args, opts.AfterID)
+	}
+	if opts.NameContains != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(opts.NameContains)
+		conditions = append(conditions, `name LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+escaped+"%")
+	}
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// sqliteIDList is a set of IDs as a JSON array for json_each. One argument
+// rather than a variable for each, there may be more than SQLite takes.
+func sqliteIDList(ids map[int]bool) string {
+	list := make([]int, 0, len(ids))
+	for id := range ids {
+		list = append(list, id)
+	}
+	encoded, _ := json.Marshal(list)
+	return string(encoded)
+}
+
+// sqlitePage builds the ORDER BY, LIMIT and OFFSET clauses of opts
+func sqlitePage(opts QueryOptions) (string, []interface{}, error) {
+	var order []string
+	for _, f := range opts.Sort {
+		column, ok := sqliteColumns[f.Field]
+		if !ok {
+			return "", nil, fmt.Errorf("cannot sort by %q", f.Field)
+		}
+		if f.Desc {
+			column += " DESC"
+		}
+		order = append(order, column)
+	}
+	order = append(order, "id")
+	limit := opts.Limit
+	if limit == 0 {
+		// A negative limit means no limit for sqlite
+		limit = -1
+	}
+	return " ORDER BY " + strings.Join(order, ", ") + " LIMIT ? OFFSET ?", []interface{}{limit, opts.Offset}, nil
+}
+
+// sqliteFind runs the count and the page query of a listing, scan is called
+// for every row. q is the transaction of sqliteReadTx, so that the total
+// matches the page.
+func sqliteFind(ctx context.Context, q sqliteQuerier, table, columns string, opts QueryOptions, scan func(*sql.Rows) error) (int, error) {
+	where, args := sqliteWhere(opts)
+	page, pageArgs, err := sqlitePage(opts)
+	if err != nil {
+		return 0, err
+	}
+	var total int
+	if err := q.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table+where, args...).Scan(&total); err != nil {
+		return 0, err
+	}
+	rows, err := q.QueryContext(ctx, "SELECT "+columns+" FROM "+table+where+page, append(args, pageArgs...)...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return 0, err
+		}
+	}
+	return total, rows.Err()
+}
+
+// sqliteVersionMatches ends the WHERE clause of a versioned write, its
+// arguments come from sqliteVersionArgs.
+const sqliteVersionMatches = "(? OR version = ?)"
+
+func sqliteVersionArgs(version int) []interface{} {
+	return []interface{}{version == AnyVersion, version}
+}
+
+// sqliteCheckWritten explains a versioned write of the row id of table
+// which changed nothing: either the row is missing or it is at another
+// version than the expected one.
+func sqliteCheckWritten(ctx context.Context, tx *sql.Tx, result sql.Result, table, entity string, id, version int, notFound error) error {
+	affected, err := result.RowsAffected()
+	if err != nil || affected > 0 {
+		return err
+	}
+	var stored int
+	err = tx.QueryRowContext(ctx, "SELECT version FROM "+table+" WHERE id = ?", id).Scan(&stored)
+	if err == sql.ErrNoRows {
+		return notFound
+	}
+	if err != nil {
+		return err
+	}
+	return &ConflictError{Entity: entity, ID: id, Expected: version, Actual: stored}
+}
+
+// sqliteQuerier is a *sql.DB or a *sql.Tx
+type sqliteQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// putSQLiteDeleted keeps entity in table, one of the deleted_ tables
+func putSQLiteDeleted(ctx context.Context, tx *sql.Tx, table string, id int, entity interface{}) error {
+	data, err := json.Marshal(entity)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO "+table+" (id, data) VALUES (?, ?)", id, string(data))
+	return err
+}
+
+// getSQLiteDeleted reads what putSQLiteDeleted kept into entity
+func getSQLiteDeleted(ctx context.Context, q sqliteQuerier, table string, id int, entity interface{}, notFound error) error {
+	var data string
+	err := q.QueryRowContext(ctx, "SELECT data FROM "+table+" WHERE id = ?", id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return notFound
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(data), entity)
+}
+
+// sqliteTx runs fn in a transaction, which commits when fn succeeds
+func sqliteTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// sqliteReadTx runs fn in a transaction which only reads, its queries all see
+// the database as it was at the first one
+func sqliteReadTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	return fn(tx)
+}
+
+// nullableTime stores the zero time as NULL, it is what the rows written before timestamps have
+func nullableTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// sqliteVersion reads the CatalogVersion of table
+func sqliteVersion(ctx context.Context, db *sql.DB, table string) (CatalogVersion, error) {
+	var version CatalogVersion
+	var modified int64
+	err := db.QueryRowContext(ctx, "SELECT version, modified_at FROM catalog_versions WHERE name = ?", table).Scan(&version.Counter, &modified)
+	if err != nil {
+		return CatalogVersion{}, err
+	}
+	version.Modified = time.Unix(0, modified*int64(time.Millisecond)).UTC()
+	return version, nil
+}
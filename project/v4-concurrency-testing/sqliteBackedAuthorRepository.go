@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+)
+
+// SQLiteBackedAuthorRepository stores authors in the authors table created by sqliteMigrations.
+type SQLiteBackedAuthorRepository struct {
+	db *sql.DB
+}
+
+func (repo *SQLiteBackedAuthorRepository) GetAll(ctx context.Context) ([]Author, error) {
+	response, _, err := repo.Find(ctx, QueryOptions{})
+	return response, err
+}
+
+// Find ignores opts.AuthorID and opts.AuthorIDs, they only apply to books
+func (repo *SQLiteBackedAuthorRepository) Find(ctx context.Context, opts QueryOptions) ([]Author, int, error) {
+	opts.AuthorID, opts.AuthorIDs = 0, nil
+	response := make([]Author, 0)
+	var total int
+	err := sqliteReadTx(ctx, repo.db, func(tx *sql.Tx) error {
+		var err error
+		total, err = sqliteFind(ctx, tx, "authors", sqliteAuthorColumns, opts, func(rows *sql.Rows) error {
+			author, err := scanSQLiteAuthor(rows)
+			if err != nil {
+				return err
+			}
+			response = append(response, *author)
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return response, total, nil
+}
+
+func (repo *SQLiteBackedAuthorRepository) Create(ctx context.Context, author *Author) error {
+	result, err := repo.db.ExecContext(ctx, "INSERT INTO authors (name, created_at, updated_at, version) VALUES (?, ?, ?, 1)",
+		author.Name, nullableTime(author.CreatedAt), nullableTime(author.UpdatedAt))
+	if err != nil {
+		return translateSQLiteError(err, errDuplicateAuthor)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	author.ID, author.Version = int(id), 1
+	return nil
+}
+
+func (repo *SQLiteBackedAuthorRepository) GetByID(ctx context.Context, id int) (*Author, error) {
+	return getSQLiteAuthor(ctx, repo.db, id)
+}
+
+func (repo *SQLiteBackedAuthorRepository) Update(ctx context.Context, author *Author, version int) error {
+	var next int
+	err := sqliteTx(ctx, repo.db, func(tx *sql.Tx) error {
+		args := []interface{}{author.Name, nullableTime(author.CreatedAt), nullableTime(author.UpdatedAt), author.ID}
+		result, err := tx.ExecContext(ctx, "UPDATE authors SET name = ?, created_at = ?, updated_at = ?, version = version + 1 WHERE id = ? AND "+sqliteVersionMatches,
+			append(args, sqliteVersionArgs(version)...)...)
+		if err != nil {
+			return translateSQLiteError(err, errDuplicateAuthor)
+		}
+		if err := sqliteCheckWritten(ctx, tx, result, "authors", "Author", author.ID, version, errAuthorNotFound); err != nil {
+			return err
+		}
+		return tx.QueryRowContext(ctx, "SELECT version FROM authors WHERE id = ?", author.ID).Scan(&next)
+	})
+	if err != nil {
+		return err
+	}
+	author.Version = next
+	return nil
+}
+
+// Delete moves the author to deleted_authors, it fails with ErrConstraint
+// while books still reference the author
+func (repo *SQLiteBackedAuthorRepository) Delete(ctx context.Context, id int, version int) error {
+	return sqliteTx(ctx, repo.db, func(tx *sql.Tx) error {
+		existing, err := getSQLiteAuthor(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if err := checkVersion("Author", id, existing.Version, version); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM authors WHERE id = ?", id); err != nil {
+			return translateSQLiteError(err, errDuplicateAuthor)
+		}
+		return putSQLiteDeleted(ctx, tx, "deleted_authors", id, existing)
+	})
+}
+
+func (repo *SQLiteBackedAuthorRepository) GetDeletedByID(ctx context.Context, id int) (*Author, error) {
+	var author Author
+	if err := getSQLiteDeleted(ctx, repo.db, "deleted_authors", id, &author, errDeletedAuthorNotFound); err != nil {
+		return nil, err
+	}
+	return &author, nil
+}
+
+func (repo *SQLiteBackedAuthorRepository) Undelete(ctx context.Context, id int) (*Author, error) {
+	var author Author
+	err := sqliteTx(ctx, repo.db, func(tx *sql.Tx) error {
+		if err := getSQLiteDeleted(ctx, tx, "deleted_authors", id, &author, errDeletedAuthorNotFound); err != nil {
+			return err
+		}
+		author.Version++
+		_, err := tx.ExecContext(ctx, "INSERT INTO authors (id, name, created_at, updated_at, version) VALUES (?, ?, ?, ?, ?)",
+			author.ID, author.Name, nullableTime(author.CreatedAt), nullableTime(author.UpdatedAt), author.Version)
+		if err != nil {
+			return translateSQLiteError(err, errDuplicateAuthor)
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM deleted_authors WHERE id = ?", id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &author, nil
+}
+
+func (repo *SQLiteBackedAuthorRepository) Version(ctx context.Context) (CatalogVersion, error) {
+	return sqliteVersion(ctx, repo.db, "authors")
+}
+
+const sqliteAuthorColumns = "id, name, version, created_at, updated_at"
+
+func getSQLiteAuthor(ctx context.Context, q sqliteQuerier, id int) (*Author, error) {
+	author, err := scanSQLiteAuthor(q.QueryRowContext(ctx, "SELECT "+sqliteAuthorColumns+" FROM authors WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, errAuthorNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return author, nil
+}
+
+// scanSQLiteAuthor reads the sqliteAuthorColumns of a row
+func scanSQLiteAuthor(row interface{ Scan(...interface{}) error }) (*Author, error) {
+	var author Author
+	var createdAt, updatedAt sql.NullTime
+	if err := row.Scan(&author.ID, &author.Name, &author.Version, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	author.CreatedAt, author.UpdatedAt = createdAt.Time, updatedAt.Time
+	return &author, nil
+}
+
+// Constructor Function, the schema has to be migrated already, see openSQLite
+func NewSQLiteBackedAuthorRepository(db *sql.DB) AuthorRepository {
+	return &SQLiteBackedAuthorRepository{db}
+}
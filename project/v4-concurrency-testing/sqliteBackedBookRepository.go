@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+)
+
+// SQLiteBackedBookRepository stores books in the books table created by
+// sqliteMigrations, and their authors in book_authors.
+type SQLiteBackedBookRepository struct {
+	db *sql.DB
+}
+
+func (repo *SQLiteBackedBookRepository) GetAll(ctx context.Context) ([]Book, error) {
+	response, _, err := repo.Find(ctx, QueryOptions{})
+	return response, err
+}
+
+func (repo *SQLiteBackedBookRepository) Find(ctx context.Context, opts QueryOptions) ([]Book, int, error) {
+	response := make([]Book, 0)
+	var total int
+	err := sqliteReadTx(ctx, repo.db, func(tx *sql.Tx) error {
+		var err error
+		total, err = sqliteFind(ctx, tx, "books", sqliteBookColumns, opts, func(rows *sql.Rows) error {
+			book, err := scanSQLiteBook(rows)
+			if err != nil {
+				return err
+			}
+			response = append(response, *book)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return loadSQLiteBookAuthors(ctx, tx, response)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return response, total, nil
+}
+
+func (repo *SQLiteBackedBookRepository) Create(ctx context.Context, book *Book) error {
+	return sqliteTx(ctx, repo.db, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, "INSERT INTO books (name, isbn, year, genres, created_at, updated_at, version) VALUES (?, ?, ?, ?, ?, ?, 1)",
+			sqliteBookValues(book)...)
+		if err != nil {
+			return translateSQLiteError(err, errDuplicateBook)
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		book.ID, book.Version = int(id), 1
+		return insertSQLiteBookAuthors(ctx, tx, book)
+	})
+}
+
+func (repo *SQLiteBackedBookRepository) GetByID(ctx context.Context, id int) (*Book, error) {
+	return getSQLiteBook(ctx, repo.db, id)
+}
+
+func (repo *SQLiteBackedBookRepository) Update(ctx context.Context, book *Book, version int) error {
+	var next int
+	err := sqliteTx(ctx, repo.db, func(tx *sql.Tx) error {
+		args := append(sqliteBookValues(book), book.ID)
+		result, err := tx.ExecContext(ctx, "UPDATE books SET name = ?, isbn = ?, year = ?, genres = ?, created_at = ?, updated_at = ?, version = version + 1 WHERE id = ? AND "+sqliteVersionMatches,
+			append(args, sqliteVersionArgs(version)...)...)
+		if err != nil {
+			return translateSQLiteError(err, errDuplicateBook)
+		}
+		if err := sqliteCheckWritten(ctx, tx, result, "books", "Book", book.ID, version, errBookNotFound); err != nil {
+			return err
+		}
+		if err := tx.QueryRowContext(ctx, "SELECT version FROM books WHERE id = ?", book.ID).Scan(&next); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM book_authors WHERE book_id = ?", book.ID); err != nil {
+			return err
+		}
+		return insertSQLiteBookAuthors(ctx, tx, book)
+	})
+	if err != nil {
+		return err
+	}
+	book.Version = next
+	return nil
+}
+
+// Delete moves the book with its authors to deleted_books, the rows of
+// book_authors go by ON DELETE CASCADE
+func (repo *SQLiteBackedBookRepository) Delete(ctx context.Context, id int, version int) error {
+	return sqliteTx(ctx, repo.db, func(tx *sql.Tx) error {
+		existing, err := getSQLiteBook(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if err := checkVersion("Book", id, existing.Version, version); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM books WHERE id = ?", id); err != nil {
+			return translateSQLiteError(err, errDuplicateBook)
+		}
+		return putSQLiteDeleted(ctx, tx, "deleted_books", id, existing)
+	})
+}
+
+func (repo *SQLiteBackedBookRepository) GetDeletedByID(ctx context.Context, id int) (*Book, error) {
+	var book Book
+	if err := getSQLiteDeleted(ctx, repo.db, "deleted_books", id, &book, errDeletedBookNotFound); err != nil {
+		return nil, err
+	}
+	return &book, nil
+}
+
+// Undelete fails with ErrConstraint when one of the authors is gone
+func (repo *SQLiteBackedBookRepository) Undelete(ctx context.Context, id int) (*Book, error) {
+	var book Book
+	err := sqliteTx(ctx, repo.db, func(tx *sql.Tx) error {
+		if err := getSQLiteDeleted(ctx, tx, "deleted_books", id, &book, errDeletedBookNotFound); err != nil {
+			return err
+		}
+		book.Version++
+		_, err := tx.ExecContext(ctx, "INSERT INTO books (name, isbn, year, genres, created_at, updated_at, version, id) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			append(sqliteBookValues(&book), book.Version, book.ID)...)
+		if err != nil {
+			return translateSQLiteError(err, errDuplicateBook)
+		}
+		if err := insertSQLiteBookAuthors(ctx, tx, &book); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM deleted_books WHERE id = ?", id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &book, nil
+}
+
+func (repo *SQLiteBackedBookRepository) Version(ctx context.Context) (CatalogVersion, error) {
+	return sqliteVersion(ctx, repo.db, "books")
+}
+
+func getSQLiteBook(ctx context.Context, q sqliteQuerier, id int) (*Book, error) {
+	book, err := scanSQLiteBook(q.QueryRowContext(ctx, "SELECT "+sqliteBookColumns+" FROM books WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, errBookNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	books := []Book{*book}
+	if err := loadSQLiteBookAuthors(ctx, q, books); err != nil {
+		return nil, err
+	}
+	return &books[0], nil
+}
+
+// sqliteBookAuthorsBatch is how many books loadSQLiteBookAuthors asks for in
+// one query, below SQLITE_MAX_VARIABLE_NUMBER which is 999 on older builds
+const sqliteBookAuthorsBatch = 500
+
+// loadSQLiteBookAuthors sets the AuthorIDs of books with one query for each
+// batch of them
+func loadSQLiteBookAuthors(ctx context.Context, q sqliteQuerier, books []Book) error {
+	position := make(map[int]int, len(books))
+	for i, book := range books {
+		position[book.ID] = i
+	}
+	for start := 0; start < len(books); start += sqliteBookAuthorsBatch {
+		end := start + sqliteBookAuthorsBatch
+		if end > len(books) {
+			end = len(books)
+		}
+		if err := loadSQLiteBookAuthorsBatch(ctx, q, books, books[start:end], position); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadSQLiteBookAuthorsBatch sets the AuthorIDs of batch, books[position[id]]
+// is the book with that id
+func loadSQLiteBookAuthorsBatch(ctx context.Context, q sqliteQuerier, books, batch []Book, position map[int]int) error {
+	args := make([]interface{}, len(batch))
+	for i, book := range batch {
+		args[i] = book.ID
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(batch)), ", ")
+	rows, err := q.QueryContext(ctx, "SELECT book_id, author_id FROM book_authors WHERE book_id IN ("+placeholders+") ORDER BY book_id, position", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var bookID, authorID int
+		if err := rows.Scan(&bookID, &authorID); err != nil {
+			return err
+		}
+		i := position[bookID]
+		books[i].AuthorIDs = append(books[i].AuthorIDs, authorID)
+	}
+	return rows.Err()
+}
+
+func insertSQLiteBookAuthors(ctx context.Context, tx *sql.Tx, book *Book) error {
+	for i, authorID := range book.AuthorIDs {
+		_, err := tx.ExecContext(ctx, "INSERT INTO book_authors (book_id, author_id, position) VALUES (?, ?, ?)", book.ID, authorID, i)
+		if err != nil {
+			return translateSQLiteError(err, errDuplicateBook)
+		}
+	}
+	return nil
+}
+
+const sqliteBookColumns = "id, name, isbn, year, genres, version, created_at, updated_at"
+
+// sqliteBookValues are the columns written by Create and Update, in their order
+func sqliteBookValues(book *Book) []interface{} {
+	var genres sql.NullString
+	if len(book.Genres) > 0 {
+		data, _ := json.Marshal(book.Genres)
+		genres = sql.NullString{String: string(data), Valid: true}
+	}
+	return []interface{}{
+		book.Name,
+		sql.NullString{String: book.ISBN, Valid: book.ISBN != ""},
+		sql.NullInt64{Int64: int64(book.Year), Valid: book.Year != 0},
+		genres,
+		nullableTime(book.CreatedAt),
+		nullableTime(book.UpdatedAt),
+	}
+}
+
+// scanSQLiteBook reads the sqliteBookColumns of a row, the authors are loaded apart
+func scanSQLiteBook(row interface{ Scan(...interface{}) error }) (*Book, error) {
+	var book Book
+	var isbn, genres sql.NullString
+	var year sql.NullInt64
+	var createdAt, updatedAt sql.NullTime
+	if err := row.Scan(&book.ID, &book.Name, &isbn, &year, &genres, &book.Version, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	book.ISBN, book.Year = isbn.String, int(year.Int64)
+	if genres.Valid {
+		if err := json.Unmarshal([]byte(genres.String), &book.Genres); err != nil {
+			return nil, err
+		}
+	}
+	book.CreatedAt, book.UpdatedAt = createdAt.Time, updatedAt.Time
+	return &book, nil
+}
+
+// Constructor Function, the schema has to be migrated already, see openSQLite
+func NewSQLiteBackedBookRepository(db *sql.DB) BookRepository {
+	return &SQLiteBackedBookRepository{db}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+)
+
+// SQLiteBackedHistoryRepository stores the entries in the history table
+// created by sqliteMigrations.
+type SQLiteBackedHistoryRepository struct {
+	db *sql.DB
+}
+
+func (repo *SQLiteBackedHistoryRepository) Append(ctx context.Context, entry *HistoryEntry) error {
+	result, err := repo.db.ExecContext(ctx, "INSERT INTO history (entity, entity_id, action, actor, at, before_json, after_json) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		entry.Entity, entry.EntityID, entry.Action, entry.Actor, entry.At, string(entry.Before), string(entry.After))
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	entry.ID = int(id)
+	return nil
+}
+
+func (repo *SQLiteBackedHistoryRepository) Find(ctx context.Context, entity string, id int) ([]HistoryEntry, error) {
+	rows, err := repo.db.QueryContext(ctx, "SELECT id, entity, entity_id, action, actor, at, before_json, after_json FROM history WHERE entity = ? AND entity_id = ? ORDER BY id", entity, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	response := make([]HistoryEntry, 0)
+	for rows.Next() {
+		var entry HistoryEntry
+		var before, after string
+		if err := rows.Scan(&entry.ID, &entry.Entity, &entry.EntityID, &entry.Action, &entry.Actor, &entry.At, &before, &after); err != nil {
+			return nil, err
+		}
+		entry.Before, entry.After = []byte(before), []byte(after)
+		response = append(response, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// Constructor Function, the schema has to be migrated already, see openSQLite
+func NewSQLiteBackedHistoryRepository(db *sql.DB) HistoryRepository {
+	return &SQLiteBackedHistoryRepository{db}
+}
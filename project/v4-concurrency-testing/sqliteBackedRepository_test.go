@@ -0,0 +1,183 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func openTestSQLite(t *testing.T) *sql.DB {
+	return openTestSQLiteAt(t, filepath.Join(t.TempDir(), "bookstore.sqlite"))
+}
+
+func openTestSQLiteAt(t *testing.T, path string) *sql.DB {
+	db, err := openSQLite(path)
+	if err != nil {
+		t.Fatalf("Unable to open sqlite database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestSQLiteMigrationsRunOnce(t *testing.T) {
+	db := openTestSQLite(t)
+	// Running them again must be a no-op
+	if err := migrate(db, sqliteMigrations); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != len(sqliteMigrations) {
+		t.Errorf("Incorrect migrations - Expected %d, found %d", len(sqliteMigrations), count)
+	}
+
+	outOfOrder := []migration{{version: 2}, {version: 1}}
+	if err := migrate(db, outOfOrder); err == nil {
+		t.Error("Expected out of order migrations to be rejected")
+	}
+}
+
+// A database from before books had several authors keeps the author of its books
+func TestSQLiteMigrationMovesAuthorsToBookAuthors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bookstore.sqlite")
+	db, err := sql.Open("sqlite3", "file:"+path+"?_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(db, sqliteMigrations[:3]); err != nil {
+		t.Fatal(err)
+	}
+	statements := []string{
+		"INSERT INTO authors (name) VALUES ('Author 1')",
+		"INSERT INTO books (name, author_id) VALUES ('Book 1', 1)",
+		"INSERT INTO books (name) VALUES ('Book 2')",
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	db = openTestSQLiteAt(t, path)
+	all, err := NewSQLiteBackedBookRepository(db).GetAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || !sameAuthors(all[0].AuthorIDs, []int{1}) || all[1].AuthorIDs != nil {
+		t.Errorf("Unexpected books %+v", all)
+	}
+}
+
+// Rows from before versions are at version 0 and can be written like the others
+func TestSQLiteMigrationStartsVersionsAtZero(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bookstore.sqlite")
+	db, err := sql.Open("sqlite3", "file:"+path+"?_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(db, sqliteMigrations[:4]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO authors (name) VALUES ('Author 1')"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	authors := NewSQLiteBackedAuthorRepository(openTestSQLiteAt(t, path))
+	author, err := authors.GetByID(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if author.Version != 0 {
+		t.Errorf("Incorrect version - Expected %d, found %d", 0, author.Version)
+	}
+	if err := authors.Update(ctx, author, 0); err != nil || author.Version != 1 {
+		t.Errorf("Expected version 1, found %d and %v", author.Version, err)
+	}
+}
+
+func TestSQLiteRepositoryErrors(t *testing.T) {
+	db := openTestSQLite(t)
+	authors := NewSQLiteBackedAuthorRepository(db)
+	books := NewSQLiteBackedBookRepository(db)
+
+	author := &Author{Name: "Author 1"}
+	if err := authors.Create(ctx, author); err != nil {
+		t.Fatal(err)
+	}
+	if err := authors.Create(ctx, &Author{Name: "Author 1"}); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("Expected ErrDuplicate, found %v", err)
+	}
+
+	book := &Book{Name: "Book 1", AuthorIDs: []int{author.ID}}
+	if err := books.Create(ctx, book); err != nil {
+		t.Fatal(err)
+	}
+	if book.ID != 1 {
+		t.Errorf("Incorrect ID - Expected %d, found %d", 1, book.ID)
+	}
+	if err := books.Create(ctx, &Book{Name: "Book 1"}); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("Expected ErrDuplicate, found %v", err)
+	}
+	if err := books.Create(ctx, &Book{Name: "Book 2", AuthorIDs: []int{42}}); !errors.Is(err, ErrConstraint) {
+		t.Errorf("Expected ErrConstraint, found %v", err)
+	}
+	// A book without an author is stored with a NULL reference
+	if err := books.Create(ctx, &Book{Name: "Book 3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := books.GetAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || !sameAuthors(all[0].AuthorIDs, []int{author.ID}) || all[1].AuthorIDs != nil {
+		t.Errorf("Unexpected books %+v", all)
+	}
+}
+
+func TestSQLiteLargeCatalog(t *testing.T) {
+	db := openTestSQLite(t)
+	authors := NewSQLiteBackedAuthorRepository(db)
+	books := NewSQLiteBackedBookRepository(db)
+	author := &Author{Name: "Author 1"}
+	if err := authors.Create(ctx, author); err != nil {
+		t.Fatal(err)
+	}
+	// More books than SQLite takes variables in one statement, stored in
+	// one transaction as Create would take minutes
+	const count = 33000
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := 1; id <= count; id++ {
+		if _, err := tx.Exec("INSERT INTO books (id, name) VALUES (?, ?)", id, fmt.Sprintf("Book %d", id)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.Exec("INSERT INTO book_authors (book_id, author_id, position) VALUES (?, ?, 0)", id, author.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := books.GetAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != count {
+		t.Fatalf("Incorrect number of books - Expected %d, found %d", count, len(all))
+	}
+	for _, book := range all {
+		if !sameAuthors(book.AuthorIDs, []int{author.ID}) {
+			t.Fatalf("Expected every book by %d, found %+v", author.ID, book)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// NewTimestampingRepositories sets CreatedAt and UpdatedAt on every write, in
+// UTC and to the millisecond so every backend stores the same value. An update
+// keeps the CreatedAt already stored, whatever the caller sent.
+func NewTimestampingRepositories(books BookRepository, authors AuthorRepository, now func() time.Time) (BookRepository, AuthorRepository) {
+	clock := timestamps{now}
+	return &timestampingBookRepository{books, clock}, &timestampingAuthorRepository{authors, clock}
+}
+
+type timestamps struct {
+	now func() time.Time
+}
+
+func (t timestamps) current() time.Time {
+	return t.now().UTC().Truncate(time.Millisecond)
+}
+
+type timestampingBookRepository struct {
+	BookRepository
+	timestamps
+}
+
+func (repo *timestampingBookRepository) Create(ctx context.Context, book *Book) error {
+	book.CreatedAt = repo.current()
+	book.UpdatedAt = book.CreatedAt
+	return repo.BookRepository.Create(ctx, book)
+}
+
+func (repo *timestampingBookRepository) Update(ctx context.Context, book *Book, version int) error {
+	// An unknown ID is left to the backend to report
+	if stored, err := repo.BookRepository.GetByID(ctx, book.ID); err == nil {
+		book.CreatedAt = stored.CreatedAt
+	}
+	book.UpdatedAt = repo.current()
+	return repo.BookRepository.Update(ctx, book, version)
+}
+
+type timestampingAuthorRepository struct {
+	AuthorRepository
+	timestamps
+}
+
+func (repo *timestampingAuthorRepository) Create(ctx context.Context, author *Author) error {
+	author.CreatedAt = repo.current()
+	author.UpdatedAt = author.CreatedAt
+	return repo.AuthorRepository.Create(ctx, author)
+}
+
+func (repo *timestampingAuthorRepository) Update(ctx context.Context, author *Author, version int) error {
+	if stored, err := repo.AuthorRepository.GetByID(ctx, author.ID); err == nil {
+		author.CreatedAt = stored.CreatedAt
+	}
+	author.UpdatedAt = repo.current()
+	return repo.AuthorRepository.Update(ctx, author, version)
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// WebhookSubscription asks for the events of some entities and actions to be
+// POSTed to URL, empty Entities or Actions match all of them. The body of a
+// delivery is the Event, the same as the data of /events. Redirects are not
+// followed, the receiver has to answer with a 2xx itself.
+type WebhookSubscription struct {
+	ID        int       `json:"id" openapi:"readOnly"`
+	URL       string    `json:"url"`
+	Entities  []string  `json:"entities,omitempty"` // books or authors
+	Actions   []string  `json:"actions,omitempty"`  // INSERT, UPDATE or DELETE
+	Secret    string    `json:"secret,omitempty"`   // signs the deliveries, it is never sent back
+	CreatedAt time.Time `json:"createdAt" openapi:"readOnly"`
+}
+
+func (s *WebhookSubscription) matches(event Event) bool {
+	return (len(s.Entities) == 0 || contains(s.Entities, event.Table)) &&
+		(len(s.Actions) == 0 || contains(s.Actions, event.Action))
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// validateWebhook checks what a client sent for a new subscription. Only an
+// IP in the URL can be checked here, the names are checked when dialled.
+func validateWebhook(s *WebhookSubscription, allowInternal bool) error {
+	var fields []FieldError
+	if u, err := url.Parse(s.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fields = append(fields, FieldError{"url", "must be an absolute http or https URL"})
+	} else if ip := net.ParseIP(u.Hostname()); ip != nil && !allowInternal && internalAddress(ip) {
+		fields = append(fields, FieldError{"url", "must not be a loopback, private or link-local address"})
+	}
+	for _, entity := range s.Entities {
+		if entity != "books" && entity != "authors" {
+			fields = append(fields, FieldError{"entities", "must be books or authors"})
+			break
+		}
+	}
+	for _, action := range s.Actions {
+		if action != "INSERT" && action != "UPDATE" && action != "DELETE" {
+			fields = append(fields, FieldError{"actions", "must be INSERT, UPDATE or DELETE"})
+			break
+		}
+	}
+	if s.Secret == "" {
+		fields = append(fields, FieldError{"secret", "cannot be empty"})
+	}
+	if len(fields) > 0 {
+		return invalidEntity("Invalid webhook", fields...)
+	}
+	return nil
+}
+
+// internalAddress tells whether ip is the machine itself or on its network,
+// cloud metadata endpoints included, which clients must not reach through us
+func internalAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+var errWebhookAddress = errors.New("loopback, private and link-local addresses are not allowed")
+
+// newWebhookClient makes the deliveries. The address is checked once the
+// name is resolved, so a name can't pass when subscribed and point to
+// 169.254.169.254 when dialled.
+func newWebhookClient(opts WebhookOptions) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if !opts.AllowInternal {
+		dialer := &net.Dialer{
+			Timeout: opts.Timeout,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || internalAddress(ip) {
+					return fmt.Errorf("dialing %s: %w", address, errWebhookAddress)
+				}
+				return nil
+			},
+		}
+		transport.DialContext = dialer.DialContext
+		// Through a proxy only the proxy would be checked
+		transport.Proxy = nil
+	}
+	return &http.Client{
+		Timeout:   opts.Timeout,
+		Transport: transport,
+		// A redirect could point anywhere, it fails the attempt instead
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+// DeadLetter is an event which could not be delivered to a subscription
+type DeadLetter struct {
+	SubscriptionID int       `json:"subscriptionId"`
+	URL            string    `json:"url"`
+	EventID        int64     `json:"eventId"`
+	Event          Event     `json:"event"`
+	Attempts       int       `json:"attempts"`
+	Error          string    `json:"error"` // of the last attempt
+	At             time.Time `json:"at"`
+}
+
+// webhookSignatureHeader carries sha256= and the hex HMAC-SHA256 of the body
+// keyed with the secret of the subscription, see signWebhook.
+const webhookSignatureHeader = "X-Bookstore-Signature"
+
+// webhookEventIDHeader is the ID of the event, the same for every attempt so
+// receivers can skip the ones they got already.
+const webhookEventIDHeader = "X-Bookstore-Event-Id"
+
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookOptions tune the delivery, the zero value of a field picks its default
+type WebhookOptions struct {
+	Workers     int           // deliveries made at the same time, 4
+	MaxAttempts int           // before an event goes to the dead letters, 5
+	BaseDelay   time.Duration // before the first retry, doubled for every next one, 1s
+	MaxDelay    time.Duration // between two attempts, 5m
+	Timeout     time.Duration // of one attempt, 10s
+	QueueSize   int           // deliveries waiting for a worker, 1000
+	DeadLetters int           // kept, the oldest go first, 1000
+	// AllowInternal lets receivers be on loopback, private and link-local
+	// addresses, only for deployments where every client is trusted
+	AllowInternal bool
+}
+
+func (o WebhookOptions) withDefaults() WebhookOptions {
+	if o.Workers == 0 {
+		o.Workers = 4
+	}
+	if o.MaxAttempts == 0 {
+		o.MaxAttempts = 5
+	}
+	if o.BaseDelay == 0 {
+		o.BaseDelay = time.Second
+	}
+	if o.MaxDelay == 0 {
+		o.MaxDelay = 5 * time.Minute
+	}
+	if o.Timeout == 0 {
+		o.Timeout = 10 * time.Second
+	}
+	if o.QueueSize == 0 {
+		o.QueueSize = 1000
+	}
+	if o.DeadLetters == 0 {
+		o.DeadLetters = 1000
+	}
+	return o
+}
+
+// webhookBackoff is the delay before the attempt following attempts failed ones
+func webhookBackoff(opts WebhookOptions, attempts int) time.Duration {
+	delay := opts.BaseDelay
+	for i := 1; i < attempts && delay < opts.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > opts.MaxDelay {
+		return opts.MaxDelay
+	}
+	return delay
+}
+
+// Webhooks delivers the events to the subscriptions matching them. Enqueue
+// never waits: the deliveries go through a queue to a pool of workers, and
+// a failed one is retried after webhookBackoff without holding a worker.
+// What still fails after MaxAttempts, or finds the queue full, ends up in
+// the dead letters. Subscriptions are kept in memory, like the events, so
+// they have to be registered again after a restart.
+type Webhooks struct {
+	mu            sync.Mutex
+	subscriptions map[int]WebhookSubscription
+	lastID        int
+	deadLetters   []DeadLetter // oldest first
+	queue         chan webhookDelivery
+	retries       map[*time.Timer]bool // waiting to enqueue a delivery again
+	closed        bool
+	opts          WebhookOptions
+	client        *http.Client
+	now           func() time.Time
+	workers       sync.WaitGroup
+}
+
+type webhookDelivery struct {
+	subscription WebhookSubscription
+	event        Event
+	attempts     int // made so far
+}
+
+var errWebhookQueueFull = errors.New("too many deliveries waiting")
+
+// Constructor Function, the workers run until Close
+func NewWebhooks(opts WebhookOptions) *Webhooks {
+	opts = opts.withDefaults()
+	wh := &Webhooks{
+		subscriptions: make(map[int]WebhookSubscription),
+		queue:         make(chan webhookDelivery, opts.QueueSize),
+		retries:       make(map[*time.Timer]bool),
+		opts:          opts,
+		client:        newWebhookClient(opts),
+		now:           time.Now,
+	}
+	wh.workers.Add(opts.Workers)
+	for i := 0; i < opts.Workers; i++ {
+		go wh.work()
+	}
+	return wh
+}
+
+// Subscribe validates s and sets its ID and CreatedAt
+func (wh *Webhooks) Subscribe(s *WebhookSubscription) error {
+	if err := validateWebhook(s, wh.opts.AllowInternal); err != nil {
+		return err
+	}
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	wh.lastID++
+	s.ID, s.CreatedAt = wh.lastID, wh.now().UTC()
+	wh.subscriptions[s.ID] = *s
+	return nil
+}
+
+// Subscriptions returns every subscription ordered by ID, without secrets
+func (wh *Webhooks) Subscriptions() []WebhookSubscription {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	response := make([]WebhookSubscription, 0, len(wh.subscriptions))
+	for _, s := range wh.subscriptions {
+		s.Secret = ""
+		response = append(response, s)
+	}
+	sort.Slice(response, func(i, j int) bool { return response[i].ID < response[j].ID })
+	return response
+}
+
+// Subscription returns the subscription id without its secret
+func (wh *Webhooks) Subscription(id int) (WebhookSubscription, error) {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	s, ok := wh.subscriptions[id]
+	if !ok {
+		return WebhookSubscription{}, errWebhookNotFound
+	}
+	s.Secret = ""
+	return s, nil
+}
+
+// Unsubscribe also drops the deliveries still waiting for the subscription
+func (wh *Webhooks) Unsubscribe(id int) error {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	if _, ok := wh.subscriptions[id]; !ok {
+		return errWebhookNotFound
+	}
+	delete(wh.subscriptions, id)
+	return nil
+}
+
+// DeadLetters returns the events which could not be delivered, oldest first
+func (wh *Webhooks) DeadLetters() []DeadLetter {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	return append(make([]DeadLetter, 0, len(wh.deadLetters)), wh.deadLetters...)
+}
+
+// Enqueue queues a delivery of event for every subscription matching it,
+// it is called by the EventBroker for every event published.
+func (wh *Webhooks) Enqueue(event Event) {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	for _, s := range wh.subscriptions {
+		if s.matches(event) {
+			wh.push(webhookDelivery{subscription: s, event: event})
+		}
+	}
+}
+
+// push queues d unless the queue is full, wh.mu has to be held
+func (wh *Webhooks) push(d webhookDelivery) {
+	if wh.closed {
+		return
+	}
+	select {
+	case wh.queue <- d:
+	default:
+		wh.bury(d, errWebhookQueueFull)
+	}
+}
+
+// bury adds d to the dead letters, wh.mu has to be held
+func (wh *Webhooks) bury(d webhookDelivery, err error) {
+	wh.deadLetters = append(wh.deadLetters, DeadLetter{
+		SubscriptionID: d.subscription.ID,
+		URL:            d.subscription.URL,
+		EventID:        d.event.ID,
+		Event:          d.event,
+		Attempts:       d.attempts,
+		Error:          err.Error(),
+		At:             wh.now().UTC(),
+	})
+	if len(wh.deadLetters) > wh.opts.DeadLetters {
+		wh.deadLetters = wh.deadLetters[len(wh.deadLetters)-wh.opts.DeadLetters:]
+	}
+}
+
+func (wh *Webhooks) work() {
+	defer wh.workers.Done()
+	for d := range wh.queue {
+		wh.attempt(d)
+	}
+}
+
+// attempt delivers d once, a failure is retried or buried. Nothing is
+// delivered once the subscription is gone or wh closed.
+func (wh *Webhooks) attempt(d webhookDelivery) {
+	wh.mu.Lock()
+	_, subscribed := wh.subscriptions[d.subscription.ID]
+	closed := wh.closed
+	wh.mu.Unlock()
+	if !subscribed || closed {
+		return
+	}
+	d.attempts++
+	err := wh.deliver(d)
+	if err == nil {
+		return
+	}
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	if d.attempts >= wh.opts.MaxAttempts {
+		wh.bury(d, err)
+		return
+	}
+	if wh.closed {
+		return
+	}
+	// The timer can't fire before it is recorded, its function needs wh.mu
+	var timer *time.Timer
+	timer = time.AfterFunc(webhookBackoff(wh.opts, d.attempts), func() {
+		wh.mu.Lock()
+		defer wh.mu.Unlock()
+		delete(wh.retries, timer)
+		wh.push(d)
+	})
+	wh.retries[timer] = true
+}
+
+func (wh *Webhooks) deliver(d webhookDelivery) error {
+	body, err := json.Marshal(d.event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, d.subscription.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventIDHeader, strconv.FormatInt(d.event.ID, 10))
+	req.Header.Set(webhookSignatureHeader, signWebhook(d.subscription.Secret, body))
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	// Reading the rest lets the connection be reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Close waits for the deliveries in progress, what is still queued or
+// waiting for a retry is dropped.
+func (wh *Webhooks) Close() {
+	wh.mu.Lock()
+	if wh.closed {
+		wh.mu.Unlock()
+		return
+	}
+	wh.closed = true
+	for timer := range wh.retries {
+		timer.Stop()
+	}
+	close(wh.queue)
+	wh.mu.Unlock()
+	wh.workers.Wait()
+}
+
+// SaveWebhook registers a subscription, the response leaves out its secret
+func (h *Handler) SaveWebhook(w http.ResponseWriter, r *http.Request) {
+	var s WebhookSubscription
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		writeError(w, errUnreadableBody)
+		return
+	}
+	if err := h.webhooks.Subscribe(&s); err != nil {
+		writeError(w, err)
+		return
+	}
+	s.Secret = ""
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+func (h *Handler) GetAllWebhooks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.webhooks.Subscriptions())
+}
+
+func (h *Handler) GetWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := idFromPath(w, r, "/webhooks/")
+	if !ok {
+		return
+	}
+	s, err := h.webhooks.Subscription(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+func (h *Handler) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := idFromPath(w, r, "/webhooks/")
+	if !ok {
+		return
+	}
+	if err := h.webhooks.Unsubscribe(id); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) GetWebhookDeadLetters(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.webhooks.DeadLetters())
+}
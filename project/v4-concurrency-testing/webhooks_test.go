@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// delivery is one request a receiver got
+type delivery struct {
+	body      []byte
+	signature string
+	eventID   string
+	at        time.Time
+}
+
+// receiver answers the deliveries with the statuses of answer in turn, the
+// last one for the rest, and passes every delivery on.
+func receiver(t *testing.T, answer ...int) (*httptest.Server, chan delivery) {
+	deliveries := make(chan delivery, 100)
+	var mu sync.Mutex
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		status := answer[len(answer)-1]
+		if calls < len(answer) {
+			status = answer[calls]
+		}
+		calls++
+		mu.Unlock()
+		deliveries <- delivery{body, r.Header.Get(webhookSignatureHeader), r.Header.Get(webhookEventIDHeader), time.Now()}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, deliveries
+}
+
+func nextDelivery(t *testing.T, deliveries chan delivery) delivery {
+	t.Helper()
+	select {
+	case d := <-deliveries:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a delivery")
+		return delivery{}
+	}
+}
+
+func noDelivery(t *testing.T, deliveries chan delivery) {
+	t.Helper()
+	select {
+	case d := <-deliveries:
+		t.Errorf("Expected no more deliveries, found %s", d.body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// deadLettersOf waits until wh has n dead letters
+func deadLettersOf(t *testing.T, wh *Webhooks, n int) []DeadLetter {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		letters := wh.DeadLetters()
+		if len(letters) >= n {
+			return letters
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Incorrect number of dead letters - Expected %d, found %d", n, len(letters))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func testEvent(id int64, table, action string) Event {
+	return Event{ID: id, Table: table, Action: action, Data: json.RawMessage(`{"id":1,"name":"Book 1"}`)}
+}
+
+func TestWebhookDeliveryIsFilteredAndSigned(t *testing.T) {
+	wh := NewWebhooks(WebhookOptions{AllowInternal: true, Workers: 2})
+	defer wh.Close()
+	server, deliveries := receiver(t, http.StatusOK)
+	s := &WebhookSubscription{URL: server.URL, Entities: []string{"books"}, Actions: []string{"INSERT", "DELETE"}, Secret: "s3cret"}
+	if err := wh.Subscribe(s); err != nil {
+		t.Fatal(err)
+	}
+
+	wh.Enqueue(testEvent(1, "authors", "INSERT"))
+	wh.Enqueue(testEvent(2, "books", "UPDATE"))
+	wh.Enqueue(testEvent(3, "books", "INSERT"))
+	d := nextDelivery(t, deliveries)
+	noDelivery(t, deliveries)
+
+	if d.eventID != "3" {
+		t.Errorf("Incorrect event ID - Expected %s, found %s", "3", d.eventID)
+	}
+	var event Event
+	json.Unmarshal(d.body, &event)
+	if event.Table != "books" || event.Action != "INSERT" || string(event.Data) != `{"id":1,"name":"Book 1"}` {
+		t.Errorf("Incorrect payload, found %s", d.body)
+	}
+	if expected := signWebhook("s3cret", d.body); d.signature != expected {
+		t.Errorf("Incorrect signature - Expected %s, found %s", expected, d.signature)
+	}
+	if signWebhook("guess", d.body) == d.signature {
+		t.Error("Expected the signature to depend on the secret")
+	}
+}
+
+func TestWebhookRetriesFlakyReceiver(t *testing.T) {
+	wh := NewWebhooks(WebhookOptions{AllowInternal: true, Workers: 1, BaseDelay: 20 * time.Millisecond})
+	defer wh.Close()
+	server, deliveries := receiver(t, http.StatusInternalServerError, http.StatusServiceUnavailable, http.StatusNoContent)
+	wh.Subscribe(&WebhookSubscription{URL: server.URL, Secret: "s3cret"})
+
+	wh.Enqueue(testEvent(1, "books", "UPDATE"))
+	attempts := []delivery{nextDelivery(t, deliveries), nextDelivery(t, deliveries), nextDelivery(t, deliveries)}
+	noDelivery(t, deliveries)
+	for _, d := range attempts[1:] {
+		if d.eventID != "1" || string(d.body) != string(attempts[0].body) || d.signature != attempts[0].signature {
+			t.Errorf("Expected the same delivery again, found %s %s", d.eventID, d.body)
+		}
+	}
+	// The second retry waits twice as long as the first
+	first, second := attempts[1].at.Sub(attempts[0].at), attempts[2].at.Sub(attempts[1].at)
+	if first < 20*time.Millisecond || second < 40*time.Millisecond {
+		t.Errorf("Expected at least 20ms and 40ms between the attempts, found %s and %s", first, second)
+	}
+	if letters := wh.DeadLetters(); len(letters) != 0 {
+		t.Errorf("Expected no dead letters, found %+v", letters)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	opts := WebhookOptions{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+	for attempts, expected := range []time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 10: 5 * time.Second} {
+		if attempts == 0 || expected == 0 {
+			continue
+		}
+		if delay := webhookBackoff(opts, attempts); delay != expected {
+			t.Errorf("Incorrect delay after %d attempts - Expected %s, found %s", attempts, expected, delay)
+		}
+	}
+}
+
+func TestWebhookDeadLetters(t *testing.T) {
+	wh := NewWebhooks(WebhookOptions{AllowInternal: true, Workers: 2, MaxAttempts: 3, BaseDelay: time.Millisecond})
+	defer wh.Close()
+	failing, deliveries := receiver(t, http.StatusInternalServerError)
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+	wh.Subscribe(&WebhookSubscription{URL: failing.URL, Secret: "s3cret"})
+	wh.Subscribe(&WebhookSubscription{URL: gone.URL, Secret: "s3cret"})
+
+	wh.Enqueue(testEvent(7, "authors", "DELETE"))
+	letters := deadLettersOf(t, wh, 2)
+	for i := 0; i < 3; i++ {
+		nextDelivery(t, deliveries)
+	}
+	noDelivery(t, deliveries)
+	byURL := map[string]DeadLetter{letters[0].URL: letters[0], letters[1].URL: letters[1]}
+	if letter := byURL[failing.URL]; letter.Attempts != 3 || letter.EventID != 7 || letter.Event.Action != "DELETE" || !strings.Contains(letter.Error, "500") {
+		t.Errorf("Incorrect dead letter of the failing receiver, found %+v", letter)
+	}
+	if letter := byURL[gone.URL]; letter.Attempts != 3 || letter.SubscriptionID != 2 || letter.Error == "" {
+		t.Errorf("Incorrect dead letter of the unreachable receiver, found %+v", letter)
+	}
+}
+
+func TestWebhookUnsubscribeDropsRetries(t *testing.T) {
+	wh := NewWebhooks(WebhookOptions{AllowInternal: true, Workers: 1, BaseDelay: 20 * time.Millisecond})
+	defer wh.Close()
+	server, deliveries := receiver(t, http.StatusInternalServerError)
+	s := &WebhookSubscription{URL: server.URL, Secret: "s3cret"}
+	wh.Subscribe(s)
+	wh.Enqueue(testEvent(1, "books", "INSERT"))
+	nextDelivery(t, deliveries)
+	if err := wh.Unsubscribe(s.ID); err != nil {
+		t.Fatal(err)
+	}
+	noDelivery(t, deliveries)
+	if letters := wh.DeadLetters(); len(letters) != 0 {
+		t.Errorf("Expected no dead letters, found %+v", letters)
+	}
+}
+
+func TestWebhookEndpoints(t *testing.T) {
+	api := newTestAPI()
+	defer api.webhooks.Close()
+	router := newRouter(api)
+	server, deliveries := receiver(t, http.StatusOK)
+
+	cases := []struct {
+		body   string
+		status int
+		field  string
+	}{
+		{`{"url":"ftp://example.com","secret":"s3cret"}`, http.StatusUnprocessableEntity, `"url"`},
+		{`{"url":"` + server.URL + `","entities":["magazines"],"secret":"s3cret"}`, http.StatusUnprocessableEntity, `"entities"`},
+		{`{"url":"` + server.URL + `","actions":["insert"],"secret":"s3cret"}`, http.StatusUnprocessableEntity, `"actions"`},
+		{`{"url":"` + server.URL + `"}`, http.StatusUnprocessableEntity, `"secret"`},
+		{`{"url":`, http.StatusBadRequest, ""},
+		{`{"url":"` + server.URL + `","entities":["books"],"actions":["INSERT"],"secret":"s3cret"}`, http.StatusOK, ""},
+	}
+	for _, c := range cases {
+		rr := do(router, http.MethodPost, "/webhooks", strings.NewReader(c.body))
+		if rr.Code != c.status {
+			t.Errorf("%s: Invalid code! I want %d but get %d", c.body, c.status, rr.Code)
+		}
+		if !strings.Contains(rr.Body.String(), c.field) {
+			t.Errorf("%s: Expected %s in %s", c.body, c.field, rr.Body)
+		}
+	}
+	rr := do(router, http.MethodGet, "/webhooks", nil)
+	var subscriptions []WebhookSubscription
+	json.Unmarshal(rr.Body.Bytes(), &subscriptions)
+	if len(subscriptions) != 1 || subscriptions[0].URL != server.URL || strings.Contains(rr.Body.String(), "s3cret") {
+		t.Errorf("Expected the subscription without its secret, found %s", rr.Body)
+	}
+
+	// A write through the API reaches the receiver
+	do(router, http.MethodPost, "/authors", strings.NewReader(`{"name":"Author 1"}`))
+	do(router, http.MethodPost, "/books", strings.NewReader(`{"name":"Book 1","authorId":1}`))
+	d := nextDelivery(t, deliveries)
+	noDelivery(t, deliveries)
+	if !strings.Contains(string(d.body), `"table":"books","action":"INSERT"`) || d.signature != signWebhook("s3cret", d.body) {
+		t.Errorf("Incorrect delivery, found %s signed %s", d.body, d.signature)
+	}
+
+	if rr := do(router, http.MethodDelete, "/webhooks/1", nil); rr.Code != http.StatusNoContent {
+		t.Errorf("Invalid code! I want %d but get %d", http.StatusNoContent, rr.Code)
+	}
+	if rr := do(router, http.MethodGet, "/webhooks/1", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Invalid code! I want %d but get %d", http.StatusNotFound, rr.Code)
+	}
+	do(router, http.MethodPost, "/books", strings.NewReader(`{"name":"Book 2","authorId":1}`))
+	noDelivery(t, deliveries)
+}
+
+func TestWebhooksNeedTheirScope(t *testing.T) {
+	api := newTestAPI()
+	api.authenticator = NewAuthenticator([]APIKey{
+		{Key: "writer-key", Principal: Principal{Subject: "writer", Scopes: []string{ScopeBooksWrite, ScopeAuthorsWrite}}},
+		{Key: "partner-key", Principal: Principal{Subject: "partner", Scopes: []string{ScopeWebhooks}}},
+	}, nil)
+	router := newRouter(api)
+	for key, status := range map[string]int{"": http.StatusUnauthorized, "writer-key": http.StatusForbidden, "partner-key": http.StatusOK} {
+		req := httptest.NewRequest(http.MethodGet, "/webhooks", nil)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != status {
+			t.Errorf("Key %q: Invalid code! I want %d but get %d", key, status, rr.Code)
+		}
+	}
+}
+
+func TestWebhookInternalAddresses(t *testing.T) {
+	wh := NewWebhooks(WebhookOptions{Workers: 1, MaxAttempts: 1})
+	defer wh.Close()
+	for _, target := range []string{"http://169.254.169.254/latest/meta-data", "http://127.0.0.1:8080/", "https://[::1]/", "http://10.1.2.3/", "http://192.168.0.1/", "http://0.0.0.0/"} {
+		if err := wh.Subscribe(&WebhookSubscription{URL: target, Secret: "s3cret"}); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: Expected ErrInvalid, found %v", target, err)
+		}
+	}
+	if err := wh.Subscribe(&WebhookSubscription{URL: "https://203.0.113.10/hook", Secret: "s3cret"}); err != nil {
+		t.Errorf("Expected a public address to be accepted, found %v", err)
+	}
+	wh.Unsubscribe(1)
+
+	// A name is only resolved when dialled, the address it gets is checked then
+	server, deliveries := receiver(t, http.StatusOK)
+	target := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	if err := wh.Subscribe(&WebhookSubscription{URL: target, Secret: "s3cret"}); err != nil {
+		t.Fatal(err)
+	}
+	wh.Enqueue(testEvent(1, "books", "INSERT"))
+	letters := deadLettersOf(t, wh, 1)
+	noDelivery(t, deliveries)
+	if !strings.Contains(letters[0].Error, errWebhookAddress.Error()) {
+		t.Errorf("Expected the address to be refused, found %s", letters[0].Error)
+	}
+}
+
+func TestWebhookRedirectsAreNotFollowed(t *testing.T) {
+	wh := NewWebhooks(WebhookOptions{AllowInternal: true, Workers: 1, MaxAttempts: 1})
+	defer wh.Close()
+	server, deliveries := receiver(t, http.StatusOK)
+	redirect := httptest.NewServer(http.RedirectHandler(server.URL, http.StatusTemporaryRedirect))
+	defer redirect.Close()
+	wh.Subscribe(&WebhookSubscription{URL: redirect.URL, Secret: "s3cret"})
+
+	wh.Enqueue(testEvent(1, "books", "INSERT"))
+	letters := deadLettersOf(t, wh, 1)
+	noDelivery(t, deliveries)
+	if !strings.Contains(letters[0].Error, "307") {
+		t.Errorf("Expected the redirect to fail the delivery, found %s", letters[0].Error)
+	}
+}